@@ -0,0 +1,110 @@
+package acl
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// 拒绝客户端的方式
+const (
+	ActionRefuse = "refuse"
+	ActionDrop   = "drop"
+)
+
+// Options 访问控制配置
+type Options struct {
+	// Allow 允许访问的 IP 或 CIDR，为空时允许所有未被拒绝的客户端
+	Allow []string
+	// Deny 拒绝访问的 IP 或 CIDR，优先于 Allow
+	Deny []string
+	// Action 拒绝的方式，refuse 返回 REFUSED，drop 不应答
+	Action string
+}
+
+// ACL 基于客户端 IP 的访问控制
+type ACL struct {
+	allow  []*net.IPNet
+	deny   []*net.IPNet
+	action string
+}
+
+// New 创建访问控制
+func New(options Options) (*ACL, error) {
+	a := &ACL{action: strings.ToLower(options.Action)}
+	switch a.action {
+	case "":
+		a.action = ActionRefuse
+	case ActionRefuse, ActionDrop:
+	default:
+		return nil, fmt.Errorf("无效的拒绝方式: %s", options.Action)
+	}
+
+	var err error
+	if a.allow, err = ParseNets(options.Allow); err != nil {
+		return nil, err
+	}
+	if a.deny, err = ParseNets(options.Deny); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Allowed 判断客户端是否允许访问
+func (a *ACL) Allowed(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	if ContainsIP(a.deny, ip) {
+		return false
+	}
+	return len(a.allow) == 0 || ContainsIP(a.allow, ip)
+}
+
+// Action 返回拒绝的方式
+func (a *ACL) Action() string {
+	if a == nil {
+		return ActionRefuse
+	}
+	return a.action
+}
+
+// ParseNets 解析 IP 或 CIDR 列表，单个 IP 视为 /32 或 /128
+func ParseNets(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range list {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("无效的 IP 地址: %s", item)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("无效的 CIDR: %s", item)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// ContainsIP 判断 IP 是否属于任意一个网段
+func ContainsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
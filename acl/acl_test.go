@@ -0,0 +1,69 @@
+package acl
+
+import (
+	"net"
+	"testing"
+)
+
+func TestACL_Allowed(t *testing.T) {
+	a, err := New(Options{
+		Allow: []string{"192.168.0.0/16", "fd00::/8", "10.0.0.1"},
+		Deny:  []string{"192.168.100.0/24"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"192.168.1.10", true},
+		{"192.168.100.5", false},
+		{"10.0.0.1", true},
+		{"10.0.0.2", false},
+		{"fd00::1", true},
+		{"8.8.8.8", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := a.Allowed(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("Allowed(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name       string
+		options    Options
+		wantAction string
+		wantErr    bool
+	}{
+		{"default action", Options{}, ActionRefuse, false},
+		{"drop", Options{Action: "DROP"}, ActionDrop, false},
+		{"invalid action", Options{Action: "ignore"}, "", true},
+		{"invalid cidr", Options{Allow: []string{"192.168.0.0/33"}}, "", true},
+		{"invalid ip", Options{Deny: []string{"example.com"}}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := New(tt.options)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && a.Action() != tt.wantAction {
+				t.Errorf("Action() = %s, want %s", a.Action(), tt.wantAction)
+			}
+		})
+	}
+
+	// 没有配置时允许所有客户端
+	a, _ := New(Options{})
+	if !a.Allowed(net.ParseIP("8.8.8.8")) {
+		t.Error("Allowed() with empty ACL = false, want true")
+	}
+}
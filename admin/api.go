@@ -0,0 +1,303 @@
+package admin
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"go-dns-proxy/metrics"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// openAPIDocument /api/v1 接口的 OpenAPI 文档，新增或修改接口时需要同步更新
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// 分页查询的默认和最大条数
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 500
+)
+
+// requestIDPattern 查询 ID 的格式，与查询日志中的 requestId 相同
+var requestIDPattern = regexp.MustCompile(`^[0-9a-fA-F-]{1,64}$`)
+
+// setupAPIRoutes 注册 /api/v1 下的 REST 接口，接口说明见 openapi.json
+func (s *Server) setupAPIRoutes() {
+	s.router.GET("/api/v1/openapi.json", s.handleOpenAPI)
+	s.router.POST("/api/v1/login", s.handleLogin)
+
+	v1 := s.router.Group("/api/v1", s.requireAuth)
+	v1.POST("/logout", s.handleLogout)
+	v1.GET("/tokens", s.handleGetTokens)
+	v1.POST("/tokens", s.handleCreateToken)
+	v1.DELETE("/tokens/:id", s.handleDeleteToken)
+	v1.GET("/stats", s.handleGetStats)
+	v1.GET("/queries", s.handleGetQueries)
+	v1.GET("/logs/:requestId", s.handleGetQueryLogs)
+	v1.GET("/log-level", s.handleGetLogLevel)
+	v1.PUT("/log-level", s.handleSetLogLevel)
+	v1.GET("/beian-cache", s.handleGetBeianCache)
+	v1.GET("/learned-domains", s.handleGetLearnedDomains)
+	v1.POST("/learned-domains/:domain/approve", s.handleReviewLearnedDomain(true))
+	v1.POST("/learned-domains/:domain/reject", s.handleReviewLearnedDomain(false))
+	v1.GET("/listeners", s.handleGetListenerStats)
+	v1.GET("/limited-clients", s.handleGetLimitedClients)
+	v1.GET("/reload", s.handleGetReload)
+	v1.POST("/reload", s.handleReload)
+	v1.GET("/explain", s.handleExplain)
+
+	// 兼容旧版本的接口
+	legacy := s.router.Group("/api", s.requireAuth)
+	legacy.POST("/reload", s.handleReload)
+	legacy.GET("/explain", s.handleExplain)
+}
+
+// apiError 返回错误信息，所有接口的错误格式都是 {"error": "..."}
+func apiError(c *gin.Context, status int, err error) {
+	c.JSON(status, gin.H{"error": err.Error()})
+}
+
+func (s *Server) handleOpenAPI(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json; charset=utf-8", openAPIDocument)
+}
+
+// handleGetStats 返回时间范围内的查询统计，默认为最近 24 小时
+func (s *Server) handleGetStats(c *gin.Context) {
+	endTime := time.Now()
+	startTime := endTime.Add(-24 * time.Hour)
+	for _, p := range []struct {
+		name  string
+		value *time.Time
+	}{
+		{"start", &startTime},
+		{"end", &endTime},
+	} {
+		v := c.Query(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, fmt.Errorf("无效的 %s 参数，需要 RFC 3339 格式: %s", p.name, v))
+			return
+		}
+		*p.value = t
+	}
+
+	stats, err := GetQueryStats(s.db, startTime, endTime)
+	if err != nil {
+		logrus.WithError(err).Error("获取查询统计失败")
+		apiError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+// handleGetQueries 分页返回查询记录
+func (s *Server) handleGetQueries(c *gin.Context) {
+	limit := defaultPageLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxPageLimit {
+			apiError(c, http.StatusBadRequest, fmt.Errorf("limit 需要是 1 到 %d 之间的整数", maxPageLimit))
+			return
+		}
+		limit = n
+	}
+
+	page, err := GetQueryPage(s.db, c.Query("cursor"), limit)
+	if err != nil {
+		apiError(c, http.StatusBadRequest, err)
+		return
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+// handleGetQueryLogs 返回一次查询处理过程中的日志
+func (s *Server) handleGetQueryLogs(c *gin.Context) {
+	requestID := c.Param("requestId")
+	if !requestIDPattern.MatchString(requestID) {
+		apiError(c, http.StatusBadRequest, fmt.Errorf("无效的查询 ID: %s", requestID))
+		return
+	}
+
+	logs, err := GetQueryLogs(s.db, requestID)
+	if err != nil {
+		logrus.WithError(err).Error("查询日志失败")
+		apiError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, logs)
+}
+
+func (s *Server) handleGetLogLevel(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"level": logrus.GetLevel().String()})
+}
+
+// handleSetLogLevel 修改日志级别，并通知所有管理页面
+func (s *Server) handleSetLogLevel(c *gin.Context) {
+	var req struct {
+		Level string `json:"level"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, http.StatusBadRequest, err)
+		return
+	}
+	level, err := logrus.ParseLevel(req.Level)
+	if err != nil {
+		apiError(c, http.StatusBadRequest, fmt.Errorf("无效的日志级别: %s", req.Level))
+		return
+	}
+
+	logrus.SetLevel(level)
+	data := map[string]string{"level": level.String()}
+	s.tryBroadcast(map[string]interface{}{
+		"type": "log_level",
+		"data": data,
+	})
+	c.JSON(http.StatusOK, data)
+}
+
+func (s *Server) handleGetBeianCache(c *gin.Context) {
+	items, err := GetBeianCacheItems(s.db, 100)
+	if err != nil {
+		logrus.WithError(err).Error("查询备案缓存失败")
+		apiError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, items)
+}
+
+// handleGetLearnedDomains 返回学习域名，可以按状态过滤
+func (s *Server) handleGetLearnedDomains(c *gin.Context) {
+	status := c.Query("status")
+	switch status {
+	case "", LearnedStatusPending, LearnedStatusApproved, LearnedStatusRejected:
+	default:
+		apiError(c, http.StatusBadRequest, fmt.Errorf("无效的状态: %s", status))
+		return
+	}
+
+	domains, err := GetLearnedDomains(s.db, status, 100)
+	if err != nil {
+		logrus.WithError(err).Error("查询学习域名失败")
+		apiError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, domains)
+}
+
+// handleReviewLearnedDomain 确认或拒绝学习域名
+func (s *Server) handleReviewLearnedDomain(approve bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.learned == nil {
+			apiError(c, http.StatusNotImplemented, fmt.Errorf("未启用域名学习"))
+			return
+		}
+
+		domain := c.Param("domain")
+		status := LearnedStatusRejected
+		var err error
+		if approve {
+			status = LearnedStatusApproved
+			err = s.learned.Approve(domain)
+		} else {
+			err = s.learned.Reject(domain)
+		}
+		if err != nil {
+			logrus.WithError(err).WithField("domain", domain).Error("审核学习域名失败")
+			apiError(c, http.StatusBadRequest, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"domain": domain, "status": status})
+	}
+}
+
+func (s *Server) handleGetListenerStats(c *gin.Context) {
+	stats := []ListenerStats{}
+	if s.listeners != nil {
+		stats = s.listeners.ListenerStats()
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+func (s *Server) handleGetLimitedClients(c *gin.Context) {
+	clients := []LimitedClient{}
+	if s.rateLimit != nil {
+		clients = s.rateLimit.LimitedClients()
+	}
+	c.JSON(http.StatusOK, clients)
+}
+
+// handleMetrics 以 Prometheus 文本格式返回指标，Prometheus 使用 API 令牌抓取
+func (s *Server) handleMetrics(c *gin.Context) {
+	if s.metrics == nil {
+		apiError(c, http.StatusNotImplemented, fmt.Errorf("不支持 Prometheus 指标"))
+		return
+	}
+	var buf bytes.Buffer
+	if err := s.metrics.WriteMetrics(&buf); err != nil {
+		apiError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Data(http.StatusOK, metrics.ContentType, buf.Bytes())
+}
+
+// handleGetReload 返回最近一次配置重载的结果，没有重载过时返回 204
+func (s *Server) handleGetReload(c *gin.Context) {
+	s.reloadMutex.Lock()
+	result := s.lastReload
+	s.reloadMutex.Unlock()
+
+	if result == nil {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// handleReload 重载配置，结果同时推送给所有管理页面
+func (s *Server) handleReload(c *gin.Context) {
+	result, err := s.Reload()
+	if err != nil {
+		apiError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// handleExplain 说明域名的处理过程，参数为 domain 和可选的 client
+func (s *Server) handleExplain(c *gin.Context) {
+	if s.explain == nil {
+		apiError(c, http.StatusNotImplemented, fmt.Errorf("不支持路由说明"))
+		return
+	}
+	domain := strings.TrimSpace(c.Query("domain"))
+	if domain == "" {
+		apiError(c, http.StatusBadRequest, fmt.Errorf("缺少 domain 参数"))
+		return
+	}
+	var clientIP net.IP
+	if client := c.Query("client"); client != "" {
+		if clientIP = net.ParseIP(client); clientIP == nil {
+			apiError(c, http.StatusBadRequest, fmt.Errorf("无效的客户端地址: %s", client))
+			return
+		}
+	}
+
+	result, err := s.explain.Explain(c.Request.Context(), domain, clientIP)
+	if err != nil {
+		apiError(c, http.StatusBadRequest, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
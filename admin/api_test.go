@@ -0,0 +1,204 @@
+package admin
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestServer(t *testing.T, options Options) *Server {
+	t.Helper()
+	db, err := InitDB(filepath.Join(t.TempDir(), "dns.db"))
+	if err != nil {
+		t.Fatalf("InitDB() error = %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewServer(db, options)
+}
+
+func doRequest(s *Server, method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAPI_Queries(t *testing.T) {
+	s := newTestServer(t, Options{AuthDisabled: true})
+	base := time.Now().Add(-time.Hour)
+	for i := 0; i < 5; i++ {
+		err := SaveDNSQuery(s.db, &DNSQuery{
+			RequestID: "req-" + string(rune('a'+i)),
+			Domain:    "example.com",
+			QueryType: "TypeA",
+			ClientIP:  "192.168.1.2",
+			CreatedAt: base.Add(time.Duration(i) * time.Minute),
+		})
+		if err != nil {
+			t.Fatalf("SaveDNSQuery() error = %v", err)
+		}
+	}
+
+	w := doRequest(s, http.MethodGet, "/api/v1/stats", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /stats status = %d, body = %s", w.Code, w.Body)
+	}
+	var stats QueryStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.TotalQueries != 5 {
+		t.Errorf("TotalQueries = %d, want 5", stats.TotalQueries)
+	}
+
+	// 按两条一页读取所有记录
+	var ids []int64
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("分页没有结束")
+		}
+		w := doRequest(s, http.MethodGet, "/api/v1/queries?limit=2&cursor="+cursor, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /queries status = %d, body = %s", w.Code, w.Body)
+		}
+		var page QueryPage
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		for _, q := range page.Data {
+			ids = append(ids, q.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	want := []int64{5, 4, 3, 2, 1}
+	if len(ids) != len(want) {
+		t.Fatalf("ids = %v, want %v", ids, want)
+	}
+	for i := range want {
+		if ids[i] != want[i] {
+			t.Fatalf("ids = %v, want %v", ids, want)
+		}
+	}
+}
+
+func TestAPI_BadRequests(t *testing.T) {
+	s := newTestServer(t, Options{AuthDisabled: true})
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"无效的开始时间", http.MethodGet, "/api/v1/stats?start=yesterday", "", http.StatusBadRequest},
+		{"limit 过大", http.MethodGet, "/api/v1/queries?limit=10000", "", http.StatusBadRequest},
+		{"无效的游标", http.MethodGet, "/api/v1/queries?cursor=abc", "", http.StatusBadRequest},
+		{"无效的查询 ID", http.MethodGet, "/api/v1/logs/a'b", "", http.StatusBadRequest},
+		{"无效的日志级别", http.MethodPut, "/api/v1/log-level", `{"level":"loud"}`, http.StatusBadRequest},
+		{"无效的学习状态", http.MethodGet, "/api/v1/learned-domains?status=maybe", "", http.StatusBadRequest},
+		{"未启用域名学习", http.MethodPost, "/api/v1/learned-domains/example.com/approve", "", http.StatusNotImplemented},
+		{"不支持路由说明", http.MethodGet, "/api/v1/explain?domain=example.com", "", http.StatusNotImplemented},
+		{"没有重载过", http.MethodGet, "/api/v1/reload", "", http.StatusNoContent},
+		{"不支持 Prometheus 指标", http.MethodGet, "/metrics", "", http.StatusNotImplemented},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(s, tt.method, tt.path, tt.body)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body = %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want >= 400 {
+				var body map[string]string
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["error"] == "" {
+					t.Errorf("错误响应 = %s，需要包含 error", w.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestAPI_LogLevel(t *testing.T) {
+	s := newTestServer(t, Options{AuthDisabled: true})
+	defer logrus.SetLevel(logrus.GetLevel())
+
+	w := doRequest(s, http.MethodPut, "/api/v1/log-level", `{"level":"debug"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT /log-level status = %d, body = %s", w.Code, w.Body)
+	}
+	w = doRequest(s, http.MethodGet, "/api/v1/log-level", "")
+	if got := strings.TrimSpace(w.Body.String()); got != `{"level":"debug"}` {
+		t.Errorf("GET /log-level = %s", got)
+	}
+}
+
+// metricsText 输出固定内容的 MetricsProvider
+type metricsText string
+
+func (m metricsText) WriteMetrics(w io.Writer) error {
+	_, err := io.WriteString(w, string(m))
+	return err
+}
+
+func TestAPI_Metrics(t *testing.T) {
+	s := newTestServer(t, Options{})
+	s.SetMetricsProvider(metricsText("dns_inflight_queries 0\n"))
+	if w := doRequest(s, http.MethodGet, "/metrics", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("未登录时 status = %d, want 401", w.Code)
+	}
+
+	token, err := CreateAPIToken(s.db, "prometheus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := doRequest(s, http.MethodGet, "/metrics", "", "Authorization", "Bearer "+token.Token)
+	if w.Code != http.StatusOK || w.Body.String() != "dns_inflight_queries 0\n" {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %s", got)
+	}
+}
+
+// 所有 /api/v1 接口都需要在 openapi.json 中说明
+func TestAPI_OpenAPI(t *testing.T) {
+	s := newTestServer(t, Options{AuthDisabled: true})
+	w := doRequest(s, http.MethodGet, "/api/v1/openapi.json", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /openapi.json status = %d", w.Code)
+	}
+	var doc struct {
+		Paths map[string]map[string]interface{} `json:"paths"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("openapi.json 格式错误: %v", err)
+	}
+
+	param := regexp.MustCompile(`:(\w+)`)
+	for _, route := range s.router.Routes() {
+		if !strings.HasPrefix(route.Path, "/api/v1/") {
+			continue
+		}
+		path := param.ReplaceAllString(strings.TrimPrefix(route.Path, "/api/v1"), "{$1}")
+		if _, ok := doc.Paths[path][strings.ToLower(route.Method)]; !ok {
+			t.Errorf("openapi.json 缺少 %s %s", route.Method, path)
+		}
+	}
+}
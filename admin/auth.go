@@ -0,0 +1,503 @@
+package admin
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// DefaultUsername 首次启动时创建的管理员用户名
+	DefaultUsername = "admin"
+	// MinPasswordLength 管理员密码的最短长度
+	MinPasswordLength = 8
+
+	sessionCookie = "go_dns_proxy_session"
+	// apiTokenPrefix API 令牌的前缀，便于在配置和日志中识别
+	apiTokenPrefix = "gdp_"
+
+	// 同一地址在 loginFailureWindow 内登录失败 loginMaxFailures 次后暂时拒绝登录
+	loginMaxFailures   = 5
+	loginFailureWindow = 15 * time.Minute
+)
+
+// dummyPasswordHash 用户不存在时仍然比较一次密码，避免通过响应时间判断用户是否存在
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("go-dns-proxy"), bcrypt.DefaultCost)
+
+// randomToken 返回 n 字节随机数的十六进制字符串
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken 会话和 API 令牌只保存 SHA-256 摘要，数据库泄露时无法直接使用
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// SetAdminPassword 设置管理员密码，用户不存在时创建。修改密码后该用户的所有会话失效
+func SetAdminPassword(db *sql.DB, username, password string) error {
+	if username == "" {
+		return fmt.Errorf("用户名不能为空")
+	}
+	if len(password) < MinPasswordLength {
+		return fmt.Errorf("密码至少需要 %d 个字符", MinPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`
+		INSERT INTO admin_users (username, password_hash, updated_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT(username) DO UPDATE SET
+			password_hash = excluded.password_hash,
+			updated_at = excluded.updated_at`,
+		username, string(hash), time.Now(),
+	); err != nil {
+		return err
+	}
+	_, err = db.Exec(`DELETE FROM admin_sessions WHERE username = ?`, username)
+	return err
+}
+
+// EnsureAdminUser 没有管理员时创建默认管理员并返回随机生成的密码，已有管理员时返回空字符串
+func EnsureAdminUser(db *sql.DB) (string, error) {
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM admin_users`).Scan(&count); err != nil {
+		return "", err
+	}
+	if count > 0 {
+		return "", nil
+	}
+
+	password, err := randomToken(8)
+	if err != nil {
+		return "", err
+	}
+	if err := SetAdminPassword(db, DefaultUsername, password); err != nil {
+		return "", err
+	}
+	return password, nil
+}
+
+// verifyPassword 检查用户名和密码
+func verifyPassword(db *sql.DB, username, password string) (bool, error) {
+	var hash string
+	err := db.QueryRow(`SELECT password_hash FROM admin_users WHERE username = ?`, username).Scan(&hash)
+	if err == sql.ErrNoRows {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil, nil
+}
+
+// createSession 创建登录会话，同时清理过期的会话
+func createSession(db *sql.DB, username string, ttl time.Duration) (string, time.Time, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+
+	if _, err := db.Exec(`DELETE FROM admin_sessions WHERE expires_at < ?`, now); err != nil {
+		return "", time.Time{}, err
+	}
+	if _, err := db.Exec(`
+		INSERT INTO admin_sessions (token_hash, username, created_at, expires_at)
+		VALUES (?, ?, ?, ?)`,
+		hashToken(token), username, now, expiresAt,
+	); err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, nil
+}
+
+// lookupSession 返回会话对应的用户名，会话不存在或已过期时返回空字符串
+func lookupSession(db *sql.DB, token string) (string, error) {
+	var username string
+	err := db.QueryRow(`
+		SELECT username FROM admin_sessions
+		WHERE token_hash = ? AND expires_at > ?`,
+		hashToken(token), time.Now(),
+	).Scan(&username)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return username, err
+}
+
+func deleteSession(db *sql.DB, token string) error {
+	_, err := db.Exec(`DELETE FROM admin_sessions WHERE token_hash = ?`, hashToken(token))
+	return err
+}
+
+// CreateAPIToken 创建 API 令牌，返回值中的 Token 只有这一次可以看到
+func CreateAPIToken(db *sql.DB, name string) (*APIToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("令牌名称不能为空")
+	}
+	secret, err := randomToken(20)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &APIToken{Name: name, Token: apiTokenPrefix + secret, CreatedAt: time.Now()}
+	result, err := db.Exec(`
+		INSERT INTO api_tokens (name, token_hash, created_at)
+		VALUES (?, ?, ?)`,
+		token.Name, hashToken(token.Token), token.CreatedAt,
+	)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return nil, fmt.Errorf("令牌 %s 已存在", name)
+		}
+		return nil, err
+	}
+	if token.ID, err = result.LastInsertId(); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// GetAPITokens 按创建时间返回所有 API 令牌，不包括令牌本身
+func GetAPITokens(db *sql.DB) ([]APIToken, error) {
+	rows, err := db.Query(`
+		SELECT id, name, created_at, last_used_at
+		FROM api_tokens
+		ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := make([]APIToken, 0)
+	for rows.Next() {
+		var t APIToken
+		var lastUsedAt sql.NullTime
+		if err := rows.Scan(&t.ID, &t.Name, &t.CreatedAt, &lastUsedAt); err != nil {
+			return nil, err
+		}
+		if lastUsedAt.Valid {
+			t.LastUsedAt = &lastUsedAt.Time
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// DeleteAPIToken 吊销 API 令牌，令牌不存在时返回 false
+func DeleteAPIToken(db *sql.DB, id int64) (bool, error) {
+	result, err := db.Exec(`DELETE FROM api_tokens WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// verifyAPIToken 返回令牌的名称并记录使用时间，令牌无效时返回空字符串
+func verifyAPIToken(db *sql.DB, token string) (string, error) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return "", nil
+	}
+	var id int64
+	var name string
+	err := db.QueryRow(`SELECT id, name FROM api_tokens WHERE token_hash = ?`, hashToken(token)).Scan(&id, &name)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err := db.Exec(`UPDATE api_tokens SET last_used_at = ? WHERE id = ?`, time.Now(), id); err != nil {
+		logrus.WithError(err).Warn("更新 API 令牌使用时间失败")
+	}
+	return name, nil
+}
+
+// loginLimiter 记录每个地址的登录失败次数，防止暴力破解密码
+type loginLimiter struct {
+	mu       sync.Mutex
+	failures map[string]*loginFailures
+}
+
+type loginFailures struct {
+	count int
+	since time.Time
+}
+
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{failures: make(map[string]*loginFailures)}
+}
+
+// allowed 判断地址是否可以尝试登录
+func (l *loginLimiter) allowed(ip string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.failures[ip]
+	return !ok || f.count < loginMaxFailures || now.Sub(f.since) > loginFailureWindow
+}
+
+// fail 记录一次登录失败，同时清理过期的记录
+func (l *loginLimiter) fail(ip string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, f := range l.failures {
+		if now.Sub(f.since) > loginFailureWindow {
+			delete(l.failures, k)
+		}
+	}
+	f, ok := l.failures[ip]
+	if !ok {
+		f = &loginFailures{since: now}
+		l.failures[ip] = f
+	}
+	f.count++
+}
+
+func (l *loginLimiter) reset(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, ip)
+}
+
+// checkOrigin 浏览器发起的请求只允许来自管理后台本身或 AllowedOrigins，
+// 没有 Origin 头的请求不是跨站请求
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range s.options.AllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate 检查 API 令牌或登录会话，返回 "user:用户名" 或 "token:令牌名称"，未认证时返回空字符串
+func (s *Server) authenticate(r *http.Request) (string, error) {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		token := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+		name, err := verifyAPIToken(s.db, token)
+		if name == "" || err != nil {
+			return "", err
+		}
+		return "token:" + name, nil
+	}
+
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", nil
+	}
+	username, err := lookupSession(s.db, cookie.Value)
+	if username == "" || err != nil {
+		return "", err
+	}
+	return "user:" + username, nil
+}
+
+// requireAuth 要求登录或使用 API 令牌，使用会话修改数据时还要求请求来自管理后台本身
+func (s *Server) requireAuth(c *gin.Context) {
+	if s.options.AuthDisabled {
+		c.Next()
+		return
+	}
+
+	principal, err := s.authenticate(c.Request)
+	if err != nil {
+		logrus.WithError(err).Error("检查登录状态失败")
+		apiError(c, http.StatusInternalServerError, err)
+		c.Abort()
+		return
+	}
+	if principal == "" {
+		apiError(c, http.StatusUnauthorized, fmt.Errorf("未登录或令牌无效"))
+		c.Abort()
+		return
+	}
+	if !s.checkOrigin(c.Request) {
+		apiError(c, http.StatusForbidden, fmt.Errorf("不允许来自 %s 的请求", c.GetHeader("Origin")))
+		c.Abort()
+		return
+	}
+	c.Set("principal", principal)
+	c.Next()
+}
+
+// handleIndex 未登录时跳转到登录页面
+func (s *Server) handleIndex(c *gin.Context) {
+	if !s.options.AuthDisabled {
+		if principal, _ := s.authenticate(c.Request); principal == "" {
+			c.Redirect(http.StatusFound, "/login")
+			return
+		}
+	}
+	c.HTML(http.StatusOK, "index.html", gin.H{"authEnabled": !s.options.AuthDisabled})
+}
+
+func (s *Server) handleLoginPage(c *gin.Context) {
+	if s.options.AuthDisabled {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	c.HTML(http.StatusOK, "login.html", nil)
+}
+
+// handleLogin 使用用户名和密码登录，成功后设置会话 Cookie
+func (s *Server) handleLogin(c *gin.Context) {
+	if s.options.AuthDisabled {
+		apiError(c, http.StatusNotImplemented, fmt.Errorf("未启用登录"))
+		return
+	}
+	if !s.checkOrigin(c.Request) {
+		apiError(c, http.StatusForbidden, fmt.Errorf("不允许来自 %s 的请求", c.GetHeader("Origin")))
+		return
+	}
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, http.StatusBadRequest, err)
+		return
+	}
+	if req.Username == "" {
+		req.Username = DefaultUsername
+	}
+
+	ip := c.ClientIP()
+	now := time.Now()
+	if !s.logins.allowed(ip, now) {
+		apiError(c, http.StatusTooManyRequests, fmt.Errorf("登录失败次数过多，请稍后再试"))
+		return
+	}
+	ok, err := verifyPassword(s.db, req.Username, req.Password)
+	if err != nil {
+		logrus.WithError(err).Error("检查密码失败")
+		apiError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		s.logins.fail(ip, now)
+		logrus.WithFields(logrus.Fields{"username": req.Username, "client": ip}).Warn("管理后台登录失败")
+		apiError(c, http.StatusUnauthorized, fmt.Errorf("用户名或密码错误"))
+		return
+	}
+	s.logins.reset(ip)
+
+	token, expiresAt, err := createSession(s.db, req.Username, s.options.SessionTTL)
+	if err != nil {
+		logrus.WithError(err).Error("创建会话失败")
+		apiError(c, http.StatusInternalServerError, err)
+		return
+	}
+	logrus.WithFields(logrus.Fields{"username": req.Username, "client": ip}).Info("管理后台登录")
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   c.Request.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	c.JSON(http.StatusOK, gin.H{"username": req.Username, "expires_at": expiresAt})
+}
+
+// handleLogout 删除当前会话
+func (s *Server) handleLogout(c *gin.Context) {
+	if cookie, err := c.Request.Cookie(sessionCookie); err == nil {
+		if err := deleteSession(s.db, cookie.Value); err != nil {
+			apiError(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   c.Request.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) handleGetTokens(c *gin.Context) {
+	tokens, err := GetAPITokens(s.db)
+	if err != nil {
+		logrus.WithError(err).Error("查询 API 令牌失败")
+		apiError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, tokens)
+}
+
+// handleCreateToken 创建 API 令牌，令牌只在响应中返回一次
+func (s *Server) handleCreateToken(c *gin.Context) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, http.StatusBadRequest, err)
+		return
+	}
+	token, err := CreateAPIToken(s.db, req.Name)
+	if err != nil {
+		apiError(c, http.StatusBadRequest, err)
+		return
+	}
+	logrus.WithFields(logrus.Fields{"name": token.Name, "by": c.GetString("principal")}).Info("创建 API 令牌")
+	c.JSON(http.StatusCreated, token)
+}
+
+func (s *Server) handleDeleteToken(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		apiError(c, http.StatusBadRequest, fmt.Errorf("无效的令牌 ID: %s", c.Param("id")))
+		return
+	}
+	deleted, err := DeleteAPIToken(s.db, id)
+	if err != nil {
+		apiError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if !deleted {
+		apiError(c, http.StatusNotFound, fmt.Errorf("令牌不存在: %d", id))
+		return
+	}
+	logrus.WithFields(logrus.Fields{"id": id, "by": c.GetString("principal")}).Info("吊销 API 令牌")
+	c.Status(http.StatusNoContent)
+}
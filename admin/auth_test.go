@@ -0,0 +1,177 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// login 登录并返回会话 Cookie
+func login(t *testing.T, s *Server, password string) string {
+	t.Helper()
+	w := doRequest(s, http.MethodPost, "/api/v1/login", `{"username":"admin","password":"`+password+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("登录失败: status = %d, body = %s", w.Code, w.Body)
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == sessionCookie {
+			if !cookie.HttpOnly || cookie.SameSite != http.SameSiteStrictMode {
+				t.Errorf("会话 Cookie 需要 HttpOnly 和 SameSite=Strict: %+v", cookie)
+			}
+			return cookie.Name + "=" + cookie.Value
+		}
+	}
+	t.Fatal("登录后没有设置会话 Cookie")
+	return ""
+}
+
+func TestAuth_Session(t *testing.T) {
+	s := newTestServer(t, Options{})
+	password, err := EnsureAdminUser(s.db)
+	if err != nil || password == "" {
+		t.Fatalf("EnsureAdminUser() = %q, %v", password, err)
+	}
+	if again, _ := EnsureAdminUser(s.db); again != "" {
+		t.Errorf("已有管理员时 EnsureAdminUser() = %q, want empty", again)
+	}
+
+	if w := doRequest(s, http.MethodGet, "/api/v1/stats", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("未登录时 status = %d, want 401", w.Code)
+	}
+	if w := doRequest(s, http.MethodGet, "/", ""); w.Code != http.StatusFound || w.Header().Get("Location") != "/login" {
+		t.Errorf("未登录时首页 status = %d, Location = %s", w.Code, w.Header().Get("Location"))
+	}
+	if w := doRequest(s, http.MethodPost, "/api/v1/login", `{"password":"wrong"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("密码错误时 status = %d, want 401", w.Code)
+	}
+
+	cookie := login(t, s, password)
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		headers []string
+		want    int
+	}{
+		{"会话", http.MethodGet, "/api/v1/stats", []string{"Cookie", cookie}, http.StatusOK},
+		{"首页", http.MethodGet, "/", []string{"Cookie", cookie}, http.StatusOK},
+		{"同源", http.MethodPut, "/api/v1/log-level", []string{"Cookie", cookie, "Origin", "http://example.com"}, http.StatusOK},
+		{"跨站请求", http.MethodPut, "/api/v1/log-level", []string{"Cookie", cookie, "Origin", "http://evil.example"}, http.StatusForbidden},
+		{"跨站 WebSocket", http.MethodGet, "/ws", []string{"Cookie", cookie, "Origin", "http://evil.example"}, http.StatusForbidden},
+		{"旧接口", http.MethodGet, "/api/explain?domain=example.com", nil, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := ""
+			if tt.method == http.MethodPut {
+				body = `{"level":"info"}`
+			}
+			if w := doRequest(s, tt.method, tt.path, body, tt.headers...); w.Code != tt.want {
+				t.Errorf("status = %d, want %d, body = %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+
+	// 修改密码后会话失效
+	if err := SetAdminPassword(s.db, DefaultUsername, "short"); err == nil {
+		t.Error("SetAdminPassword() 应该拒绝过短的密码")
+	}
+	if err := SetAdminPassword(s.db, DefaultUsername, "new-password"); err != nil {
+		t.Fatal(err)
+	}
+	if w := doRequest(s, http.MethodGet, "/api/v1/stats", "", "Cookie", cookie); w.Code != http.StatusUnauthorized {
+		t.Errorf("修改密码后 status = %d, want 401", w.Code)
+	}
+
+	cookie = login(t, s, "new-password")
+	if w := doRequest(s, http.MethodPost, "/api/v1/logout", "", "Cookie", cookie); w.Code != http.StatusNoContent {
+		t.Fatalf("退出登录 status = %d", w.Code)
+	}
+	if w := doRequest(s, http.MethodGet, "/api/v1/stats", "", "Cookie", cookie); w.Code != http.StatusUnauthorized {
+		t.Errorf("退出登录后 status = %d, want 401", w.Code)
+	}
+}
+
+func TestAuth_APIToken(t *testing.T) {
+	s := newTestServer(t, Options{})
+	if err := SetAdminPassword(s.db, DefaultUsername, "password"); err != nil {
+		t.Fatal(err)
+	}
+	cookie := login(t, s, "password")
+
+	w := doRequest(s, http.MethodPost, "/api/v1/tokens", `{"name":"grafana"}`, "Cookie", cookie)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("创建令牌 status = %d, body = %s", w.Code, w.Body)
+	}
+	var token APIToken
+	if err := json.Unmarshal(w.Body.Bytes(), &token); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(token.Token, apiTokenPrefix) {
+		t.Fatalf("令牌 = %q", token.Token)
+	}
+	if w := doRequest(s, http.MethodPost, "/api/v1/tokens", `{"name":"grafana"}`, "Cookie", cookie); w.Code != http.StatusBadRequest {
+		t.Errorf("重复的名称 status = %d, want 400", w.Code)
+	}
+
+	bearer := "Bearer " + token.Token
+	if w := doRequest(s, http.MethodGet, "/api/v1/stats", "", "Authorization", bearer); w.Code != http.StatusOK {
+		t.Errorf("使用令牌 status = %d, body = %s", w.Code, w.Body)
+	}
+	if w := doRequest(s, http.MethodGet, "/api/v1/stats", "", "Authorization", "Bearer gdp_invalid"); w.Code != http.StatusUnauthorized {
+		t.Errorf("无效的令牌 status = %d, want 401", w.Code)
+	}
+
+	tokens, err := GetAPITokens(s.db)
+	if err != nil || len(tokens) != 1 {
+		t.Fatalf("GetAPITokens() = %v, %v", tokens, err)
+	}
+	if tokens[0].Token != "" || tokens[0].LastUsedAt == nil {
+		t.Errorf("令牌列表 = %+v，不应包含令牌本身，需要记录使用时间", tokens[0])
+	}
+
+	if w := doRequest(s, http.MethodDelete, "/api/v1/tokens/1", "", "Authorization", bearer); w.Code != http.StatusNoContent {
+		t.Fatalf("吊销令牌 status = %d", w.Code)
+	}
+	if w := doRequest(s, http.MethodGet, "/api/v1/stats", "", "Authorization", bearer); w.Code != http.StatusUnauthorized {
+		t.Errorf("吊销后 status = %d, want 401", w.Code)
+	}
+}
+
+func TestAuth_LoginLimit(t *testing.T) {
+	s := newTestServer(t, Options{})
+	if err := SetAdminPassword(s.db, DefaultUsername, "password"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < loginMaxFailures; i++ {
+		doRequest(s, http.MethodPost, "/api/v1/login", `{"password":"wrong"}`)
+	}
+	if w := doRequest(s, http.MethodPost, "/api/v1/login", `{"password":"password"}`); w.Code != http.StatusTooManyRequests {
+		t.Errorf("多次失败后 status = %d, want 429", w.Code)
+	}
+}
+
+func TestServer_CheckOrigin(t *testing.T) {
+	s := &Server{options: Options{AllowedOrigins: []string{"https://router.lan/"}}}
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"http://192.168.1.1:8080", true},
+		{"https://router.lan", true},
+		{"http://router.lan", false},
+		{"http://evil.example", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://192.168.1.1:8080/ws", nil)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if got := s.checkOrigin(req); got != tt.want {
+			t.Errorf("checkOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package admin
+
+import (
+	"database/sql"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BatchOptions 异步批量写入数据库的配置
+type BatchOptions struct {
+	// QueueSize 等待写入的最多记录数，队列已满时丢弃新记录，默认 4096
+	QueueSize int
+	// BatchSize 一个事务最多写入的记录数，默认 256
+	BatchSize int
+	// FlushInterval 没有攒满一批时最长的等待时间，默认 1 秒
+	FlushInterval time.Duration
+}
+
+func (o BatchOptions) withDefaults() BatchOptions {
+	if o.QueueSize <= 0 {
+		o.QueueSize = 4096
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 256
+	}
+	if o.FlushInterval <= 0 {
+		o.FlushInterval = time.Second
+	}
+	return o
+}
+
+// batchWriter 在后台按批写入数据库，每批使用一个事务。
+// 写入方不会被数据库阻塞，队列已满时记录被丢弃并计数
+type batchWriter struct {
+	// 原子操作的 64 位字段放在最前面，保证在 32 位平台上对齐
+	dropped uint64
+
+	db      *sql.DB
+	options BatchOptions
+	queue   chan interface{}
+	// write 在事务中写入一批记录
+	write func(tx *sql.Tx, batch []interface{}) error
+	// flushed 在一批记录写入后调用，err 为写入失败的原因
+	flushed func(n int, err error)
+
+	// mu 保护 closed，add 在持有读锁时加入队列，保证 close 之后排空队列时不会再有新记录
+	mu        sync.RWMutex
+	closed    bool
+	closeOnce sync.Once
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+func newBatchWriter(db *sql.DB, options BatchOptions, write func(tx *sql.Tx, batch []interface{}) error, flushed func(n int, err error)) *batchWriter {
+	options = options.withDefaults()
+	return &batchWriter{
+		db:      db,
+		options: options,
+		queue:   make(chan interface{}, options.QueueSize),
+		write:   write,
+		flushed: flushed,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// add 将记录加入队列，队列已满或已经关闭时返回 false
+func (w *batchWriter) add(item interface{}) bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return false
+	}
+	select {
+	case w.queue <- item:
+		return true
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+		return false
+	}
+}
+
+// run 读取队列并写入数据库，直到 close 被调用
+func (w *batchWriter) run() {
+	defer close(w.stopped)
+
+	ticker := time.NewTicker(w.options.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]interface{}, 0, w.options.BatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := writeBatch(w.db, batch, w.write)
+		if w.flushed != nil {
+			w.flushed(len(batch), err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case item := <-w.queue:
+			batch = append(batch, item)
+			if len(batch) >= w.options.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-w.done:
+			// 写入队列中剩余的记录
+			for {
+				select {
+				case item := <-w.queue:
+					batch = append(batch, item)
+					if len(batch) >= w.options.BatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// close 停止接收新记录，写入队列中剩余的记录后返回
+func (w *batchWriter) close() {
+	w.closeOnce.Do(func() {
+		w.mu.Lock()
+		w.closed = true
+		w.mu.Unlock()
+		close(w.done)
+	})
+	<-w.stopped
+}
+
+// droppedCount 返回因队列已满丢弃的记录数
+func (w *batchWriter) droppedCount() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// writeBatch 在一个事务中写入一批记录
+func writeBatch(db *sql.DB, batch []interface{}, write func(tx *sql.Tx, batch []interface{}) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := write(tx, batch); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -27,8 +29,9 @@ func InitDB(dbPath string) (*sql.DB, error) {
 		return nil, fmt.Errorf("创建数据库目录失败: %v", err)
 	}
 
-	// 打开数据库连接
-	db, err := sql.Open("sqlite", dbPath)
+	// 打开数据库连接。busy_timeout 只对设置它的连接生效，
+	// 在连接参数中设置，保证连接池中的每个连接在数据库被锁定时都会等待
+	db, err := sql.Open("sqlite", dbPath+"?_pragma=busy_timeout(5000)")
 	if err != nil {
 		return nil, fmt.Errorf("打开数据库失败: %v", err)
 	}
@@ -44,10 +47,7 @@ func InitDB(dbPath string) (*sql.DB, error) {
 
 func createTables(db *sql.DB) error {
 	// 设置 SQLite 参数以减少锁定问题
-	if _, err := db.Exec(`
-		PRAGMA journal_mode=WAL;
-		PRAGMA busy_timeout=5000;
-	`); err != nil {
+	if _, err := db.Exec(`PRAGMA journal_mode=WAL;`); err != nil {
 		return fmt.Errorf("设置 SQLite 参数失败: %v", err)
 	}
 
@@ -85,60 +85,177 @@ func createTables(db *sql.DB) error {
 			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
 		);
 		CREATE INDEX IF NOT EXISTS idx_beian_cache_updated_at ON beian_cache(updated_at);
+
+		CREATE TABLE IF NOT EXISTS learned_domains (
+			domain TEXT PRIMARY KEY,
+			route TEXT NOT NULL,
+			hit_count INTEGER NOT NULL DEFAULT 0,
+			status TEXT NOT NULL DEFAULT 'pending',
+			evidence TEXT NOT NULL DEFAULT '',
+			first_seen DATETIME NOT NULL,
+			last_seen DATETIME NOT NULL,
+			expires_at DATETIME
+		);
+		CREATE INDEX IF NOT EXISTS idx_learned_domains_last_seen ON learned_domains(last_seen);
+
+		CREATE TABLE IF NOT EXISTS admin_users (
+			username TEXT PRIMARY KEY,
+			password_hash TEXT NOT NULL,
+			updated_at DATETIME NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS admin_sessions (
+			token_hash TEXT PRIMARY KEY,
+			username TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_admin_sessions_expires_at ON admin_sessions(expires_at);
+
+		CREATE TABLE IF NOT EXISTS api_tokens (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE,
+			token_hash TEXT NOT NULL UNIQUE,
+			created_at DATETIME NOT NULL,
+			last_used_at DATETIME
+		);
 	`)
-	return err
-}
+	if err != nil {
+		return err
+	}
 
-func SaveDNSQuery(db *sql.DB, query *DNSQuery) error {
-	// 只在 info 和 debug 级别保存查询记录
-	if log.GetLevel() != log.InfoLevel && log.GetLevel() != log.DebugLevel {
-		return nil
+	// 兼容旧版本数据库，补充新增的列
+	columns := []struct {
+		table, column, definition string
+	}{
+		{"dns_queries", "route_reason", "TEXT NOT NULL DEFAULT ''"},
+		{"dns_queries", "route_detail", "TEXT NOT NULL DEFAULT '{}'"},
+		{"dns_queries", "is_local", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"dns_queries", "blocked", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"dns_queries", "block_rule", "TEXT NOT NULL DEFAULT ''"},
+		{"dns_queries", "client_group", "TEXT NOT NULL DEFAULT ''"},
+		{"dns_queries", "poison_reason", "TEXT NOT NULL DEFAULT ''"},
+		{"dns_queries", "cached", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"dns_queries", "dnssec", "TEXT NOT NULL DEFAULT ''"},
+	}
+	for _, c := range columns {
+		if err := ensureColumn(db, c.table, c.column, c.definition); err != nil {
+			return err
+		}
 	}
 
-	answersJSON, err := json.Marshal(query.Answers)
+	return nil
+}
+
+// ensureColumn 如果表中不存在指定的列则添加
+func ensureColumn(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
 	if err != nil {
 		return err
 	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    int
+			defaultVal sql.NullString
+			pk         int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("添加列 %s.%s 失败: %v", table, column, err)
+	}
+	return nil
+}
+
+// dnsQueryColumns 查询记录的列，顺序与 scanDNSQuery 保持一致
+const dnsQueryColumns = `id, request_id, domain, query_type, client_ip,
+	server, is_china_dns, response_code, answer_count,
+	total_time_ms, created_at, answers, route_reason, route_detail, is_local,
+	blocked, block_rule, client_group, poison_reason, cached, dnssec`
+
+// scanDNSQuery 从结果集中读取一条查询记录
+func scanDNSQuery(rows *sql.Rows) (*DNSQuery, error) {
+	var q DNSQuery
+	var answersJSON string
+	err := rows.Scan(
+		&q.ID, &q.RequestID, &q.Domain, &q.QueryType, &q.ClientIP,
+		&q.Server, &q.IsChinaDNS, &q.ResponseCode, &q.AnswerCount,
+		&q.TotalTimeMs, &q.CreatedAt, &answersJSON, &q.RouteReason, &q.RouteDetail,
+		&q.IsLocal, &q.Blocked, &q.BlockRule,
+		&q.ClientGroup, &q.PoisonReason, &q.Cached, &q.DNSSEC,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(answersJSON), &q.Answers); err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
 
-	_, err = db.Exec(`
+// SaveDNSQuery 立即保存一条查询记录，只在 info 和 debug 级别保存。
+// 查询处理过程中使用 QueryLogger 在后台批量保存
+func SaveDNSQuery(db *sql.DB, query *DNSQuery) error {
+	if !queryLogEnabled() {
+		return nil
+	}
+	return writeBatch(db, []interface{}{query}, insertDNSQueries)
+}
+
+// queryLogEnabled 只在 info 和 debug 级别保存查询记录
+func queryLogEnabled() bool {
+	return log.GetLevel() == log.InfoLevel || log.GetLevel() == log.DebugLevel
+}
+
+// insertDNSQueries 在事务中写入一批查询记录
+func insertDNSQueries(tx *sql.Tx, batch []interface{}) error {
+	stmt, err := tx.Prepare(`
 		INSERT INTO dns_queries (
 			request_id, domain, query_type, client_ip, server,
 			is_china_dns, response_code, answer_count, total_time_ms, created_at,
-			answers
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		query.RequestID, query.Domain, query.QueryType, query.ClientIP,
-		query.Server, query.IsChinaDNS, query.ResponseCode,
-		query.AnswerCount, query.TotalTimeMs, query.CreatedAt,
-		string(answersJSON),
-	)
-
+			answers, route_reason, route_detail, is_local, blocked, block_rule,
+			client_group, poison_reason, cached, dnssec
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
 	if err != nil {
 		return err
 	}
+	defer stmt.Close()
 
-	// 如果保存成功且管理服务器已初始化，发送更新
-	if adminServer != nil {
-		// 获取最新统计数据
-		endTime := time.Now()
-		startTime := endTime.Add(-24 * time.Hour)
-		stats, err := GetQueryStats(db, startTime, endTime)
-		if err == nil {
-			adminServer.broadcast <- stats
+	for _, item := range batch {
+		query := item.(*DNSQuery)
+		answersJSON, err := json.Marshal(query.Answers)
+		if err != nil {
+			return err
 		}
-
-		// 获取最新查询记录
-		queries, err := GetRecentQueries(db, "", 20)
-		if err == nil {
-			adminServer.broadcast <- map[string]interface{}{
-				"type": "queries",
-				"data": map[string]interface{}{
-					"data":        queries,
-					"next_cursor": "",
-				},
-			}
+		_, err = stmt.Exec(
+			query.RequestID, query.Domain, query.QueryType, query.ClientIP,
+			query.Server, query.IsChinaDNS, query.ResponseCode,
+			query.AnswerCount, query.TotalTimeMs, query.CreatedAt,
+			string(answersJSON), query.RouteReason, query.RouteDetail, query.IsLocal,
+			query.Blocked, query.BlockRule, query.ClientGroup, query.PoisonReason,
+			query.Cached, query.DNSSEC,
+		)
+		if err != nil {
+			return err
 		}
 	}
-
 	return nil
 }
 
@@ -152,11 +269,13 @@ func GetQueryStats(db *sql.DB, startTime, endTime time.Time) (*QueryStats, error
 			COALESCE(COUNT(*), 0) as total_queries,
 			COALESCE(AVG(total_time_ms), 0) as avg_time,
 			COALESCE(SUM(CASE WHEN is_china_dns = 1 THEN 1 ELSE 0 END), 0) as china_dns_queries,
-			COALESCE(SUM(CASE WHEN is_china_dns = 0 THEN 1 ELSE 0 END), 0) as oversea_dns_queries
+			COALESCE(SUM(CASE WHEN is_china_dns = 0 AND is_local = 0 AND blocked = 0 THEN 1 ELSE 0 END), 0) as oversea_dns_queries,
+			COALESCE(SUM(CASE WHEN is_local = 1 THEN 1 ELSE 0 END), 0) as local_queries,
+			COALESCE(SUM(CASE WHEN blocked = 1 THEN 1 ELSE 0 END), 0) as blocked_queries
 		FROM dns_queries
 		WHERE created_at BETWEEN ? AND ?`,
 		startTime, endTime,
-	).Scan(&stats.TotalQueries, &avgTime, &stats.ChinaDNSQueries, &stats.OverseaDNSQueries)
+	).Scan(&stats.TotalQueries, &avgTime, &stats.ChinaDNSQueries, &stats.OverseaDNSQueries, &stats.LocalQueries, &stats.BlockedQueries)
 
 	if err != nil {
 		return nil, err
@@ -221,27 +340,20 @@ func GetRecentQueries(db *sql.DB, cursor string, limit int) ([]DNSQuery, error)
 
 	if cursor == "" {
 		rows, err = db.Query(`
-			SELECT id, request_id, domain, query_type, client_ip,
-				   server, is_china_dns, response_code, answer_count,
-				   total_time_ms, created_at, answers
+			SELECT `+dnsQueryColumns+`
 			FROM dns_queries
 			ORDER BY created_at DESC, id DESC
 			LIMIT ?`,
 			limit,
 		)
 	} else {
-		// 解析游标
-		var cursorTime time.Time
-		var cursorID int64
-		_, err := fmt.Sscanf(cursor, "%s_%d", &cursorTime, &cursorID)
-		if err != nil {
-			return nil, fmt.Errorf("无效的游标格式: %v", err)
+		cursorTime, cursorID, cursorErr := parseQueryCursor(cursor)
+		if cursorErr != nil {
+			return nil, cursorErr
 		}
 
 		rows, err = db.Query(`
-			SELECT id, request_id, domain, query_type, client_ip,
-				   server, is_china_dns, response_code, answer_count,
-				   total_time_ms, created_at, answers
+			SELECT `+dnsQueryColumns+`
 			FROM dns_queries
 			WHERE (created_at, id) < (?, ?)
 			ORDER BY created_at DESC, id DESC
@@ -257,47 +369,139 @@ func GetRecentQueries(db *sql.DB, cursor string, limit int) ([]DNSQuery, error)
 
 	var queries []DNSQuery
 	for rows.Next() {
-		var q DNSQuery
-		var answersJSON string
-		err := rows.Scan(
-			&q.ID, &q.RequestID, &q.Domain, &q.QueryType, &q.ClientIP,
-			&q.Server, &q.IsChinaDNS, &q.ResponseCode, &q.AnswerCount,
-			&q.TotalTimeMs, &q.CreatedAt, &answersJSON,
-		)
+		q, err := scanDNSQuery(rows)
 		if err != nil {
 			return nil, err
 		}
+		queries = append(queries, *q)
+	}
 
-		err = json.Unmarshal([]byte(answersJSON), &q.Answers)
-		if err != nil {
+	return queries, nil
+}
+
+// GetQueryPage 按时间倒序分页返回查询记录，cursor 为上一页返回的 NextCursor，为空时返回第一页
+func GetQueryPage(db *sql.DB, cursor string, limit int) (*QueryPage, error) {
+	// 多获取一条用于判断是否有下一页
+	queries, err := GetRecentQueries(db, cursor, limit+1)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &QueryPage{Data: []DNSQuery{}}
+	if len(queries) > limit {
+		queries = queries[:limit]
+		last := queries[limit-1]
+		page.NextCursor = fmt.Sprintf("%s_%d", last.CreatedAt.Format(time.RFC3339Nano), last.ID)
+	}
+	page.Data = append(page.Data, queries...)
+	return page, nil
+}
+
+// parseQueryCursor 解析 "创建时间_ID" 格式的分页游标
+func parseQueryCursor(cursor string) (time.Time, int64, error) {
+	i := strings.LastIndex(cursor, "_")
+	if i < 0 {
+		return time.Time{}, 0, fmt.Errorf("无效的游标格式")
+	}
+	cursorTime, err := time.Parse(time.RFC3339Nano, cursor[:i])
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("解析游标时间失败: %v", err)
+	}
+	cursorID, err := strconv.ParseInt(cursor[i+1:], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("解析游标ID失败: %v", err)
+	}
+	return cursorTime, cursorID, nil
+}
+
+// GetQueryLogs 按时间顺序返回一次查询处理过程中的日志
+func GetQueryLogs(db *sql.DB, requestID string) ([]LogEntry, error) {
+	rows, err := db.Query(`
+		SELECT timestamp, level, message, fields
+		FROM dns_logs
+		WHERE fields LIKE ?
+		ORDER BY timestamp ASC`,
+		"%\"requestId\":\""+requestID+"\"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	logs := []LogEntry{}
+	for rows.Next() {
+		var entry LogEntry
+		var fieldsStr string
+		if err := rows.Scan(&entry.Timestamp, &entry.Level, &entry.Message, &fieldsStr); err != nil {
 			return nil, err
 		}
+		entry.Fields = json.RawMessage(fieldsStr)
+		logs = append(logs, entry)
+	}
+	return logs, rows.Err()
+}
 
-		queries = append(queries, q)
+// GetBeianCacheItems 按更新时间倒序返回备案缓存
+func GetBeianCacheItems(db *sql.DB, limit int) ([]BeianCacheItem, error) {
+	rows, err := db.Query(`
+		SELECT domain, is_beian, api_response, updated_at
+		FROM beian_cache
+		ORDER BY updated_at DESC
+		LIMIT ?`,
+		limit,
+	)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	return queries, nil
+	items := []BeianCacheItem{}
+	for rows.Next() {
+		var item BeianCacheItem
+		if err := rows.Scan(&item.Domain, &item.IsBeian, &item.APIResponse, &item.UpdatedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// GetBeianStatuses 返回所有域名的备案状态和更新时间，不包含接口原始响应，用于启动时加载到内存
+func GetBeianStatuses(db *sql.DB) ([]BeianCacheItem, error) {
+	rows, err := db.Query(`SELECT domain, is_beian, updated_at FROM beian_cache`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []BeianCacheItem{}
+	for rows.Next() {
+		var item BeianCacheItem
+		if err := rows.Scan(&item.Domain, &item.IsBeian, &item.UpdatedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
 }
 
-func GetBeianCache(db *sql.DB, domain string) (bool, string, bool) {
-	var isBeian bool
-	var apiResponse string
+func GetBeianCache(db *sql.DB, domain string) (*BeianCacheItem, bool) {
+	item := BeianCacheItem{Domain: domain}
 	err := db.QueryRow(`
-		SELECT is_beian, api_response
+		SELECT is_beian, api_response, updated_at
 		FROM beian_cache
 		WHERE domain = ?`,
 		domain,
-	).Scan(&isBeian, &apiResponse)
+	).Scan(&item.IsBeian, &item.APIResponse, &item.UpdatedAt)
 
 	if err == sql.ErrNoRows {
-		return false, "{}", false
+		return nil, false
 	}
 	if err != nil {
 		log.WithError(err).Error("查询备案缓存失败")
-		return false, "{}", false
+		return nil, false
 	}
 
-	return isBeian, apiResponse, true
+	return &item, true
 }
 
 func SaveBeianCache(db *sql.DB, domain string, isBeian bool, apiResponse string) error {
@@ -313,4 +517,90 @@ func SaveBeianCache(db *sql.DB, domain string, isBeian bool, apiResponse string)
 	return err
 }
 
-// ... rest of the file ... 
\ No newline at end of file
+// learnedDomainColumns 学习域名的列，顺序与 scanLearnedDomain 保持一致
+const learnedDomainColumns = `domain, route, hit_count, status, evidence, first_seen, last_seen, expires_at`
+
+func scanLearnedDomain(rows *sql.Rows) (*LearnedDomain, error) {
+	var d LearnedDomain
+	var expiresAt sql.NullTime
+	if err := rows.Scan(&d.Domain, &d.Route, &d.HitCount, &d.Status, &d.Evidence,
+		&d.FirstSeen, &d.LastSeen, &expiresAt); err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		d.ExpiresAt = &expiresAt.Time
+	}
+	return &d, nil
+}
+
+// GetLearnedDomains 按最近出现时间返回学习域名，status 为空时返回全部
+func GetLearnedDomains(db *sql.DB, status string, limit int) ([]LearnedDomain, error) {
+	rows, err := db.Query(`
+		SELECT `+learnedDomainColumns+`
+		FROM learned_domains
+		WHERE ? = '' OR status = ?
+		ORDER BY last_seen DESC
+		LIMIT ?`,
+		status, status, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	domains := make([]LearnedDomain, 0)
+	for rows.Next() {
+		d, err := scanLearnedDomain(rows)
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, *d)
+	}
+	return domains, rows.Err()
+}
+
+// SaveLearnedDomain 立即保存一条学习域名。查询处理过程中使用 LearnedDomainWriter 在后台批量保存
+func SaveLearnedDomain(db *sql.DB, d *LearnedDomain) error {
+	return writeBatch(db, []interface{}{d}, upsertLearnedDomains)
+}
+
+// upsertLearnedDomains 在事务中写入一批学习域名，已存在的域名会被更新
+func upsertLearnedDomains(tx *sql.Tx, batch []interface{}) error {
+	stmt, err := tx.Prepare(`
+		INSERT INTO learned_domains (` + learnedDomainColumns + `)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(domain) DO UPDATE SET
+			route = excluded.route,
+			hit_count = excluded.hit_count,
+			status = excluded.status,
+			evidence = excluded.evidence,
+			first_seen = excluded.first_seen,
+			last_seen = excluded.last_seen,
+			expires_at = excluded.expires_at`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, item := range batch {
+		d := item.(*LearnedDomain)
+		if _, err := stmt.Exec(d.Domain, d.Route, d.HitCount, d.Status, d.Evidence,
+			d.FirstSeen, d.LastSeen, d.ExpiresAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteExpiredLearnedDomains 删除已过期的待审核学习域名
+func DeleteExpiredLearnedDomains(db *sql.DB, now time.Time) (int64, error) {
+	result, err := db.Exec(`
+		DELETE FROM learned_domains
+		WHERE status = ? AND expires_at IS NOT NULL AND expires_at < ?`,
+		LearnedStatusPending, now,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,35 @@
+package admin
+
+import (
+	"database/sql"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// LearnedDomainWriter 在后台批量保存学习域名，与查询记录使用相同的写入方式。
+// 同一个域名按加入队列的顺序写入，较新的结果不会被较早的结果覆盖
+type LearnedDomainWriter struct {
+	writer *batchWriter
+}
+
+// NewLearnedDomainWriter 创建学习域名写入器并启动后台写入
+func NewLearnedDomainWriter(db *sql.DB, options BatchOptions) *LearnedDomainWriter {
+	w := &LearnedDomainWriter{}
+	w.writer = newBatchWriter(db, options, upsertLearnedDomains, func(n int, err error) {
+		if err != nil {
+			log.WithError(err).WithField("count", n).Error("保存学习域名失败")
+		}
+	})
+	go w.writer.run()
+	return w
+}
+
+// Save 将学习域名加入写入队列，队列已满或已经关闭时返回 false
+func (w *LearnedDomainWriter) Save(d LearnedDomain) bool {
+	return w.writer.add(&d)
+}
+
+// Close 保存队列中剩余的学习域名并停止后台写入
+func (w *LearnedDomainWriter) Close() {
+	w.writer.close()
+}
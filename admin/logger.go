@@ -3,16 +3,36 @@ package admin
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
+	"os"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// DBHook 将日志保存到数据库，在后台批量写入，不阻塞输出日志的协程
 type DBHook struct {
-	db *sql.DB
+	writer *batchWriter
+}
+
+// logRecord 等待写入的一条日志
+type logRecord struct {
+	time    time.Time
+	level   string
+	message string
+	fields  string
 }
 
 func NewDBHook(db *sql.DB) *DBHook {
-	return &DBHook{db: db}
+	hook := &DBHook{}
+	hook.writer = newBatchWriter(db, BatchOptions{}, insertLogs, func(n int, err error) {
+		// 不能使用 logrus 输出，否则写入失败的日志又会进入队列
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "保存 %d 条日志失败: %v\n", n, err)
+		}
+	})
+	go hook.writer.run()
+	return hook
 }
 
 func (hook *DBHook) Levels() []log.Level {
@@ -26,16 +46,47 @@ func (hook *DBHook) Levels() []log.Level {
 	}
 }
 
+// Fire 将日志加入写入队列，队列已满时丢弃
 func (hook *DBHook) Fire(entry *log.Entry) error {
 	fieldsBytes, err := json.Marshal(entry.Data)
 	if err != nil {
 		return err
 	}
 
-	_, err = hook.db.Exec(`
+	hook.writer.add(&logRecord{
+		time:    entry.Time,
+		level:   entry.Level.String(),
+		message: entry.Message,
+		fields:  string(fieldsBytes),
+	})
+	return nil
+}
+
+// Dropped 返回因队列已满丢弃的日志数
+func (hook *DBHook) Dropped() uint64 {
+	return hook.writer.droppedCount()
+}
+
+// Close 保存队列中剩余的日志并停止后台写入，之后的日志不再保存
+func (hook *DBHook) Close() {
+	hook.writer.close()
+}
+
+// insertLogs 在事务中写入一批日志
+func insertLogs(tx *sql.Tx, batch []interface{}) error {
+	stmt, err := tx.Prepare(`
 		INSERT INTO dns_logs (timestamp, level, message, fields)
-		VALUES (?, ?, ?, ?)`,
-		entry.Time, entry.Level.String(), entry.Message, string(fieldsBytes),
-	)
-	return err
-} 
\ No newline at end of file
+		VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, item := range batch {
+		record := item.(*logRecord)
+		if _, err := stmt.Exec(record.time, record.level, record.message, record.fields); err != nil {
+			return err
+		}
+	}
+	return nil
+}
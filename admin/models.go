@@ -1,6 +1,7 @@
 package admin
 
 import (
+	"encoding/json"
 	"time"
 
 	_ "modernc.org/sqlite" // SQLite 驱动程序
@@ -19,6 +20,15 @@ type DNSQuery struct {
 	TotalTimeMs  float64   `json:"total_time_ms"`
 	CreatedAt    time.Time `json:"created_at"`
 	Answers      []string  `json:"answers"`
+	RouteReason  string    `json:"route_reason"`
+	RouteDetail  string    `json:"route_detail"`
+	IsLocal      bool      `json:"is_local"`
+	Blocked      bool      `json:"blocked"`
+	BlockRule    string    `json:"block_rule"`
+	ClientGroup  string    `json:"client_group"`
+	PoisonReason string    `json:"poison_reason"`
+	Cached       bool      `json:"cached"`
+	DNSSEC       string    `json:"dnssec"`
 }
 
 type QueryStats struct {
@@ -26,6 +36,8 @@ type QueryStats struct {
 	AverageTimeMs     float64       `json:"average_time_ms"`
 	ChinaDNSQueries   int64         `json:"china_dns_queries"`
 	OverseaDNSQueries int64         `json:"oversea_dns_queries"`
+	LocalQueries      int64         `json:"local_queries"`
+	BlockedQueries    int64         `json:"blocked_queries"`
 	TopDomains        []DomainCount `json:"top_domains"`
 	TopClients        []ClientCount `json:"top_clients"`
 }
@@ -38,4 +50,79 @@ type DomainCount struct {
 type ClientCount struct {
 	ClientIP string `json:"client_ip"`
 	Count    int64  `json:"count"`
-} 
\ No newline at end of file
+}
+
+type BeianCacheItem struct {
+	Domain      string    `json:"domain"`
+	IsBeian     bool      `json:"is_beian"`
+	APIResponse string    `json:"api_response"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// QueryPage 一页查询记录，NextCursor 为空表示没有更多记录
+type QueryPage struct {
+	Data       []DNSQuery `json:"data"`
+	NextCursor string     `json:"next_cursor"`
+}
+
+// LogEntry 一条查询处理过程中的日志
+type LogEntry struct {
+	Timestamp time.Time       `json:"timestamp"`
+	Level     string          `json:"level"`
+	Message   string          `json:"message"`
+	Fields    json.RawMessage `json:"fields"`
+}
+
+// 学习域名状态
+const (
+	LearnedStatusPending  = "pending"
+	LearnedStatusApproved = "approved"
+	LearnedStatusRejected = "rejected"
+)
+
+type LearnedDomain struct {
+	Domain    string     `json:"domain"`
+	Route     string     `json:"route"`
+	HitCount  int64      `json:"hit_count"`
+	Status    string     `json:"status"`
+	Evidence  string     `json:"evidence"`
+	FirstSeen time.Time  `json:"first_seen"`
+	LastSeen  time.Time  `json:"last_seen"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// ListenerStats 监听器的查询和拒绝计数
+type ListenerStats struct {
+	Name    string `json:"name"`
+	Network string `json:"network"`
+	Addr    string `json:"addr"`
+	Queries int64  `json:"queries"`
+	Refused int64  `json:"refused"`
+	Dropped int64  `json:"dropped"`
+	Limited int64  `json:"limited"`
+}
+
+// LimitedClient 被限速的客户端，Client 为 IP 或子网
+type LimitedClient struct {
+	Client      string    `json:"client"`
+	Limited     int64     `json:"limited"`
+	Slipped     int64     `json:"slipped"`
+	Dropped     int64     `json:"dropped"`
+	LastLimited time.Time `json:"last_limited"`
+}
+
+// ReloadResult 配置重载的结果，Changed 为已经生效的配置项，RestartRequired 为需要重启才能生效的配置项
+type ReloadResult struct {
+	Time            time.Time `json:"time"`
+	Changed         []string  `json:"changed"`
+	RestartRequired []string  `json:"restart_required"`
+}
+
+// APIToken 供脚本调用接口的令牌，令牌本身只在创建时返回
+type APIToken struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Token      string     `json:"token,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
@@ -0,0 +1,64 @@
+package admin
+
+import (
+	"database/sql"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// QueryLogger 在后台批量保存查询记录，查询处理过程中不读写数据库
+type QueryLogger struct {
+	writer *batchWriter
+	// reported 已经输出过警告的丢弃记录数，只在写入协程中使用
+	reported uint64
+}
+
+// NewQueryLogger 创建查询记录写入器并启动后台写入
+func NewQueryLogger(db *sql.DB, options BatchOptions) *QueryLogger {
+	l := &QueryLogger{}
+	l.writer = newBatchWriter(db, options, insertDNSQueries, l.flushed)
+	go l.writer.run()
+	return l
+}
+
+// Log 将查询记录加入写入队列，只在 info 和 debug 级别保存。
+// 队列已满时丢弃记录并返回 false
+func (l *QueryLogger) Log(query *DNSQuery) bool {
+	if l == nil || !queryLogEnabled() {
+		return false
+	}
+	return l.writer.add(query)
+}
+
+// Dropped 返回因队列已满丢弃的查询记录数
+func (l *QueryLogger) Dropped() uint64 {
+	if l == nil {
+		return 0
+	}
+	return l.writer.droppedCount()
+}
+
+// Close 保存队列中剩余的查询记录并停止后台写入
+func (l *QueryLogger) Close() {
+	if l == nil {
+		return
+	}
+	l.writer.close()
+}
+
+// flushed 一批查询记录写入后通知管理页面，并报告新丢弃的记录
+func (l *QueryLogger) flushed(n int, err error) {
+	if err != nil {
+		log.WithError(err).WithField("count", n).Error("保存查询记录失败")
+	} else if adminServer != nil {
+		adminServer.notifyQueries()
+	}
+
+	if dropped := l.writer.droppedCount(); dropped > l.reported {
+		log.WithFields(log.Fields{
+			"dropped": dropped - l.reported,
+			"total":   dropped,
+		}).Warn("查询记录写入队列已满，丢弃了部分查询记录")
+		l.reported = dropped
+	}
+}
@@ -0,0 +1,164 @@
+package admin
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestQueryLogger(t *testing.T) {
+	db, err := InitDB(filepath.Join(t.TempDir(), "dns.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	logger := NewQueryLogger(db, BatchOptions{BatchSize: 3, FlushInterval: time.Hour})
+	for i := 0; i < 10; i++ {
+		if !logger.Log(&DNSQuery{RequestID: fmt.Sprintf("q%d", i), Domain: "example.com", CreatedAt: time.Now()}) {
+			t.Fatalf("Log(q%d) = false", i)
+		}
+	}
+	// 关闭时保存队列中剩余的记录
+	logger.Close()
+	if logger.Log(&DNSQuery{RequestID: "closed"}) {
+		t.Error("关闭后 Log() = true")
+	}
+
+	queries, err := GetRecentQueries(db, "", 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 10 {
+		t.Errorf("保存了 %d 条查询记录, want 10", len(queries))
+	}
+
+	var nilLogger *QueryLogger
+	if nilLogger.Log(&DNSQuery{}) || nilLogger.Dropped() != 0 {
+		t.Error("nil QueryLogger 应该忽略查询记录")
+	}
+}
+
+func TestBatchWriter_QueueFull(t *testing.T) {
+	db, err := InitDB(filepath.Join(t.TempDir(), "dns.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// 写入协程启动前队列不会被读取
+	var flushed int
+	w := newBatchWriter(db, BatchOptions{QueueSize: 2}, insertDNSQueries, func(n int, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		flushed += n
+	})
+	for i := 0; i < 3; i++ {
+		added := w.add(&DNSQuery{RequestID: fmt.Sprintf("q%d", i), CreatedAt: time.Now()})
+		if want := i < 2; added != want {
+			t.Errorf("add(q%d) = %v, want %v", i, added, want)
+		}
+	}
+	if w.droppedCount() != 1 {
+		t.Errorf("droppedCount() = %d, want 1", w.droppedCount())
+	}
+
+	go w.run()
+	w.close()
+	if flushed != 2 {
+		t.Errorf("写入了 %d 条记录, want 2", flushed)
+	}
+}
+
+func TestBatchWriter_CloseWhileAdding(t *testing.T) {
+	db, err := InitDB(filepath.Join(t.TempDir(), "dns.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var flushed int
+	w := newBatchWriter(db, BatchOptions{}, insertDNSQueries, func(n int, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		flushed += n
+	})
+	go w.run()
+
+	// 关闭期间加入成功的记录都会被写入
+	var wg sync.WaitGroup
+	var added int64
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 2000; j++ {
+				if w.add(&DNSQuery{RequestID: fmt.Sprintf("q%d-%d", i, j), CreatedAt: time.Now()}) {
+					atomic.AddInt64(&added, 1)
+				}
+			}
+		}(i)
+	}
+	w.close()
+	wg.Wait()
+
+	if want := int(atomic.LoadInt64(&added)); flushed != want {
+		t.Errorf("写入了 %d 条记录, want %d", flushed, want)
+	}
+}
+
+func TestLearnedDomainWriter(t *testing.T) {
+	db, err := InitDB(filepath.Join(t.TempDir(), "dns.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// 同一个域名按加入队列的顺序写入，最后的结果生效
+	w := NewLearnedDomainWriter(db, BatchOptions{FlushInterval: time.Hour})
+	now := time.Now()
+	for i, status := range []string{LearnedStatusPending, LearnedStatusApproved} {
+		d := LearnedDomain{Domain: "example.com", Route: "china", HitCount: int64(i + 1), Status: status, FirstSeen: now, LastSeen: now}
+		if !w.Save(d) {
+			t.Fatalf("Save(%s) = false", status)
+		}
+	}
+	w.Close()
+
+	domains, err := GetLearnedDomains(db, "", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 1 || domains[0].Status != LearnedStatusApproved || domains[0].HitCount != 2 {
+		t.Errorf("GetLearnedDomains() = %+v, want 1 approved domain with 2 hits", domains)
+	}
+}
+
+func TestDBHook(t *testing.T) {
+	db, err := InitDB(filepath.Join(t.TempDir(), "dns.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	hook := NewDBHook(db)
+	logger := log.New()
+	logger.AddHook(hook)
+	logger.WithField("requestId", "abc-123").Info("DNS 查询完成")
+	hook.Close()
+
+	logs, err := GetQueryLogs(db, "abc-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 || logs[0].Message != "DNS 查询完成" {
+		t.Errorf("GetQueryLogs() = %+v", logs)
+	}
+}
@@ -1,15 +1,17 @@
 package admin
 
 import (
+	"context"
+	"crypto/tls"
 	"database/sql"
 	"embed"
-	"encoding/json"
 	"fmt"
 	"html/template"
+	"io"
+	"net"
 	"net/http"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -20,26 +22,105 @@ import (
 //go:embed templates/*.html
 var templatesFS embed.FS
 
+// queryBroadcastInterval 向管理页面推送查询统计和最新查询的最短间隔，
+// 期间保存的多批查询记录合并为一次推送
+const queryBroadcastInterval = 2 * time.Second
+
+// Options 管理后台配置
+type Options struct {
+	// AuthDisabled 不需要登录，只应在管理后台仅监听本机地址或由反向代理认证时使用
+	AuthDisabled bool
+	// SessionTTL 登录会话的有效时间，小于等于 0 时为 7 天
+	SessionTTL time.Duration
+	// AllowedOrigins 除管理后台本身外允许连接 /ws 和调用接口的页面来源，例如 https://router.lan
+	AllowedOrigins []string
+	// TLSDisabled 使用 HTTP，只应在由反向代理提供 HTTPS 时使用
+	TLSDisabled bool
+	// CertFile 和 KeyFile 证书和私钥文件，都为空时使用 DataDir 中的自签名证书
+	CertFile string
+	KeyFile  string
+	// DataDir 保存自签名证书的目录
+	DataDir string
+}
+
 type Server struct {
 	router        *gin.Engine
 	db            *sql.DB
+	options       Options
+	upgrader      websocket.Upgrader
+	logins        *loginLimiter
 	broadcast     chan interface{}
 	wsClients     map[*websocket.Conn]bool
 	wsClientMutex sync.RWMutex
+	learned       LearnedDomainManager
+	listeners     ListenerStatsProvider
+	rateLimit     RateLimitProvider
+	reload        ReloadProvider
+	explain       ExplainProvider
+	metrics       MetricsProvider
+	reloadMutex   sync.Mutex
+	lastReload    *ReloadResult
+	// queriesChanged 上次推送后是否保存了新的查询记录，使用原子操作
+	queriesChanged int32
+}
+
+// LearnedDomainManager 学习域名的审核接口
+type LearnedDomainManager interface {
+	Approve(domain string) error
+	Reject(domain string) error
+}
+
+// ListenerStatsProvider 提供监听器的统计数据
+type ListenerStatsProvider interface {
+	ListenerStats() []ListenerStats
+}
+
+// RateLimitProvider 提供被限速的客户端
+type RateLimitProvider interface {
+	LimitedClients() []LimitedClient
 }
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+// ReloadProvider 重新读取配置并替换上游解析器、域名列表和规则
+type ReloadProvider interface {
+	Reload() (*ReloadResult, error)
 }
 
-func NewServer(db *sql.DB) *Server {
+// ReloadFunc 将函数用作 ReloadProvider
+type ReloadFunc func() (*ReloadResult, error)
+
+// Reload 调用 f()
+func (f ReloadFunc) Reload() (*ReloadResult, error) {
+	return f()
+}
+
+// ExplainProvider 说明域名对某个客户端的处理过程，clientIP 可以为 nil
+type ExplainProvider interface {
+	Explain(ctx context.Context, domain string, clientIP net.IP) (interface{}, error)
+}
+
+// ExplainFunc 将函数用作 ExplainProvider
+type ExplainFunc func(ctx context.Context, domain string, clientIP net.IP) (interface{}, error)
+
+// Explain 调用 f(ctx, domain, clientIP)
+func (f ExplainFunc) Explain(ctx context.Context, domain string, clientIP net.IP) (interface{}, error) {
+	return f(ctx, domain, clientIP)
+}
+
+// MetricsProvider 以 Prometheus 文本格式输出指标
+type MetricsProvider interface {
+	WriteMetrics(w io.Writer) error
+}
+
+func NewServer(db *sql.DB, options Options) *Server {
+	if options.SessionTTL <= 0 {
+		options.SessionTTL = 7 * 24 * time.Hour
+	}
+
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.New()
 	router.Use(gin.Recovery())
+	// 不信任 X-Forwarded-For，登录失败次数按连接的来源地址计算
+	router.SetTrustedProxies(nil)
 
 	// 使用 embed.FS 加载模板
 	templ := template.Must(template.New("").ParseFS(templatesFS, "templates/*.html"))
@@ -48,25 +129,92 @@ func NewServer(db *sql.DB) *Server {
 	s := &Server{
 		router:    router,
 		db:        db,
+		options:   options,
+		logins:    newLoginLimiter(),
 		broadcast: make(chan interface{}, 100),
 		wsClients: make(map[*websocket.Conn]bool),
 	}
+	s.upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     s.checkOrigin,
+	}
 
 	s.setupRoutes()
 	go s.handleBroadcast()
+	go s.broadcastQueries()
 
 	return s
 }
 
-func (s *Server) setupRoutes() {
-	s.router.GET("/", func(c *gin.Context) {
-		c.HTML(http.StatusOK, "index.html", nil)
+// SetLearnedDomainManager 设置学习域名的审核接口
+func (s *Server) SetLearnedDomainManager(manager LearnedDomainManager) {
+	s.learned = manager
+}
+
+// SetListenerStatsProvider 设置监听器统计数据的来源
+func (s *Server) SetListenerStatsProvider(provider ListenerStatsProvider) {
+	s.listeners = provider
+}
+
+// SetRateLimitProvider 设置被限速客户端的来源
+func (s *Server) SetRateLimitProvider(provider RateLimitProvider) {
+	s.rateLimit = provider
+}
+
+// SetReloadProvider 设置配置重载的实现
+func (s *Server) SetReloadProvider(provider ReloadProvider) {
+	s.reload = provider
+}
+
+// SetExplainProvider 设置路由说明的实现
+func (s *Server) SetExplainProvider(provider ExplainProvider) {
+	s.explain = provider
+}
+
+// SetMetricsProvider 设置 /metrics 输出的指标
+func (s *Server) SetMetricsProvider(provider MetricsProvider) {
+	s.metrics = provider
+}
+
+// Reload 重载配置并通知所有管理页面，收到 SIGHUP 信号和管理页面请求时调用
+func (s *Server) Reload() (*ReloadResult, error) {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	var result *ReloadResult
+	err := fmt.Errorf("不支持重载配置")
+	if s.reload != nil {
+		result, err = s.reload.Reload()
+	}
+	if err != nil {
+		logrus.WithError(err).Error("重载配置失败")
+		s.tryBroadcast(map[string]interface{}{
+			"type": "reload_error",
+			"data": map[string]string{"message": err.Error()},
+		})
+		return nil, err
+	}
+	s.lastReload = result
+	s.tryBroadcast(map[string]interface{}{
+		"type": "reload_result",
+		"data": result,
 	})
-	s.router.GET("/ws", s.handleWebSocket)
+	return result, nil
+}
+
+func (s *Server) setupRoutes() {
+	s.router.GET("/", s.handleIndex)
+	s.router.GET("/login", s.handleLoginPage)
+	s.router.GET("/ws", s.requireAuth, s.handleWebSocket)
+	s.router.GET("/metrics", s.requireAuth, s.handleMetrics)
+	s.setupAPIRoutes()
 }
 
+// handleWebSocket 向管理页面推送新的查询、配置重载结果和日志级别变化，
+// 数据的读取和修改都通过 REST 接口完成
 func (s *Server) handleWebSocket(c *gin.Context) {
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	conn, err := s.upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		logrus.WithError(err).Error("WebSocket 升级失败")
 		return
@@ -83,7 +231,6 @@ func (s *Server) handleWebSocket(c *gin.Context) {
 	s.wsClients[conn] = true
 	s.wsClientMutex.Unlock()
 
-	s.sendInitialData(conn)
 	go s.startPing(conn)
 
 	go func() {
@@ -94,182 +241,18 @@ func (s *Server) handleWebSocket(c *gin.Context) {
 			conn.Close()
 		}()
 
+		// 不处理客户端发送的消息，读取只是为了处理 pong 和关闭
 		for {
-			_, message, err := conn.ReadMessage()
-			if err != nil {
+			if _, _, err := conn.ReadMessage(); err != nil {
 				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 					logrus.WithError(err).Error("WebSocket 读取错误")
 				}
 				return
 			}
-
-			s.handleWSMessage(conn, message)
 		}
 	}()
 }
 
-func (s *Server) handleWSMessage(conn *websocket.Conn, message []byte) {
-	var msg struct {
-		Type    string          `json:"type"`
-		Payload map[string]any `json:"payload"`
-	}
-	if err := json.Unmarshal(message, &msg); err != nil {
-		logrus.WithError(err).Error("解析 WebSocket 消息失败")
-		return
-	}
-
-	switch msg.Type {
-	case "get_beian_cache":
-		s.handleGetBeianCache(conn)
-	case "get_stats":
-		if start, ok := msg.Payload["start"].(string); ok {
-			if end, ok := msg.Payload["end"].(string); ok {
-				startTime, _ := time.Parse(time.RFC3339, start)
-				endTime, _ := time.Parse(time.RFC3339, end)
-				s.handleGetStats(conn, startTime, endTime)
-			}
-		}
-	case "get_today_stats":
-		if start, ok := msg.Payload["start"].(string); ok {
-			if end, ok := msg.Payload["end"].(string); ok {
-				startTime, _ := time.Parse(time.RFC3339, start)
-				endTime, _ := time.Parse(time.RFC3339, end)
-				s.handleGetTodayStats(conn, startTime, endTime)
-			}
-		}
-	case "get_query_logs":
-		if requestID, ok := msg.Payload["request_id"].(string); ok {
-			s.handleGetQueryLogs(conn, requestID)
-		}
-	case "get_queries":
-		limit := 20
-		if l, ok := msg.Payload["limit"].(float64); ok {
-			limit = int(l)
-		}
-		var cursor string
-		if c, ok := msg.Payload["cursor"].(string); ok {
-			cursor = c
-		}
-		s.handleGetQueries(conn, cursor, limit)
-	case "set_log_level":
-		if level, ok := msg.Payload["level"].(string); ok {
-			s.handleSetLogLevel(conn, level)
-		}
-	}
-}
-
-func (s *Server) handleGetBeianCache(conn *websocket.Conn) {
-	rows, err := s.db.Query(`
-		SELECT domain, is_beian, api_response, updated_at
-		FROM beian_cache
-		ORDER BY updated_at DESC
-		LIMIT 100
-	`)
-	if err != nil {
-		logrus.WithError(err).Error("查询备案缓存失败")
-		return
-	}
-	defer rows.Close()
-
-	type BeianCacheItem struct {
-		Domain      string    `json:"domain"`
-		IsBeian    bool      `json:"is_beian"`
-		APIResponse string    `json:"api_response"`
-		UpdatedAt   time.Time `json:"updated_at"`
-	}
-
-	var cacheItems []BeianCacheItem
-	for rows.Next() {
-		var item BeianCacheItem
-		if err := rows.Scan(&item.Domain, &item.IsBeian, &item.APIResponse, &item.UpdatedAt); err != nil {
-			logrus.WithError(err).Error("扫描备案缓存记录失败")
-			continue
-		}
-		cacheItems = append(cacheItems, item)
-	}
-
-	s.sendWSMessage(conn, "beian_cache", cacheItems)
-}
-
-func (s *Server) handleGetStats(conn *websocket.Conn, startTime, endTime time.Time) {
-	stats, err := GetQueryStats(s.db, startTime, endTime)
-	if err != nil {
-		logrus.WithError(err).Error("获取查询统计失败")
-		return
-	}
-	s.sendWSMessage(conn, "stats", stats)
-}
-
-func (s *Server) handleGetTodayStats(conn *websocket.Conn, startTime, endTime time.Time) {
-	// 获取统计数据
-	stats, err := GetQueryStats(s.db, startTime, endTime)
-	if err != nil {
-		logrus.WithError(err).Error("获取今日统计数据失败")
-		return
-	}
-
-	// 构造返回数据，使用前端期望的字段名
-	data := []map[string]interface{}{
-		{
-			"total":       stats.TotalQueries,
-			"china_dns":   stats.ChinaDNSQueries,
-			"oversea_dns": stats.OverseaDNSQueries,
-		},
-	}
-
-	s.sendWSMessage(conn, "today_stats", data)
-}
-
-func (s *Server) handleGetQueryLogs(conn *websocket.Conn, requestID string) {
-	rows, err := s.db.Query(`
-		SELECT timestamp, level, message, fields
-		FROM dns_logs
-		WHERE fields LIKE ?
-		ORDER BY timestamp ASC`,
-		"%\"requestId\":\""+requestID+"\"%")
-	if err != nil {
-		logrus.WithError(err).Error("查询日志失败")
-		return
-	}
-	defer rows.Close()
-
-	type LogEntry struct {
-		Timestamp time.Time         `json:"timestamp"`
-		Level     string           `json:"level"`
-		Message   string           `json:"message"`
-		Fields    json.RawMessage  `json:"fields"`
-	}
-
-	var logs []LogEntry
-	for rows.Next() {
-		var log LogEntry
-		var fieldsStr string
-		if err := rows.Scan(&log.Timestamp, &log.Level, &log.Message, &fieldsStr); err != nil {
-			logrus.WithError(err).Error("扫描日志记录失败")
-			continue
-		}
-		log.Fields = json.RawMessage(fieldsStr)
-		logs = append(logs, log)
-	}
-
-	s.sendWSMessage(conn, "query_logs", logs)
-}
-
-func (s *Server) handleSetLogLevel(conn *websocket.Conn, level string) {
-	parsedLevel, err := logrus.ParseLevel(level)
-	if err != nil {
-		s.sendWSMessage(conn, "error", map[string]string{
-			"message": "无效的日志级别",
-		})
-		return
-	}
-
-	logrus.SetLevel(parsedLevel)
-	s.sendWSMessage(conn, "log_level", map[string]string{
-		"level": parsedLevel.String(),
-	})
-}
-
 func (s *Server) startPing(conn *websocket.Conn) {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
@@ -277,145 +260,116 @@ func (s *Server) startPing(conn *websocket.Conn) {
 	for {
 		select {
 		case <-ticker.C:
-			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			// WriteControl 可以和 handleBroadcast 中的写入并发调用
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
 				return
 			}
 		}
 	}
 }
 
-func (s *Server) sendInitialData(conn *websocket.Conn) {
-	endTime := time.Now()
-	startTime := endTime.Add(-24 * time.Hour)
-	s.handleGetStats(conn, startTime, endTime)
-	s.handleGetBeianCache(conn)
-	s.handleGetQueries(conn, "", 20)
-
-	s.sendWSMessage(conn, "log_level", map[string]string{
-		"level": logrus.GetLevel().String(),
-	})
-}
+// wsWriteTimeout 向管理页面发送一条消息的超时时间，避免一个客户端阻塞所有推送
+const wsWriteTimeout = 10 * time.Second
 
 func (s *Server) handleBroadcast() {
 	for data := range s.broadcast {
+		var failed []*websocket.Conn
 		s.wsClientMutex.RLock()
 		for conn := range s.wsClients {
-			err := conn.WriteJSON(data)
-			if err != nil {
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := conn.WriteJSON(data); err != nil {
 				logrus.WithError(err).Error("WebSocket 发送失败")
-				s.wsClientMutex.Lock()
+				failed = append(failed, conn)
+			}
+		}
+		s.wsClientMutex.RUnlock()
+
+		if len(failed) > 0 {
+			s.wsClientMutex.Lock()
+			for _, conn := range failed {
 				delete(s.wsClients, conn)
-				s.wsClientMutex.Unlock()
+			}
+			s.wsClientMutex.Unlock()
+			for _, conn := range failed {
 				conn.Close()
 			}
 		}
-		s.wsClientMutex.RUnlock()
 	}
 }
 
-func (s *Server) sendWSMessage(conn *websocket.Conn, msgType string, data interface{}) {
-	msg := map[string]interface{}{
-		"type": msgType,
-		"data": data,
-	}
-	err := conn.WriteJSON(msg)
-	if err != nil {
-		logrus.WithError(err).Error("WebSocket 发送失败")
-	}
+// notifyQueries 标记保存了新的查询记录，由 broadcastQueries 合并后推送
+func (s *Server) notifyQueries() {
+	atomic.StoreInt32(&s.queriesChanged, 1)
 }
 
-func (s *Server) handleGetQueries(conn *websocket.Conn, cursor string, limit int) {
-	var rows *sql.Rows
-	var err error
-
-	if cursor == "" {
-		// 第一页，直接获取最新的记录
-		rows, err = s.db.Query(`
-			SELECT id, request_id, domain, query_type, client_ip,
-				   server, is_china_dns, response_code, answer_count,
-				   total_time_ms, created_at, answers
-			FROM dns_queries
-			ORDER BY created_at DESC, id DESC
-			LIMIT ?`,
-			limit+1, // 多获取条用于判断是否有下一页
-		)
-	} else {
-		// 解析游标
-		cursorData := strings.Split(cursor, "_")
-		if len(cursorData) != 2 {
-			logrus.Error("无效的游标格式")
-			return
-		}
-		cursorTime, err := time.Parse(time.RFC3339Nano, cursorData[0])
-		if err != nil {
-			logrus.WithError(err).Error("解析游标时间失败")
-			return
+// broadcastQueries 定时向管理页面推送查询统计和最新查询，
+// 只在有新的查询记录并且有管理页面连接时查询数据库
+func (s *Server) broadcastQueries() {
+	ticker := time.NewTicker(queryBroadcastInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if atomic.SwapInt32(&s.queriesChanged, 0) == 0 {
+			continue
 		}
-		cursorID, err := strconv.ParseInt(cursorData[1], 10, 64)
-		if err != nil {
-			logrus.WithError(err).Error("解析游标ID失败")
-			return
+		s.wsClientMutex.RLock()
+		clients := len(s.wsClients)
+		s.wsClientMutex.RUnlock()
+		if clients == 0 {
+			continue
 		}
 
-		// 使用游标获取下一页
-		rows, err = s.db.Query(`
-			SELECT id, request_id, domain, query_type, client_ip,
-				   server, is_china_dns, response_code, answer_count,
-				   total_time_ms, created_at, answers
-			FROM dns_queries
-			WHERE (created_at, id) < (?, ?)
-			ORDER BY created_at DESC, id DESC
-			LIMIT ?`,
-			cursorTime, cursorID, limit+1,
-		)
-	}
-
-	if err != nil {
-		logrus.WithError(err).Error("查询DNS记录失败")
-		return
-	}
-	defer rows.Close()
-
-	var queries []DNSQuery
-	var lastQuery *DNSQuery
-	for rows.Next() {
-		var q DNSQuery
-		var answersJSON string
-		err := rows.Scan(
-			&q.ID, &q.RequestID, &q.Domain, &q.QueryType, &q.ClientIP,
-			&q.Server, &q.IsChinaDNS, &q.ResponseCode, &q.AnswerCount,
-			&q.TotalTimeMs, &q.CreatedAt, &answersJSON,
-		)
+		endTime := time.Now()
+		stats, err := GetQueryStats(s.db, endTime.Add(-24*time.Hour), endTime)
 		if err != nil {
-			logrus.WithError(err).Error("扫描DNS记录失败")
+			logrus.WithError(err).Error("获取查询统计失败")
 			continue
 		}
-
-		err = json.Unmarshal([]byte(answersJSON), &q.Answers)
+		queries, err := GetRecentQueries(s.db, "", 20)
 		if err != nil {
-			logrus.WithError(err).Error("解析DNS应答失败")
+			logrus.WithError(err).Error("获取最近查询失败")
 			continue
 		}
-
-		if len(queries) < limit {
-			queries = append(queries, q)
-			lastQuery = &q
-		}
+		s.tryBroadcast(map[string]interface{}{"type": "stats", "data": stats})
+		s.tryBroadcast(map[string]interface{}{
+			"type": "queries",
+			"data": map[string]interface{}{
+				"data":        queries,
+				"next_cursor": "",
+			},
+		})
 	}
+}
 
-	// 构造下一页游标
-	var nextCursor string
-	if len(queries) == limit && lastQuery != nil {
-		nextCursor = fmt.Sprintf("%s_%d", lastQuery.CreatedAt.Format(time.RFC3339Nano), lastQuery.ID)
+// tryBroadcast 推送队列已满时丢弃消息，下一次推送会包含最新的数据
+func (s *Server) tryBroadcast(data interface{}) {
+	select {
+	case s.broadcast <- data:
+	default:
 	}
-
-	// 发送分页数据
-	s.sendWSMessage(conn, "queries", map[string]interface{}{
-		"data": queries,
-		"next_cursor": nextCursor,
-	})
 }
 
+// Start 启动管理后台，没有关闭 TLS 时使用 HTTPS
 func (s *Server) Start(addr string) error {
-	return s.router.Run(addr)
+	if s.options.TLSDisabled {
+		return s.router.Run(addr)
+	}
+
+	cert, err := s.loadCertificate()
+	if err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{
+		"addr":        addr,
+		"fingerprint": CertFingerprint(cert),
+	}).Info("管理后台使用 HTTPS")
+	server := &http.Server{
+		Addr:    addr,
+		Handler: s.router,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		},
+	}
+	return server.ListenAndServeTLS("", "")
 } 
\ No newline at end of file
@@ -0,0 +1,144 @@
+package admin
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 自签名证书保存在数据目录中的文件名
+const (
+	selfSignedCertFile = "admin-cert.pem"
+	selfSignedKeyFile  = "admin-key.pem"
+)
+
+// selfSignedValidity 自签名证书的有效期，过期后启动时重新生成
+const selfSignedValidity = 10 * 365 * 24 * time.Hour
+
+// loadCertificate 读取配置的证书，没有配置时使用数据目录中的自签名证书
+func (s *Server) loadCertificate() (tls.Certificate, error) {
+	if s.options.CertFile != "" || s.options.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.options.CertFile, s.options.KeyFile)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("读取管理后台证书失败: %v", err)
+		}
+		return cert, nil
+	}
+	return LoadOrCreateSelfSignedCert(s.options.DataDir)
+}
+
+// LoadOrCreateSelfSignedCert 读取 dir 中的自签名证书，不存在或已过期时重新生成并保存
+func LoadOrCreateSelfSignedCert(dir string) (tls.Certificate, error) {
+	certPath := filepath.Join(dir, selfSignedCertFile)
+	keyPath := filepath.Join(dir, selfSignedKeyFile)
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err == nil && time.Now().Before(leaf.NotAfter) {
+			return cert, nil
+		}
+		logrus.WithField("file", certPath).Info("管理后台自签名证书已过期，重新生成")
+	} else if !os.IsNotExist(err) {
+		logrus.WithError(err).WithField("file", certPath).Warn("读取管理后台自签名证书失败，重新生成")
+	}
+
+	certPEM, keyPEM, err := generateSelfSignedCert(time.Now())
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("生成自签名证书失败: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return tls.Certificate{}, fmt.Errorf("保存自签名证书失败: %v", err)
+	}
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return tls.Certificate{}, fmt.Errorf("保存自签名证书失败: %v", err)
+	}
+
+	cert, err = tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	logrus.WithFields(logrus.Fields{
+		"file":        certPath,
+		"fingerprint": CertFingerprint(cert),
+	}).Info("已生成管理后台自签名证书")
+	return cert, nil
+}
+
+// generateSelfSignedCert 生成 ECDSA P-256 自签名证书，包含本机名称、localhost 和当前所有网卡地址
+func generateSelfSignedCert(now time.Time) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "go-dns-proxy", Organization: []string{"go-dns-proxy"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname != "" && hostname != "localhost" {
+		template.DNSNames = append(template.DNSNames, hostname)
+		if !strings.Contains(hostname, ".") {
+			template.DNSNames = append(template.DNSNames, hostname+".lan")
+		}
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+				template.IPAddresses = append(template.IPAddresses, ipNet.IP)
+			}
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// CertFingerprint 返回证书的 SHA-256 指纹，用于在浏览器中核对自签名证书
+func CertFingerprint(cert tls.Certificate) string {
+	sum := sha256.Sum256(cert.Certificate[0])
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = strings.ToUpper(hex.EncodeToString([]byte{b}))
+	}
+	return strings.Join(parts, ":")
+}
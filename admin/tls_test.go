@@ -0,0 +1,98 @@
+package admin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadOrCreateSelfSignedCert(t *testing.T) {
+	dir := t.TempDir()
+	cert, err := LoadOrCreateSelfSignedCert(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, selfSignedKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("私钥文件权限 = %v, want 0600", info.Mode().Perm())
+	}
+
+	// 再次启动时使用同一个证书
+	again, err := LoadOrCreateSelfSignedCert(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if CertFingerprint(again) != CertFingerprint(cert) {
+		t.Error("再次读取时重新生成了证书")
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.VerifyHostname("localhost"); err != nil {
+		t.Error(err)
+	}
+	if err := leaf.VerifyHostname("127.0.0.1"); err != nil {
+		t.Error(err)
+	}
+
+	// 过期的证书重新生成
+	certPEM, keyPEM, err := generateSelfSignedCert(time.Now().Add(-selfSignedValidity - time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, selfSignedCertFile), certPEM, 0644)
+	os.WriteFile(filepath.Join(dir, selfSignedKeyFile), keyPEM, 0600)
+	expired, _ := tls.X509KeyPair(certPEM, keyPEM)
+	renewed, err := LoadOrCreateSelfSignedCert(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if CertFingerprint(renewed) == CertFingerprint(expired) {
+		t.Error("证书过期后没有重新生成")
+	}
+}
+
+func TestServer_LoadCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certPEM, keyPEM, err := generateSelfSignedCert(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "router.crt")
+	keyFile := filepath.Join(dir, "router.key")
+	os.WriteFile(certFile, certPEM, 0644)
+	os.WriteFile(keyFile, keyPEM, 0600)
+	want, _ := tls.X509KeyPair(certPEM, keyPEM)
+
+	tests := []struct {
+		name    string
+		options Options
+		wantErr bool
+	}{
+		{"配置的证书", Options{CertFile: certFile, KeyFile: keyFile, DataDir: dir}, false},
+		{"证书不存在", Options{CertFile: filepath.Join(dir, "missing.crt"), KeyFile: keyFile, DataDir: dir}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{options: tt.options}
+			cert, err := s.loadCertificate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadCertificate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && CertFingerprint(cert) != CertFingerprint(want) {
+				t.Error("没有使用配置的证书")
+			}
+		})
+	}
+	if _, err := os.Stat(filepath.Join(dir, selfSignedCertFile)); !os.IsNotExist(err) {
+		t.Error("配置了证书时不应生成自签名证书")
+	}
+}
@@ -0,0 +1,335 @@
+package bench
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"go-dns-proxy/admin"
+	"go-dns-proxy/client"
+	"go-dns-proxy/server"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Query 压测发送的一条查询
+type Query struct {
+	Name string
+	Type dnsmessage.Type
+}
+
+// Options 压测配置
+type Options struct {
+	// QPS 每秒发送的查询数，小于等于 0 时不限制
+	QPS int
+	// Concurrency 同时等待响应的查询数，小于等于 0 时为 1
+	Concurrency int
+	// Count 发送的查询总数，查询列表不够时循环使用，为 0 且没有指定 Duration 时发送一遍
+	Count int
+	// Duration 压测时长，与 Count 同时指定时先满足的条件结束压测
+	Duration time.Duration
+	// Timeout 单个查询的超时时间，小于等于 0 时为 2 秒
+	Timeout time.Duration
+}
+
+// Latency 成功响应的用时分布，单位为毫秒
+type Latency struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P95  float64 `json:"p95"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+// Report 对一个服务器的压测结果。Errors 不包括超时
+type Report struct {
+	Server      string         `json:"server"`
+	Sent        int            `json:"sent"`
+	Responses   int            `json:"responses"`
+	Errors      int            `json:"errors"`
+	Timeouts    int            `json:"timeouts"`
+	ErrorRate   float64        `json:"error_rate"`
+	TimeoutRate float64        `json:"timeout_rate"`
+	DurationMs  float64        `json:"duration_ms"`
+	QPS         float64        `json:"qps"`
+	Latency     Latency        `json:"latency_ms"`
+	RCodes      map[string]int `json:"rcodes"`
+	// ErrorSamples 最先出现的几种错误和出现的次数
+	ErrorSamples map[string]int `json:"error_samples,omitempty"`
+}
+
+// maxErrorSamples 最多记录的错误种类
+const maxErrorSamples = 5
+
+// result 单个查询的结果
+type result struct {
+	rtt     time.Duration
+	rcode   dnsmessage.RCode
+	err     error
+	timeout bool
+}
+
+// Run 按配置向服务器发送查询并统计结果，ctx 取消时提前结束
+func Run(ctx context.Context, resolver client.DNSResolver, queries []Query, options Options) (*Report, error) {
+	if len(queries) == 0 {
+		return nil, fmt.Errorf("没有可以发送的查询")
+	}
+	if options.Concurrency <= 0 {
+		options.Concurrency = 1
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = 2 * time.Second
+	}
+	if options.Count <= 0 && options.Duration <= 0 {
+		options.Count = len(queries)
+	}
+	// 压测时长只限制发送，已经发送的查询继续等待响应
+	dispatchCtx := ctx
+	if options.Duration > 0 {
+		var cancel context.CancelFunc
+		dispatchCtx, cancel = context.WithTimeout(ctx, options.Duration)
+		defer cancel()
+	}
+
+	jobs := make(chan Query)
+	results := make(chan result, options.Concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < options.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for q := range jobs {
+				results <- send(ctx, resolver, q, options.Timeout)
+			}
+		}()
+	}
+
+	start := time.Now()
+	go func() {
+		defer close(jobs)
+		var tick <-chan time.Time
+		if options.QPS > 0 && options.QPS <= int(time.Second) {
+			ticker := time.NewTicker(time.Second / time.Duration(options.QPS))
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for i := 0; options.Count <= 0 || i < options.Count; i++ {
+			if tick != nil {
+				select {
+				case <-tick:
+				case <-dispatchCtx.Done():
+					return
+				}
+			}
+			select {
+			case jobs <- queries[i%len(queries)]:
+			case <-dispatchCtx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	report := &Report{
+		Server:       resolver.String(),
+		RCodes:       make(map[string]int),
+		ErrorSamples: make(map[string]int),
+	}
+	var rtts []time.Duration
+	for r := range results {
+		report.Sent++
+		switch {
+		case r.timeout:
+			report.Timeouts++
+		case r.err != nil:
+			report.Errors++
+			msg := r.err.Error()
+			if _, ok := report.ErrorSamples[msg]; ok || len(report.ErrorSamples) < maxErrorSamples {
+				report.ErrorSamples[msg]++
+			}
+		default:
+			report.Responses++
+			report.RCodes[server.RCodeName(r.rcode)]++
+			rtts = append(rtts, r.rtt)
+		}
+	}
+
+	elapsed := time.Since(start)
+	report.DurationMs = milliseconds(elapsed)
+	if elapsed > 0 {
+		report.QPS = float64(report.Sent) / elapsed.Seconds()
+	}
+	if report.Sent > 0 {
+		report.ErrorRate = float64(report.Errors) / float64(report.Sent)
+		report.TimeoutRate = float64(report.Timeouts) / float64(report.Sent)
+	}
+	report.Latency = latency(rtts)
+	return report, nil
+}
+
+// send 发送一个查询，每个查询使用随机的 ID
+func send(ctx context.Context, resolver client.DNSResolver, q Query, timeout time.Duration) result {
+	name := q.Name
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return result{err: fmt.Errorf("无效的域名 %s: %v", q.Name, err)}
+	}
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               uint16(rand.Intn(1 << 16)),
+			RecursionDesired: true,
+		},
+		Questions: []dnsmessage.Question{{Name: qname, Type: q.Type, Class: dnsmessage.ClassINET}},
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	data, err := resolver.Request(ctx, msg)
+	rtt := time.Since(start)
+	if err != nil {
+		return result{rtt: rtt, err: err, timeout: isTimeout(err)}
+	}
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(data)
+	if err != nil {
+		return result{rtt: rtt, err: fmt.Errorf("解析 DNS 响应失败: %v", err)}
+	}
+	if header.ID != msg.Header.ID {
+		return result{rtt: rtt, err: fmt.Errorf("响应 ID 不匹配")}
+	}
+	return result{rtt: rtt, rcode: header.RCode}
+}
+
+// isTimeout 判断错误是否为超时
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// latency 计算用时分布，百分位数使用最近秩法
+func latency(rtts []time.Duration) Latency {
+	if len(rtts) == 0 {
+		return Latency{}
+	}
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+
+	var total time.Duration
+	for _, rtt := range rtts {
+		total += rtt
+	}
+	percentile := func(p float64) float64 {
+		rank := int(p*float64(len(rtts))+0.999999) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		return milliseconds(rtts[rank])
+	}
+	return Latency{
+		Min:  milliseconds(rtts[0]),
+		Mean: milliseconds(total / time.Duration(len(rtts))),
+		P50:  percentile(0.50),
+		P90:  percentile(0.90),
+		P95:  percentile(0.95),
+		P99:  percentile(0.99),
+		Max:  milliseconds(rtts[len(rtts)-1]),
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// LoadDomains 读取域名列表，每行一个域名，可以在域名后指定类型，例如 "example.com AAAA"。
+// 空行和 # 开头的注释会被忽略，没有指定类型时使用 defaultType
+func LoadDomains(r io.Reader, defaultType dnsmessage.Type) ([]Query, error) {
+	var queries []Query
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		q := Query{Name: fields[0], Type: defaultType}
+		if len(fields) > 1 {
+			t, err := server.ParseType(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("第 %d 行: %v", lineNo, err)
+			}
+			q.Type = t
+		}
+		queries = append(queries, q)
+	}
+	return queries, scanner.Err()
+}
+
+// LoadQueryLog 从查询日志数据库中读取最近的 limit 条查询，按查询时间排列
+func LoadQueryLog(db *sql.DB, limit int) ([]Query, error) {
+	records, err := admin.GetRecentQueries(db, "", limit)
+	if err != nil {
+		return nil, err
+	}
+
+	queries := make([]Query, 0, len(records))
+	for i := len(records) - 1; i >= 0; i-- {
+		// 查询日志中的类型为 TypeA 的格式
+		t, err := server.ParseType(strings.TrimPrefix(records[i].QueryType, "Type"))
+		if err != nil {
+			continue
+		}
+		queries = append(queries, Query{Name: records[i].Domain, Type: t})
+	}
+	return queries, nil
+}
+
+// WriteText 输出压测结果
+func (r *Report) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "服务器: %s\n", r.Server)
+	fmt.Fprintf(bw, "查询: %d，用时 %.1f 秒，%.1f QPS\n", r.Sent, r.DurationMs/1000, r.QPS)
+	fmt.Fprintf(bw, "响应: %d，错误: %d (%.2f%%)，超时: %d (%.2f%%)\n",
+		r.Responses, r.Errors, r.ErrorRate*100, r.Timeouts, r.TimeoutRate*100)
+	l := r.Latency
+	fmt.Fprintf(bw, "延迟 (ms): min %.2f  mean %.2f  p50 %.2f  p90 %.2f  p95 %.2f  p99 %.2f  max %.2f\n",
+		l.Min, l.Mean, l.P50, l.P90, l.P95, l.P99, l.Max)
+
+	rcodes := make([]string, 0, len(r.RCodes))
+	for rcode := range r.RCodes {
+		rcodes = append(rcodes, rcode)
+	}
+	sort.Slice(rcodes, func(i, j int) bool {
+		if r.RCodes[rcodes[i]] != r.RCodes[rcodes[j]] {
+			return r.RCodes[rcodes[i]] > r.RCodes[rcodes[j]]
+		}
+		return rcodes[i] < rcodes[j]
+	})
+	for _, rcode := range rcodes {
+		fmt.Fprintf(bw, "  %-10s %d\n", rcode, r.RCodes[rcode])
+	}
+	for msg, n := range r.ErrorSamples {
+		fmt.Fprintf(bw, "  错误 %d 次: %s\n", n, msg)
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,151 @@
+package bench
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeResolver 按域名返回固定的结果
+type fakeResolver struct {
+	requests int64
+}
+
+func (r *fakeResolver) Request(ctx context.Context, m dnsmessage.Message) ([]byte, error) {
+	atomic.AddInt64(&r.requests, 1)
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: m.Header.ID, Response: true},
+		Questions: m.Questions,
+	}
+	switch m.Questions[0].Name.String() {
+	case "missing.example.":
+		resp.Header.RCode = dnsmessage.RCodeNameError
+	case "broken.example.":
+		return nil, fmt.Errorf("connection refused")
+	case "slow.example.":
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return resp.Pack()
+}
+
+func (r *fakeResolver) String() string {
+	return "fake"
+}
+
+func TestRun(t *testing.T) {
+	queries := []Query{
+		{"ok.example", dnsmessage.TypeA},
+		{"ok.example", dnsmessage.TypeAAAA},
+		{"missing.example", dnsmessage.TypeA},
+		{"broken.example", dnsmessage.TypeA},
+		{"slow.example", dnsmessage.TypeA},
+	}
+
+	tests := []struct {
+		name        string
+		options     Options
+		wantSent    int
+		wantRCodes  map[string]int
+		wantErrors  int
+		wantTimeout int
+	}{
+		{
+			name:        "one pass",
+			options:     Options{Concurrency: 5, Timeout: 50 * time.Millisecond},
+			wantSent:    5,
+			wantRCodes:  map[string]int{"NOERROR": 2, "NXDOMAIN": 1},
+			wantErrors:  1,
+			wantTimeout: 1,
+		},
+		{
+			name:        "count repeats queries",
+			options:     Options{Concurrency: 5, Count: 12, QPS: 1000, Timeout: 50 * time.Millisecond},
+			wantSent:    12,
+			wantRCodes:  map[string]int{"NOERROR": 6, "NXDOMAIN": 2},
+			wantErrors:  2,
+			wantTimeout: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := &fakeResolver{}
+			report, err := Run(context.Background(), resolver, queries, tt.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Sent != tt.wantSent || int(resolver.requests) != tt.wantSent {
+				t.Errorf("Run() sent = %d, requests = %d, want %d", report.Sent, resolver.requests, tt.wantSent)
+			}
+			if report.Errors != tt.wantErrors || report.Timeouts != tt.wantTimeout {
+				t.Errorf("Run() errors = %d, timeouts = %d, want %d, %d",
+					report.Errors, report.Timeouts, tt.wantErrors, tt.wantTimeout)
+			}
+			if fmt.Sprint(report.RCodes) != fmt.Sprint(tt.wantRCodes) {
+				t.Errorf("Run() rcodes = %v, want %v", report.RCodes, tt.wantRCodes)
+			}
+			if report.Latency.P99 < report.Latency.P50 || report.Latency.Max < report.Latency.P99 {
+				t.Errorf("Run() latency = %+v, want ordered percentiles", report.Latency)
+			}
+		})
+	}
+}
+
+func TestRun_Duration(t *testing.T) {
+	resolver := &fakeResolver{}
+	start := time.Now()
+	report, err := Run(context.Background(), resolver, []Query{{"ok.example", dnsmessage.TypeA}},
+		Options{QPS: 100, Concurrency: 2, Duration: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Run() took %v, want about 200ms", elapsed)
+	}
+	if report.Sent < 10 || report.Sent > 30 {
+		t.Errorf("Run() sent = %d, want about 20 at 100 QPS", report.Sent)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	var rtts []time.Duration
+	for i := 100; i >= 1; i-- {
+		rtts = append(rtts, time.Duration(i)*time.Millisecond)
+	}
+	got := latency(rtts)
+	want := Latency{Min: 1, Mean: 50.5, P50: 50, P90: 90, P95: 95, P99: 99, Max: 100}
+	if got != want {
+		t.Errorf("latency() = %+v, want %+v", got, want)
+	}
+}
+
+func TestLoadDomains(t *testing.T) {
+	input := `# 常用域名
+www.example.com
+example.com AAAA
+
+mail.example.com MX
+`
+	queries, err := LoadDomains(strings.NewReader(input), dnsmessage.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Query{
+		{"www.example.com", dnsmessage.TypeA},
+		{"example.com", dnsmessage.TypeAAAA},
+		{"mail.example.com", dnsmessage.TypeMX},
+	}
+	if fmt.Sprint(queries) != fmt.Sprint(want) {
+		t.Errorf("LoadDomains() = %v, want %v", queries, want)
+	}
+
+	if _, err := LoadDomains(strings.NewReader("example.com BOGUS\n"), dnsmessage.TypeA); err == nil {
+		t.Error("LoadDomains() with invalid type should fail")
+	}
+}
@@ -0,0 +1,441 @@
+package blocklist
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// 拦截应答方式
+const (
+	ModeNXDomain = "nxdomain"
+	ModeNullIP   = "null"
+	ModeRefused  = "refused"
+	ModeCustomIP = "custom"
+)
+
+// blockedTTL 拦截应答的 TTL
+const blockedTTL = 60
+
+// Options 拦截列表配置
+type Options struct {
+	// URLs 订阅的拦截列表地址，支持 hosts 格式和 AdBlock 格式
+	URLs []string
+	// Rules 自定义规则，格式与订阅列表相同
+	Rules []string
+	// RefreshInterval 订阅列表刷新间隔
+	RefreshInterval time.Duration
+	// DataDir 订阅列表的本地缓存目录
+	DataDir string
+}
+
+// Match 一次拦截匹配结果
+type Match struct {
+	Rule   string `json:"rule"`
+	Source string `json:"source"`
+}
+
+// ruleSet 解析后的一组规则
+type ruleSet struct {
+	// exact 只匹配域名本身
+	exact map[string]Match
+	// suffix 匹配域名及其子域名
+	suffix map[string]Match
+	// regexps 正则表达式规则，按顺序匹配
+	regexps []regexRule
+}
+
+// regexRule 正则表达式规则
+type regexRule struct {
+	re    *regexp.Regexp
+	match Match
+}
+
+func newRuleSet() *ruleSet {
+	return &ruleSet{
+		exact:  make(map[string]Match),
+		suffix: make(map[string]Match),
+	}
+}
+
+// match 查找域名匹配的规则，子域名规则优先，正则表达式规则最后匹配
+func (r *ruleSet) match(domain string) (Match, bool) {
+	if m, ok := r.exact[domain]; ok {
+		return m, true
+	}
+	for d := domain; ; {
+		if m, ok := r.suffix[d]; ok {
+			return m, true
+		}
+		i := strings.Index(d, ".")
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+	}
+	for _, rule := range r.regexps {
+		if rule.re.MatchString(domain) {
+			return rule.match, true
+		}
+	}
+	return Match{}, false
+}
+
+func (r *ruleSet) len() int {
+	return len(r.exact) + len(r.suffix) + len(r.regexps)
+}
+
+// Blocklist 广告和跟踪域名拦截
+type Blocklist struct {
+	options Options
+	client  *http.Client
+
+	mu    sync.RWMutex
+	block *ruleSet
+	allow *ruleSet
+}
+
+// New 创建拦截列表，需要调用 Load 加载规则
+func New(options Options) *Blocklist {
+	if options.RefreshInterval <= 0 {
+		options.RefreshInterval = 24 * time.Hour
+	}
+
+	return &Blocklist{
+		options: options,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+		block: newRuleSet(),
+		allow: newRuleSet(),
+	}
+}
+
+// Load 加载所有订阅列表和自定义规则，下载失败时使用本地缓存
+func (b *Blocklist) Load() error {
+	return b.load(true)
+}
+
+// LoadCached 只从本地缓存加载订阅列表和自定义规则，不下载，用于启动和重载时避免等待下载
+func (b *Blocklist) LoadCached() error {
+	return b.load(false)
+}
+
+func (b *Blocklist) load(download bool) error {
+	block := newRuleSet()
+	allow := newRuleSet()
+
+	parseRules(strings.NewReader(strings.Join(b.options.Rules, "\n")), "custom", block, allow)
+
+	var lastErr error
+	for _, url := range b.options.URLs {
+		if err := b.loadURL(url, block, allow, download); err != nil {
+			log.WithError(err).WithField("url", url).Error("加载拦截列表失败")
+			lastErr = err
+		}
+	}
+
+	b.mu.Lock()
+	b.block = block
+	b.allow = allow
+	b.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"lists": len(b.options.URLs),
+		"rules": block.len(),
+		"allow": allow.len(),
+	}).Info("已加载拦截列表")
+	return lastErr
+}
+
+// loadURL 下载一个订阅列表并解析，下载失败或 download 为 false 时使用上一次的本地缓存
+func (b *Blocklist) loadURL(url string, block, allow *ruleSet, download bool) error {
+	localFile := b.cacheFile(url)
+
+	var downloadErr error
+	if download {
+		if downloadErr = b.download(url, localFile); downloadErr != nil {
+			log.WithError(downloadErr).WithField("url", url).Warn("下载拦截列表失败，使用本地缓存")
+		}
+	}
+
+	file, err := os.Open(localFile)
+	if err != nil {
+		if downloadErr != nil {
+			return downloadErr
+		}
+		return err
+	}
+	defer file.Close()
+
+	return parseRules(file, url, block, allow)
+}
+
+// cacheFile 返回订阅列表的本地缓存路径
+func (b *Blocklist) cacheFile(url string) string {
+	sum := sha1.Sum([]byte(url))
+	return filepath.Join(b.options.DataDir, "blocklists", hex.EncodeToString(sum[:8])+".txt")
+}
+
+// download 下载文件到本地，先写入临时文件再重命名
+func (b *Blocklist) download(url, localFile string) error {
+	if err := os.MkdirAll(filepath.Dir(localFile), 0755); err != nil {
+		return err
+	}
+
+	resp, err := b.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("下载失败，HTTP状态码: %d", resp.StatusCode)
+	}
+
+	tmpFile := localFile + ".tmp"
+	out, err := os.Create(tmpFile)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		out.Close()
+		os.Remove(tmpFile)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return os.Rename(tmpFile, localFile)
+}
+
+// Run 按配置的间隔刷新订阅列表，直到 stop 关闭
+func (b *Blocklist) Run(stop <-chan struct{}) {
+	if len(b.options.URLs) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(b.options.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := b.Load(); err != nil {
+				log.WithError(err).Error("刷新拦截列表失败")
+			}
+		}
+	}
+}
+
+// Match 判断域名是否被拦截，例外规则（@@）优先
+func (b *Blocklist) Match(domain string) (*Match, bool) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if _, ok := b.allow.match(domain); ok {
+		return nil, false
+	}
+	m, ok := b.block.match(domain)
+	if !ok {
+		return nil, false
+	}
+	return &m, true
+}
+
+// Len 返回拦截规则数量
+func (b *Blocklist) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.block.len()
+}
+
+// parseRules 解析 hosts 格式和 AdBlock 格式的规则，忽略不支持的规则
+//
+// 支持以下格式：
+//
+//	0.0.0.0 ads.example.com      hosts 格式，只拦截该域名
+//	ads.example.com              域名列表，拦截该域名及其子域名
+//	||ads.example.com^           拦截该域名及其子域名
+//	|ads.example.com^            只拦截该域名
+//	/^ad[0-9]+\.example\.com$/   正则表达式，匹配不带末尾点的小写域名
+//	@@||example.com^             例外规则，不拦截该域名及其子域名
+//
+// 带有路径、通配符或修饰符（$）的规则只对网页生效，忽略。
+func parseRules(r io.Reader, source string, block, allow *ruleSet) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		parseRule(scanner.Text(), source, block, allow)
+	}
+	return scanner.Err()
+}
+
+// parseRule 解析一条规则并添加到 block 或 allow，规则不会生效时返回错误
+func parseRule(line, source string, block, allow *ruleSet) error {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "[") {
+		return nil
+	}
+
+	// hosts 格式
+	if fields := strings.Fields(line); len(fields) >= 2 && net.ParseIP(fields[0]) != nil {
+		added := false
+		for _, name := range fields[1:] {
+			if strings.HasPrefix(name, "#") {
+				break
+			}
+			name = normalizeDomain(name)
+			if name != "" && name != "localhost" && isValidDomain(name) {
+				block.exact[name] = Match{Rule: line, Source: source}
+				added = true
+			}
+		}
+		if !added {
+			return fmt.Errorf("规则中没有有效的域名: %s", line)
+		}
+		return nil
+	}
+
+	target := block
+	rule := line
+	if strings.HasPrefix(rule, "@@") {
+		target = allow
+		rule = rule[2:]
+	}
+
+	// 正则表达式
+	if len(rule) > 2 && strings.HasPrefix(rule, "/") && strings.HasSuffix(rule, "/") {
+		re, err := regexp.Compile(rule[1 : len(rule)-1])
+		if err != nil {
+			return fmt.Errorf("无效的正则表达式规则 %s: %v", line, err)
+		}
+		target.regexps = append(target.regexps, regexRule{re: re, match: Match{Rule: line, Source: source}})
+		return nil
+	}
+
+	exact := false
+	switch {
+	case strings.HasPrefix(rule, "||"):
+		rule = rule[2:]
+	case strings.HasPrefix(rule, "|"):
+		rule = rule[1:]
+		exact = true
+	}
+	rule = strings.TrimSuffix(rule, "^")
+	rule = strings.TrimSuffix(rule, "|")
+
+	name := normalizeDomain(rule)
+	if !isValidDomain(name) {
+		return fmt.Errorf("不支持的规则，只能拦截域名: %s", line)
+	}
+	if exact {
+		target.exact[name] = Match{Rule: line, Source: source}
+	} else {
+		target.suffix[name] = Match{Rule: line, Source: source}
+	}
+	return nil
+}
+
+// CheckRule 检查一条自定义规则，规则无效或者会被忽略时返回错误
+func CheckRule(rule string) error {
+	return parseRule(rule, "custom", newRuleSet(), newRuleSet())
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+}
+
+// isValidDomain 判断规则是否为纯域名
+func isValidDomain(domain string) bool {
+	if domain == "" || !strings.Contains(domain, ".") {
+		return false
+	}
+	for _, c := range domain {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '.', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Response 拦截应答方式
+type Response struct {
+	Mode string
+	IPv4 net.IP
+	IPv6 net.IP
+}
+
+// ParseResponse 解析拦截应答方式，可以是 nxdomain、null（0.0.0.0 和 ::）、refused，或者自定义 IP（多个 IP 用逗号分隔）
+func ParseResponse(s string) (Response, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", ModeNXDomain:
+		return Response{Mode: ModeNXDomain}, nil
+	case ModeNullIP, "0.0.0.0":
+		return Response{Mode: ModeNullIP, IPv4: net.IPv4zero.To4(), IPv6: net.IPv6zero}, nil
+	case ModeRefused:
+		return Response{Mode: ModeRefused}, nil
+	}
+
+	resp := Response{Mode: ModeCustomIP}
+	for _, part := range strings.Split(s, ",") {
+		ip := net.ParseIP(strings.TrimSpace(part))
+		if ip == nil {
+			return Response{}, fmt.Errorf("无效的拦截应答方式: %s", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			resp.IPv4 = ip4
+		} else {
+			resp.IPv6 = ip
+		}
+	}
+	return resp, nil
+}
+
+// Answer 返回拦截应答的响应码和应答记录
+func (r Response) Answer(question dnsmessage.Question) (dnsmessage.RCode, []dnsmessage.Resource) {
+	switch r.Mode {
+	case ModeNXDomain:
+		return dnsmessage.RCodeNameError, nil
+	case ModeRefused:
+		return dnsmessage.RCodeRefused, nil
+	}
+
+	header := dnsmessage.ResourceHeader{
+		Name:  question.Name,
+		Type:  question.Type,
+		Class: dnsmessage.ClassINET,
+		TTL:   blockedTTL,
+	}
+	switch {
+	case question.Type == dnsmessage.TypeA && r.IPv4 != nil:
+		a := &dnsmessage.AResource{}
+		copy(a.A[:], r.IPv4.To4())
+		return dnsmessage.RCodeSuccess, []dnsmessage.Resource{{Header: header, Body: a}}
+	case question.Type == dnsmessage.TypeAAAA && r.IPv6 != nil:
+		aaaa := &dnsmessage.AAAAResource{}
+		copy(aaaa.AAAA[:], r.IPv6.To16())
+		return dnsmessage.RCodeSuccess, []dnsmessage.Resource{{Header: header, Body: aaaa}}
+	}
+	// 其他类型返回空应答
+	return dnsmessage.RCodeSuccess, nil
+}
@@ -0,0 +1,176 @@
+package blocklist
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestBlocklist_Match(t *testing.T) {
+	list := `! AdBlock 列表
+[Adblock Plus 2.0]
+||ads.example.com^
+|exact.example.net^
+@@||good.ads.example.com^
+||tracker.example.org^$third-party
+/banner/*.gif
+0.0.0.0 hosts.example.com # 注释
+127.0.0.1 localhost
+plain.example.io
+`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, list)
+	}))
+	defer server.Close()
+
+	b := New(Options{
+		URLs:    []string{server.URL},
+		Rules:   []string{"||custom.example.com^", `/^ad[0-9]+\.example\.org$/`, `@@/^ad0\./`},
+		DataDir: t.TempDir(),
+	})
+	if err := b.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		domain   string
+		want     bool
+		wantRule string
+	}{
+		{"ads.example.com.", true, "||ads.example.com^"},
+		{"x.ads.example.com", true, "||ads.example.com^"},
+		{"good.ads.example.com", false, ""},
+		{"a.good.ads.example.com", false, ""},
+		{"exact.example.net", true, "|exact.example.net^"},
+		{"sub.exact.example.net", false, ""},
+		{"tracker.example.org", false, ""},
+		{"hosts.example.com", true, "0.0.0.0 hosts.example.com # 注释"},
+		{"sub.hosts.example.com", false, ""},
+		{"localhost", false, ""},
+		{"www.plain.example.io", true, "plain.example.io"},
+		{"custom.example.com", true, "||custom.example.com^"},
+		{"ad1.example.org", true, `/^ad[0-9]+\.example\.org$/`},
+		{"ad0.example.org", false, ""},
+		{"ad.example.org", false, ""},
+		{"example.com", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			m, blocked := b.Match(tt.domain)
+			if blocked != tt.want {
+				t.Fatalf("Match() blocked = %v, want %v", blocked, tt.want)
+			}
+			if blocked && m.Rule != tt.wantRule {
+				t.Errorf("Match() rule = %q, want %q", m.Rule, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestBlocklist_LoadFallbackToCache(t *testing.T) {
+	available := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, "||ads.example.com^\n")
+	}))
+	defer server.Close()
+
+	b := New(Options{URLs: []string{server.URL}, DataDir: t.TempDir()})
+	if err := b.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 下载失败时继续使用本地缓存
+	available = false
+	if err := b.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, blocked := b.Match("ads.example.com"); !blocked {
+		t.Error("Match() after failed refresh = false, want true")
+	}
+
+	// LoadCached 只读取本地缓存，不下载
+	requested := false
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+	})
+	cached := New(Options{URLs: []string{server.URL}, DataDir: b.options.DataDir})
+	if err := cached.LoadCached(); err != nil {
+		t.Fatal(err)
+	}
+	if _, blocked := cached.Match("ads.example.com"); !blocked || requested {
+		t.Errorf("LoadCached() blocked = %v, requested = %v, want cached list without download", blocked, requested)
+	}
+}
+
+func TestCheckRule(t *testing.T) {
+	tests := []struct {
+		rule    string
+		wantErr bool
+	}{
+		{"||ads.example.com^", false},
+		{"@@||example.com^", false},
+		{"0.0.0.0 ads.example.com", false},
+		{"! 注释", false},
+		{`/^ad[0-9]+\./`, false},
+		{"/^ad[0-9+\\./", true},
+		{"||tracker.example.org^$third-party", true},
+		{"/banner/*.gif", true},
+		{"127.0.0.1 localhost", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			if err := CheckRule(tt.rule); (err != nil) != tt.wantErr {
+				t.Errorf("CheckRule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResponse_Answer(t *testing.T) {
+	q := func(qtype dnsmessage.Type) dnsmessage.Question {
+		return dnsmessage.Question{Name: dnsmessage.MustNewName("ads.example.com."), Type: qtype, Class: dnsmessage.ClassINET}
+	}
+
+	tests := []struct {
+		mode        string
+		qtype       dnsmessage.Type
+		wantRCode   dnsmessage.RCode
+		wantAnswers int
+		wantErr     bool
+	}{
+		{"nxdomain", dnsmessage.TypeA, dnsmessage.RCodeNameError, 0, false},
+		{"refused", dnsmessage.TypeA, dnsmessage.RCodeRefused, 0, false},
+		{"null", dnsmessage.TypeA, dnsmessage.RCodeSuccess, 1, false},
+		{"null", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, 1, false},
+		{"null", dnsmessage.TypeTXT, dnsmessage.RCodeSuccess, 0, false},
+		{"192.168.1.1", dnsmessage.TypeA, dnsmessage.RCodeSuccess, 1, false},
+		{"192.168.1.1", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, 0, false},
+		{"192.168.1.1,fd00::1", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, 1, false},
+		{"invalid", dnsmessage.TypeA, 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode+tt.qtype.String(), func(t *testing.T) {
+			resp, err := ParseResponse(tt.mode)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseResponse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			rcode, answers := resp.Answer(q(tt.qtype))
+			if rcode != tt.wantRCode || len(answers) != tt.wantAnswers {
+				t.Errorf("Answer() = (%v, %d answers), want (%v, %d answers)", rcode, len(answers), tt.wantRCode, tt.wantAnswers)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package cache
+
+import (
+	"container/list"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Options 缓存配置
+type Options struct {
+	// Size 最多缓存的响应数，0 表示不使用缓存
+	Size int
+	// MinTTL 缓存时间的下限
+	MinTTL time.Duration
+	// MaxTTL 缓存时间的上限，默认 24 小时
+	MaxTTL time.Duration
+	// NegativeTTL 没有 SOA 记录的否定应答的缓存时间，默认 60 秒
+	NegativeTTL time.Duration
+}
+
+// Key 缓存键，不包含 ECS，ECS 在同一个键下按作用域区分
+type Key struct {
+	Name     string
+	Type     dnsmessage.Type
+	Class    dnsmessage.Class
+	Upstream string
+	// CheckingDisabled 发往上游的查询设置了 CD 标志，上游对两种查询的应答可能不同
+	CheckingDisabled bool
+}
+
+// NewKey 根据问题、上游和发往上游的查询的 CD 标志创建缓存键
+func NewKey(question dnsmessage.Question, upstream string, checkingDisabled bool) Key {
+	return Key{
+		Name:             strings.ToLower(question.Name.String()),
+		Type:             question.Type,
+		Class:            question.Class,
+		Upstream:         upstream,
+		CheckingDisabled: checkingDisabled,
+	}
+}
+
+// Entry 缓存的响应及其查询信息
+type Entry struct {
+	Msg          dnsmessage.Message
+	Server       string
+	IsChina      bool
+	PoisonReason string
+	DNSSEC       string
+	// Bogus DNSSEC 验证失败，缓存的是上游的原始应答，没有设置 CD 标志的查询应该返回 SERVFAIL
+	Bogus bool
+}
+
+// item 一条缓存记录，scope 为空时适用于所有客户端
+type item struct {
+	key     Key
+	scope   *net.IPNet
+	entry   Entry
+	stored  time.Time
+	expires time.Time
+	elem    *list.Element
+}
+
+// Cache 按 LRU 淘汰的 DNS 响应缓存，支持 ECS 作用域
+type Cache struct {
+	options Options
+	mu      sync.Mutex
+	items   map[Key][]*item
+	lru     *list.List
+	now     func() time.Time
+}
+
+// New 创建缓存，Size 为 0 时返回 nil
+func New(options Options) *Cache {
+	if options.Size <= 0 {
+		return nil
+	}
+	if options.MaxTTL <= 0 {
+		options.MaxTTL = 24 * time.Hour
+	}
+	if options.NegativeTTL <= 0 {
+		options.NegativeTTL = 60 * time.Second
+	}
+	return &Cache{
+		options: options,
+		items:   make(map[Key][]*item),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+// Get 查找缓存的响应，subnet 为发往上游的查询中的 ECS 子网。
+// 返回的响应是副本，TTL 已减去缓存的时间
+func (c *Cache) Get(key Key, subnet *net.IPNet) (Entry, bool) {
+	if c == nil {
+		return Entry{}, false
+	}
+
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var best *item
+	for _, it := range c.items[key] {
+		if !now.Before(it.expires) || !scopeMatches(it.scope, subnet) {
+			continue
+		}
+		if best == nil || scopeLen(it.scope) > scopeLen(best.scope) {
+			best = it
+		}
+	}
+	if best == nil {
+		return Entry{}, false
+	}
+	c.lru.MoveToFront(best.elem)
+
+	entry := best.entry
+	elapsed := uint32(now.Sub(best.stored) / time.Second)
+	entry.Msg.Answers = decreaseTTL(entry.Msg.Answers, elapsed)
+	entry.Msg.Authorities = decreaseTTL(entry.Msg.Authorities, elapsed)
+	entry.Msg.Additionals = decreaseTTL(entry.Msg.Additionals, elapsed)
+	return entry, true
+}
+
+// Set 缓存响应。subnet 为发往上游的查询中的 ECS 子网，scope 为上游返回的作用域前缀长度，
+// 作用域为 0 或者查询没有 ECS 时响应适用于所有客户端
+func (c *Cache) Set(key Key, subnet *net.IPNet, scope int, entry Entry) {
+	if c == nil {
+		return
+	}
+	ttl, ok := c.ttl(&entry.Msg)
+	if !ok {
+		return
+	}
+
+	var scopeNet *net.IPNet
+	if subnet != nil && scope > 0 {
+		source, bits := subnet.Mask.Size()
+		if scope > source {
+			scope = source
+		}
+		mask := net.CIDRMask(scope, bits)
+		scopeNet = &net.IPNet{IP: subnet.IP.Mask(mask), Mask: mask}
+	}
+
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// 替换相同作用域的旧记录
+	for _, it := range c.items[key] {
+		if scopeEqual(it.scope, scopeNet) {
+			c.remove(it)
+			break
+		}
+	}
+
+	it := &item{key: key, scope: scopeNet, entry: entry, stored: now, expires: now.Add(ttl)}
+	it.elem = c.lru.PushFront(it)
+	c.items[key] = append(c.items[key], it)
+
+	for c.lru.Len() > c.options.Size {
+		c.remove(c.lru.Back().Value.(*item))
+	}
+}
+
+// Len 返回缓存的响应数
+func (c *Cache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Flush 清空缓存
+func (c *Cache) Flush() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items = make(map[Key][]*item)
+	c.lru.Init()
+}
+
+func (c *Cache) remove(it *item) {
+	c.lru.Remove(it.elem)
+	items := c.items[it.key]
+	for i, other := range items {
+		if other == it {
+			items = append(items[:i], items[i+1:]...)
+			break
+		}
+	}
+	if len(items) == 0 {
+		delete(c.items, it.key)
+	} else {
+		c.items[it.key] = items
+	}
+}
+
+// ttl 计算响应的缓存时间，只缓存成功和域名不存在的完整响应
+func (c *Cache) ttl(msg *dnsmessage.Message) (time.Duration, bool) {
+	if msg.Header.Truncated || (msg.Header.RCode != dnsmessage.RCodeSuccess && msg.Header.RCode != dnsmessage.RCodeNameError) {
+		return 0, false
+	}
+
+	minTTL, found := uint32(0), false
+	for _, section := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for _, rr := range section {
+			if rr.Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			if !found || rr.Header.TTL < minTTL {
+				minTTL, found = rr.Header.TTL, true
+			}
+		}
+	}
+
+	ttl := time.Duration(minTTL) * time.Second
+	if !found {
+		ttl = c.options.NegativeTTL
+	}
+	if ttl < c.options.MinTTL {
+		ttl = c.options.MinTTL
+	}
+	if ttl > c.options.MaxTTL {
+		ttl = c.options.MaxTTL
+	}
+	return ttl, ttl > 0
+}
+
+// decreaseTTL 复制记录并减去已经缓存的时间
+func decreaseTTL(resources []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	if resources == nil {
+		return nil
+	}
+	result := make([]dnsmessage.Resource, len(resources))
+	for i, rr := range resources {
+		if rr.Header.Type != dnsmessage.TypeOPT {
+			if rr.Header.TTL > elapsed {
+				rr.Header.TTL -= elapsed
+			} else {
+				rr.Header.TTL = 0
+			}
+		}
+		result[i] = rr
+	}
+	return result
+}
+
+func scopeMatches(scope, subnet *net.IPNet) bool {
+	if scope == nil {
+		return true
+	}
+	if subnet == nil || (scope.IP.To4() == nil) != (subnet.IP.To4() == nil) {
+		return false
+	}
+	return scope.Contains(subnet.IP)
+}
+
+func scopeLen(scope *net.IPNet) int {
+	if scope == nil {
+		return -1
+	}
+	ones, _ := scope.Mask.Size()
+	return ones
+}
+
+func scopeEqual(a, b *net.IPNet) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.String() == b.String()
+}
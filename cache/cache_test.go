@@ -0,0 +1,145 @@
+package cache
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var question = dnsmessage.Question{
+	Name:  dnsmessage.MustNewName("Example.com."),
+	Type:  dnsmessage.TypeA,
+	Class: dnsmessage.ClassINET,
+}
+
+func newEntry(ttl uint32, ip byte) Entry {
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true},
+		Questions: []dnsmessage.Question{question},
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, ip}},
+		}},
+	}
+	return Entry{Msg: msg, Server: "8.8.8.8:53"}
+}
+
+func newTestCache(options Options) (*Cache, *time.Time) {
+	c := New(options)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+func answerIP(entry Entry) byte {
+	return entry.Msg.Answers[0].Body.(*dnsmessage.AResource).A[3]
+}
+
+func TestCache_GetSet(t *testing.T) {
+	c, now := newTestCache(Options{Size: 10})
+	key := NewKey(question, "8.8.8.8:53", false)
+
+	if _, ok := c.Get(key, nil); ok {
+		t.Fatal("Get() on empty cache = true")
+	}
+
+	c.Set(key, nil, 0, newEntry(300, 1))
+	*now = now.Add(100 * time.Second)
+	entry, ok := c.Get(NewKey(dnsmessage.Question{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}, "8.8.8.8:53", false), nil)
+	if !ok {
+		t.Fatal("Get() = false, want cached entry")
+	}
+	if ttl := entry.Msg.Answers[0].Header.TTL; ttl != 200 {
+		t.Errorf("TTL = %d, want 200", ttl)
+	}
+
+	// 不同上游的响应分开缓存
+	if _, ok := c.Get(NewKey(question, "1.1.1.1:53", false), nil); ok {
+		t.Error("Get() for other upstream = true")
+	}
+	// 设置了 CD 标志的查询分开缓存
+	if _, ok := c.Get(NewKey(question, "8.8.8.8:53", true), nil); ok {
+		t.Error("Get() with CD bit = true")
+	}
+
+	*now = now.Add(300 * time.Second)
+	if _, ok := c.Get(key, nil); ok {
+		t.Error("Get() after expiry = true")
+	}
+}
+
+func TestCache_Scope(t *testing.T) {
+	c, _ := newTestCache(Options{Size: 10})
+	key := NewKey(question, "8.8.8.8:53", false)
+	_, subnetA, _ := net.ParseCIDR("203.0.113.0/24")
+	_, subnetB, _ := net.ParseCIDR("198.51.100.0/24")
+	_, subnetA2, _ := net.ParseCIDR("203.0.112.0/24")
+
+	// 作用域 /16 的响应适用于同一个 /16 内的子网
+	c.Set(key, subnetA, 16, newEntry(300, 1))
+	if entry, ok := c.Get(key, subnetA2); !ok || answerIP(entry) != 1 {
+		t.Errorf("Get() for subnet in scope = %v, want entry 1", ok)
+	}
+	if _, ok := c.Get(key, subnetB); ok {
+		t.Error("Get() for subnet outside scope = true")
+	}
+	if _, ok := c.Get(key, nil); ok {
+		t.Error("Get() without ECS for scoped entry = true")
+	}
+
+	// 作用域为 0 的响应适用于所有客户端，更具体的作用域优先
+	c.Set(key, subnetB, 0, newEntry(300, 2))
+	if entry, ok := c.Get(key, subnetB); !ok || answerIP(entry) != 2 {
+		t.Errorf("Get() for global entry = %v", ok)
+	}
+	if entry, ok := c.Get(key, subnetA); !ok || answerIP(entry) != 1 {
+		t.Errorf("Get() should prefer scoped entry, got %v", ok)
+	}
+}
+
+func TestCache_Eviction(t *testing.T) {
+	c, _ := newTestCache(Options{Size: 2})
+	for i, name := range []string{"a.example.", "b.example.", "c.example."} {
+		q := question
+		q.Name = dnsmessage.MustNewName(name)
+		c.Set(NewKey(q, "up", false), nil, 0, newEntry(300, byte(i)))
+	}
+	if c.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", c.Len())
+	}
+	q := question
+	q.Name = dnsmessage.MustNewName("a.example.")
+	if _, ok := c.Get(NewKey(q, "up", false), nil); ok {
+		t.Error("oldest entry was not evicted")
+	}
+}
+
+func TestCache_TTL(t *testing.T) {
+	c, _ := newTestCache(Options{Size: 10, MinTTL: 60 * time.Second, MaxTTL: time.Hour})
+
+	tests := []struct {
+		name   string
+		modify func(*dnsmessage.Message)
+		want   time.Duration
+		wantOK bool
+	}{
+		{"min ttl", func(m *dnsmessage.Message) { m.Answers[0].Header.TTL = 5 }, 60 * time.Second, true},
+		{"max ttl", func(m *dnsmessage.Message) { m.Answers[0].Header.TTL = 86400 }, time.Hour, true},
+		{"negative without soa", func(m *dnsmessage.Message) { m.Header.RCode = dnsmessage.RCodeNameError; m.Answers = nil }, 60 * time.Second, true},
+		{"servfail", func(m *dnsmessage.Message) { m.Header.RCode = dnsmessage.RCodeServerFailure }, 0, false},
+		{"truncated", func(m *dnsmessage.Message) { m.Header.Truncated = true }, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := newEntry(300, 1)
+			tt.modify(&entry.Msg)
+			got, ok := c.ttl(&entry.Msg)
+			if ok != tt.wantOK || (ok && got != tt.want) {
+				t.Errorf("ttl() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"testing"
 
 	"golang.org/x/net/dns/dnsmessage"
@@ -49,7 +50,7 @@ func TestDNSClient_Request(t *testing.T) {
 				},
 			}
 
-			resp, err := c.Request(msg)
+			resp, err := c.Request(context.Background(), msg)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("DNSClient.Request() error = %v, wantErr %v", err, tt.wantErr)
 				return
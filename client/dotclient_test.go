@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"os"
 	"testing"
 	"time"
@@ -65,7 +66,7 @@ func TestDOTClient_Request(t *testing.T) {
 					},
 				}
 
-				resp, err := c.Request(msg)
+				resp, err := c.Request(context.Background(), msg)
 				if (err != nil) != tt.wantErr {
 					t.Errorf("DOTClient.Request() error = %v, wantErr %v", err, tt.wantErr)
 					done <- true
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TCPClient 通过 TCP 发送 DNS 查询，消息带有两字节的长度前缀
+type TCPClient struct {
+	serverAddr string
+}
+
+func NewTCPClient(serverAddr string) *TCPClient {
+	return &TCPClient{serverAddr: serverAddr}
+}
+
+func (c *TCPClient) Request(ctx context.Context, m dnsmessage.Message) ([]byte, error) {
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	request := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(request, uint16(len(packed)))
+	copy(request[2:], packed)
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, fmt.Errorf("读取响应长度失败: %v", err)
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, fmt.Errorf("读取响应失败: %v", err)
+	}
+	return response, nil
+}
+
+func (c *TCPClient) String() string {
+	return "tcp://" + c.serverAddr
+}
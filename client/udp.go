@@ -21,18 +21,25 @@ func (c *UDPClient) Request(ctx context.Context, m dnsmessage.Message) ([]byte,
 		return nil, err
 	}
 
-	conn, err := net.Dial("udp", c.serverAddr)
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", c.serverAddr)
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Close()
 
+	// 没有设置超时时读取可能一直阻塞
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
 	_, err = conn.Write(packed)
 	if err != nil {
 		return nil, err
 	}
 
-	response := make([]byte, 512)
+	// 使用 EDNS 时响应可能超过 512 字节
+	response := make([]byte, 65535)
 	n, err := conn.Read(response)
 	if err != nil {
 		return nil, err
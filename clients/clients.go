@@ -0,0 +1,237 @@
+package clients
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// 分组强制使用的路由
+const (
+	RouteChina   = "china"
+	RouteOversea = "oversea"
+)
+
+// Group 客户端分组及其策略
+type Group struct {
+	Name string `json:"name" yaml:"name"`
+	// Clients 分组包含的客户端，可以是 IP、CIDR、MAC 地址或主机名（来自本地 hosts 记录）
+	Clients []string `json:"clients" yaml:"clients"`
+
+	// Route 强制使用的路由，china 或 oversea，为空时按域名判断
+	Route string `json:"route,omitempty" yaml:"route,omitempty"`
+	// ChinaDomains 该分组额外使用国内 DNS 的域名后缀
+	ChinaDomains []string `json:"china_domains,omitempty" yaml:"china_domains,omitempty"`
+	// OverseaDomains 该分组额外使用海外 DNS 的域名后缀
+	OverseaDomains []string `json:"oversea_domains,omitempty" yaml:"oversea_domains,omitempty"`
+
+	// ChinaServer 覆盖国内 DNS 服务器
+	ChinaServer string `json:"china_server,omitempty" yaml:"china_server,omitempty"`
+	// OverseaServer 覆盖海外 DNS 服务器
+	OverseaServer string `json:"oversea_server,omitempty" yaml:"oversea_server,omitempty"`
+
+	// BlockingDisabled 不使用全局拦截列表
+	BlockingDisabled bool `json:"blocking_disabled,omitempty" yaml:"blocking_disabled,omitempty"`
+	// BlocklistURLs 该分组额外订阅的拦截列表
+	BlocklistURLs []string `json:"blocklist_urls,omitempty" yaml:"blocklist_urls,omitempty"`
+	// BlockRules 该分组额外的拦截规则
+	BlockRules []string `json:"block_rules,omitempty" yaml:"block_rules,omitempty"`
+
+	// SafeSearch 强制搜索引擎使用安全搜索
+	SafeSearch bool `json:"safe_search,omitempty" yaml:"safe_search,omitempty"`
+
+	ips   []net.IP
+	nets  []*net.IPNet
+	macs  []string
+	names []string
+}
+
+// RouteFor 返回分组为域名指定的路由和命中的规则，没有指定时返回空字符串
+func (g *Group) RouteFor(domain string) (string, string) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if rule, ok := matchSuffix(domain, g.OverseaDomains); ok {
+		return RouteOversea, rule
+	}
+	if rule, ok := matchSuffix(domain, g.ChinaDomains); ok {
+		return RouteChina, rule
+	}
+	if g.Route != "" {
+		return g.Route, "route=" + g.Route
+	}
+	return "", ""
+}
+
+// matchSuffix 判断域名是否等于列表中的域名或是其子域名
+func matchSuffix(domain string, suffixes []string) (string, bool) {
+	for _, suffix := range suffixes {
+		suffix = strings.ToLower(strings.Trim(suffix, "."))
+		if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+			return suffix, true
+		}
+	}
+	return "", false
+}
+
+// compile 解析分组中的客户端标识
+func (g *Group) compile() error {
+	if g.Name == "" {
+		return fmt.Errorf("客户端分组缺少名称")
+	}
+	switch g.Route {
+	case "", RouteChina, RouteOversea:
+	default:
+		return fmt.Errorf("客户端分组 %s 的路由无效: %s", g.Name, g.Route)
+	}
+
+	for _, c := range g.Clients {
+		c = strings.TrimSpace(c)
+		if mac, err := net.ParseMAC(c); err == nil {
+			g.macs = append(g.macs, mac.String())
+		} else if _, ipNet, err := net.ParseCIDR(c); err == nil {
+			g.nets = append(g.nets, ipNet)
+		} else if ip := net.ParseIP(c); ip != nil {
+			g.ips = append(g.ips, ip)
+		} else if c != "" {
+			g.names = append(g.names, strings.ToLower(strings.TrimSuffix(c, ".")))
+		}
+	}
+	return nil
+}
+
+// matchAddr 判断 IP 或 MAC 地址是否属于分组
+func (g *Group) matchAddr(ip net.IP, mac string) bool {
+	if mac != "" {
+		for _, m := range g.macs {
+			if m == mac {
+				return true
+			}
+		}
+	}
+	for _, i := range g.ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	for _, n := range g.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchNames 判断客户端主机名是否属于分组
+func (g *Group) matchNames(names []string) bool {
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		for _, n := range g.names {
+			if n == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NameResolver 根据客户端 IP 查找主机名
+type NameResolver func(ip net.IP) []string
+
+// Manager 根据客户端地址查找所属分组
+type Manager struct {
+	groups    []*Group
+	neighbors *NeighborTable
+	names     NameResolver
+}
+
+// LoadGroups 从 JSON 文件读取客户端分组
+func LoadGroups(filePath string) ([]*Group, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("读取客户端分组失败: %v", err)
+	}
+
+	var groups []*Group
+	if err := json.Unmarshal(data, &groups); err != nil {
+		return nil, fmt.Errorf("解析客户端分组失败: %v", err)
+	}
+	return groups, nil
+}
+
+// NewManager 创建客户端分组管理，按顺序匹配，第一个匹配的分组生效
+func NewManager(groups []*Group, neighbors *NeighborTable, names NameResolver) (*Manager, error) {
+	seen := make(map[string]bool)
+	for _, g := range groups {
+		if err := g.compile(); err != nil {
+			return nil, err
+		}
+		if seen[g.Name] {
+			return nil, fmt.Errorf("客户端分组名称重复: %s", g.Name)
+		}
+		seen[g.Name] = true
+	}
+
+	return &Manager{
+		groups:    groups,
+		neighbors: neighbors,
+		names:     names,
+	}, nil
+}
+
+// Run 在后台刷新邻居表，直到 stop 关闭
+func (m *Manager) Run(stop <-chan struct{}) {
+	if m.neighbors != nil {
+		m.neighbors.Run(stop)
+	}
+}
+
+// Groups 返回所有分组
+func (m *Manager) Groups() []*Group {
+	return m.groups
+}
+
+// Match 返回客户端所属的分组，不属于任何分组时返回 nil
+func (m *Manager) Match(ip net.IP) *Group {
+	var mac string
+	if m.neighbors != nil {
+		if hw, ok := m.neighbors.Lookup(ip); ok {
+			mac = hw.String()
+		}
+	}
+
+	var names []string
+	if m.names != nil {
+		names = m.names(ip)
+	}
+	for _, g := range m.groups {
+		if g.matchAddr(ip, mac) || g.matchNames(names) {
+			return g
+		}
+	}
+	return nil
+}
+
+// safeSearchHosts 搜索引擎域名对应的安全搜索域名
+var safeSearchHosts = map[string]string{
+	"www.google.com":           "forcesafesearch.google.com",
+	"google.com":               "forcesafesearch.google.com",
+	"www.google.com.hk":        "forcesafesearch.google.com",
+	"www.bing.com":             "strict.bing.com",
+	"bing.com":                 "strict.bing.com",
+	"cn.bing.com":              "strict.bing.com",
+	"duckduckgo.com":           "safe.duckduckgo.com",
+	"www.duckduckgo.com":       "safe.duckduckgo.com",
+	"www.youtube.com":          "restrict.youtube.com",
+	"m.youtube.com":            "restrict.youtube.com",
+	"youtube.com":              "restrict.youtube.com",
+	"youtubei.googleapis.com":  "restrict.youtube.com",
+	"youtube.googleapis.com":   "restrict.youtube.com",
+	"www.youtube-nocookie.com": "restrict.youtube.com",
+}
+
+// SafeSearchTarget 返回搜索引擎域名对应的安全搜索域名
+func SafeSearchTarget(domain string) (string, bool) {
+	target, ok := safeSearchHosts[strings.ToLower(strings.TrimSuffix(domain, "."))]
+	return target, ok
+}
@@ -0,0 +1,140 @@
+package clients
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestManager_Match(t *testing.T) {
+	neighbors := NewNeighborTable(func() (map[string]net.HardwareAddr, error) {
+		return ParseIPNeigh(strings.NewReader(
+			"192.168.1.50 dev br-lan lladdr aa:bb:cc:dd:ee:ff REACHABLE\n" +
+				"fe80::1 dev br-lan lladdr 11:22:33:44:55:66 STALE\n" +
+				"192.168.1.99 dev br-lan FAILED\n",
+		))
+	}, time.Minute)
+
+	names := func(ip net.IP) []string {
+		if ip.String() == "192.168.1.60" {
+			return []string{"ipad.lan"}
+		}
+		return nil
+	}
+
+	manager, err := NewManager([]*Group{
+		{Name: "kids", Clients: []string{"AA:BB:CC:DD:EE:FF", "ipad.lan"}, SafeSearch: true},
+		{Name: "work", Clients: []string{"10.0.0.0/24", "192.168.1.70"}, Route: RouteOversea},
+	}, neighbors, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"192.168.1.50", "kids"},
+		{"192.168.1.60", "kids"},
+		{"10.0.0.8", "work"},
+		{"192.168.1.70", "work"},
+		{"192.168.1.99", ""},
+		{"fe80::2", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			group := manager.Match(net.ParseIP(tt.ip))
+			got := ""
+			if group != nil {
+				got = group.Name
+			}
+			if got != tt.want {
+				t.Errorf("Match(%s) = %q, want %q", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewManager_Invalid(t *testing.T) {
+	if _, err := NewManager([]*Group{{Name: "a", Route: "moon"}}, nil, nil); err == nil {
+		t.Error("NewManager() with invalid route error = nil")
+	}
+	if _, err := NewManager([]*Group{{Name: "a"}, {Name: "a"}}, nil, nil); err == nil {
+		t.Error("NewManager() with duplicate name error = nil")
+	}
+}
+
+func TestGroup_RouteFor(t *testing.T) {
+	group := &Group{
+		Name:           "work",
+		Route:          RouteOversea,
+		ChinaDomains:   []string{"corp.example.cn"},
+		OverseaDomains: []string{"baidu.com"},
+	}
+	if err := group.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		domain string
+		want   string
+	}{
+		{"git.corp.example.cn.", RouteChina},
+		{"www.baidu.com", RouteOversea},
+		{"www.qq.com", RouteOversea},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			if got, _ := group.RouteFor(tt.domain); got != tt.want {
+				t.Errorf("RouteFor(%s) = %q, want %q", tt.domain, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseProcARP(t *testing.T) {
+	content := `IP address       HW type     Flags       HW address            Mask     Device
+192.168.1.10     0x1         0x2         aa:bb:cc:dd:ee:01     *        br-lan
+192.168.1.11     0x1         0x0         00:00:00:00:00:00     *        br-lan
+`
+	entries, err := ParseProcARP(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries["192.168.1.10"].String() != "aa:bb:cc:dd:ee:01" {
+		t.Errorf("ParseProcARP() = %v", entries)
+	}
+}
+
+func TestNeighborTable_Run(t *testing.T) {
+	var mu sync.Mutex
+	neigh := "192.168.1.50 dev br-lan lladdr aa:bb:cc:dd:ee:ff REACHABLE\n"
+	table := NewNeighborTable(func() (map[string]net.HardwareAddr, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return ParseIPNeigh(strings.NewReader(neigh))
+	}, 10*time.Millisecond)
+
+	// 创建时读取一次
+	if mac, ok := table.Lookup(net.ParseIP("192.168.1.50")); !ok || mac.String() != "aa:bb:cc:dd:ee:ff" {
+		t.Fatalf("Lookup() = %v, %v, want aa:bb:cc:dd:ee:ff", mac, ok)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go table.Run(stop)
+
+	mu.Lock()
+	neigh = "192.168.1.51 dev br-lan lladdr 11:22:33:44:55:66 REACHABLE\n"
+	mu.Unlock()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if _, ok := table.Lookup(net.ParseIP("192.168.1.51")); ok {
+			return
+		}
+	}
+	t.Error("neighbor table was not refreshed in the background")
+}
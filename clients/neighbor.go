@@ -0,0 +1,143 @@
+package clients
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// NeighborSource 读取邻居表（ARP 和 IPv6 邻居）
+type NeighborSource func() (map[string]net.HardwareAddr, error)
+
+// NeighborTable 缓存的邻居表，用于根据 IP 查找客户端 MAC 地址。
+// 邻居表在后台定时读取，查询时只读取缓存
+type NeighborTable struct {
+	source   NeighborSource
+	interval time.Duration
+
+	mu      sync.RWMutex
+	entries map[string]net.HardwareAddr
+}
+
+// NewNeighborTable 创建邻居表并读取一次，source 为空时读取系统邻居表
+func NewNeighborTable(source NeighborSource, interval time.Duration) *NeighborTable {
+	if source == nil {
+		source = SystemNeighbors
+	}
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	t := &NeighborTable{
+		source:   source,
+		interval: interval,
+		entries:  make(map[string]net.HardwareAddr),
+	}
+	t.refresh()
+	return t
+}
+
+// Lookup 返回缓存中 IP 对应的 MAC 地址
+func (t *NeighborTable) Lookup(ip net.IP) (net.HardwareAddr, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	mac, ok := t.entries[ip.String()]
+	return mac, ok
+}
+
+// Run 按刷新间隔重新读取邻居表，直到 stop 关闭
+func (t *NeighborTable) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			t.refresh()
+		}
+	}
+}
+
+// refresh 读取邻居表，失败时保留之前的结果
+func (t *NeighborTable) refresh() {
+	entries, err := t.source()
+	if err != nil {
+		log.WithError(err).Debug("读取邻居表失败")
+		return
+	}
+	t.mu.Lock()
+	t.entries = entries
+	t.mu.Unlock()
+}
+
+// SystemNeighbors 读取系统邻居表，优先使用 ip neigh，失败时读取 /proc/net/arp
+func SystemNeighbors() (map[string]net.HardwareAddr, error) {
+	if out, err := exec.Command("ip", "neigh", "show").Output(); err == nil {
+		return ParseIPNeigh(bytes.NewReader(out))
+	}
+
+	file, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseProcARP(file)
+}
+
+// ParseIPNeigh 解析 ip neigh show 的输出，例如：
+//
+//	192.168.1.10 dev br-lan lladdr aa:bb:cc:dd:ee:ff REACHABLE
+func ParseIPNeigh(r io.Reader) (map[string]net.HardwareAddr, error) {
+	entries := make(map[string]net.HardwareAddr)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		for i := 1; i+1 < len(fields); i++ {
+			if fields[i] != "lladdr" {
+				continue
+			}
+			if mac, err := net.ParseMAC(fields[i+1]); err == nil {
+				entries[ip.String()] = mac
+			}
+			break
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// ParseProcARP 解析 /proc/net/arp 的内容
+func ParseProcARP(r io.Reader) (map[string]net.HardwareAddr, error) {
+	entries := make(map[string]net.HardwareAddr)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		mac, err := net.ParseMAC(fields[3])
+		if err != nil || mac.String() == "00:00:00:00:00:00" {
+			continue
+		}
+		entries[ip.String()] = mac
+	}
+	return entries, scanner.Err()
+}
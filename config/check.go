@@ -0,0 +1,112 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"go-dns-proxy/blocklist"
+	"go-dns-proxy/clients"
+	"go-dns-proxy/hosts"
+	"net/url"
+)
+
+// Check 离线检查配置，不下载列表也不连接上游。除了 ServerOptions 的检查外，
+// 还会读取 hosts 文件和客户端分组文件、编译拦截规则并检查订阅地址，返回发现的所有问题
+func (c *Config) Check() []error {
+	var errs []error
+	seen := make(map[string]bool)
+	add := func(err error) {
+		if err != nil && !seen[err.Error()] {
+			seen[err.Error()] = true
+			errs = append(errs, err)
+		}
+	}
+	addFor := func(path string, err error) {
+		if err != nil {
+			add(c.errorFor(path, err))
+		}
+	}
+
+	_, err := c.ServerOptions()
+	add(err)
+
+	// hosts 文件和静态记录
+	for _, r := range c.Hosts.Records {
+		_, err := hosts.ParseRecord(r)
+		addFor("hosts.records", err)
+	}
+	if c.Hosts.File != "" {
+		_, err := hosts.NewStore(c.Hosts.File, nil)
+		addFor("hosts.file", err)
+	}
+
+	// 管理后台证书
+	if c.Admin.TLS && c.Admin.CertFile != "" && c.Admin.KeyFile != "" {
+		_, err := tls.LoadX509KeyPair(c.Admin.CertFile, c.Admin.KeyFile)
+		addFor("admin.cert_file", err)
+	}
+
+	// 订阅地址和拦截规则
+	for _, u := range []struct {
+		path string
+		urls []string
+	}{
+		{"china_domains.list_url", []string{c.ChinaDomains.ListURL}},
+		{"learning.china_ip_list_url", []string{c.Learning.ChinaIPListURL}},
+		{"blocklist.urls", c.Blocklist.URLs},
+	} {
+		for _, s := range u.urls {
+			addFor(u.path, checkURL(s))
+		}
+	}
+	for _, rule := range c.Blocklist.Rules {
+		addFor("blocklist.rules", blocklist.CheckRule(rule))
+	}
+
+	// 客户端分组
+	groups, err := c.clientGroups()
+	if err != nil {
+		add(err)
+		groups = c.Clients.Groups
+	}
+	for i, group := range groups {
+		path := func(key string) string {
+			if i < len(c.Clients.Groups) {
+				return fmt.Sprintf("clients.groups[%d].%s", i, key)
+			}
+			return "clients.groups_file"
+		}
+		for _, s := range group.BlocklistURLs {
+			addFor(path("blocklist_urls"), groupError(group, checkURL(s)))
+		}
+		for _, rule := range group.BlockRules {
+			addFor(path("block_rules"), groupError(group, blocklist.CheckRule(rule)))
+		}
+	}
+	_, err = clients.NewManager(groups, nil, nil)
+	addFor("clients", err)
+
+	return errs
+}
+
+// checkURL 检查订阅地址，为空时不检查
+func checkURL(s string) error {
+	if s == "" {
+		return nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("只支持 http 和 https 地址: %s", s)
+	}
+	return nil
+}
+
+// groupError 为客户端分组中的错误加上分组名称
+func groupError(group *clients.Group, err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("分组 %s: %v", group.Name, err)
+}
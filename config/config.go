@@ -0,0 +1,381 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"go-dns-proxy/clients"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config 配置文件的结构，每个配置项通过 flag 标签对应一个命令行参数
+type Config struct {
+	LogLevel  string   `yaml:"log_level" flag:"logLevel"`
+	Port      int      `yaml:"port" flag:"port"`
+	Listen    []string `yaml:"listen" flag:"listen"`
+	AdminPort int      `yaml:"admin_port" flag:"adminPort"`
+	DataDir   string   `yaml:"data_dir" flag:"dataDir"`
+
+	Admin        Admin        `yaml:"admin"`
+	Upstreams    Upstreams    `yaml:"upstreams"`
+	ACL          ACL          `yaml:"acl"`
+	ChinaDomains ChinaDomains `yaml:"china_domains"`
+	Pinyin       Pinyin       `yaml:"pinyin"`
+	Beian        Beian        `yaml:"beian"`
+	Learning     Learning     `yaml:"learning"`
+	Hosts        Hosts        `yaml:"hosts"`
+	Blocklist    Blocklist    `yaml:"blocklist"`
+	Clients      Clients      `yaml:"clients"`
+	RateLimit    RateLimit    `yaml:"rate_limit"`
+	Rebind       Rebind       `yaml:"rebind"`
+	Poison       Poison       `yaml:"poison"`
+	Forward      Forward      `yaml:"forward"`
+	ECS          ECS          `yaml:"ecs"`
+	Cache        Cache        `yaml:"cache"`
+	DNSSEC       DNSSEC       `yaml:"dnssec"`
+	Sets         Sets         `yaml:"sets"`
+
+	// file 配置文件路径，lines 配置项所在的行，用于错误信息
+	file  string
+	lines map[string]int
+}
+
+// Admin 管理后台的监听地址和认证，端口为 admin_port
+type Admin struct {
+	Bind           string        `yaml:"bind" flag:"adminBind"`
+	Auth           bool          `yaml:"auth" flag:"adminAuth"`
+	SessionTTL     time.Duration `yaml:"session_ttl" flag:"adminSessionTtl"`
+	AllowedOrigins []string      `yaml:"allowed_origins" flag:"adminAllowedOrigin"`
+	TLS            bool          `yaml:"tls" flag:"adminTls"`
+	CertFile       string        `yaml:"cert_file" flag:"adminCertFile"`
+	KeyFile        string        `yaml:"key_file" flag:"adminKeyFile"`
+}
+
+// Upstreams 国内和海外上游 DNS
+type Upstreams struct {
+	China   string `yaml:"china" flag:"chinaServer"`
+	Oversea string `yaml:"oversea" flag:"overSeaServer"`
+}
+
+// ACL 默认的访问控制
+type ACL struct {
+	Allow  []string `yaml:"allow" flag:"allow"`
+	Deny   []string `yaml:"deny" flag:"deny"`
+	Action string   `yaml:"action" flag:"denyAction"`
+}
+
+// ChinaDomains 中国域名列表
+type ChinaDomains struct {
+	ListURL string `yaml:"list_url" flag:"chinaDomainListUrl"`
+}
+
+// Pinyin 拼音域名判断
+type Pinyin struct {
+	Enabled   bool     `yaml:"enabled" flag:"pinyinEnabled"`
+	Threshold float64  `yaml:"threshold" flag:"pinyinThreshold"`
+	Allowlist []string `yaml:"allowlist" flag:"pinyinAllowlist"`
+	Denylist  []string `yaml:"denylist" flag:"pinyinDenylist"`
+}
+
+// Beian 备案查询
+type Beian struct {
+	APIURL      string        `yaml:"api_url" flag:"beianApiUrl"`
+	APIKey      string        `yaml:"api_key" flag:"beianApiKey"`
+	Timeout     time.Duration `yaml:"timeout" flag:"beianTimeout"`
+	PositiveTTL time.Duration `yaml:"positive_ttl" flag:"beianPositiveTTL"`
+	NegativeTTL time.Duration `yaml:"negative_ttl" flag:"beianNegativeTTL"`
+}
+
+// Learning 域名学习
+type Learning struct {
+	Enabled        bool          `yaml:"enabled" flag:"learnEnabled"`
+	TTL            time.Duration `yaml:"ttl" flag:"learnTTL"`
+	MinHits        int64         `yaml:"min_hits" flag:"learnMinHits"`
+	ChinaIPListURL string        `yaml:"china_ip_list_url" flag:"chinaIpListUrl"`
+}
+
+// Hosts 本地 hosts 文件和静态记录
+type Hosts struct {
+	File    string   `yaml:"file" flag:"hostsFile"`
+	Records []string `yaml:"records" flag:"staticRecord"`
+}
+
+// Blocklist 广告和跟踪域名拦截
+type Blocklist struct {
+	URLs     []string      `yaml:"urls" flag:"blocklistUrl"`
+	Rules    []string      `yaml:"rules" flag:"blockRule"`
+	Refresh  time.Duration `yaml:"refresh" flag:"blocklistRefresh"`
+	Response string        `yaml:"response" flag:"blockResponse"`
+}
+
+// Clients 客户端分组，Groups 在配置文件中直接配置，GroupsFile 中的分组排在后面
+type Clients struct {
+	GroupsFile string           `yaml:"groups_file" flag:"clientGroupsFile"`
+	Groups     []*clients.Group `yaml:"groups"`
+}
+
+// RateLimit 查询限速和响应限速
+type RateLimit struct {
+	QPS          float64  `yaml:"qps" flag:"rateLimit"`
+	Burst        int      `yaml:"burst" flag:"rateLimitBurst"`
+	IPv4Prefix   int      `yaml:"ipv4_prefix" flag:"rateLimitIpv4Prefix"`
+	IPv6Prefix   int      `yaml:"ipv6_prefix" flag:"rateLimitIpv6Prefix"`
+	Exempt       []string `yaml:"exempt" flag:"rateLimitExempt"`
+	RRLResponses float64  `yaml:"rrl_responses" flag:"rrlResponses"`
+	RRLSlip      int      `yaml:"rrl_slip" flag:"rrlSlip"`
+}
+
+// Rebind DNS 重绑定防护
+type Rebind struct {
+	Mode           string   `yaml:"mode" flag:"rebindProtection"`
+	AllowedDomains []string `yaml:"allowed_domains" flag:"rebindAllowDomain"`
+}
+
+// Poison 污染检测
+type Poison struct {
+	Enabled       bool          `yaml:"enabled" flag:"poisonDetection"`
+	BogusIPs      []string      `yaml:"bogus_ips" flag:"bogusIp"`
+	BogusNXDomain []string      `yaml:"bogus_nxdomain" flag:"bogusNxdomain"`
+	MinRTT        time.Duration `yaml:"min_rtt" flag:"poisonMinRtt"`
+}
+
+// Forward 条件转发
+type Forward struct {
+	Rules        []string `yaml:"rules" flag:"forward"`
+	LocalServer  string   `yaml:"local_server" flag:"localServer"`
+	DefaultZones bool     `yaml:"default_zones" flag:"forwardDefaultZones"`
+}
+
+// ECS 国内和海外上游的 EDNS Client Subnet
+type ECS struct {
+	China      string `yaml:"china" flag:"chinaEcs"`
+	Oversea    string `yaml:"oversea" flag:"overseaEcs"`
+	IPv4Prefix int    `yaml:"ipv4_prefix" flag:"ecsIpv4Prefix"`
+	IPv6Prefix int    `yaml:"ipv6_prefix" flag:"ecsIpv6Prefix"`
+}
+
+// Cache 响应缓存
+type Cache struct {
+	Size   int           `yaml:"size" flag:"cacheSize"`
+	MinTTL time.Duration `yaml:"min_ttl" flag:"cacheMinTtl"`
+	MaxTTL time.Duration `yaml:"max_ttl" flag:"cacheMaxTtl"`
+}
+
+// DNSSEC DNSSEC 验证
+type DNSSEC struct {
+	Enabled      bool     `yaml:"enabled" flag:"dnssec"`
+	TrustAnchors []string `yaml:"trust_anchors" flag:"trustAnchor"`
+}
+
+// Sets ipset 和 nftables 集合
+type Sets struct {
+	IPSet         []string `yaml:"ipset" flag:"ipset"`
+	NFTSet        []string `yaml:"nftset" flag:"nftset"`
+	OverseaIPSet  []string `yaml:"oversea_ipset" flag:"overseaIpset"`
+	OverseaNFTSet []string `yaml:"oversea_nftset" flag:"overseaNftset"`
+}
+
+// Flags 命令行参数，*cli.Context 实现了该接口
+type Flags interface {
+	IsSet(name string) bool
+	String(name string) string
+	Int(name string) int
+	Int64(name string) int64
+	Float64(name string) float64
+	Bool(name string) bool
+	Duration(name string) time.Duration
+	StringSlice(name string) []string
+}
+
+// Load 合并命令行参数的默认值、配置文件和命令行参数（包括环境变量），
+// 后面的优先。file 为空时只使用命令行参数
+func Load(file string, flags Flags) (*Config, error) {
+	c := &Config{file: file, lines: make(map[string]int)}
+	applyFlags(reflect.ValueOf(c).Elem(), flags, false)
+
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("读取配置文件失败: %v", err)
+		}
+		if err := c.parse(data); err != nil {
+			return nil, err
+		}
+	}
+
+	applyFlags(reflect.ValueOf(c).Elem(), flags, true)
+	return c, nil
+}
+
+// parse 解析配置文件，检查未知的配置项和值的类型
+func (c *Config) parse(data []byte) error {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return c.wrapYAMLError(err)
+	}
+	if len(root.Content) == 0 {
+		return nil
+	}
+	if err := c.checkKeys(root.Content[0], reflect.TypeOf(*c), ""); err != nil {
+		return err
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil {
+		return c.wrapYAMLError(err)
+	}
+	return nil
+}
+
+// checkKeys 检查映射中的配置项是否都存在，并记录每个配置项所在的行
+func (c *Config) checkKeys(node *yaml.Node, t reflect.Type, prefix string) error {
+	if node.Kind != yaml.MappingNode {
+		if prefix == "" {
+			return c.errorAt(node.Line, "配置文件的顶层必须是映射")
+		}
+		if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+			return nil
+		}
+		return c.errorAt(node.Line, "%s 必须是映射", prefix)
+	}
+
+	fields := yamlFields(t)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		path := key.Value
+		if prefix != "" {
+			path = prefix + "." + key.Value
+		}
+
+		field, ok := fields[key.Value]
+		if !ok {
+			names := make([]string, 0, len(fields))
+			for name := range fields {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return c.errorAt(key.Line, "未知的配置项 %s，可用的配置项: %s", path, strings.Join(names, ", "))
+		}
+		c.lines[path] = key.Line
+
+		switch {
+		case field.Type.Kind() == reflect.Struct:
+			if err := c.checkKeys(value, field.Type, path); err != nil {
+				return err
+			}
+		case field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() == reflect.Ptr && value.Kind == yaml.SequenceNode:
+			for j, item := range value.Content {
+				if err := c.checkKeys(item, field.Type.Elem().Elem(), fmt.Sprintf("%s[%d]", path, j)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// yamlFields 返回结构体中 yaml 标签对应的字段
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = field
+	}
+	return fields
+}
+
+// applyFlags 将命令行参数的值写入对应的配置项，onlySet 为 true 时只写入指定了的参数
+func applyFlags(v reflect.Value, flags Flags, onlySet bool) {
+	if flags == nil {
+		return
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, value := t.Field(i), v.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := field.Tag.Get("flag")
+		if name == "" {
+			if field.Type.Kind() == reflect.Struct {
+				applyFlags(value, flags, onlySet)
+			}
+			continue
+		}
+		if onlySet && !flags.IsSet(name) {
+			continue
+		}
+
+		switch value.Interface().(type) {
+		case string:
+			value.SetString(flags.String(name))
+		case int:
+			value.SetInt(int64(flags.Int(name)))
+		case int64:
+			value.SetInt(flags.Int64(name))
+		case float64:
+			value.SetFloat(flags.Float64(name))
+		case bool:
+			value.SetBool(flags.Bool(name))
+		case time.Duration:
+			value.SetInt(int64(flags.Duration(name)))
+		case []string:
+			value.Set(reflect.ValueOf(flags.StringSlice(name)))
+		}
+	}
+}
+
+// Line 返回配置项在配置文件中的行号，不在配置文件中时返回 0
+func (c *Config) Line(path string) int {
+	return c.lines[path]
+}
+
+// File 返回配置文件路径
+func (c *Config) File() string {
+	return c.file
+}
+
+// errorAt 返回带配置文件行号的错误
+func (c *Config) errorAt(line int, format string, args ...interface{}) error {
+	return fmt.Errorf("%s:%d: %s", c.file, line, fmt.Sprintf(format, args...))
+}
+
+// errorFor 返回配置项的错误，配置项来自配置文件时带有行号
+func (c *Config) errorFor(path string, err error) error {
+	if line := c.lines[path]; line > 0 {
+		return c.errorAt(line, "%s: %v", path, err)
+	}
+	return fmt.Errorf("%s: %v", path, err)
+}
+
+// wrapYAMLError 为 yaml 的错误加上配置文件路径
+func (c *Config) wrapYAMLError(err error) error {
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		return fmt.Errorf("%s: 配置项的类型错误:\n  %s", c.file, strings.Join(typeErr.Errors, "\n  "))
+	}
+	return fmt.Errorf("%s: %v", c.file, strings.TrimPrefix(err.Error(), "yaml: "))
+}
+
+// YAML 返回合并后的配置
+func (c *Config) YAML() ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,261 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeFlags 命令行参数，values 为参数的值（包括默认值），set 为指定了的参数
+type fakeFlags struct {
+	values map[string]interface{}
+	set    map[string]bool
+}
+
+func (f *fakeFlags) IsSet(name string) bool { return f.set[name] }
+
+func (f *fakeFlags) String(name string) string {
+	s, _ := f.values[name].(string)
+	return s
+}
+
+func (f *fakeFlags) Int(name string) int {
+	i, _ := f.values[name].(int)
+	return i
+}
+
+func (f *fakeFlags) Int64(name string) int64 {
+	i, _ := f.values[name].(int64)
+	return i
+}
+
+func (f *fakeFlags) Float64(name string) float64 {
+	v, _ := f.values[name].(float64)
+	return v
+}
+
+func (f *fakeFlags) Bool(name string) bool {
+	b, _ := f.values[name].(bool)
+	return b
+}
+
+func (f *fakeFlags) Duration(name string) time.Duration {
+	d, _ := f.values[name].(time.Duration)
+	return d
+}
+
+func (f *fakeFlags) StringSlice(name string) []string {
+	s, _ := f.values[name].([]string)
+	return s
+}
+
+// defaultFlags 返回与 start 命令默认值相同的参数
+func defaultFlags() *fakeFlags {
+	return &fakeFlags{
+		values: map[string]interface{}{
+			"logLevel":         "info",
+			"chinaServer":      "120.53.53.53",
+			"overSeaServer":    "1.1.1.1",
+			"adminPort":        8080,
+			"adminAuth":        true,
+			"adminSessionTtl":  7 * 24 * time.Hour,
+			"adminTls":         true,
+			"dataDir":          "./data",
+			"pinyinEnabled":    true,
+			"denyAction":       "refuse",
+			"rebindProtection": "off",
+			"cacheSize":        4096,
+			"cacheMaxTtl":      24 * time.Hour,
+			"chinaEcs":         "off",
+			"overseaEcs":       "off",
+			"blockResponse":    "nxdomain",
+		},
+		set: map[string]bool{},
+	}
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoad(t *testing.T) {
+	file := writeConfig(t, `
+port: 5353
+upstreams:
+  china: 223.5.5.5
+  oversea: https://dns.google/dns-query
+cache:
+  size: 100
+  min_ttl: 1m
+blocklist:
+  rules:
+    - ads.example.com
+clients:
+  groups:
+    - name: kids
+      clients: [192.168.1.50]
+      safe_search: true
+`)
+
+	flags := defaultFlags()
+	flags.values["overSeaServer"] = "tls://1.1.1.1"
+	flags.set["overSeaServer"] = true
+
+	c, err := Load(file, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"file value", c.Port, 5353},
+		{"file value in section", c.Upstreams.China, "223.5.5.5"},
+		{"flag overrides file", c.Upstreams.Oversea, "tls://1.1.1.1"},
+		{"default", c.AdminPort, 8080},
+		{"admin addr", c.AdminAddr(), ":8080"},
+		{"admin auth", c.AdminOptions().AuthDisabled, false},
+		{"admin url", c.AdminURL(), "https://127.0.0.1:8080"},
+		{"duration", c.Cache.MinTTL, time.Minute},
+		{"default in section", c.Cache.MaxTTL, 24 * time.Hour},
+		{"list", c.Blocklist.Rules, []string{"ads.example.com"}},
+		{"client group", c.Clients.Groups[0].SafeSearch, true},
+		{"line", c.Line("cache.min_ttl"), 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !reflect.DeepEqual(tt.got, tt.want) {
+				t.Errorf("got %v, want %v", tt.got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoad_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"unknown key", "port: 53\nupstreams:\n  chinaa: 223.5.5.5\n", ":3: 未知的配置项 upstreams.chinaa"},
+		{"unknown top level key", "port: 53\nupstream: {}\n", ":2: 未知的配置项 upstream"},
+		{"unknown group key", "clients:\n  groups:\n    - name: kids\n      safesearch: true\n", ":4: 未知的配置项 clients.groups[0].safesearch"},
+		{"wrong type", "port: fifty\n", "line 1: cannot unmarshal"},
+		{"section is not a mapping", "cache: 100\n", ":1: cache 必须是映射"},
+		{"invalid yaml", "port: [53\n", "config.yaml"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(writeConfig(t, tt.content), defaultFlags())
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Load() error = %v, want containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfig_ServerOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"valid", "port: 53\nforward:\n  rules: [corp.example.com=10.0.0.1]\n", ""},
+		{"missing port", "admin_port: 8080\n", "port: 没有配置 listen 时必须指定"},
+		{"invalid rebind mode", "port: 53\nrebind:\n  mode: block\n", ":3: rebind.mode"},
+		{"invalid ecs", "port: 53\necs:\n  china: somewhere\n", ":3: ecs.china"},
+		{"invalid listener", "listen:\n  - quic://0.0.0.0:53\n", ":1: listen"},
+		{"invalid nftset", "port: 53\nsets:\n  nftset: [/google.com/proxy]\n", ":3: sets.nftset"},
+		{"invalid admin bind", "port: 53\nadmin:\n  bind: router.lan\n", ":3: admin.bind"},
+		{"admin cert without key", "port: 53\nadmin:\n  cert_file: /etc/ssl/admin.pem\n", ":3: admin.cert_file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Load(writeConfig(t, tt.content), defaultFlags())
+			if err != nil {
+				t.Fatal(err)
+			}
+			options, err := c.ServerOptions()
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("ServerOptions() error = %v", err)
+				}
+				if len(options.Listeners) != 2 || len(options.ForwardOptions.Rules) != 1 {
+					t.Errorf("ServerOptions() = %+v", options)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ServerOptions() error = %v, want containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfig_Check(t *testing.T) {
+	dir := t.TempDir()
+	groupsFile := filepath.Join(dir, "groups.json")
+	if err := os.WriteFile(groupsFile, []byte(`[{"name": "kids", "block_rules": ["/[/"]}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	file := writeConfig(t, `port: 53
+hosts:
+  file: `+filepath.Join(dir, "missing-hosts")+`
+  records:
+    - nas.lan A not-an-ip
+blocklist:
+  urls: [ftp://lists.example.com/ads.txt]
+  rules:
+    - "||ads.example.com^"
+    - '/^ad[0-9+\./'
+clients:
+  groups_file: `+groupsFile+`
+  groups:
+    - name: kids
+      block_rules: ["||tracker.example.com^$third-party"]
+`)
+	c, err := Load(file, defaultFlags())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		":4: hosts.records",
+		":3: hosts.file",
+		":7: blocklist.urls",
+		":8: blocklist.rules: 无效的正则表达式规则 /^ad[0-9+\\./",
+		":15: clients.groups[0].block_rules: 分组 kids",
+		":12: clients.groups_file: 分组 kids: 无效的正则表达式规则",
+		"客户端分组名称重复: kids",
+	}
+	errs := c.Check()
+	if len(errs) != len(want) {
+		t.Fatalf("Check() = %v, want %d errors", errs, len(want))
+	}
+	for i, err := range errs {
+		if !strings.Contains(err.Error(), want[i]) {
+			t.Errorf("Check()[%d] = %v, want containing %q", i, err, want[i])
+		}
+	}
+
+	valid, err := Load(writeConfig(t, "port: 53\nblocklist:\n  rules: [\"/^ad[0-9]+\\\\./\"]\n"), defaultFlags())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := valid.Check(); len(errs) != 0 {
+		t.Errorf("Check() = %v, want no errors", errs)
+	}
+}
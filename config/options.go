@@ -0,0 +1,319 @@
+package config
+
+import (
+	"fmt"
+	"go-dns-proxy/acl"
+	"go-dns-proxy/admin"
+	"go-dns-proxy/blocklist"
+	"go-dns-proxy/cache"
+	"go-dns-proxy/clients"
+	"go-dns-proxy/dnssec"
+	"go-dns-proxy/domain"
+	"go-dns-proxy/ecs"
+	"go-dns-proxy/forward"
+	"go-dns-proxy/ipset"
+	"go-dns-proxy/poison"
+	"go-dns-proxy/ratelimit"
+	"go-dns-proxy/rebind"
+	"go-dns-proxy/server"
+	"net"
+	"path/filepath"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Validate 检查配置项的取值范围，错误信息带有配置文件中的行号
+func (c *Config) Validate() error {
+	if _, err := log.ParseLevel(c.LogLevel); err != nil {
+		return c.errorFor("log_level", fmt.Errorf("无效的日志级别: %s", c.LogLevel))
+	}
+	if len(c.Listen) == 0 && (c.Port <= 0 || c.Port > 65535) {
+		return c.errorFor("port", fmt.Errorf("没有配置 listen 时必须指定 1-65535 之间的端口"))
+	}
+	if c.AdminPort <= 0 || c.AdminPort > 65535 {
+		return c.errorFor("admin_port", fmt.Errorf("端口必须在 1-65535 之间"))
+	}
+	if c.Admin.Bind != "" && c.Admin.Bind != "localhost" && net.ParseIP(c.Admin.Bind) == nil {
+		return c.errorFor("admin.bind", fmt.Errorf("需要是 IP 地址或 localhost: %s", c.Admin.Bind))
+	}
+	if c.Admin.SessionTTL < 0 {
+		return c.errorFor("admin.session_ttl", fmt.Errorf("不能小于 0"))
+	}
+	if (c.Admin.CertFile == "") != (c.Admin.KeyFile == "") {
+		return c.errorFor("admin.cert_file", fmt.Errorf("证书和私钥需要同时配置"))
+	}
+	if c.Upstreams.China == "" {
+		return c.errorFor("upstreams.china", fmt.Errorf("不能为空"))
+	}
+	if c.Upstreams.Oversea == "" {
+		return c.errorFor("upstreams.oversea", fmt.Errorf("不能为空"))
+	}
+	if c.Pinyin.Threshold < 0 || c.Pinyin.Threshold > 1 {
+		return c.errorFor("pinyin.threshold", fmt.Errorf("必须在 0-1 之间"))
+	}
+	if c.Cache.MaxTTL > 0 && c.Cache.MinTTL > c.Cache.MaxTTL {
+		return c.errorFor("cache.min_ttl", fmt.Errorf("不能大于 cache.max_ttl"))
+	}
+
+	prefixes := []struct {
+		path   string
+		value  int
+		maxLen int
+	}{
+		{"rate_limit.ipv4_prefix", c.RateLimit.IPv4Prefix, 32},
+		{"rate_limit.ipv6_prefix", c.RateLimit.IPv6Prefix, 128},
+		{"ecs.ipv4_prefix", c.ECS.IPv4Prefix, 32},
+		{"ecs.ipv6_prefix", c.ECS.IPv6Prefix, 128},
+	}
+	for _, p := range prefixes {
+		if p.value < 0 || p.value > p.maxLen {
+			return c.errorFor(p.path, fmt.Errorf("前缀长度必须在 0-%d 之间", p.maxLen))
+		}
+	}
+
+	if _, err := acl.New(c.defaultACL()); err != nil {
+		return c.errorFor("acl", err)
+	}
+	if _, err := rebind.New(rebind.Options{Mode: c.Rebind.Mode}); err != nil {
+		return c.errorFor("rebind.mode", err)
+	}
+	if _, err := poison.New(poison.Options{BogusIPs: c.Poison.BogusIPs, BogusNXDomain: c.Poison.BogusNXDomain}); err != nil {
+		return c.errorFor("poison", err)
+	}
+	if _, err := dnssec.New(dnssec.Options{Enabled: true, TrustAnchors: c.DNSSEC.TrustAnchors}); err != nil {
+		return c.errorFor("dnssec.trust_anchors", err)
+	}
+	return nil
+}
+
+// ServerOptions 检查配置并转换为服务器配置，会读取客户端分组文件
+func (c *Config) ServerOptions() (*server.NewServerOptions, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	clientGroups, err := c.clientGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	// 条件转发
+	var forwardRules []forward.Rule
+	for _, r := range c.Forward.Rules {
+		rule, err := forward.ParseRule(r)
+		if err != nil {
+			return nil, c.errorFor("forward.rules", err)
+		}
+		forwardRules = append(forwardRules, rule)
+	}
+
+	// ipset 和 nftables 集合
+	var setOptions ipset.Options
+	setRules := []struct {
+		path  string
+		kind  string
+		rules []string
+	}{
+		{"sets.ipset", ipset.KindIPSet, c.Sets.IPSet},
+		{"sets.nftset", ipset.KindNFT, c.Sets.NFTSet},
+	}
+	for _, s := range setRules {
+		for _, r := range s.rules {
+			rule, err := ipset.ParseRule(s.kind, r)
+			if err != nil {
+				return nil, c.errorFor(s.path, err)
+			}
+			setOptions.Rules = append(setOptions.Rules, rule)
+		}
+	}
+	overseaSets := []struct {
+		path string
+		kind string
+		sets []string
+	}{
+		{"sets.oversea_ipset", ipset.KindIPSet, c.Sets.OverseaIPSet},
+		{"sets.oversea_nftset", ipset.KindNFT, c.Sets.OverseaNFTSet},
+	}
+	for _, s := range overseaSets {
+		for _, item := range s.sets {
+			sets, err := ipset.ParseSets(s.kind, item)
+			if err != nil {
+				return nil, c.errorFor(s.path, err)
+			}
+			setOptions.OverseaSets = append(setOptions.OverseaSets, sets...)
+		}
+	}
+
+	// 国内和海外上游的 ECS
+	chinaECS, err := ecs.ParseOptions(c.ECS.China)
+	if err != nil {
+		return nil, c.errorFor("ecs.china", err)
+	}
+	overseaECS, err := ecs.ParseOptions(c.ECS.Oversea)
+	if err != nil {
+		return nil, c.errorFor("ecs.oversea", err)
+	}
+	for _, options := range []*ecs.Options{&chinaECS, &overseaECS} {
+		options.IPv4Prefix = c.ECS.IPv4Prefix
+		options.IPv6Prefix = c.ECS.IPv6Prefix
+	}
+
+	if _, err := blocklist.ParseResponse(c.Blocklist.Response); err != nil {
+		return nil, c.errorFor("blocklist.response", err)
+	}
+
+	// 监听器和访问控制
+	defaultACL := c.defaultACL()
+	var listeners []server.ListenerOptions
+	for _, addr := range c.Listen {
+		listener, err := server.ParseListener(addr, defaultACL)
+		if err != nil {
+			return nil, c.errorFor("listen", err)
+		}
+		if _, err := acl.New(listener.ACL); err != nil {
+			return nil, c.errorFor("listen", err)
+		}
+		listeners = append(listeners, listener)
+	}
+	if len(listeners) == 0 {
+		addr := fmt.Sprintf("0.0.0.0:%d", c.Port)
+		listeners = []server.ListenerOptions{
+			{Network: "udp", Addr: addr, ACL: defaultACL},
+			{Network: "tcp", Addr: addr, ACL: defaultACL},
+		}
+	}
+
+	return &server.NewServerOptions{
+		ListenPort:         c.Port,
+		Listeners:          listeners,
+		ChinaServerAddr:    c.Upstreams.China,
+		OverSeaServerAddr:  c.Upstreams.Oversea,
+		DBPath:             c.DBPath(),
+		DataDir:            c.DataDir,
+		ChinaDomainListUrl: c.ChinaDomains.ListURL,
+		PinyinOptions: domain.PinyinOptions{
+			Disabled:  !c.Pinyin.Enabled,
+			Threshold: c.Pinyin.Threshold,
+			Allowlist: c.Pinyin.Allowlist,
+			Denylist:  c.Pinyin.Denylist,
+		},
+		BeianAPIURL: c.Beian.APIURL,
+		BeianAPIKey: c.Beian.APIKey,
+		BeianOptions: domain.BeianOptions{
+			PositiveTTL: c.Beian.PositiveTTL,
+			NegativeTTL: c.Beian.NegativeTTL,
+			Timeout:     c.Beian.Timeout,
+		},
+		ChinaIPListUrl: c.Learning.ChinaIPListURL,
+		LearningOptions: domain.LearnedDomainOptions{
+			Disabled: !c.Learning.Enabled,
+			TTL:      c.Learning.TTL,
+			MinHits:  c.Learning.MinHits,
+		},
+		HostsFile:     c.Hosts.File,
+		StaticRecords: c.Hosts.Records,
+		BlocklistOptions: blocklist.Options{
+			URLs:            c.Blocklist.URLs,
+			Rules:           c.Blocklist.Rules,
+			RefreshInterval: c.Blocklist.Refresh,
+			DataDir:         c.DataDir,
+		},
+		BlockResponse: c.Blocklist.Response,
+		ClientGroups:  clientGroups,
+		RateLimitOptions: ratelimit.Options{
+			QPS:                c.RateLimit.QPS,
+			Burst:              c.RateLimit.Burst,
+			IPv4Prefix:         c.RateLimit.IPv4Prefix,
+			IPv6Prefix:         c.RateLimit.IPv6Prefix,
+			ResponsesPerSecond: c.RateLimit.RRLResponses,
+			Slip:               c.RateLimit.RRLSlip,
+			Exempt:             c.RateLimit.Exempt,
+		},
+		RebindOptions: rebind.Options{
+			Mode:           c.Rebind.Mode,
+			AllowedDomains: c.Rebind.AllowedDomains,
+		},
+		PoisonOptions: poison.Options{
+			Disabled:      !c.Poison.Enabled,
+			BogusIPs:      c.Poison.BogusIPs,
+			BogusNXDomain: c.Poison.BogusNXDomain,
+			MinRTT:        c.Poison.MinRTT,
+		},
+		ForwardOptions: forward.Options{
+			Rules:                forwardRules,
+			LocalServer:          c.Forward.LocalServer,
+			DefaultZonesDisabled: !c.Forward.DefaultZones,
+		},
+		ChinaECS:   chinaECS,
+		OverseaECS: overseaECS,
+		CacheOptions: cache.Options{
+			Size:   c.Cache.Size,
+			MinTTL: c.Cache.MinTTL,
+			MaxTTL: c.Cache.MaxTTL,
+		},
+		DNSSECOptions: dnssec.Options{
+			Enabled:      c.DNSSEC.Enabled,
+			TrustAnchors: c.DNSSEC.TrustAnchors,
+		},
+		IPSetOptions: setOptions,
+	}, nil
+}
+
+// DBPath 返回查询日志、学习域名和管理后台账号所在的数据库
+func (c *Config) DBPath() string {
+	return filepath.Join(c.DataDir, "dns.db")
+}
+
+// AdminAddr 返回管理后台的监听地址，没有配置 admin.bind 时监听所有地址
+func (c *Config) AdminAddr() string {
+	return net.JoinHostPort(c.Admin.Bind, strconv.Itoa(c.AdminPort))
+}
+
+// AdminOptions 返回管理后台的认证和 TLS 配置
+func (c *Config) AdminOptions() admin.Options {
+	return admin.Options{
+		AuthDisabled:   !c.Admin.Auth,
+		SessionTTL:     c.Admin.SessionTTL,
+		AllowedOrigins: c.Admin.AllowedOrigins,
+		TLSDisabled:    !c.Admin.TLS,
+		CertFile:       c.Admin.CertFile,
+		KeyFile:        c.Admin.KeyFile,
+		DataDir:        c.DataDir,
+	}
+}
+
+// AdminURL 返回本机访问管理后台的地址
+func (c *Config) AdminURL() string {
+	scheme := "https"
+	if !c.Admin.TLS {
+		scheme = "http"
+	}
+	host := c.Admin.Bind
+	if host == "" || net.ParseIP(host).IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, strconv.Itoa(c.AdminPort)))
+}
+
+// clientGroups 返回客户端分组，配置文件中的分组在前，然后是分组文件中的分组
+func (c *Config) clientGroups() ([]*clients.Group, error) {
+	groups := append([]*clients.Group(nil), c.Clients.Groups...)
+	if c.Clients.GroupsFile != "" {
+		fileGroups, err := clients.LoadGroups(c.Clients.GroupsFile)
+		if err != nil {
+			return nil, c.errorFor("clients.groups_file", err)
+		}
+		groups = append(groups, fileGroups...)
+	}
+	return groups, nil
+}
+
+// defaultACL 返回监听器默认使用的访问控制
+func (c *Config) defaultACL() acl.Options {
+	return acl.Options{
+		Allow:  c.ACL.Allow,
+		Deny:   c.ACL.Deny,
+		Action: c.ACL.Action,
+	}
+}
@@ -0,0 +1,842 @@
+package dnssec
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// 验证结果
+const (
+	// StatusSecure 签名验证通过
+	StatusSecure = "secure"
+	// StatusInsecure 域名所在的区域没有签名
+	StatusInsecure = "insecure"
+	// StatusBogus 签名验证失败或者缺少应有的签名
+	StatusBogus = "bogus"
+)
+
+// RootTrustAnchors 内置的根区域信任锚，KSK-2017 和 KSK-2024 的 DS 记录
+var RootTrustAnchors = []string{
+	". 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// udpPayloadSize 添加 OPT 记录时声明的 UDP 负载大小
+const udpPayloadSize = 1232
+
+// maxCacheTTL 密钥和 DS 记录的最长缓存时间
+const maxCacheTTL = time.Hour
+
+// maxCacheEntries 缓存的区域数超过该值时清空缓存
+const maxCacheEntries = 10000
+
+// Resolver 用于查询 DNSKEY 和 DS 记录的上游 DNS
+type Resolver interface {
+	Request(ctx context.Context, m dnsmessage.Message) ([]byte, error)
+}
+
+// Options DNSSEC 验证配置
+type Options struct {
+	// Enabled 验证上游应答的签名
+	Enabled bool
+	// TrustAnchors 信任锚，DS 记录格式，例如 ". 20326 8 2 E06D...8C8D"，为空时使用内置的根区域信任锚
+	TrustAnchors []string
+}
+
+// Result 验证结果
+type Result struct {
+	Status string
+	Reason string
+}
+
+// String 返回验证结果，验证失败时包含原因，例如 bogus:签名已过期
+func (r Result) String() string {
+	if r.Status == StatusBogus && r.Reason != "" {
+		return r.Status + ":" + r.Reason
+	}
+	return r.Status
+}
+
+// zoneKeys 区域经过验证的密钥，insecure 表示区域没有签名
+type zoneKeys struct {
+	keys     []*dnskey
+	insecure bool
+	expires  time.Time
+}
+
+// delegation DS 查询的验证结果
+type delegation struct {
+	ds []*ds
+	// cut 表示域名是委派点
+	cut bool
+	// insecure 表示上级区域没有签名，或者 NSEC3 Opt-Out 覆盖了该域名
+	insecure bool
+	expires  time.Time
+}
+
+// Validator 从信任锚开始逐级验证 DNSKEY、DS 和 RRSIG
+type Validator struct {
+	anchors     map[string][]*ds
+	mu          sync.Mutex
+	keys        map[string]*zoneKeys
+	delegations map[string]*delegation
+	now         func() time.Time
+}
+
+// New 创建 DNSSEC 验证，没有启用时返回 nil
+func New(options Options) (*Validator, error) {
+	if !options.Enabled {
+		return nil, nil
+	}
+
+	trustAnchors := options.TrustAnchors
+	if len(trustAnchors) == 0 {
+		trustAnchors = RootTrustAnchors
+	}
+	anchors := make(map[string][]*ds)
+	for _, s := range trustAnchors {
+		zone, anchor, err := parseTrustAnchor(s)
+		if err != nil {
+			return nil, err
+		}
+		anchors[zone] = append(anchors[zone], anchor)
+	}
+	if _, ok := anchors["."]; !ok {
+		return nil, errors.New("缺少根区域的信任锚")
+	}
+
+	return &Validator{
+		anchors:     anchors,
+		keys:        make(map[string]*zoneKeys),
+		delegations: make(map[string]*delegation),
+		now:         time.Now,
+	}, nil
+}
+
+// parseTrustAnchor 解析 DS 记录格式的信任锚，例如 ". IN DS 20326 8 2 E06D...8C8D"
+func parseTrustAnchor(s string) (string, *ds, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 7 && strings.EqualFold(fields[1], "IN") && strings.EqualFold(fields[2], "DS") {
+		fields = append(fields[:1], fields[3:]...)
+	}
+	if len(fields) != 5 {
+		return "", nil, fmt.Errorf("无效的信任锚: %s，格式为 zone keytag algorithm digesttype digest", s)
+	}
+
+	invalid := fmt.Errorf("无效的信任锚: %s", s)
+	keyTag, err := strconv.ParseUint(fields[1], 10, 16)
+	if err != nil {
+		return "", nil, invalid
+	}
+	algorithm, err := strconv.ParseUint(fields[2], 10, 8)
+	if err != nil {
+		return "", nil, invalid
+	}
+	digestType, err := strconv.ParseUint(fields[3], 10, 8)
+	if err != nil {
+		return "", nil, invalid
+	}
+	digest, err := hex.DecodeString(fields[4])
+	if err != nil {
+		return "", nil, invalid
+	}
+	return canonicalName(fields[0]), &ds{
+		keyTag:     uint16(keyTag),
+		algorithm:  uint8(algorithm),
+		digestType: uint8(digestType),
+		digest:     digest,
+	}, nil
+}
+
+// PrepareQuery 设置发往上游的查询的 DO 和 CD 标志，让上游返回签名且不替我们丢弃验证失败的应答。
+// 附加记录会被复制，不影响原来的消息
+func (v *Validator) PrepareQuery(msg *dnsmessage.Message) {
+	if v == nil {
+		return
+	}
+	msg.Header.CheckingDisabled = true
+	setDO(msg)
+}
+
+// setDO 设置 OPT 记录的 DO 标志，没有 OPT 记录时添加
+func setDO(msg *dnsmessage.Message) {
+	additionals := make([]dnsmessage.Resource, 0, len(msg.Additionals)+1)
+	found := false
+	for _, rr := range msg.Additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT {
+			rr.Header.TTL |= 0x8000
+			found = true
+		}
+		additionals = append(additionals, rr)
+	}
+	if !found {
+		var header dnsmessage.ResourceHeader
+		header.SetEDNS0(udpPayloadSize, dnsmessage.RCodeSuccess, true)
+		additionals = append(additionals, dnsmessage.Resource{Header: header, Body: &dnsmessage.OPTResource{}})
+	}
+	msg.Additionals = additionals
+}
+
+// DNSSECOK 判断查询是否设置了 DO 标志
+func DNSSECOK(msg *dnsmessage.Message) bool {
+	for _, rr := range msg.Additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT {
+			return rr.Header.DNSSECAllowed()
+		}
+	}
+	return false
+}
+
+// StripRecords 删除应答中的 RRSIG、NSEC 和 NSEC3 记录，用于没有设置 DO 标志的客户端。
+// 查询的类型本身是这些类型时保留
+func StripRecords(msg *dnsmessage.Message, qtype dnsmessage.Type) {
+	strip := func(section []dnsmessage.Resource) []dnsmessage.Resource {
+		var result []dnsmessage.Resource
+		for _, rr := range section {
+			switch rr.Header.Type {
+			case TypeRRSIG, TypeNSEC, TypeNSEC3:
+				if rr.Header.Type != qtype {
+					continue
+				}
+			}
+			result = append(result, rr)
+		}
+		return result
+	}
+	msg.Answers = strip(msg.Answers)
+	msg.Authorities = strip(msg.Authorities)
+}
+
+// Validate 验证上游的应答，r 为返回该应答的上游，用于查询 DNSKEY 和 DS 记录。
+// 上游返回 SERVFAIL 等错误时不验证，返回空的结果
+func (v *Validator) Validate(ctx context.Context, r Resolver, msg *dnsmessage.Message) Result {
+	if v == nil || len(msg.Questions) == 0 ||
+		(msg.Header.RCode != dnsmessage.RCodeSuccess && msg.Header.RCode != dnsmessage.RCodeNameError) {
+		return Result{}
+	}
+
+	status, err := v.validate(ctx, r, msg)
+	if err != nil {
+		return Result{Status: StatusBogus, Reason: err.Error()}
+	}
+	return Result{Status: status}
+}
+
+func (v *Validator) validate(ctx context.Context, r Resolver, msg *dnsmessage.Message) (string, error) {
+	status := StatusSecure
+	answers := groupRRsets(msg.Answers)
+	authorities := groupRRsets(msg.Authorities)
+
+	var denials []*rrset
+	for i, set := range append(append([]*rrset{}, answers...), authorities...) {
+		// 授权部分只验证否定应答使用的记录
+		if i >= len(answers) && set.typ != dnsmessage.TypeSOA && set.typ != TypeNSEC && set.typ != TypeNSEC3 {
+			continue
+		}
+		secure, err := v.verify(ctx, r, set)
+		if err != nil {
+			return "", err
+		}
+		if !secure {
+			status = StatusInsecure
+			continue
+		}
+		if set.typ == TypeNSEC || set.typ == TypeNSEC3 {
+			denials = append(denials, set)
+		}
+	}
+	if status != StatusSecure {
+		return status, nil
+	}
+
+	// 通配符展开的记录必须有证明没有更接近匹配的域名的 NSEC 或 NSEC3 记录（RFC 4035 第 5.3.4 节）
+	for _, set := range answers {
+		if set.wildcard == "" {
+			continue
+		}
+		insecure, err := checkWildcard(set.name, set.wildcard, denials)
+		if err != nil {
+			return "", err
+		}
+		if insecure {
+			status = StatusInsecure
+		}
+	}
+	if status != StatusSecure {
+		return status, nil
+	}
+
+	// 沿着 CNAME 找到最终的域名，没有对应类型的记录时必须有证明记录不存在的 NSEC 或 NSEC3
+	question := msg.Questions[0]
+	name := canonicalName(question.Name.String())
+	for i := 0; i < 8 && question.Type != dnsmessage.TypeCNAME; i++ {
+		set := findRRset(answers, name, dnsmessage.TypeCNAME)
+		if set == nil {
+			break
+		}
+		name = canonicalName(set.records[0].Body.(*dnsmessage.CNAMEResource).CNAME.String())
+	}
+	if findRRset(answers, name, question.Type) != nil {
+		return StatusSecure, nil
+	}
+
+	if len(denials) == 0 {
+		insecure, err := v.provenInsecure(ctx, r, name)
+		if err != nil {
+			return "", err
+		}
+		if !insecure {
+			return "", fmt.Errorf("%s 缺少否定应答的证明", name)
+		}
+		return StatusInsecure, nil
+	}
+	d, err := checkDenial(name, question.Type, msg.Header.RCode == dnsmessage.RCodeNameError, denials)
+	if err != nil {
+		return "", err
+	}
+	if d.optOut {
+		return StatusInsecure, nil
+	}
+	return StatusSecure, nil
+}
+
+// verify 验证记录集的签名，没有签名时证明记录所在的区域不安全，返回记录是否安全
+func (v *Validator) verify(ctx context.Context, r Resolver, set *rrset) (bool, error) {
+	if len(set.sigs) == 0 {
+		insecure, err := v.provenInsecure(ctx, r, set.name)
+		if err != nil {
+			return false, err
+		}
+		if !insecure {
+			return false, fmt.Errorf("%s %s 缺少签名", set.name, typeString(set.typ))
+		}
+		return false, nil
+	}
+	return v.verifySigned(ctx, r, set)
+}
+
+// verifySigned 使用签名者区域的密钥验证记录集，签名者区域不安全时返回 false
+func (v *Validator) verifySigned(ctx context.Context, r Resolver, set *rrset) (bool, error) {
+	signer := set.sigs[0].signerName
+	if !isSubdomain(set.name, signer) {
+		return false, fmt.Errorf("%s %s 的签名者 %s 不是上级区域", set.name, typeString(set.typ), signer)
+	}
+	keys, err := v.zoneKeys(ctx, r, signer)
+	if err != nil {
+		return false, err
+	}
+	if keys.insecure {
+		return false, nil
+	}
+	return true, v.verifyRRset(set, signer, keys.keys)
+}
+
+// verifyRRset 使用区域的密钥验证记录集，任意一个签名验证通过即可
+func (v *Validator) verifyRRset(set *rrset, zone string, keys []*dnskey) error {
+	now := uint32(v.now().Unix())
+	err := fmt.Errorf("%s %s 没有可用的签名", set.name, typeString(set.typ))
+	for _, sig := range set.sigs {
+		if sig.signerName != zone || int(sig.labels) > len(nameLabels(set.name)) {
+			continue
+		}
+		if !sig.validAt(now) {
+			err = fmt.Errorf("%s %s 的签名已过期或尚未生效", set.name, typeString(set.typ))
+			continue
+		}
+		data, dataErr := signedData(set, sig)
+		if dataErr != nil {
+			err = dataErr
+			continue
+		}
+		for _, key := range keys {
+			if key.keyTag() != sig.keyTag || key.algorithm != sig.algorithm ||
+				key.protocol != 3 || key.flags&dnskeyZoneFlag == 0 {
+				continue
+			}
+			if verifyErr := verifySignature(key, data, sig.signature); verifyErr != nil {
+				err = fmt.Errorf("%s %s 的签名错误: %v", set.name, typeString(set.typ), verifyErr)
+				continue
+			}
+			set.wildcard = wildcardEncloser(set.name, sig)
+			return nil
+		}
+	}
+	return err
+}
+
+// zoneKeys 返回区域经过验证的密钥：先验证上级区域的 DS 记录，再用 DS 验证区域的 DNSKEY
+func (v *Validator) zoneKeys(ctx context.Context, r Resolver, zone string) (*zoneKeys, error) {
+	now := v.now()
+	v.mu.Lock()
+	cached, ok := v.keys[zone]
+	v.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached, nil
+	}
+
+	dsRecords, trusted := v.anchors[zone]
+	expires := now.Add(maxCacheTTL)
+	if !trusted {
+		if zone == "." {
+			return nil, errors.New("缺少根区域的信任锚")
+		}
+		d, err := v.delegation(ctx, r, zone)
+		if err != nil {
+			return nil, err
+		}
+		if d.insecure || (d.cut && len(d.ds) == 0) {
+			return v.storeKeys(zone, &zoneKeys{insecure: true, expires: d.expires}), nil
+		}
+		if !d.cut {
+			return nil, fmt.Errorf("签名者 %s 不是区域顶点", zone)
+		}
+		dsRecords, expires = d.ds, d.expires
+	}
+
+	// 只使用支持的算法，全部不支持时视为没有签名（RFC 4035 第 5.2 节）
+	var supported []*ds
+	for _, d := range dsRecords {
+		if d.supported() {
+			supported = append(supported, d)
+		}
+	}
+	if len(supported) == 0 {
+		return v.storeKeys(zone, &zoneKeys{insecure: true, expires: expires}), nil
+	}
+
+	msg, err := v.query(ctx, r, zone, TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	set := findRRset(groupRRsets(msg.Answers), zone, TypeDNSKEY)
+	if set == nil {
+		return nil, fmt.Errorf("%s 没有 DNSKEY 记录", zone)
+	}
+
+	var keys, trustedKeys []*dnskey
+	for _, rr := range set.records {
+		key, err := parseDNSKEY(unknownData(rr))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		for _, d := range supported {
+			if d.matches(zone, key) {
+				trustedKeys = append(trustedKeys, key)
+				break
+			}
+		}
+	}
+	if len(trustedKeys) == 0 {
+		return nil, fmt.Errorf("%s 的 DNSKEY 与 DS 记录不匹配", zone)
+	}
+	if err := v.verifyRRset(set, zone, trustedKeys); err != nil {
+		return nil, err
+	}
+
+	if ttlExpires := now.Add(cacheTTL(set.ttl)); ttlExpires.Before(expires) {
+		expires = ttlExpires
+	}
+	return v.storeKeys(zone, &zoneKeys{keys: keys, expires: expires}), nil
+}
+
+// delegation 查询并验证域名的 DS 记录，没有 DS 时使用上级区域的 NSEC 或 NSEC3 证明
+func (v *Validator) delegation(ctx context.Context, r Resolver, name string) (*delegation, error) {
+	now := v.now()
+	v.mu.Lock()
+	cached, ok := v.delegations[name]
+	v.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached, nil
+	}
+
+	msg, err := v.query(ctx, r, name, TypeDS)
+	if err != nil {
+		return nil, err
+	}
+
+	if set := findRRset(groupRRsets(msg.Answers), name, TypeDS); set != nil {
+		if len(set.sigs) == 0 || set.sigs[0].signerName == name {
+			return nil, fmt.Errorf("%s 的 DS 记录缺少上级区域的签名", name)
+		}
+		secure, err := v.verifySigned(ctx, r, set)
+		if err != nil {
+			return nil, err
+		}
+		d := &delegation{cut: true, insecure: !secure, expires: now.Add(cacheTTL(set.ttl))}
+		for _, rr := range set.records {
+			record, err := parseDS(unknownData(rr))
+			if err != nil {
+				return nil, err
+			}
+			d.ds = append(d.ds, record)
+		}
+		return v.storeDelegation(name, d), nil
+	}
+
+	// 否定应答，必须由上级区域签名
+	ttl := uint32(60)
+	var denials []*rrset
+	for _, set := range groupRRsets(msg.Authorities) {
+		if set.typ != TypeNSEC && set.typ != TypeNSEC3 {
+			continue
+		}
+		if len(set.sigs) == 0 || set.sigs[0].signerName == name {
+			denials = nil
+			break
+		}
+		secure, err := v.verifySigned(ctx, r, set)
+		if err != nil {
+			return nil, err
+		}
+		if !secure {
+			return v.storeDelegation(name, &delegation{insecure: true, expires: now.Add(cacheTTL(set.ttl))}), nil
+		}
+		denials = append(denials, set)
+		if set.ttl < ttl {
+			ttl = set.ttl
+		}
+	}
+
+	if len(denials) == 0 {
+		// 没有签名的否定应答，只有上级区域不安全时才可以接受
+		insecure, err := v.provenInsecure(ctx, r, parentName(name))
+		if err != nil {
+			return nil, err
+		}
+		if !insecure {
+			return nil, fmt.Errorf("%s 的 DS 否定应答缺少签名", name)
+		}
+		return v.storeDelegation(name, &delegation{insecure: true, expires: now.Add(cacheTTL(ttl))}), nil
+	}
+
+	d, err := checkDenial(name, TypeDS, msg.Header.RCode == dnsmessage.RCodeNameError, denials)
+	if err != nil {
+		return nil, err
+	}
+	return v.storeDelegation(name, &delegation{
+		cut:      d.delegation,
+		insecure: d.optOut,
+		expires:  now.Add(cacheTTL(ttl)),
+	}), nil
+}
+
+// provenInsecure 从顶级域名开始逐级查询 DS 记录，判断域名是否位于没有签名的区域中
+func (v *Validator) provenInsecure(ctx context.Context, r Resolver, name string) (bool, error) {
+	labels := nameLabels(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		zone := strings.Join(labels[i:], ".") + "."
+		if _, ok := v.anchors[zone]; ok {
+			continue
+		}
+		d, err := v.delegation(ctx, r, zone)
+		if err != nil {
+			return false, err
+		}
+		if d.insecure || (d.cut && len(d.ds) == 0) {
+			return true, nil
+		}
+		if len(d.ds) > 0 {
+			supported := false
+			for _, record := range d.ds {
+				supported = supported || record.supported()
+			}
+			if !supported {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// denial 否定应答证明的结果
+type denial struct {
+	// exists 域名存在，只是没有查询的类型
+	exists bool
+	// delegation 域名是委派点
+	delegation bool
+	// optOut 域名被 NSEC3 Opt-Out 覆盖，可能是没有签名的委派
+	optOut bool
+}
+
+// checkDenial 检查 NSEC 或 NSEC3 记录是否证明域名没有 qtype 类型的记录。
+// 不检查通配符，NSEC3 只检查覆盖域名本身哈希的记录
+func checkDenial(name string, qtype dnsmessage.Type, nxdomain bool, sets []*rrset) (denial, error) {
+	matched := func(types typeBitmap) (denial, error) {
+		if nxdomain {
+			return denial{}, fmt.Errorf("%s 存在，与 NXDOMAIN 应答不符", name)
+		}
+		if types[qtype] || types[dnsmessage.TypeCNAME] {
+			return denial{}, fmt.Errorf("NSEC 记录显示 %s 存在 %s 记录", name, typeString(qtype))
+		}
+		return denial{
+			exists:     true,
+			delegation: types[dnsmessage.TypeNS] && !types[dnsmessage.TypeSOA],
+		}, nil
+	}
+
+	var covered *nsec3
+	for _, set := range sets {
+		for _, rr := range set.records {
+			switch set.typ {
+			case TypeNSEC:
+				n, err := parseNSEC(unknownData(rr))
+				if err != nil {
+					return denial{}, err
+				}
+				if set.name == name {
+					return matched(n.types)
+				}
+				if covers(set.name, n.next, name) {
+					return denial{}, nil
+				}
+
+			case TypeNSEC3:
+				n, err := parseNSEC3(unknownData(rr))
+				if err != nil {
+					return denial{}, err
+				}
+				labels := nameLabels(set.name)
+				if n.hashAlgorithm != 1 || len(labels) == 0 || !isSubdomain(name, parentName(set.name)) {
+					continue
+				}
+				if n.iterations > maxNSEC3Iterations {
+					return denial{optOut: true}, nil
+				}
+				owner, err := nsec3Encoding.DecodeString(strings.ToUpper(labels[0]))
+				if err != nil {
+					continue
+				}
+				hash := n.hash(name)
+				if bytes.Equal(hash, owner) {
+					return matched(n.types)
+				}
+				if coversHash(owner, n.next, hash) {
+					covered = n
+				}
+			}
+		}
+	}
+	if covered != nil {
+		optOut := covered.flags&nsec3OptOutFlag != 0
+		return denial{delegation: optOut, optOut: optOut}, nil
+	}
+	return denial{}, fmt.Errorf("没有证明 %s %s 不存在的 NSEC 或 NSEC3 记录", name, typeString(qtype))
+}
+
+// wildcardEncloser 记录集由通配符展开时返回通配符所在的域名，否则返回空字符串
+func wildcardEncloser(name string, sig *rrsig) string {
+	labels := nameLabels(name)
+	if len(labels) > 0 && labels[0] == "*" {
+		labels = labels[1:]
+	}
+	if int(sig.labels) >= len(labels) {
+		return ""
+	}
+	return strings.Join(labels[len(labels)-int(sig.labels):], ".") + "."
+}
+
+// checkWildcard 检查 NSEC 或 NSEC3 记录是否证明 name 不存在，只能由 encloser 下的通配符展开。
+// NSEC 需要覆盖 name，NSEC3 需要覆盖比 encloser 多一级的域名。NSEC3 迭代次数过多时返回不安全
+func checkWildcard(name, encloser string, sets []*rrset) (bool, error) {
+	labels := nameLabels(name)
+	nextCloser := strings.Join(labels[len(labels)-len(nameLabels(encloser))-1:], ".") + "."
+
+	for _, set := range sets {
+		for _, rr := range set.records {
+			switch set.typ {
+			case TypeNSEC:
+				n, err := parseNSEC(unknownData(rr))
+				if err != nil {
+					return false, err
+				}
+				if covers(set.name, n.next, name) {
+					return false, nil
+				}
+
+			case TypeNSEC3:
+				n, err := parseNSEC3(unknownData(rr))
+				if err != nil {
+					return false, err
+				}
+				ownerLabels := nameLabels(set.name)
+				if n.hashAlgorithm != 1 || len(ownerLabels) == 0 || !isSubdomain(name, parentName(set.name)) {
+					continue
+				}
+				if n.iterations > maxNSEC3Iterations {
+					return true, nil
+				}
+				owner, err := nsec3Encoding.DecodeString(strings.ToUpper(ownerLabels[0]))
+				if err != nil {
+					continue
+				}
+				if coversHash(owner, n.next, n.hash(nextCloser)) {
+					return false, nil
+				}
+			}
+		}
+	}
+	return false, fmt.Errorf("%s 由通配符展开，缺少证明没有更接近匹配的 NSEC 或 NSEC3 记录", name)
+}
+
+// query 向上游查询 DNSSEC 记录
+func (v *Validator) query(ctx context.Context, r Resolver, name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: uint16(rand.Intn(65536)), RecursionDesired: true, CheckingDisabled: true},
+		Questions: []dnsmessage.Question{{
+			Name:  qname,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	setDO(&msg)
+
+	data, err := r.Request(ctx, msg)
+	if err != nil {
+		return nil, fmt.Errorf("查询 %s %s 失败: %v", name, typeString(qtype), err)
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(data); err != nil {
+		return nil, fmt.Errorf("解析 %s %s 的应答失败: %v", name, typeString(qtype), err)
+	}
+	if resp.Header.RCode != dnsmessage.RCodeSuccess && resp.Header.RCode != dnsmessage.RCodeNameError {
+		return nil, fmt.Errorf("查询 %s %s 失败: %v", name, typeString(qtype), resp.Header.RCode)
+	}
+	return &resp, nil
+}
+
+func (v *Validator) storeKeys(zone string, keys *zoneKeys) *zoneKeys {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.keys) >= maxCacheEntries {
+		v.keys = make(map[string]*zoneKeys)
+	}
+	v.keys[zone] = keys
+	return keys
+}
+
+func (v *Validator) storeDelegation(name string, d *delegation) *delegation {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.delegations) >= maxCacheEntries {
+		v.delegations = make(map[string]*delegation)
+	}
+	v.delegations[name] = d
+	return d
+}
+
+func cacheTTL(ttl uint32) time.Duration {
+	if d := time.Duration(ttl) * time.Second; d < maxCacheTTL {
+		return d
+	}
+	return maxCacheTTL
+}
+
+// rrset 名称、类型和类别相同的一组记录及其签名
+type rrset struct {
+	name    string
+	typ     dnsmessage.Type
+	class   dnsmessage.Class
+	ttl     uint32
+	records []dnsmessage.Resource
+	sigs    []*rrsig
+	// wildcard 验证通过的签名表明记录由通配符展开时，为通配符所在的域名
+	wildcard string
+}
+
+type rrsetKey struct {
+	name string
+	typ  dnsmessage.Type
+}
+
+// groupRRsets 将记录按名称和类型分组，并把 RRSIG 记录关联到对应的记录集
+func groupRRsets(section []dnsmessage.Resource) []*rrset {
+	var sets []*rrset
+	index := make(map[rrsetKey]*rrset)
+	type ownedSig struct {
+		name string
+		sig  *rrsig
+	}
+	var sigs []ownedSig
+
+	for _, rr := range section {
+		name := canonicalName(rr.Header.Name.String())
+		switch rr.Header.Type {
+		case dnsmessage.TypeOPT:
+			continue
+		case TypeRRSIG:
+			sig, err := parseRRSIG(unknownData(rr))
+			if err == nil {
+				sigs = append(sigs, ownedSig{name, sig})
+			}
+			continue
+		}
+
+		key := rrsetKey{name, rr.Header.Type}
+		set, ok := index[key]
+		if !ok {
+			set = &rrset{name: name, typ: rr.Header.Type, class: rr.Header.Class, ttl: rr.Header.TTL}
+			index[key] = set
+			sets = append(sets, set)
+		}
+		set.records = append(set.records, rr)
+		if rr.Header.TTL < set.ttl {
+			set.ttl = rr.Header.TTL
+		}
+	}
+
+	for _, s := range sigs {
+		if set, ok := index[rrsetKey{s.name, s.sig.typeCovered}]; ok {
+			set.sigs = append(set.sigs, s.sig)
+		}
+	}
+	return sets
+}
+
+func findRRset(sets []*rrset, name string, typ dnsmessage.Type) *rrset {
+	for _, set := range sets {
+		if set.name == name && set.typ == typ {
+			return set
+		}
+	}
+	return nil
+}
+
+// unknownData 返回 dnsmessage 未解析的记录数据
+func unknownData(rr dnsmessage.Resource) []byte {
+	if body, ok := rr.Body.(*dnsmessage.UnknownResource); ok {
+		return body.Data
+	}
+	return nil
+}
+
+// typeString 返回记录类型的名称，例如 A、DNSKEY
+func typeString(t dnsmessage.Type) string {
+	switch t {
+	case TypeDS:
+		return "DS"
+	case TypeRRSIG:
+		return "RRSIG"
+	case TypeNSEC:
+		return "NSEC"
+	case TypeDNSKEY:
+		return "DNSKEY"
+	case TypeNSEC3:
+		return "NSEC3"
+	}
+	return strings.TrimPrefix(t.String(), "Type")
+}
@@ -0,0 +1,336 @@
+package dnssec
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testZone 测试使用的签名区域
+type testZone struct {
+	name string
+	key  *ecdsa.PrivateKey
+	rr   dnsmessage.Resource
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdata := []byte{0x01, 0x01, 3, algECDSAP256SHA256}
+	rdata = append(rdata, key.X.FillBytes(make([]byte, 32))...)
+	rdata = append(rdata, key.Y.FillBytes(make([]byte, 32))...)
+	return &testZone{name: name, key: key, rr: resource(name, TypeDNSKEY, rdata)}
+}
+
+func (z *testZone) dnskey() *dnskey {
+	key, _ := parseDNSKEY(unknownData(z.rr))
+	return key
+}
+
+// ds 返回区域密钥的 DS 记录
+func (z *testZone) ds() dnsmessage.Resource {
+	key := z.dnskey()
+	h := sha256.New()
+	h.Write(nameWire(z.name))
+	h.Write(key.rdata)
+	rdata := make([]byte, 4)
+	binary.BigEndian.PutUint16(rdata, key.keyTag())
+	rdata[2], rdata[3] = algECDSAP256SHA256, digestSHA256
+	return resource(z.name, TypeDS, append(rdata, h.Sum(nil)...))
+}
+
+// anchor 返回区域密钥的信任锚
+func (z *testZone) anchor() string {
+	rdata := unknownData(z.ds())
+	return fmt.Sprintf("%s %d %d %d %s", z.name, binary.BigEndian.Uint16(rdata), rdata[2], rdata[3], hex.EncodeToString(rdata[4:]))
+}
+
+// sign 返回记录集的 RRSIG 记录
+func (z *testZone) sign(t *testing.T, records ...dnsmessage.Resource) dnsmessage.Resource {
+	t.Helper()
+	set := groupRRsets(records)[0]
+
+	now := uint32(time.Now().Unix())
+	rdata := make([]byte, 18)
+	binary.BigEndian.PutUint16(rdata, uint16(set.typ))
+	rdata[2] = algECDSAP256SHA256
+	labels := nameLabels(set.name)
+	if len(labels) > 0 && labels[0] == "*" {
+		labels = labels[1:]
+	}
+	rdata[3] = byte(len(labels))
+	binary.BigEndian.PutUint32(rdata[4:], set.ttl)
+	binary.BigEndian.PutUint32(rdata[8:], now+3600)
+	binary.BigEndian.PutUint32(rdata[12:], now-3600)
+	binary.BigEndian.PutUint16(rdata[16:], z.dnskey().keyTag())
+	rdata = append(rdata, nameWire(z.name)...)
+
+	sig, err := parseRRSIG(rdata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := signedData(set, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(data)
+	r, s, err := ecdsa.Sign(rand.Reader, z.key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdata = append(rdata, r.FillBytes(make([]byte, 32))...)
+	rdata = append(rdata, s.FillBytes(make([]byte, 32))...)
+	return resource(set.name, TypeRRSIG, rdata)
+}
+
+// signed 返回记录集及其签名
+func (z *testZone) signed(t *testing.T, records ...dnsmessage.Resource) []dnsmessage.Resource {
+	return append(records, z.sign(t, records...))
+}
+
+func resource(name string, typ dnsmessage.Type, data []byte) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   &dnsmessage.UnknownResource{Type: typ, Data: data},
+	}
+}
+
+func aRecord(name, ip string) dnsmessage.Resource {
+	var a [4]byte
+	copy(a[:], net.ParseIP(ip).To4())
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   &dnsmessage.AResource{A: a},
+	}
+}
+
+func soaRecord(zone string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(zone), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 300},
+		Body: &dnsmessage.SOAResource{
+			NS:      dnsmessage.MustNewName("ns." + zone),
+			MBox:    dnsmessage.MustNewName("hostmaster." + zone),
+			Serial:  1,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			MinTTL:  300,
+		},
+	}
+}
+
+func nsecRecord(name, next string, types ...dnsmessage.Type) dnsmessage.Resource {
+	bitmap := make([]byte, 32)
+	length := 0
+	for _, typ := range types {
+		bitmap[typ/8] |= 0x80 >> (typ % 8)
+		if int(typ/8)+1 > length {
+			length = int(typ/8) + 1
+		}
+	}
+	rdata := append(nameWire(next), 0, byte(length))
+	return resource(name, TypeNSEC, append(rdata, bitmap[:length]...))
+}
+
+// fakeResolver 按问题返回预先构造的应答
+type fakeResolver map[rrsetKey]*dnsmessage.Message
+
+func (f fakeResolver) Request(ctx context.Context, m dnsmessage.Message) ([]byte, error) {
+	q := m.Questions[0]
+	resp, ok := f[rrsetKey{canonicalName(q.Name.String()), q.Type}]
+	if !ok {
+		return nil, fmt.Errorf("unexpected query %s %v", q.Name, q.Type)
+	}
+	resp.Header.ID = m.Header.ID
+	resp.Header.Response = true
+	resp.Questions = m.Questions
+	return resp.Pack()
+}
+
+func TestValidator_Validate(t *testing.T) {
+	root := newTestZone(t, ".")
+	example := newTestZone(t, "example.")
+
+	resolver := fakeResolver{
+		{".", TypeDNSKEY}:        {Answers: root.signed(t, root.rr)},
+		{"example.", TypeDS}:     {Answers: root.signed(t, example.ds())},
+		{"example.", TypeDNSKEY}: {Answers: example.signed(t, example.rr)},
+		{"www.example.", TypeDS}: {Authorities: example.signed(t,
+			nsecRecord("www.example.", "example.", dnsmessage.TypeA, TypeRRSIG, TypeNSEC))},
+		{"missing.example.", TypeDS}: {
+			Header: dnsmessage.Header{RCode: dnsmessage.RCodeNameError},
+			Authorities: example.signed(t,
+				nsecRecord("example.", "www.example.", dnsmessage.TypeSOA, dnsmessage.TypeNS, TypeRRSIG, TypeNSEC, TypeDNSKEY)),
+		},
+		// insecure. 是没有 DS 的委派
+		{"insecure.", TypeDS}: {Authorities: root.signed(t,
+			nsecRecord("insecure.", ".", dnsmessage.TypeNS, TypeRRSIG, TypeNSEC))},
+	}
+
+	tampered := example.signed(t, aRecord("www.example.", "93.184.216.34"))
+	tampered[0] = aRecord("www.example.", "198.51.100.1")
+
+	// www.example. 不是委派，不能用自己的密钥签名
+	forged := newTestZone(t, "www.example.")
+
+	// 由 *.example. 展开的 foo.example.
+	wildcard := func() []dnsmessage.Resource {
+		records := example.signed(t, aRecord("*.example.", "93.184.216.34"))
+		for i := range records {
+			records[i].Header.Name = dnsmessage.MustNewName("foo.example.")
+		}
+		return records
+	}
+
+	tests := []struct {
+		name  string
+		msg   dnsmessage.Message
+		rcode dnsmessage.RCode
+		want  string
+	}{
+		{
+			name: "secure",
+			msg:  dnsmessage.Message{Answers: example.signed(t, aRecord("www.example.", "93.184.216.34"))},
+			want: StatusSecure,
+		},
+		{
+			name: "tampered answer",
+			msg:  dnsmessage.Message{Answers: tampered},
+			want: StatusBogus,
+		},
+		{
+			name: "missing signature",
+			msg:  dnsmessage.Message{Answers: []dnsmessage.Resource{aRecord("www.example.", "93.184.216.34")}},
+			want: StatusBogus,
+		},
+		{
+			name: "signer is not a zone apex",
+			msg:  dnsmessage.Message{Answers: forged.signed(t, aRecord("www.example.", "93.184.216.34"))},
+			want: StatusBogus,
+		},
+		{
+			name: "wildcard with nsec",
+			msg: dnsmessage.Message{
+				Answers:     wildcard(),
+				Authorities: example.signed(t, nsecRecord("example.", "www.example.", dnsmessage.TypeSOA, dnsmessage.TypeNS, TypeRRSIG, TypeNSEC, TypeDNSKEY)),
+			},
+			want: StatusSecure,
+		},
+		{
+			name: "wildcard without proof",
+			msg:  dnsmessage.Message{Answers: wildcard()},
+			want: StatusBogus,
+		},
+		{
+			name: "unsigned zone",
+			msg:  dnsmessage.Message{Answers: []dnsmessage.Resource{aRecord("www.insecure.", "93.184.216.34")}},
+			want: StatusInsecure,
+		},
+		{
+			name: "nxdomain with nsec",
+			msg: dnsmessage.Message{Authorities: append(
+				example.signed(t, soaRecord("example.")),
+				example.signed(t, nsecRecord("example.", "www.example.", dnsmessage.TypeSOA, dnsmessage.TypeNS, TypeRRSIG, TypeNSEC, TypeDNSKEY))...,
+			)},
+			rcode: dnsmessage.RCodeNameError,
+			want:  StatusSecure,
+		},
+		{
+			name:  "nxdomain without proof",
+			msg:   dnsmessage.Message{Authorities: example.signed(t, soaRecord("example."))},
+			rcode: dnsmessage.RCodeNameError,
+			want:  StatusBogus,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := New(Options{Enabled: true, TrustAnchors: []string{root.anchor()}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			qname := "www.example."
+			if len(tt.msg.Answers) > 0 {
+				qname = tt.msg.Answers[0].Header.Name.String()
+			} else if tt.rcode == dnsmessage.RCodeNameError {
+				qname = "missing.example."
+			}
+			tt.msg.Header = dnsmessage.Header{Response: true, RCode: tt.rcode}
+			tt.msg.Questions = []dnsmessage.Question{{Name: dnsmessage.MustNewName(qname), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}}
+
+			// 经过打包和解析，与上游返回的应答一致
+			packed, err := tt.msg.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(packed); err != nil {
+				t.Fatal(err)
+			}
+
+			got := v.Validate(context.Background(), resolver, &msg)
+			if got.Status != tt.want {
+				t.Errorf("Validate() = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustAnchor(t *testing.T) {
+	tests := []struct {
+		s       string
+		zone    string
+		keyTag  uint16
+		wantErr bool
+	}{
+		{RootTrustAnchors[0], ".", 20326, false},
+		{". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16", ".", 38696, false},
+		{"Example.com 12345 13 2 ABCDEF", "example.com.", 12345, false},
+		{". 20326 8 2", "", 0, true},
+		{". 20326 8 2 XYZ", "", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			zone, anchor, err := parseTrustAnchor(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTrustAnchor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (zone != tt.zone || anchor.keyTag != tt.keyTag) {
+				t.Errorf("parseTrustAnchor() = %s %d, want %s %d", zone, anchor.keyTag, tt.zone, tt.keyTag)
+			}
+		})
+	}
+}
+
+func TestCompareNames(t *testing.T) {
+	// RFC 4034 第 6.1 节的示例顺序
+	names := []string{
+		"example.",
+		"a.example.",
+		"yljkjljk.a.example.",
+		"z.a.example.",
+		"zabc.a.example.",
+		"z.example.",
+		"*.z.example.",
+	}
+	for i := 1; i < len(names); i++ {
+		if compareNames(names[i-1], names[i]) >= 0 {
+			t.Errorf("compareNames(%s, %s) >= 0, want < 0", names[i-1], names[i])
+		}
+	}
+}
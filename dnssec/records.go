@@ -0,0 +1,569 @@
+package dnssec
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNSSEC 相关的记录类型，dnsmessage 会把它们解析为 UnknownResource
+const (
+	TypeDS     dnsmessage.Type = 43
+	TypeRRSIG  dnsmessage.Type = 46
+	TypeNSEC   dnsmessage.Type = 47
+	TypeDNSKEY dnsmessage.Type = 48
+	TypeNSEC3  dnsmessage.Type = 50
+)
+
+// 签名算法（RFC 8624）
+const (
+	algRSASHA1         = 5
+	algRSASHA1NSEC3    = 7
+	algRSASHA256       = 8
+	algRSASHA512       = 10
+	algECDSAP256SHA256 = 13
+	algECDSAP384SHA384 = 14
+	algED25519         = 15
+)
+
+// DS 摘要算法
+const (
+	digestSHA1   = 1
+	digestSHA256 = 2
+	digestSHA384 = 4
+)
+
+// dnskeyZoneFlag DNSKEY 的 Zone Key 标志，没有该标志的密钥不能用于验证签名
+const dnskeyZoneFlag = 0x0100
+
+// nsec3OptOutFlag NSEC3 的 Opt-Out 标志
+const nsec3OptOutFlag = 0x01
+
+// maxNSEC3Iterations NSEC3 迭代次数超过该值时视为不安全（RFC 9276）
+const maxNSEC3Iterations = 150
+
+var nsec3Encoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// dnskey 解析后的 DNSKEY 记录
+type dnskey struct {
+	flags     uint16
+	protocol  uint8
+	algorithm uint8
+	publicKey []byte
+	rdata     []byte
+}
+
+func parseDNSKEY(rdata []byte) (*dnskey, error) {
+	if len(rdata) < 5 {
+		return nil, errors.New("DNSKEY 记录长度错误")
+	}
+	return &dnskey{
+		flags:     binary.BigEndian.Uint16(rdata),
+		protocol:  rdata[2],
+		algorithm: rdata[3],
+		publicKey: rdata[4:],
+		rdata:     rdata,
+	}, nil
+}
+
+// keyTag 计算密钥标签（RFC 4034 附录 B）
+func (k *dnskey) keyTag() uint16 {
+	var ac uint32
+	for i, b := range k.rdata {
+		if i&1 == 1 {
+			ac += uint32(b)
+		} else {
+			ac += uint32(b) << 8
+		}
+	}
+	ac += ac >> 16 & 0xffff
+	return uint16(ac & 0xffff)
+}
+
+// ds 解析后的 DS 记录
+type ds struct {
+	keyTag     uint16
+	algorithm  uint8
+	digestType uint8
+	digest     []byte
+}
+
+func parseDS(rdata []byte) (*ds, error) {
+	if len(rdata) < 5 {
+		return nil, errors.New("DS 记录长度错误")
+	}
+	return &ds{
+		keyTag:     binary.BigEndian.Uint16(rdata),
+		algorithm:  rdata[2],
+		digestType: rdata[3],
+		digest:     rdata[4:],
+	}, nil
+}
+
+// supported 判断是否支持 DS 的签名算法和摘要算法
+func (d *ds) supported() bool {
+	return supportedAlgorithm(d.algorithm) && digestHash(d.digestType) != nil
+}
+
+// matches 判断 DS 记录是否对应区域 owner 的密钥
+func (d *ds) matches(owner string, key *dnskey) bool {
+	if d.keyTag != key.keyTag() || d.algorithm != key.algorithm {
+		return false
+	}
+	h := digestHash(d.digestType)
+	if h == nil {
+		return false
+	}
+	h.Write(nameWire(owner))
+	h.Write(key.rdata)
+	return bytes.Equal(h.Sum(nil), d.digest)
+}
+
+func digestHash(digestType uint8) interface {
+	Write([]byte) (int, error)
+	Sum([]byte) []byte
+} {
+	switch digestType {
+	case digestSHA1:
+		return sha1.New()
+	case digestSHA256:
+		return sha256.New()
+	case digestSHA384:
+		return sha512.New384()
+	}
+	return nil
+}
+
+// rrsig 解析后的 RRSIG 记录
+type rrsig struct {
+	typeCovered dnsmessage.Type
+	algorithm   uint8
+	labels      uint8
+	origTTL     uint32
+	expiration  uint32
+	inception   uint32
+	keyTag      uint16
+	signerName  string
+	signature   []byte
+	// signedRData 不包含签名的 RDATA，签名者名称已转换为小写
+	signedRData []byte
+}
+
+func parseRRSIG(rdata []byte) (*rrsig, error) {
+	if len(rdata) < 18 {
+		return nil, errors.New("RRSIG 记录长度错误")
+	}
+	signer, off, err := readName(rdata, 18)
+	if err != nil {
+		return nil, err
+	}
+	signed := append([]byte{}, rdata[:off]...)
+	lowerWire(signed[18:])
+	return &rrsig{
+		typeCovered: dnsmessage.Type(binary.BigEndian.Uint16(rdata)),
+		algorithm:   rdata[2],
+		labels:      rdata[3],
+		origTTL:     binary.BigEndian.Uint32(rdata[4:]),
+		expiration:  binary.BigEndian.Uint32(rdata[8:]),
+		inception:   binary.BigEndian.Uint32(rdata[12:]),
+		keyTag:      binary.BigEndian.Uint16(rdata[16:]),
+		signerName:  signer,
+		signature:   rdata[off:],
+		signedRData: signed,
+	}, nil
+}
+
+// validAt 判断签名在 now（Unix 时间）是否有效，使用序列号算术比较（RFC 1982）
+func (s *rrsig) validAt(now uint32) bool {
+	return int32(now-s.inception) >= 0 && int32(s.expiration-now) >= 0
+}
+
+// nsec 解析后的 NSEC 记录
+type nsec struct {
+	next  string
+	types typeBitmap
+}
+
+func parseNSEC(rdata []byte) (*nsec, error) {
+	next, off, err := readName(rdata, 0)
+	if err != nil {
+		return nil, err
+	}
+	types, err := parseTypeBitmap(rdata[off:])
+	if err != nil {
+		return nil, err
+	}
+	return &nsec{next: next, types: types}, nil
+}
+
+// nsec3 解析后的 NSEC3 记录
+type nsec3 struct {
+	hashAlgorithm uint8
+	flags         uint8
+	iterations    uint16
+	salt          []byte
+	next          []byte
+	types         typeBitmap
+}
+
+func parseNSEC3(rdata []byte) (*nsec3, error) {
+	if len(rdata) < 5 {
+		return nil, errors.New("NSEC3 记录长度错误")
+	}
+	off := 5 + int(rdata[4])
+	if len(rdata) < off+1 {
+		return nil, errors.New("NSEC3 记录长度错误")
+	}
+	salt := rdata[5:off]
+	hashLen := int(rdata[off])
+	off++
+	if len(rdata) < off+hashLen {
+		return nil, errors.New("NSEC3 记录长度错误")
+	}
+	types, err := parseTypeBitmap(rdata[off+hashLen:])
+	if err != nil {
+		return nil, err
+	}
+	return &nsec3{
+		hashAlgorithm: rdata[0],
+		flags:         rdata[1],
+		iterations:    binary.BigEndian.Uint16(rdata[2:]),
+		salt:          salt,
+		next:          rdata[off : off+hashLen],
+		types:         types,
+	}, nil
+}
+
+// hash 计算域名的 NSEC3 哈希（RFC 5155 第 5 节）
+func (n *nsec3) hash(name string) []byte {
+	h := sha1.Sum(append(nameWire(name), n.salt...))
+	for i := 0; i < int(n.iterations); i++ {
+		h = sha1.Sum(append(h[:], n.salt...))
+	}
+	return h[:]
+}
+
+// typeBitmap NSEC 和 NSEC3 记录中的类型位图
+type typeBitmap map[dnsmessage.Type]bool
+
+func parseTypeBitmap(data []byte) (typeBitmap, error) {
+	types := make(typeBitmap)
+	for len(data) > 0 {
+		if len(data) < 2 || len(data) < 2+int(data[1]) || data[1] == 0 || data[1] > 32 {
+			return nil, errors.New("类型位图格式错误")
+		}
+		window, length := int(data[0]), int(data[1])
+		for i, b := range data[2 : 2+length] {
+			for bit := 0; bit < 8; bit++ {
+				if b&(0x80>>bit) != 0 {
+					types[dnsmessage.Type(window*256+i*8+bit)] = true
+				}
+			}
+		}
+		data = data[2+length:]
+	}
+	return types, nil
+}
+
+// readName 读取 RDATA 中未压缩的域名，返回小写的完整域名和之后的偏移量
+func readName(data []byte, off int) (string, int, error) {
+	var labels []string
+	for {
+		if off >= len(data) {
+			return "", 0, errors.New("域名格式错误")
+		}
+		length := int(data[off])
+		off++
+		if length == 0 {
+			break
+		}
+		if length > 63 || off+length > len(data) {
+			return "", 0, errors.New("域名格式错误")
+		}
+		labels = append(labels, string(data[off:off+length]))
+		off += length
+	}
+	return canonicalName(strings.Join(labels, ".")), off, nil
+}
+
+// canonicalName 返回小写并以点结尾的域名
+func canonicalName(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+// nameLabels 返回域名的标签，根域名返回空
+func nameLabels(name string) []string {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, ".")
+}
+
+// nameWire 返回域名未压缩的线路格式
+func nameWire(name string) []byte {
+	var wire []byte
+	for _, label := range nameLabels(name) {
+		wire = append(wire, byte(len(label)))
+		wire = append(wire, label...)
+	}
+	return append(wire, 0)
+}
+
+// lowerWire 将线路格式的域名转换为小写，长度字节不超过 63，不受影响
+func lowerWire(wire []byte) {
+	for i, b := range wire {
+		if b >= 'A' && b <= 'Z' {
+			wire[i] = b + 'a' - 'A'
+		}
+	}
+}
+
+// isSubdomain 判断 child 是否等于 parent 或者是 parent 的子域名
+func isSubdomain(child, parent string) bool {
+	return parent == "." || child == parent || strings.HasSuffix(child, "."+parent)
+}
+
+// parentName 返回上一级域名
+func parentName(name string) string {
+	labels := nameLabels(name)
+	if len(labels) <= 1 {
+		return "."
+	}
+	return strings.Join(labels[1:], ".") + "."
+}
+
+// compareNames 按 DNSSEC 规范顺序比较域名（RFC 4034 第 6.1 节）
+func compareNames(a, b string) int {
+	la, lb := nameLabels(a), nameLabels(b)
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// covers 判断 name 是否位于 owner 和 next 之间，next 不大于 owner 时表示区域中的最后一条记录
+func covers(owner, next, name string) bool {
+	if compareNames(next, owner) <= 0 {
+		return compareNames(name, owner) > 0 || compareNames(name, next) < 0
+	}
+	return compareNames(name, owner) > 0 && compareNames(name, next) < 0
+}
+
+// coversHash 判断哈希是否位于 owner 和 next 之间
+func coversHash(owner, next, hash []byte) bool {
+	if bytes.Compare(next, owner) <= 0 {
+		return bytes.Compare(hash, owner) > 0 || bytes.Compare(hash, next) < 0
+	}
+	return bytes.Compare(hash, owner) > 0 && bytes.Compare(hash, next) < 0
+}
+
+// canonicalRData 返回记录规范格式的 RDATA（RFC 4034 第 6.2 节）：
+// 域名不压缩，NS、CNAME、PTR、MX、SOA、SRV 中的域名转换为小写
+func canonicalRData(rr dnsmessage.Resource) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	h := rr.Header
+	switch body := rr.Body.(type) {
+	case *dnsmessage.AResource:
+		err = b.AResource(h, *body)
+	case *dnsmessage.AAAAResource:
+		err = b.AAAAResource(h, *body)
+	case *dnsmessage.TXTResource:
+		err = b.TXTResource(h, *body)
+	case *dnsmessage.NSResource:
+		err = b.NSResource(h, dnsmessage.NSResource{NS: lowerName(body.NS)})
+	case *dnsmessage.CNAMEResource:
+		err = b.CNAMEResource(h, dnsmessage.CNAMEResource{CNAME: lowerName(body.CNAME)})
+	case *dnsmessage.PTRResource:
+		err = b.PTRResource(h, dnsmessage.PTRResource{PTR: lowerName(body.PTR)})
+	case *dnsmessage.MXResource:
+		err = b.MXResource(h, dnsmessage.MXResource{Pref: body.Pref, MX: lowerName(body.MX)})
+	case *dnsmessage.SRVResource:
+		srv := *body
+		srv.Target = lowerName(body.Target)
+		err = b.SRVResource(h, srv)
+	case *dnsmessage.SOAResource:
+		soa := *body
+		soa.NS = lowerName(body.NS)
+		soa.MBox = lowerName(body.MBox)
+		err = b.SOAResource(h, soa)
+	case *dnsmessage.UnknownResource:
+		err = b.UnknownResource(h, *body)
+	default:
+		return nil, fmt.Errorf("不支持的记录类型: %v", rr.Header.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	packed, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+	var p dnsmessage.Parser
+	if _, err := p.Start(packed); err != nil {
+		return nil, err
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+	header, err := p.AnswerHeader()
+	if err != nil {
+		return nil, err
+	}
+	return packed[len(packed)-int(header.Length):], nil
+}
+
+func lowerName(name dnsmessage.Name) dnsmessage.Name {
+	lower, err := dnsmessage.NewName(strings.ToLower(name.String()))
+	if err != nil {
+		return name
+	}
+	return lower
+}
+
+// signedData 构造 RRSIG 签名的数据（RFC 4034 第 3.1.8.1 节）
+func signedData(set *rrset, sig *rrsig) ([]byte, error) {
+	owner := set.name
+	if labels := nameLabels(owner); int(sig.labels) < len(labels) {
+		// 通配符展开的记录，签名使用通配符域名
+		owner = "*." + strings.Join(labels[len(labels)-int(sig.labels):], ".") + "."
+	}
+
+	var rdatas [][]byte
+	for _, rr := range set.records {
+		rdata, err := canonicalRData(rr)
+		if err != nil {
+			return nil, err
+		}
+		rdatas = append(rdatas, rdata)
+	}
+	sort.Slice(rdatas, func(i, j int) bool {
+		return bytes.Compare(rdatas[i], rdatas[j]) < 0
+	})
+
+	data := append([]byte{}, sig.signedRData...)
+	ownerWire := nameWire(owner)
+	for i, rdata := range rdatas {
+		if i > 0 && bytes.Equal(rdata, rdatas[i-1]) {
+			continue
+		}
+		data = append(data, ownerWire...)
+		var fixed [10]byte
+		binary.BigEndian.PutUint16(fixed[0:], uint16(set.typ))
+		binary.BigEndian.PutUint16(fixed[2:], uint16(set.class))
+		binary.BigEndian.PutUint32(fixed[4:], sig.origTTL)
+		binary.BigEndian.PutUint16(fixed[8:], uint16(len(rdata)))
+		data = append(data, fixed[:]...)
+		data = append(data, rdata...)
+	}
+	return data, nil
+}
+
+// supportedAlgorithm 判断是否支持签名算法
+func supportedAlgorithm(algorithm uint8) bool {
+	switch algorithm {
+	case algRSASHA1, algRSASHA1NSEC3, algRSASHA256, algRSASHA512,
+		algECDSAP256SHA256, algECDSAP384SHA384, algED25519:
+		return true
+	}
+	return false
+}
+
+// verifySignature 使用密钥验证签名
+func verifySignature(key *dnskey, data, signature []byte) error {
+	switch key.algorithm {
+	case algRSASHA1, algRSASHA1NSEC3, algRSASHA256, algRSASHA512:
+		pub, err := rsaPublicKey(key.publicKey)
+		if err != nil {
+			return err
+		}
+		hash := crypto.SHA1
+		switch key.algorithm {
+		case algRSASHA256:
+			hash = crypto.SHA256
+		case algRSASHA512:
+			hash = crypto.SHA512
+		}
+		h := hash.New()
+		h.Write(data)
+		return rsa.VerifyPKCS1v15(pub, hash, h.Sum(nil), signature)
+
+	case algECDSAP256SHA256, algECDSAP384SHA384:
+		curve, hash, size := elliptic.P256(), crypto.SHA256, 32
+		if key.algorithm == algECDSAP384SHA384 {
+			curve, hash, size = elliptic.P384(), crypto.SHA384, 48
+		}
+		if len(key.publicKey) != 2*size || len(signature) != 2*size {
+			return errors.New("ECDSA 密钥或签名长度错误")
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(key.publicKey[:size]),
+			Y:     new(big.Int).SetBytes(key.publicKey[size:]),
+		}
+		h := hash.New()
+		h.Write(data)
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, h.Sum(nil), r, s) {
+			return errors.New("ECDSA 签名错误")
+		}
+		return nil
+
+	case algED25519:
+		if len(key.publicKey) != ed25519.PublicKeySize {
+			return errors.New("Ed25519 密钥长度错误")
+		}
+		if !ed25519.Verify(ed25519.PublicKey(key.publicKey), data, signature) {
+			return errors.New("Ed25519 签名错误")
+		}
+		return nil
+	}
+	return fmt.Errorf("不支持的签名算法: %d", key.algorithm)
+}
+
+// rsaPublicKey 解析 RSA 公钥（RFC 3110 第 2 节）
+func rsaPublicKey(key []byte) (*rsa.PublicKey, error) {
+	if len(key) < 3 {
+		return nil, errors.New("RSA 密钥长度错误")
+	}
+	expLen, off := int(key[0]), 1
+	if expLen == 0 {
+		expLen, off = int(binary.BigEndian.Uint16(key[1:])), 3
+	}
+	if expLen > 4 || len(key) <= off+expLen {
+		return nil, errors.New("RSA 密钥格式错误")
+	}
+	exp := 0
+	for _, b := range key[off : off+expLen] {
+		exp = exp<<8 | int(b)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(key[off+expLen:]), E: exp}, nil
+}
@@ -0,0 +1,375 @@
+package domain
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"go-dns-proxy/admin"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+// ErrRateLimited 备案查询接口触发限流
+var ErrRateLimited = errors.New("备案查询接口限流")
+
+// 备案查询状态
+const (
+	BeianStatusFiled   = "filed"
+	BeianStatusUnfiled = "unfiled"
+	BeianStatusUnknown = "unknown"
+)
+
+// ICPRecord 备案查询结果
+type ICPRecord struct {
+	Domain  string
+	IsBeian bool
+	// Raw 接口原始响应，用于缓存和排查
+	Raw string
+}
+
+// ICPProvider 备案查询接口
+type ICPProvider interface {
+	Lookup(ctx context.Context, domain string) (*ICPRecord, error)
+}
+
+// RateLimitError 携带重试时间的限流错误
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%v，%s 后重试", ErrRateLimited, e.RetryAfter)
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return ErrRateLimited
+}
+
+// HTTPICPProvider 基于 HTTP API 的备案查询
+//
+// 请求格式为 GET <apiURL>?domainName=<域名>&apiKey=<key>，
+// 响应为 JSON，StateCode 为 1 表示已备案。
+type HTTPICPProvider struct {
+	apiURL string
+	apiKey string
+	client *http.Client
+}
+
+// NewHTTPICPProvider 创建一个新的 HTTP 备案查询接口
+func NewHTTPICPProvider(apiURL, apiKey string) *HTTPICPProvider {
+	return &HTTPICPProvider{
+		apiURL: apiURL,
+		apiKey: apiKey,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+// Lookup 查询域名备案信息
+func (p *HTTPICPProvider) Lookup(ctx context.Context, domain string) (*ICPRecord, error) {
+	reqURL, err := url.Parse(p.apiURL)
+	if err != nil {
+		return nil, fmt.Errorf("无效的备案查询地址: %v", err)
+	}
+	query := reqURL.Query()
+	query.Set("domainName", domain)
+	if p.apiKey != "" {
+		query.Set("apiKey", p.apiKey)
+	}
+	reqURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("创建HTTP请求失败: %v", err)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("发送请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		retryAfter := time.Minute
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		return nil, &RateLimitError{RetryAfter: retryAfter}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP状态码错误: %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("读取响应失败: %v", err)
+	}
+	if !gjson.ValidBytes(body) {
+		return nil, fmt.Errorf("无效的备案查询响应: %s", string(body))
+	}
+
+	return &ICPRecord{
+		Domain:  domain,
+		IsBeian: gjson.GetBytes(body, "StateCode").Int() == 1,
+		Raw:     string(body),
+	}, nil
+}
+
+// BeianOptions 备案查询配置
+type BeianOptions struct {
+	// PositiveTTL 已备案结果的缓存时间
+	PositiveTTL time.Duration
+	// NegativeTTL 未备案结果的缓存时间
+	NegativeTTL time.Duration
+	// Timeout 单次 DNS 查询最多等待备案结果的时间，超时后查询继续在后台完成
+	Timeout time.Duration
+	// MaxInflight 同时进行的备案查询数量上限
+	MaxInflight int
+}
+
+// BeianCheck 一次备案判断的结果
+type BeianCheck struct {
+	Domain string `json:"domain"`
+	Status string `json:"status"`
+	Source string `json:"source,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type beianCacheEntry struct {
+	isBeian   bool
+	expiresAt time.Time
+	// source 结果来源，启动时从数据库加载的为 db
+	source string
+}
+
+// beianLookup 进行中的备案查询，done 关闭后 isBeian 和 ok 可读
+type beianLookup struct {
+	done    chan struct{}
+	isBeian bool
+	ok      bool
+}
+
+// BeianService 带缓存的备案查询服务
+type BeianService struct {
+	provider ICPProvider
+	db       *sql.DB
+	options  BeianOptions
+
+	mu          sync.Mutex
+	cache       map[string]beianCacheEntry
+	inflight    map[string]*beianLookup
+	pausedUntil time.Time
+}
+
+// NewBeianService 创建一个新的备案查询服务，db 为空时只使用内存缓存。
+// 数据库中未过期的备案结果在创建时加载到内存，查询时不再读取数据库
+func NewBeianService(provider ICPProvider, db *sql.DB, options BeianOptions) *BeianService {
+	if options.PositiveTTL <= 0 {
+		options.PositiveTTL = 7 * 24 * time.Hour
+	}
+	if options.NegativeTTL <= 0 {
+		options.NegativeTTL = 24 * time.Hour
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = 300 * time.Millisecond
+	}
+	if options.MaxInflight <= 0 {
+		options.MaxInflight = 4
+	}
+
+	s := &BeianService{
+		provider: provider,
+		db:       db,
+		options:  options,
+		cache:    make(map[string]beianCacheEntry),
+		inflight: make(map[string]*beianLookup),
+	}
+	s.loadCache()
+	return s
+}
+
+// loadCache 将数据库中未过期的备案结果加载到内存缓存
+func (s *BeianService) loadCache() {
+	if s.db == nil {
+		return
+	}
+
+	items, err := admin.GetBeianStatuses(s.db)
+	if err != nil {
+		log.WithError(err).Error("加载备案缓存失败")
+		return
+	}
+	now := time.Now()
+	for _, item := range items {
+		expiresAt := item.UpdatedAt.Add(s.ttl(item.IsBeian))
+		if now.Before(expiresAt) {
+			s.cache[item.Domain] = beianCacheEntry{isBeian: item.IsBeian, expiresAt: expiresAt, source: "db"}
+		}
+	}
+	log.WithField("count", len(s.cache)).Debug("已加载备案缓存")
+}
+
+// Check 查询域名的备案状态，等待时间不会超过配置的超时时间和 ctx 的截止时间
+func (s *BeianService) Check(ctx context.Context, domain string) *BeianCheck {
+	check := &BeianCheck{
+		Domain: extractRegistrableDomain(domain),
+		Status: BeianStatusUnknown,
+	}
+	if check.Domain == "" {
+		return check
+	}
+
+	if isBeian, source, ok := s.cached(check.Domain); ok {
+		check.Status = beianStatus(isBeian)
+		check.Source = source
+		return check
+	}
+
+	lookup, err := s.startLookup(check.Domain)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+
+	timer := time.NewTimer(s.options.Timeout)
+	defer timer.Stop()
+
+	select {
+	case <-lookup.done:
+		if lookup.ok {
+			check.Status = beianStatus(lookup.isBeian)
+			check.Source = "api"
+		} else {
+			check.Error = "备案查询失败"
+		}
+	case <-timer.C:
+		check.Error = "备案查询超时"
+	case <-ctx.Done():
+		check.Error = ctx.Err().Error()
+	}
+
+	return check
+}
+
+// cached 从内存缓存中读取备案状态，不读取数据库
+func (s *BeianService) cached(domain string) (bool, string, bool) {
+	s.mu.Lock()
+	entry, ok := s.cache[domain]
+	s.mu.Unlock()
+	if !ok || !time.Now().Before(entry.expiresAt) {
+		return false, "", false
+	}
+	return entry.isBeian, entry.source, true
+}
+
+// startLookup 在后台发起备案查询，同一域名只会有一个查询在进行
+func (s *BeianService) startLookup(domain string) (*beianLookup, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if lookup, ok := s.inflight[domain]; ok {
+		return lookup, nil
+	}
+	if time.Now().Before(s.pausedUntil) {
+		return nil, errors.New("备案查询已暂停")
+	}
+	if len(s.inflight) >= s.options.MaxInflight {
+		return nil, errors.New("进行中的备案查询过多")
+	}
+
+	lookup := &beianLookup{done: make(chan struct{})}
+	s.inflight[domain] = lookup
+	go s.lookup(domain, lookup)
+	return lookup, nil
+}
+
+// lookup 调用备案接口并写入缓存
+func (s *BeianService) lookup(domain string, lookup *beianLookup) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.inflight, domain)
+		s.mu.Unlock()
+		close(lookup.done)
+	}()
+
+	logger := log.WithField("domain", domain)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	record, err := s.provider.Lookup(ctx, domain)
+	if err != nil {
+		var rateLimitErr *RateLimitError
+		if errors.As(err, &rateLimitErr) {
+			s.pause(rateLimitErr.RetryAfter)
+			logger.WithField("retryAfter", rateLimitErr.RetryAfter.String()).Warn("备案查询接口限流，暂停查询")
+			return
+		}
+		// 接口异常时短暂暂停，避免每次 DNS 查询都请求接口
+		s.pause(30 * time.Second)
+		logger.WithError(err).Error("备案查询失败")
+		return
+	}
+
+	lookup.isBeian = record.IsBeian
+	lookup.ok = true
+
+	s.mu.Lock()
+	s.cache[domain] = beianCacheEntry{
+		isBeian:   record.IsBeian,
+		expiresAt: time.Now().Add(s.ttl(record.IsBeian)),
+		source:    "memory",
+	}
+	s.mu.Unlock()
+
+	if s.db != nil {
+		if err := admin.SaveBeianCache(s.db, domain, record.IsBeian, record.Raw); err != nil {
+			logger.WithError(err).Error("保存备案缓存失败")
+		}
+	}
+	logger.WithField("isBeian", record.IsBeian).Debug("备案查询完成")
+}
+
+// pause 在指定时间内不再发起新的备案查询
+func (s *BeianService) pause(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if until := time.Now().Add(d); until.After(s.pausedUntil) {
+		s.pausedUntil = until
+	}
+}
+
+// ttl 返回备案结果对应的缓存时间
+func (s *BeianService) ttl(isBeian bool) time.Duration {
+	if isBeian {
+		return s.options.PositiveTTL
+	}
+	return s.options.NegativeTTL
+}
+
+func beianStatus(isBeian bool) string {
+	if isBeian {
+		return BeianStatusFiled
+	}
+	return BeianStatusUnfiled
+}
+
+// extractRegistrableDomain 提取可注册域名，如 www.baidu.com.cn 返回 baidu.com.cn
+func extractRegistrableDomain(domain string) string {
+	parts := strings.Split(strings.ToLower(strings.TrimSuffix(domain, ".")), ".")
+	index := mainDomainIndex(parts)
+	if index < 0 {
+		return ""
+	}
+	return strings.Join(parts[index:], ".")
+}
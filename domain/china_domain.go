@@ -3,6 +3,8 @@ package domain
 import (
 	"bufio"
 	"context"
+	"fmt"
+	"go-dns-proxy/admin"
 	"io"
 	"net/http"
 	"os"
@@ -14,11 +16,42 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// 路由判断原因
+const (
+	ReasonDomainList      = "domain_list"
+	ReasonChinaTLD        = "china_tld"
+	ReasonLearned         = "learned"
+	ReasonBeian           = "beian"
+	ReasonNoBeian         = "no_beian"
+	ReasonPinyin          = "pinyin"
+	ReasonPinyinAllowlist = "pinyin_allowlist"
+	ReasonPinyinDenylist  = "pinyin_denylist"
+	ReasonDefault         = "default"
+	ReasonClientGroup     = "client_group"
+)
+
+// RouteDecision 域名路由判断结果
+type RouteDecision struct {
+	Domain      string               `json:"domain"`
+	IsChina     bool                 `json:"is_china"`
+	Reason      string               `json:"reason"`
+	MatchedRule string               `json:"matched_rule,omitempty"`
+	MainDomain  string               `json:"main_domain,omitempty"`
+	Learned     *admin.LearnedDomain `json:"learned,omitempty"`
+	Beian       *BeianCheck          `json:"beian,omitempty"`
+	Pinyin      *PinyinResult        `json:"pinyin,omitempty"`
+}
+
 // ChinaDomainService 用于检测中国域名
 type ChinaDomainService struct {
 	pinyinService *PinyinDomainService
-	chinaDomains map[string]bool
-	mu           sync.RWMutex
+	beianService  *BeianService
+	learnedStore  *LearnedDomainStore
+	pinyinOptions PinyinOptions
+	pinyinAllow   map[string]bool
+	pinyinDeny    map[string]bool
+	chinaDomains  map[string]bool
+	mu            sync.RWMutex
 }
 
 // NewChinaDomainService 创建一个新的中国域名检测服务
@@ -29,6 +62,33 @@ func NewChinaDomainService() *ChinaDomainService {
 	}
 }
 
+// SetPinyinOptions 设置拼音启发式规则
+func (s *ChinaDomainService) SetPinyinOptions(options PinyinOptions) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pinyinOptions = options
+	s.pinyinAllow = toDomainSet(options.Allowlist)
+	s.pinyinDeny = toDomainSet(options.Denylist)
+	s.pinyinService.SetThreshold(options.Threshold)
+}
+
+// SetBeianService 设置备案查询服务，为空时不使用备案信息判断
+func (s *ChinaDomainService) SetBeianService(beianService *BeianService) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.beianService = beianService
+}
+
+// SetLearnedStore 设置学习域名存储，为空时不使用学习结果
+func (s *ChinaDomainService) SetLearnedStore(learnedStore *LearnedDomainStore) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.learnedStore = learnedStore
+}
+
 // LoadChinaDomainList 从文件加载中国域名列表
 func (s *ChinaDomainService) LoadChinaDomainList(filePath string) error {
 	file, err := os.Open(filePath)
@@ -57,6 +117,15 @@ func (s *ChinaDomainService) LoadChinaDomainList(filePath string) error {
 	return scanner.Err()
 }
 
+// LoadCachedChinaDomainList 加载本地缓存的中国域名列表，不下载，本地文件不存在时返回 false
+func (s *ChinaDomainService) LoadCachedChinaDomainList(dataDir string) (bool, error) {
+	localFile := filepath.Join(dataDir, "china_domains.txt")
+	if _, err := os.Stat(localFile); err != nil {
+		return false, nil
+	}
+	return true, s.LoadChinaDomainList(localFile)
+}
+
 // DownloadAndLoadChinaDomainList 下载并加载中国域名列表
 func (s *ChinaDomainService) DownloadAndLoadChinaDomainList(url string, dataDir string) error {
 	// 确保目录存在
@@ -75,7 +144,16 @@ func (s *ChinaDomainService) DownloadAndLoadChinaDomainList(url string, dataDir
 
 	// 本地文件不存在时才下载
 	log.WithField("url", url).Info("本地文件不存在，开始下载中国域名列表")
+	if err := downloadFile(url, localFile); err != nil {
+		return err
+	}
 
+	log.Info("中国域名列表下载完成")
+	return s.LoadChinaDomainList(localFile)
+}
+
+// downloadFile 下载文件到本地，先写入临时文件再重命名
+func downloadFile(url string, localFile string) error {
 	// 创建 HTTP 客户端
 	client := &http.Client{
 		Timeout: 30 * time.Second,
@@ -88,6 +166,10 @@ func (s *ChinaDomainService) DownloadAndLoadChinaDomainList(url string, dataDir
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("下载失败，HTTP状态码: %d", resp.StatusCode)
+	}
+
 	// 创建临时文件
 	tmpFile := localFile + ".tmp"
 	out, err := os.Create(tmpFile)
@@ -112,8 +194,7 @@ func (s *ChinaDomainService) DownloadAndLoadChinaDomainList(url string, dataDir
 		return err
 	}
 
-	log.Info("中国域名列表下载完成")
-	return s.LoadChinaDomainList(localFile)
+	return nil
 }
 
 // extractMainDomain 提取主域名（二级域名）
@@ -121,10 +202,19 @@ func extractMainDomain(domain string) string {
 	// 移除末尾的点
 	domain = strings.TrimSuffix(domain, ".")
 	parts := strings.Split(domain, ".")
-	
-	if len(parts) < 2 {
+
+	index := mainDomainIndex(parts)
+	if index < 0 {
 		return ""
 	}
+	return parts[index]
+}
+
+// mainDomainIndex 返回主域名在域名各级标签中的位置，无法提取时返回 -1
+func mainDomainIndex(parts []string) int {
+	if len(parts) < 2 {
+		return -1
+	}
 
 	// 处理特殊的二级域名后缀
 	if len(parts) >= 3 {
@@ -137,75 +227,191 @@ func extractMainDomain(domain string) string {
 			"gov.cn": true,
 			"edu.cn": true,
 		}
-		
+
 		if specialSuffixes[sld+"."+tld] {
-			if len(parts) >= 3 {
-				// 返回三级域名
-				return parts[len(parts)-3]
-			}
-			return ""
+			// 返回三级域名
+			return len(parts) - 3
 		}
 	}
 
 	// 返回二级域名
-	return parts[len(parts)-2]
+	return len(parts) - 2
 }
 
-// isDomainInList 检查域名是否在中国域名列表中
-func (s *ChinaDomainService) isDomainInList(domain string) bool {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
+// matchDomainSuffix 检查域名或其父域名是否在集合中，返回命中的条目
+func matchDomainSuffix(domain string, set map[string]bool) (string, bool) {
 	// 检查完整域名
-	if s.chinaDomains[domain] {
-		return true
+	if set[domain] {
+		return domain, true
 	}
 
 	// 检查父域名
 	parts := strings.Split(domain, ".")
 	for i := 1; i < len(parts); i++ {
 		parentDomain := strings.Join(parts[i:], ".")
-		if s.chinaDomains[parentDomain] {
-			return true
+		if set[parentDomain] {
+			return parentDomain, true
 		}
 	}
 
-	return false
+	return "", false
+}
+
+// chinaTLD 检查域名是否使用中国顶级域名，返回命中的顶级域名
+func chinaTLD(domain string) (string, bool) {
+	for _, tld := range []string{".cn", ".中国"} {
+		if strings.HasSuffix(domain, tld) {
+			return tld, true
+		}
+	}
+	return "", false
+}
+
+// isDomainInList 检查域名是否在中国域名列表中，返回命中的列表条目
+func (s *ChinaDomainService) isDomainInList(domain string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return matchDomainSuffix(domain, s.chinaDomains)
 }
 
 // IsChinaDomain 检查是否为中国域名
 func (s *ChinaDomainService) IsChinaDomain(ctx context.Context, domain string) bool {
+	return s.Decide(ctx, domain).IsChina
+}
+
+// Decide 判断域名应该使用的 DNS 服务器，并返回判断依据
+func (s *ChinaDomainService) Decide(ctx context.Context, domain string) *RouteDecision {
 	logger := log.WithField("domain", domain)
 
 	// 移除末尾的点
 	domain = strings.TrimSuffix(domain, ".")
+	decision := &RouteDecision{Domain: domain, Reason: ReasonDefault}
 
 	// 检查是否在中国域名列表中
-	if s.isDomainInList(domain) {
-		logger.Debug("域名在中国域名列表中")
-		return true
+	if entry, ok := s.isDomainInList(domain); ok {
+		logger.WithField("entry", entry).Debug("域名在中国域名列表中")
+		decision.IsChina = true
+		decision.Reason = ReasonDomainList
+		decision.MatchedRule = entry
+		return decision
 	}
 
 	// 检查是否为中国顶级域名
-	if strings.HasSuffix(domain, ".cn") || strings.HasSuffix(domain, ".中国") {
+	if tld, ok := chinaTLD(domain); ok {
 		logger.Debug("中国顶级域名")
-		return true
+		decision.IsChina = true
+		decision.Reason = ReasonChinaTLD
+		decision.MatchedRule = tld
+		return decision
+	}
+
+	s.mu.RLock()
+	learnedStore := s.learnedStore
+	beianService := s.beianService
+	s.mu.RUnlock()
+
+	// 检查根据实际解析结果学习到的路由
+	if learnedStore != nil {
+		if learned, ok := learnedStore.Lookup(domain); ok {
+			logger.WithFields(log.Fields{
+				"route":    learned.Route,
+				"hitCount": learned.HitCount,
+				"status":   learned.Status,
+			}).Debug("命中学习域名")
+			decision.IsChina = learned.Route == RouteChina
+			decision.Reason = ReasonLearned
+			decision.MatchedRule = learned.Domain
+			decision.Learned = learned
+			return decision
+		}
 	}
 
 	// 提取主域名
-	mainDomain := extractMainDomain(domain)
-	if mainDomain == "" {
-		return false
+	decision.MainDomain = extractMainDomain(domain)
+	if decision.MainDomain == "" {
+		return decision
 	}
 
-	// 检查主域名是否为拼音
-	isPinyin := s.pinyinService.IsPinyinDomain(mainDomain)
+	// 根据备案信息判断，查询失败或超时时继续使用拼音判断
+	if beianService != nil {
+		decision.Beian = beianService.Check(ctx, domain)
+		logger.WithFields(log.Fields{
+			"beianDomain": decision.Beian.Domain,
+			"status":      decision.Beian.Status,
+			"source":      decision.Beian.Source,
+		}).Debug("备案检查结果")
+
+		switch decision.Beian.Status {
+		case BeianStatusFiled:
+			decision.IsChina = true
+			decision.Reason = ReasonBeian
+			decision.MatchedRule = decision.Beian.Domain
+			return decision
+		case BeianStatusUnfiled:
+			decision.Reason = ReasonNoBeian
+			decision.MatchedRule = decision.Beian.Domain
+			return decision
+		}
+	}
+
+	s.pinyinDecision(decision)
 	logger.WithFields(log.Fields{
-		"mainDomain": mainDomain,
-		"isPinyin": isPinyin,
+		"mainDomain": decision.MainDomain,
+		"reason":     decision.Reason,
+		"isPinyin":   decision.IsChina,
 	}).Debug("拼音域名检查结果")
 
-	return isPinyin
+	return decision
+}
+
+// pinyinDecision 使用拼音启发式规则判断主域名
+func (s *ChinaDomainService) pinyinDecision(decision *RouteDecision) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.pinyinOptions.Disabled {
+		return
+	}
+
+	if entry, ok := matchDomainSuffix(decision.Domain, s.pinyinDeny); ok {
+		decision.Reason = ReasonPinyinDenylist
+		decision.MatchedRule = entry
+		return
+	}
+
+	if entry, ok := matchDomainSuffix(decision.Domain, s.pinyinAllow); ok {
+		decision.IsChina = true
+		decision.Reason = ReasonPinyinAllowlist
+		decision.MatchedRule = entry
+		return
+	}
+
+	// 检查主域名是否为拼音
+	decision.Pinyin = s.pinyinService.ScorePinyinDomain(decision.MainDomain)
+	if decision.Pinyin.Matched {
+		decision.IsChina = true
+		decision.Reason = ReasonPinyin
+	}
+}
+
+// toDomainSet 将域名列表转换为集合
+func toDomainSet(domains []string) map[string]bool {
+	set := make(map[string]bool, len(domains))
+	for _, d := range domains {
+		d = strings.ToLower(strings.Trim(strings.TrimSpace(d), "."))
+		if d != "" {
+			set[d] = true
+		}
+	}
+	return set
+}
+
+// Len 返回中国域名列表中的域名数量
+func (s *ChinaDomainService) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.chinaDomains)
 }
 
 // Close 关闭服务
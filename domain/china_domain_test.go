@@ -10,7 +10,9 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func setupTestDB(t *testing.T) *sql.DB {
@@ -48,9 +50,11 @@ func TestChinaDomainService_IsChinaDomain(t *testing.T) {
 	}))
 	defer mockServer.Close()
 
-	service := NewChinaDomainService("test_api_key", db)
-	// 修改备案查询 URL 为 mock 服务器地址
-	service.beianAPIURL = mockServer.URL
+	service := NewChinaDomainService()
+	// 备案查询使用 mock 服务器地址
+	service.SetBeianService(NewBeianService(NewHTTPICPProvider(mockServer.URL, "test_api_key"), db, BeianOptions{
+		Timeout: time.Second,
+	}))
 
 	tests := []struct {
 		name   string
@@ -123,8 +127,9 @@ func TestChinaDomainService_Cache(t *testing.T) {
 	}))
 	defer mockServer.Close()
 
-	service := NewChinaDomainService("test_api_key", db)
-	service.beianAPIURL = mockServer.URL
+	service := NewBeianService(NewHTTPICPProvider(mockServer.URL, "test_api_key"), db, BeianOptions{
+		Timeout: time.Second,
+	})
 
 	// 测试缓存写入和读取
 	domains := []struct {
@@ -138,22 +143,157 @@ func TestChinaDomainService_Cache(t *testing.T) {
 	for _, d := range domains {
 		// 触发备案查询并缓存
 		ctx := context.Background()
-		result := service.isBeianDomain(ctx, fmt.Sprintf("www.%s.", d.domain))
-		if result != d.want {
-			t.Errorf("isBeianDomain(%s) = %v, want %v", d.domain, result, d.want)
+		check := service.Check(ctx, fmt.Sprintf("www.%s.", d.domain))
+		if check.Status != beianStatus(d.want) || check.Source != "api" {
+			t.Errorf("Check(%s) = (%s, %s), want (%s, api)", d.domain, check.Status, check.Source, beianStatus(d.want))
 		}
 
 		// 验证缓存
-		if isBeian, found := admin.GetBeianCache(db, d.domain); !found || isBeian != d.want {
-			t.Errorf("Cache for %s = %v, want %v", d.domain, isBeian, d.want)
+		if item, found := admin.GetBeianCache(db, d.domain); !found || item.IsBeian != d.want {
+			t.Errorf("Cache for %s = %v, want %v", d.domain, item, d.want)
 		}
 	}
 
-	// 测试缓存持久化
-	service2 := NewChinaDomainService("test_api_key", db)
+	// 测试缓存持久化，数据库中的结果在创建时加载，查询时不再读取数据库
+	service2 := NewBeianService(NewHTTPICPProvider(mockServer.URL, "test_api_key"), db, BeianOptions{})
+	service3 := NewBeianService(NewHTTPICPProvider(mockServer.URL, "test_api_key"), db, BeianOptions{
+		NegativeTTL: time.Nanosecond,
+		Timeout:     time.Second,
+	})
+	if _, err := db.Exec("DELETE FROM beian_cache"); err != nil {
+		t.Fatal(err)
+	}
 	for _, d := range domains {
-		if isBeian, found := admin.GetBeianCache(db, d.domain); !found || isBeian != d.want {
-			t.Errorf("Persisted cache for %s = %v, want %v", d.domain, isBeian, d.want)
+		check := service2.Check(context.Background(), "www."+d.domain)
+		if check.Status != beianStatus(d.want) || check.Source != "db" {
+			t.Errorf("Persisted cache for %s = (%s, %s), want (%s, db)", d.domain, check.Status, check.Source, beianStatus(d.want))
 		}
 	}
-} 
\ No newline at end of file
+
+	// 测试负向结果过期
+	if check := service3.Check(context.Background(), "www.example.com"); check.Source != "api" {
+		t.Errorf("Expired negative cache source = %s, want api", check.Source)
+	}
+}
+
+func TestBeianService_RateLimit(t *testing.T) {
+	var requests int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer mockServer.Close()
+
+	service := NewBeianService(NewHTTPICPProvider(mockServer.URL, ""), nil, BeianOptions{
+		Timeout: time.Second,
+	})
+
+	ctx := context.Background()
+	if check := service.Check(ctx, "www.example.com"); check.Status != BeianStatusUnknown {
+		t.Errorf("Check() status = %s, want %s", check.Status, BeianStatusUnknown)
+	}
+
+	// 限流期间不再请求接口
+	if check := service.Check(ctx, "www.example.net"); check.Status != BeianStatusUnknown || check.Error == "" {
+		t.Errorf("Check() during rate limit = %+v, want unknown with error", check)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("API requests = %d, want 1", n)
+	}
+}
+
+func TestBeianService_Deadline(t *testing.T) {
+	release := make(chan struct{})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte(`{"StateCode": 1}`))
+	}))
+	defer mockServer.Close()
+	defer close(release)
+
+	service := NewBeianService(NewHTTPICPProvider(mockServer.URL, ""), nil, BeianOptions{
+		Timeout: 50 * time.Millisecond,
+	})
+
+	start := time.Now()
+	check := service.Check(context.Background(), "www.slow.com")
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Check() took %s, want less than 500ms", elapsed)
+	}
+	if check.Status != BeianStatusUnknown {
+		t.Errorf("Check() status = %s, want %s", check.Status, BeianStatusUnknown)
+	}
+
+	// 后台查询完成后结果进入缓存
+	release <- struct{}{}
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if check := service.Check(context.Background(), "www.slow.com"); check.Status == BeianStatusFiled {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("background lookup result was not cached")
+}
+
+func TestChinaDomainService_Explain(t *testing.T) {
+	service := NewChinaDomainService()
+	service.chinaDomains["qq.com"] = true
+	service.SetPinyinOptions(PinyinOptions{Denylist: []string{"zhongguoyidong.net"}})
+	ctx := context.Background()
+
+	tests := []struct {
+		domain       string
+		wantDecisive string
+		wantEntry    string
+		wantTLD      string
+		wantMain     string
+		wantSyllable []string
+	}{
+		{"mail.qq.com", ReasonDomainList, "qq.com", "", "qq", nil},
+		{"www.example.com.cn", ReasonChinaTLD, "", ".cn", "example", nil},
+		{"www.zhongguoyidong.com", ReasonPinyin, "", "", "zhongguoyidong", []string{"zhong", "guo", "yi", "dong"}},
+		{"www.zhongguoyidong.net", ReasonPinyinDenylist, "", "", "zhongguoyidong", nil},
+		{"www.example.com", ReasonDefault, "", "", "example", nil},
+		{"localhost", ReasonDefault, "", "", "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			e := service.Explain(ctx, tt.domain)
+			if e.ListEntry != tt.wantEntry || e.ChinaTLD != tt.wantTLD || e.MainDomain != tt.wantMain {
+				t.Errorf("Explain() = entry %q, tld %q, main %q, want %q, %q, %q",
+					e.ListEntry, e.ChinaTLD, e.MainDomain, tt.wantEntry, tt.wantTLD, tt.wantMain)
+			}
+
+			decisive := ""
+			skipped := false
+			for _, step := range e.Steps {
+				if step.Decisive {
+					if decisive != "" {
+						t.Errorf("Explain() has more than one decisive step: %s, %s", decisive, step.Name)
+					}
+					decisive = step.Name
+				} else if decisive != "" && !step.Skipped {
+					t.Errorf("Explain() step %s after %s is not skipped", step.Name, decisive)
+				}
+				skipped = skipped || step.Skipped
+			}
+			if decisive != tt.wantDecisive {
+				t.Errorf("Explain() decisive step = %s, want %s", decisive, tt.wantDecisive)
+			}
+			if tt.wantDecisive == ReasonDefault && skipped {
+				t.Errorf("Explain() skipped steps before default route")
+			}
+
+			var syllables []string
+			if e.Pinyin != nil {
+				syllables = e.Pinyin.Syllables
+			}
+			if tt.wantSyllable != nil && strings.Join(syllables, "+") != strings.Join(tt.wantSyllable, "+") {
+				t.Errorf("Explain() syllables = %v, want %v", syllables, tt.wantSyllable)
+			}
+		})
+	}
+}
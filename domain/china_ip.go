@@ -0,0 +1,160 @@
+package domain
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ipRange 一段连续的 IP 地址，统一使用 16 字节表示
+type ipRange struct {
+	start net.IP
+	end   net.IP
+}
+
+// ChinaIPService 用于判断 IP 是否属于中国大陆
+type ChinaIPService struct {
+	ranges []ipRange
+	mu     sync.RWMutex
+}
+
+// NewChinaIPService 创建一个新的中国 IP 判断服务
+func NewChinaIPService() *ChinaIPService {
+	return &ChinaIPService{}
+}
+
+// LoadChinaIPList 从文件加载 CIDR 格式的中国 IP 列表
+func (s *ChinaIPService) LoadChinaIPList(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var ranges []ipRange
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if r, ok := parseIPRange(line); ok {
+			ranges = append(ranges, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	s.setRanges(ranges)
+	log.WithField("count", len(ranges)).Info("已加载中国 IP 列表")
+	return nil
+}
+
+// SetCIDRs 使用 CIDR 列表替换当前的中国 IP 列表
+func (s *ChinaIPService) SetCIDRs(cidrs []string) {
+	var ranges []ipRange
+	for _, cidr := range cidrs {
+		if r, ok := parseIPRange(cidr); ok {
+			ranges = append(ranges, r)
+		}
+	}
+	s.setRanges(ranges)
+}
+
+// setRanges 替换当前的 IP 段列表
+func (s *ChinaIPService) setRanges(ranges []ipRange) {
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].start, ranges[j].start) < 0
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ranges = ranges
+}
+
+// DownloadAndLoadChinaIPList 下载并加载中国 IP 列表
+func (s *ChinaIPService) DownloadAndLoadChinaIPList(url string, dataDir string) error {
+	// 确保目录存在
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return err
+	}
+
+	localFile := filepath.Join(dataDir, "china_ip.txt")
+
+	// 如果本地文件存在，直接加载
+	if _, err := os.Stat(localFile); err == nil {
+		log.Info("使用本地中国 IP 列表")
+		return s.LoadChinaIPList(localFile)
+	}
+
+	log.WithField("url", url).Info("本地文件不存在，开始下载中国 IP 列表")
+	if err := downloadFile(url, localFile); err != nil {
+		return err
+	}
+
+	log.Info("中国 IP 列表下载完成")
+	return s.LoadChinaIPList(localFile)
+}
+
+// Len 返回已加载的 IP 段数量
+func (s *ChinaIPService) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.ranges)
+}
+
+// Contains 判断 IP 是否属于中国大陆
+func (s *ChinaIPService) Contains(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// 找到最后一个起始地址不大于 ip 的段
+	i := sort.Search(len(s.ranges), func(i int) bool {
+		return bytes.Compare(s.ranges[i].start, ip) > 0
+	})
+	if i == 0 {
+		return false
+	}
+	return bytes.Compare(ip, s.ranges[i-1].end) <= 0
+}
+
+// parseIPRange 解析 CIDR 或单个 IP
+func parseIPRange(s string) (ipRange, bool) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return ipRange{}, false
+		}
+		return ipRange{start: ip.To16(), end: ip.To16()}, true
+	}
+
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return ipRange{}, false
+	}
+
+	start := ipNet.IP.To16()
+	mask := ipNet.Mask
+	if len(mask) == net.IPv4len {
+		// IPv4 掩码扩展为 16 字节，前 12 字节全为 1
+		mask = append(net.CIDRMask(96, 128)[:12], mask...)
+	}
+	end := make(net.IP, net.IPv6len)
+	for i := range start {
+		end[i] = start[i] | ^mask[i]
+	}
+	return ipRange{start: start, end: end}, true
+}
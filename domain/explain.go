@@ -0,0 +1,178 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// StepMainDomain 提取主域名的步骤，其他步骤的名称与判断原因相同
+const StepMainDomain = "main_domain"
+
+// ExplainStep 路由判断中的一步检查。Decisive 表示这一步决定了路由，
+// Skipped 表示实际判断在前面的步骤已经结束，这一步的结果仅供参考
+type ExplainStep struct {
+	Name     string `json:"name"`
+	Matched  bool   `json:"matched"`
+	Decisive bool   `json:"decisive,omitempty"`
+	Skipped  bool   `json:"skipped,omitempty"`
+	Detail   string `json:"detail"`
+}
+
+// Explanation 域名路由判断的完整过程，包括没有执行到的检查
+type Explanation struct {
+	Domain     string         `json:"domain"`
+	Decision   *RouteDecision `json:"decision"`
+	ListEntry  string         `json:"list_entry,omitempty"`
+	ChinaTLD   string         `json:"china_tld,omitempty"`
+	MainDomain string         `json:"main_domain,omitempty"`
+	Pinyin     *PinyinResult  `json:"pinyin,omitempty"`
+	Steps      []ExplainStep  `json:"steps"`
+}
+
+// Explain 判断域名的路由，并按判断顺序列出每一步检查的结果。
+// 备案只使用实际判断时的查询结果，没有执行到时不会查询接口
+func (s *ChinaDomainService) Explain(ctx context.Context, domain string) *Explanation {
+	domain = strings.TrimSuffix(domain, ".")
+	decision := s.Decide(ctx, domain)
+	e := &Explanation{
+		Domain:     domain,
+		Decision:   decision,
+		MainDomain: extractMainDomain(domain),
+	}
+
+	// 中国域名列表
+	s.mu.RLock()
+	listSize := len(s.chinaDomains)
+	learnedStore := s.learnedStore
+	beianService := s.beianService
+	s.mu.RUnlock()
+	if entry, ok := s.isDomainInList(domain); ok {
+		e.ListEntry = entry
+		detail := fmt.Sprintf("域名 %s 在中国域名列表中", entry)
+		if entry != domain {
+			detail = fmt.Sprintf("父域名 %s 在中国域名列表中", entry)
+		}
+		e.addStep(ReasonDomainList, true, detail)
+	} else {
+		e.addStep(ReasonDomainList, false, fmt.Sprintf("不在中国域名列表中，列表共 %d 条", listSize))
+	}
+
+	// 中国顶级域名
+	if tld, ok := chinaTLD(domain); ok {
+		e.ChinaTLD = tld
+		e.addStep(ReasonChinaTLD, true, fmt.Sprintf("顶级域名为 %s", tld))
+	} else {
+		e.addStep(ReasonChinaTLD, false, "不是 .cn 或 .中国 顶级域名")
+	}
+
+	// 学习域名
+	if learnedStore == nil {
+		e.addStep(ReasonLearned, false, "未开启域名学习")
+	} else if learned, ok := learnedStore.Lookup(domain); ok {
+		e.addStep(ReasonLearned, true, fmt.Sprintf("%s 学习为 %s，命中 %d 次，状态 %s",
+			learned.Domain, learned.Route, learned.HitCount, learned.Status))
+	} else {
+		e.addStep(ReasonLearned, false, "没有生效的学习记录")
+	}
+
+	// 主域名
+	if e.MainDomain != "" {
+		e.addStep(StepMainDomain, true, fmt.Sprintf("主域名为 %s", e.MainDomain))
+	} else {
+		e.addStep(StepMainDomain, false, "无法提取主域名")
+	}
+
+	// 备案
+	switch {
+	case decision.Beian != nil:
+		detail := fmt.Sprintf("%s 的备案状态为 %s", decision.Beian.Domain, decision.Beian.Status)
+		if decision.Beian.Source != "" {
+			detail += "，来源 " + decision.Beian.Source
+		}
+		if decision.Beian.Error != "" {
+			detail += "，" + decision.Beian.Error
+		}
+		e.addStep(ReasonBeian, decision.Beian.Status != BeianStatusUnknown, detail)
+	case beianService == nil:
+		e.addStep(ReasonBeian, false, "未配置备案查询")
+	default:
+		e.addStep(ReasonBeian, false, "未查询")
+	}
+
+	s.explainPinyin(e)
+
+	if decision.Reason == ReasonDefault {
+		e.addStep(ReasonDefault, true, "以上检查都没有命中，使用海外 DNS")
+	}
+
+	e.markDecisive()
+	return e
+}
+
+// explainPinyin 列出拼音黑白名单和拼音拆分的结果
+func (s *ChinaDomainService) explainPinyin(e *Explanation) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.pinyinOptions.Disabled {
+		for _, name := range []string{ReasonPinyinDenylist, ReasonPinyinAllowlist, ReasonPinyin} {
+			e.addStep(name, false, "未开启拼音判断")
+		}
+		return
+	}
+
+	for _, list := range []struct {
+		name string
+		set  map[string]bool
+	}{
+		{ReasonPinyinDenylist, s.pinyinDeny},
+		{ReasonPinyinAllowlist, s.pinyinAllow},
+	} {
+		if entry, ok := matchDomainSuffix(e.Domain, list.set); ok {
+			e.addStep(list.name, true, fmt.Sprintf("命中 %s", entry))
+		} else if len(list.set) == 0 {
+			e.addStep(list.name, false, "没有配置")
+		} else {
+			e.addStep(list.name, false, "没有命中")
+		}
+	}
+
+	if e.MainDomain == "" {
+		e.addStep(ReasonPinyin, false, "无法提取主域名")
+		return
+	}
+	e.Pinyin = e.Decision.Pinyin
+	if e.Pinyin == nil {
+		e.Pinyin = s.pinyinService.ScorePinyinDomain(e.MainDomain)
+	}
+	detail := e.Pinyin.Label
+	if len(e.Pinyin.Syllables) > 0 {
+		detail += " 拆分为 " + strings.Join(e.Pinyin.Syllables, "+")
+	}
+	detail += fmt.Sprintf("，得分 %.2f，阈值 %.2f：%s", e.Pinyin.Score, e.Pinyin.Threshold, e.Pinyin.Reason)
+	e.addStep(ReasonPinyin, e.Pinyin.Matched, detail)
+}
+
+func (e *Explanation) addStep(name string, matched bool, detail string) {
+	e.Steps = append(e.Steps, ExplainStep{Name: name, Matched: matched, Detail: detail})
+}
+
+// markDecisive 标记决定路由的步骤，之后的步骤实际没有执行
+func (e *Explanation) markDecisive() {
+	reason := e.Decision.Reason
+	if reason == ReasonNoBeian {
+		reason = ReasonBeian
+	}
+	decided := false
+	for i := range e.Steps {
+		step := &e.Steps[i]
+		switch {
+		case decided:
+			step.Skipped = true
+		case step.Name == reason:
+			step.Decisive = true
+			decided = true
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package domain
+
+import (
+	"database/sql"
+	"fmt"
+	"go-dns-proxy/admin"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 路由目标
+const (
+	RouteChina   = "china"
+	RouteOversea = "oversea"
+)
+
+// LearnedDomainOptions 学习域名配置
+type LearnedDomainOptions struct {
+	// Disabled 关闭域名学习
+	Disabled bool
+	// TTL 待审核的学习结果在最后一次出现后的有效时间
+	TTL time.Duration
+	// MinHits 学习结果生效前需要观察到的最少次数
+	MinHits int64
+	// FlushInterval 命中次数写入数据库的间隔，默认 1 分钟。路由和状态的变化会立即在后台写入
+	FlushInterval time.Duration
+}
+
+// LearnedDomainStore 根据实际解析结果学习到的域名路由，数据保存在 SQLite 中并缓存在内存。
+// 查询处理过程中只更新内存，变化由后台协程交给 LearnedDomainWriter 批量写入数据库
+type LearnedDomainStore struct {
+	writer  *admin.LearnedDomainWriter
+	options LearnedDomainOptions
+	domains map[string]*admin.LearnedDomain
+	// dirty 内存中有变化、还没有写入数据库的域名
+	dirty map[string]bool
+	mu    sync.RWMutex
+
+	// changed 有路由变化需要尽快写入
+	changed   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+// NewLearnedDomainStore 创建学习域名存储并从数据库加载已有结果
+func NewLearnedDomainStore(db *sql.DB, options LearnedDomainOptions) (*LearnedDomainStore, error) {
+	if options.TTL <= 0 {
+		options.TTL = 7 * 24 * time.Hour
+	}
+	if options.MinHits <= 0 {
+		options.MinHits = 2
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = time.Minute
+	}
+
+	s := &LearnedDomainStore{
+		options: options,
+		domains: make(map[string]*admin.LearnedDomain),
+		dirty:   make(map[string]bool),
+		changed: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	if deleted, err := admin.DeleteExpiredLearnedDomains(db, time.Now()); err != nil {
+		return nil, fmt.Errorf("清理过期学习域名失败: %v", err)
+	} else if deleted > 0 {
+		log.WithField("count", deleted).Info("已清理过期学习域名")
+	}
+
+	domains, err := admin.GetLearnedDomains(db, "", -1)
+	if err != nil {
+		return nil, fmt.Errorf("加载学习域名失败: %v", err)
+	}
+	for i := range domains {
+		s.domains[domains[i].Domain] = &domains[i]
+	}
+
+	log.WithField("count", len(s.domains)).Info("已加载学习域名")
+	s.writer = admin.NewLearnedDomainWriter(db, admin.BatchOptions{})
+	go s.run()
+	return s, nil
+}
+
+// Lookup 返回域名已生效的学习结果
+func (s *LearnedDomainStore) Lookup(domain string) (*admin.LearnedDomain, bool) {
+	domain = normalizeLearnedDomain(domain)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	d, ok := s.domains[domain]
+	if !ok || !s.active(d, time.Now()) {
+		return nil, false
+	}
+	copied := *d
+	return &copied, true
+}
+
+// active 判断学习结果是否参与路由
+func (s *LearnedDomainStore) active(d *admin.LearnedDomain, now time.Time) bool {
+	switch d.Status {
+	case admin.LearnedStatusApproved:
+		return true
+	case admin.LearnedStatusPending:
+		return d.HitCount >= s.options.MinHits && (d.ExpiresAt == nil || now.Before(*d.ExpiresAt))
+	default:
+		return false
+	}
+}
+
+// Observe 记录一次域名实际应该使用的路由，只更新内存，不会被数据库阻塞。
+// 新域名和路由变化会立即在后台写入，命中次数按 FlushInterval 定时写入
+func (s *LearnedDomainStore) Observe(domain, route, evidence string) *admin.LearnedDomain {
+	domain = normalizeLearnedDomain(domain)
+	now := time.Now()
+	expiresAt := now.Add(s.options.TTL)
+
+	s.mu.Lock()
+	d, ok := s.domains[domain]
+	changed := true
+	switch {
+	case !ok || (d.Status == admin.LearnedStatusPending && d.ExpiresAt != nil && !now.Before(*d.ExpiresAt)):
+		// 新域名或已过期的结果重新开始计数
+		d = &admin.LearnedDomain{
+			Domain:    domain,
+			Route:     route,
+			HitCount:  1,
+			Status:    admin.LearnedStatusPending,
+			Evidence:  evidence,
+			FirstSeen: now,
+			LastSeen:  now,
+			ExpiresAt: &expiresAt,
+		}
+		s.domains[domain] = d
+	case d.Status == admin.LearnedStatusRejected:
+		// 已拒绝的域名不再学习
+		s.mu.Unlock()
+		return nil
+	case d.Route == route:
+		changed = false
+		d.HitCount++
+		d.LastSeen = now
+		d.Evidence = evidence
+		if d.Status == admin.LearnedStatusPending {
+			d.ExpiresAt = &expiresAt
+		}
+	case d.Status == admin.LearnedStatusApproved:
+		// 已确认的结果不会被相反的观察覆盖
+		s.mu.Unlock()
+		return nil
+	default:
+		// 观察结果与之前相反，重新计数
+		d.Route = route
+		d.HitCount = 1
+		d.FirstSeen = now
+		d.LastSeen = now
+		d.Evidence = evidence
+		d.ExpiresAt = &expiresAt
+	}
+	s.dirty[domain] = true
+	copied := *d
+	s.mu.Unlock()
+
+	if changed {
+		select {
+		case s.changed <- struct{}{}:
+		default:
+		}
+	}
+	return &copied
+}
+
+// run 在路由变化时和定时将变化加入写入队列，直到 Close 被调用
+func (s *LearnedDomainStore) run() {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(s.options.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.changed:
+		case <-ticker.C:
+		case <-s.done:
+			s.flushAndLog()
+			return
+		}
+		s.flushAndLog()
+	}
+}
+
+func (s *LearnedDomainStore) flushAndLog() {
+	if err := s.flush(); err != nil {
+		log.WithError(err).Warn("学习域名写入队列已满，稍后重试")
+	}
+}
+
+// flush 将有变化的域名加入写入队列，队列已满时留到下次重试。
+// 持有锁时加入队列，保证同一个域名按变化的顺序写入
+func (s *LearnedDomainStore) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	for domain := range s.dirty {
+		if !s.writer.Save(*s.domains[domain]) {
+			err = fmt.Errorf("写入队列已满: %s", domain)
+			break
+		}
+		delete(s.dirty, domain)
+	}
+	return err
+}
+
+// Close 写入剩余的变化并停止后台写入
+func (s *LearnedDomainStore) Close() {
+	if s == nil {
+		return
+	}
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	<-s.stopped
+	s.writer.Close()
+}
+
+// Approve 将学习结果确认为永久规则
+func (s *LearnedDomainStore) Approve(domain string) error {
+	return s.setStatus(domain, admin.LearnedStatusApproved)
+}
+
+// Reject 拒绝学习结果，之后不再学习该域名
+func (s *LearnedDomainStore) Reject(domain string) error {
+	return s.setStatus(domain, admin.LearnedStatusRejected)
+}
+
+func (s *LearnedDomainStore) setStatus(domain, status string) error {
+	domain = normalizeLearnedDomain(domain)
+
+	s.mu.Lock()
+	d, ok := s.domains[domain]
+	if !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("学习域名不存在: %s", domain)
+	}
+	d.Status = status
+	d.ExpiresAt = nil
+	s.dirty[domain] = true
+	route := d.Route
+	s.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"domain": domain,
+		"route":  route,
+		"status": status,
+	}).Info("更新学习域名状态")
+	// 审核结果立即加入写入队列
+	return s.flush()
+}
+
+// Len 返回学习域名数量
+func (s *LearnedDomainStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.domains)
+}
+
+func normalizeLearnedDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
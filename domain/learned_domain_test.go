@@ -0,0 +1,115 @@
+package domain
+
+import (
+	"context"
+	"go-dns-proxy/admin"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestChinaIPService_Contains(t *testing.T) {
+	service := NewChinaIPService()
+	service.SetCIDRs([]string{"1.0.1.0/24", "223.5.5.0/24", "240e::/20"})
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"1.0.1.1", true},
+		{"1.0.2.1", false},
+		{"223.5.5.5", true},
+		{"8.8.8.8", false},
+		{"240e:1::1", true},
+		{"2001:4860::8888", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := service.Contains(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("Contains(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLearnedDomainStore(t *testing.T) {
+	db := setupTestDB(t)
+
+	store, err := NewLearnedDomainStore(db, LearnedDomainOptions{MinHits: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// 第一次观察不生效
+	if d := store.Observe("www.zhongguoyidong.com.", RouteOversea, "test"); d == nil || d.HitCount != 1 {
+		t.Fatalf("Observe() = %+v, want 1 hit", d)
+	}
+	if _, ok := store.Lookup("www.zhongguoyidong.com"); ok {
+		t.Error("Lookup() after 1 hit = true, want false")
+	}
+
+	// 达到最少次数后生效，并优先于拼音判断
+	store.Observe("www.zhongguoyidong.com", RouteOversea, "test")
+	service := NewChinaDomainService()
+	service.SetLearnedStore(store)
+	decision := service.Decide(context.Background(), "www.zhongguoyidong.com")
+	if decision.IsChina || decision.Reason != ReasonLearned {
+		t.Errorf("Decide() = (%v, %s), want (false, %s)", decision.IsChina, decision.Reason, ReasonLearned)
+	}
+
+	// 相反的观察重新计数
+	store.Observe("www.zhongguoyidong.com", RouteChina, "test")
+	if _, ok := store.Lookup("www.zhongguoyidong.com"); ok {
+		t.Error("Lookup() after route flip = true, want false")
+	}
+
+	// 确认后永久生效，重新加载后依然存在
+	if err := store.Approve("www.zhongguoyidong.com"); err != nil {
+		t.Fatal(err)
+	}
+	// 关闭时等待写入队列中的结果保存完成
+	store.Close()
+	reloaded, err := NewLearnedDomainStore(db, LearnedDomainOptions{MinHits: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+	if d, ok := reloaded.Lookup("www.zhongguoyidong.com"); !ok || d.Route != RouteChina {
+		t.Errorf("Lookup() after approve = %+v, %v, want china route", d, ok)
+	}
+
+	// 拒绝后不再学习
+	if err := reloaded.Reject("www.zhongguoyidong.com"); err != nil {
+		t.Fatal(err)
+	}
+	if d := reloaded.Observe("www.zhongguoyidong.com", RouteChina, "test"); d != nil {
+		t.Errorf("Observe() after reject = %+v, want nil", d)
+	}
+	if _, ok := reloaded.Lookup("www.zhongguoyidong.com"); ok {
+		t.Error("Lookup() after reject = true, want false")
+	}
+}
+
+func TestLearnedDomainStore_Flush(t *testing.T) {
+	db := setupTestDB(t)
+
+	// 命中次数只在定时写入或关闭时保存
+	store, err := NewLearnedDomainStore(db, LearnedDomainOptions{FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		store.Observe("www.example.com", RouteChina, "test")
+	}
+	store.Close()
+
+	domains, err := admin.GetLearnedDomains(db, "", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 1 || domains[0].HitCount != 3 || domains[0].Route != RouteChina {
+		t.Errorf("GetLearnedDomains() = %+v, want 1 domain with 3 hits", domains)
+	}
+}
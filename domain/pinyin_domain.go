@@ -6,6 +6,31 @@ import (
 	"github.com/mozillazg/go-pinyin"
 )
 
+// 拼音判断的默认阈值。拼音声母缩写（0.5 分）与 cnn、bbc 等英文缩写无法区分，默认不会命中
+const DefaultPinyinThreshold = 0.6
+
+// PinyinOptions 拼音启发式规则配置
+type PinyinOptions struct {
+	// Disabled 关闭拼音启发式判断
+	Disabled bool
+	// Threshold 判定为拼音域名的最低分数，小于等于 0 时使用默认值
+	Threshold float64
+	// Allowlist 强制视为中国域名的域名后缀
+	Allowlist []string
+	// Denylist 永不按拼音判断的域名后缀
+	Denylist []string
+}
+
+// PinyinResult 拼音判断的详细结果
+type PinyinResult struct {
+	Label     string   `json:"label"`
+	Score     float64  `json:"score"`
+	Threshold float64  `json:"threshold"`
+	Matched   bool     `json:"matched"`
+	Syllables []string `json:"syllables,omitempty"`
+	Reason    string   `json:"reason"`
+}
+
 // PinyinDomainService 用于检测域名是否为拼音域名
 type PinyinDomainService struct {
 	// pinyinArgs 拼音转换的参数配置
@@ -13,6 +38,8 @@ type PinyinDomainService struct {
 	// 常用拼音词组的最小和最大长度
 	minPinyinLen int
 	maxPinyinLen int
+	// threshold 判定为拼音域名的最低分数
+	threshold float64
 }
 
 // NewPinyinDomainService 创建一个新的拼音域名服务
@@ -28,30 +55,82 @@ func NewPinyinDomainService() *PinyinDomainService {
 		pinyinArgs:   args,
 		minPinyinLen: 2,    // 最短的拼音（如"ai"）
 		maxPinyinLen: 6,    // 最长的拼音（如"zhuang"）
+		threshold:    DefaultPinyinThreshold,
 	}
 }
 
+// SetThreshold 设置判定阈值，小于等于 0 时恢复默认值
+func (s *PinyinDomainService) SetThreshold(threshold float64) {
+	if threshold <= 0 {
+		threshold = DefaultPinyinThreshold
+	}
+	s.threshold = threshold
+}
+
 // IsPinyinDomain 检查域名是否为拼音域名
 func (s *PinyinDomainService) IsPinyinDomain(domain string) bool {
+	return s.ScorePinyinDomain(domain).Matched
+}
+
+// ScorePinyinDomain 计算域名为拼音域名的置信度
+func (s *PinyinDomainService) ScorePinyinDomain(domain string) *PinyinResult {
+	result := &PinyinResult{
+		Label:     domain,
+		Threshold: s.threshold,
+	}
+
 	// 检查是否全是字母
 	if !isAllLetters(domain) {
-		return false
+		result.Reason = "包含非字母字符"
+		return result
 	}
 
 	// 排除单个字母的情况
 	if len(domain) < 2 {
-		return false
+		result.Reason = "长度不足"
+		return result
 	}
-	
-	// 检查是否为拼音缩写
-	if len(domain) <= 4 { // 通常拼音缩写不会太长
-		if s.isValidPinyinAbbr(domain) {
-			return true
-		}
+
+	// 常见的中文网站拼音直接给出最高分
+	if knownSitePinyins[domain] {
+		result.Score = 1
+		result.Syllables = []string{domain}
+		result.Reason = "常见中文网站拼音"
+		result.Matched = result.Score >= s.threshold
+		return result
 	}
 
 	// 检查是否为拼音组合
-	return s.isValidPinyinCombination(domain)
+	if syllables := s.splitIntoPinyin(domain); syllables != nil {
+		result.Syllables = syllables
+		switch {
+		case commonEnglishWords[domain]:
+			result.Score = 0.2
+			result.Reason = "可拆分为拼音但也是常见英文单词"
+		case len(syllables) == 1:
+			result.Score = 0.4
+			result.Reason = "单个拼音音节"
+		case len(syllables) == 2:
+			result.Score = 0.7
+			result.Reason = "两个拼音音节"
+		default:
+			result.Score = 0.9
+			result.Reason = "多个拼音音节"
+		}
+		result.Matched = result.Score >= s.threshold
+		return result
+	}
+
+	// 检查是否为拼音缩写
+	if len(domain) <= 4 && s.isValidPinyinAbbr(domain) { // 通常拼音缩写不会太长
+		result.Score = 0.5
+		result.Reason = "拼音声母缩写"
+		result.Matched = result.Score >= s.threshold
+		return result
+	}
+
+	result.Reason = "无法拆分为拼音"
+	return result
 }
 
 // isValidPinyinAbbr 检查是否为有效的拼音缩写
@@ -70,35 +149,28 @@ func (s *PinyinDomainService) isValidPinyinAbbr(word string) bool {
 	return true
 }
 
-// isValidPinyinCombination 检查是否为有效的拼音组合
-func (s *PinyinDomainService) isValidPinyinCombination(word string) bool {
+// splitIntoPinyin 将字符串拆分为音节数最少的拼音组合，无法拆分时返回 nil
+func (s *PinyinDomainService) splitIntoPinyin(word string) []string {
 	// 如果长度太短或太长，可能不是拼音
 	if len(word) < 2 || len(word) > 30 {
-		return false
+		return nil
 	}
 
-	// 尝试将词分割成可能的拼音片段
-	return s.canBeSplitIntoPinyin(word)
-}
-
-// canBeSplitIntoPinyin 检查字符串是否可以被分割成有效的拼音组合
-func (s *PinyinDomainService) canBeSplitIntoPinyin(word string) bool {
-	if word == "" {
-		return true
-	}
-
-	// 尝试不同长度的前缀
-	for i := s.minPinyinLen; i <= s.maxPinyinLen && i <= len(word); i++ {
-		prefix := word[:i]
-		// 检查这个前缀是否是有效的拼音
-		if s.isValidSinglePinyin(prefix) {
-			// 递归检查剩余部分
-			if s.canBeSplitIntoPinyin(word[i:]) {
-				return true
+	// best[i] 表示 word[i:] 的最优拆分
+	best := make([][]string, len(word)+1)
+	best[len(word)] = []string{}
+	for i := len(word) - 1; i >= 0; i-- {
+		for l := s.minPinyinLen; l <= s.maxPinyinLen && i+l <= len(word); l++ {
+			rest := best[i+l]
+			if rest == nil || !s.isValidSinglePinyin(word[i:i+l]) {
+				continue
+			}
+			if best[i] == nil || len(rest)+1 < len(best[i]) {
+				best[i] = append([]string{word[i : i+l]}, rest...)
 			}
 		}
 	}
-	return false
+	return best[0]
 }
 
 // isValidSinglePinyin 检查是否为有效的单个拼音
@@ -154,14 +226,9 @@ func (s *PinyinDomainService) isValidSinglePinyin(pinyin string) bool {
 		// 零声母
 		"a": true, "o": true, "e": true, "ai": true, "ei": true, "ao": true, "ou": true, "an": true, "en": true, "ang": true, "eng": true, "er": true,
 
-		// 常见的中文网站拼音
-		"taobao": true, "baidu": true, "weixin": true, "zhihu": true, "youku": true, "tudou": true, "alibaba": true, "alipay": true,
-		"tencent": true, "douyin": true, "weibo": true, "xiami": true, "huawei": true, "xiaomi": true, "pinduoduo": true,
-		"meituan": true, "dianping": true, "ctrip": true, "feiniu": true, "suning": true, "guomei": true,
-		"dangdang": true, "tianmao": true, "feishu": true,
 	}
 
-	return validPinyins[pinyin]
+	return validPinyins[pinyin] || knownSitePinyins[pinyin]
 }
 
 // isPinyinInitial 检查字母是否是有效的拼音声母
@@ -186,4 +253,23 @@ func isAllLetters(s string) bool {
 		}
 	}
 	return true
-} 
\ No newline at end of file
+}
+
+// knownSitePinyins 常见的中文网站拼音
+var knownSitePinyins = map[string]bool{
+	"taobao": true, "baidu": true, "weixin": true, "zhihu": true, "youku": true, "tudou": true, "alibaba": true, "alipay": true,
+	"tencent": true, "douyin": true, "weibo": true, "xiami": true, "huawei": true, "xiaomi": true, "pinduoduo": true,
+	"meituan": true, "dianping": true, "ctrip": true, "feiniu": true, "suning": true, "guomei": true,
+	"dangdang": true, "tianmao": true, "feishu": true,
+}
+
+// commonEnglishWords 可以拆分为拼音的常见英文单词，这些单词作为域名时通常不是中文网站
+var commonEnglishWords = map[string]bool{
+	"bing": true, "china": true, "panda": true, "banana": true, "line": true, "dune": true,
+	"pin": true, "ping": true, "long": true, "song": true, "man": true, "men": true,
+	"fan": true, "ban": true, "pan": true, "tan": true, "can": true, "ran": true,
+	"sun": true, "run": true, "bun": true, "gun": true, "she": true, "die": true,
+	"tie": true, "pie": true, "lie": true, "bin": true, "hen": true, "pen": true,
+	"zen": true, "bang": true, "hang": true, "gang": true, "mile": true, "tile": true,
+	"pile": true, "tune": true, "june": true,
+}
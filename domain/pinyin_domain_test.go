@@ -0,0 +1,212 @@
+package domain
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPinyinDomainService_ScorePinyinDomain(t *testing.T) {
+	service := NewPinyinDomainService()
+
+	tests := []struct {
+		name      string
+		label     string
+		wantMatch bool
+		wantSplit int
+	}{
+		{
+			name:      "Test known site",
+			label:     "taobao",
+			wantMatch: true,
+			wantSplit: 1,
+		},
+		{
+			name:      "Test multi syllable pinyin",
+			label:     "zhongguoyidong",
+			wantMatch: true,
+			wantSplit: 4,
+		},
+		{
+			name:      "Test two syllable pinyin",
+			label:     "xinlang",
+			wantMatch: true,
+			wantSplit: 2,
+		},
+		{
+			name:      "Test pinyin abbreviation",
+			label:     "zgyd",
+			wantMatch: false,
+			wantSplit: 0,
+		},
+		{
+			name:      "Test english abbreviation cnn",
+			label:     "cnn",
+			wantMatch: false,
+			wantSplit: 0,
+		},
+		{
+			name:      "Test english abbreviation bbc",
+			label:     "bbc",
+			wantMatch: false,
+			wantSplit: 0,
+		},
+		{
+			name:      "Test english abbreviation abc",
+			label:     "abc",
+			wantMatch: false,
+			wantSplit: 0,
+		},
+		{
+			name:      "Test brand bmw",
+			label:     "bmw",
+			wantMatch: false,
+			wantSplit: 0,
+		},
+		{
+			name:      "Test english word sky",
+			label:     "sky",
+			wantMatch: false,
+			wantSplit: 0,
+		},
+		{
+			name:      "Test single syllable",
+			label:     "bing",
+			wantMatch: false,
+			wantSplit: 1,
+		},
+		{
+			name:      "Test english word",
+			label:     "china",
+			wantMatch: false,
+			wantSplit: 2,
+		},
+		{
+			name:      "Test non pinyin",
+			label:     "google",
+			wantMatch: false,
+			wantSplit: 0,
+		},
+		{
+			name:      "Test digits",
+			label:     "360",
+			wantMatch: false,
+			wantSplit: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := service.ScorePinyinDomain(tt.label)
+			if result.Matched != tt.wantMatch {
+				t.Errorf("ScorePinyinDomain(%s).Matched = %v (score %.2f, %s), want %v",
+					tt.label, result.Matched, result.Score, result.Reason, tt.wantMatch)
+			}
+			if len(result.Syllables) != tt.wantSplit {
+				t.Errorf("ScorePinyinDomain(%s).Syllables = %v, want %d syllables", tt.label, result.Syllables, tt.wantSplit)
+			}
+		})
+	}
+
+	// 阈值降低到 0.5 后拼音声母缩写才会命中
+	service.SetThreshold(0.5)
+	if !service.IsPinyinDomain("zgyd") {
+		t.Error("IsPinyinDomain(zgyd) = false with threshold 0.5, want true")
+	}
+
+	// 降低阈值后单个音节也会命中
+	service.SetThreshold(0.3)
+	if !service.IsPinyinDomain("dong") {
+		t.Error("IsPinyinDomain(dong) = false with threshold 0.3, want true")
+	}
+	if service.IsPinyinDomain("bing") {
+		t.Error("IsPinyinDomain(bing) = true with threshold 0.3, want false")
+	}
+}
+
+func TestChinaDomainService_PinyinOptions(t *testing.T) {
+	service := NewChinaDomainService()
+	ctx := context.Background()
+
+	tests := []struct {
+		name       string
+		options    PinyinOptions
+		domain     string
+		wantChina  bool
+		wantReason string
+	}{
+		{
+			name:       "Test pinyin heuristic",
+			options:    PinyinOptions{},
+			domain:     "www.zhongguoyidong.com",
+			wantChina:  true,
+			wantReason: ReasonPinyin,
+		},
+		{
+			name:       "Test pinyin abbreviation with default threshold",
+			options:    PinyinOptions{},
+			domain:     "www.zgyd.com",
+			wantChina:  false,
+			wantReason: ReasonDefault,
+		},
+		{
+			name:       "Test pinyin abbreviation with lowered threshold",
+			options:    PinyinOptions{Threshold: 0.5},
+			domain:     "www.zgyd.com",
+			wantChina:  true,
+			wantReason: ReasonPinyin,
+		},
+		{
+			name:       "Test english abbreviation",
+			options:    PinyinOptions{},
+			domain:     "edition.cnn.com",
+			wantChina:  false,
+			wantReason: ReasonDefault,
+		},
+		{
+			name:       "Test english brand",
+			options:    PinyinOptions{},
+			domain:     "www.bbc.co.uk",
+			wantChina:  false,
+			wantReason: ReasonDefault,
+		},
+		{
+			name:       "Test pinyin disabled",
+			options:    PinyinOptions{Disabled: true},
+			domain:     "www.zhongguoyidong.com",
+			wantChina:  false,
+			wantReason: ReasonDefault,
+		},
+		{
+			name:       "Test denylist",
+			options:    PinyinOptions{Denylist: []string{"zhongguoyidong.com"}},
+			domain:     "www.zhongguoyidong.com",
+			wantChina:  false,
+			wantReason: ReasonPinyinDenylist,
+		},
+		{
+			name:       "Test allowlist",
+			options:    PinyinOptions{Allowlist: []string{"example.com"}},
+			domain:     "cdn.example.com",
+			wantChina:  true,
+			wantReason: ReasonPinyinAllowlist,
+		},
+		{
+			name:       "Test china tld ignores options",
+			options:    PinyinOptions{Disabled: true},
+			domain:     "www.example.cn",
+			wantChina:  true,
+			wantReason: ReasonChinaTLD,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service.SetPinyinOptions(tt.options)
+			decision := service.Decide(ctx, tt.domain)
+			if decision.IsChina != tt.wantChina || decision.Reason != tt.wantReason {
+				t.Errorf("Decide(%s) = (%v, %s), want (%v, %s)",
+					tt.domain, decision.IsChina, decision.Reason, tt.wantChina, tt.wantReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package ecs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// optionCode EDNS Client Subnet 选项的代码（RFC 7871）
+const optionCode = 8
+
+// udpPayloadSize 添加 OPT 记录时声明的 UDP 负载大小
+const udpPayloadSize = 1232
+
+// ECS 处理方式
+const (
+	// ModeOff 不修改查询中的 ECS
+	ModeOff = "off"
+	// ModeForward 使用客户端所在的子网
+	ModeForward = "forward"
+	// ModeFixed 使用固定的子网
+	ModeFixed = "fixed"
+	// ModeStrip 删除查询中的 ECS
+	ModeStrip = "strip"
+)
+
+// Options ECS 配置
+type Options struct {
+	// Mode 处理方式
+	Mode string
+	// Subnet ModeFixed 使用的子网
+	Subnet *net.IPNet
+	// IPv4Prefix ModeForward 时 IPv4 客户端使用的前缀长度，默认 24
+	IPv4Prefix int
+	// IPv6Prefix ModeForward 时 IPv6 客户端使用的前缀长度，默认 56
+	IPv6Prefix int
+}
+
+// ParseOptions 解析 ECS 配置，支持 off、forward、strip 或者固定的子网，例如 203.0.113.0/24
+func ParseOptions(s string) (Options, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	switch s {
+	case "", ModeOff:
+		return Options{Mode: ModeOff}, nil
+	case ModeForward, ModeStrip:
+		return Options{Mode: s}, nil
+	}
+
+	if !strings.Contains(s, "/") {
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			s = fmt.Sprintf("%s/%d", s, bits)
+		}
+	}
+	_, subnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return Options{}, fmt.Errorf("无效的 ECS 配置: %s，支持 off、forward、strip 或子网", s)
+	}
+	return Options{Mode: ModeFixed, Subnet: subnet}, nil
+}
+
+// Subnet 消息中的 ECS 选项
+type Subnet struct {
+	// Net 源地址和源前缀长度
+	Net *net.IPNet
+	// Scope 应答适用的前缀长度，只在响应中有意义
+	Scope int
+}
+
+// Policy 按配置修改发往上游的查询中的 ECS
+type Policy struct {
+	options Options
+}
+
+// New 创建 ECS 处理策略
+func New(options Options) (*Policy, error) {
+	switch options.Mode {
+	case "":
+		options.Mode = ModeOff
+	case ModeOff, ModeForward, ModeStrip:
+	case ModeFixed:
+		if options.Subnet == nil {
+			return nil, fmt.Errorf("固定 ECS 子网为空")
+		}
+	default:
+		return nil, fmt.Errorf("无效的 ECS 处理方式: %s", options.Mode)
+	}
+	if options.IPv4Prefix == 0 {
+		options.IPv4Prefix = 24
+	}
+	if options.IPv6Prefix == 0 {
+		options.IPv6Prefix = 56
+	}
+	if options.IPv4Prefix < 0 || options.IPv4Prefix > 32 || options.IPv6Prefix < 0 || options.IPv6Prefix > 128 {
+		return nil, fmt.Errorf("无效的 ECS 前缀长度: /%d, /%d", options.IPv4Prefix, options.IPv6Prefix)
+	}
+	return &Policy{options: options}, nil
+}
+
+// Mode 返回处理方式
+func (p *Policy) Mode() string {
+	if p == nil {
+		return ModeOff
+	}
+	return p.options.Mode
+}
+
+// Apply 按配置替换或删除查询中的 ECS。附加记录会被复制，不影响原来的消息
+func (p *Policy) Apply(msg *dnsmessage.Message, clientIP net.IP) {
+	if p.Mode() == ModeOff {
+		return
+	}
+
+	msg.Additionals = withoutECS(msg.Additionals)
+	if p.options.Mode == ModeStrip {
+		return
+	}
+
+	subnet := p.options.Subnet
+	if p.options.Mode == ModeForward {
+		subnet = p.clientSubnet(clientIP)
+	}
+	if subnet == nil {
+		return
+	}
+
+	option := dnsmessage.Option{Code: optionCode, Data: encode(subnet)}
+	for i, rr := range msg.Additionals {
+		if opt, ok := rr.Body.(*dnsmessage.OPTResource); ok {
+			options := append(append([]dnsmessage.Option{}, opt.Options...), option)
+			msg.Additionals[i].Body = &dnsmessage.OPTResource{Options: options}
+			return
+		}
+	}
+
+	var header dnsmessage.ResourceHeader
+	header.SetEDNS0(udpPayloadSize, dnsmessage.RCodeSuccess, false)
+	msg.Additionals = append(msg.Additionals, dnsmessage.Resource{
+		Header: header,
+		Body:   &dnsmessage.OPTResource{Options: []dnsmessage.Option{option}},
+	})
+}
+
+// clientSubnet 返回客户端所在的子网，内网地址不发送给上游
+func (p *Policy) clientSubnet(ip net.IP) *net.IPNet {
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		mask := net.CIDRMask(p.options.IPv4Prefix, 32)
+		return &net.IPNet{IP: ip4.Mask(mask), Mask: mask}
+	}
+	mask := net.CIDRMask(p.options.IPv6Prefix, 128)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// FromMessage 读取消息中的 ECS 选项
+func FromMessage(msg *dnsmessage.Message) (Subnet, bool) {
+	for _, rr := range msg.Additionals {
+		opt, ok := rr.Body.(*dnsmessage.OPTResource)
+		if !ok {
+			continue
+		}
+		for _, option := range opt.Options {
+			if option.Code != optionCode {
+				continue
+			}
+			if subnet, ok := decode(option.Data); ok {
+				return subnet, true
+			}
+		}
+	}
+	return Subnet{}, false
+}
+
+// StripResponse 删除上游响应中的 ECS 选项，客户端的查询没有 OPT 记录时同时删除 OPT 记录
+func StripResponse(msg *dnsmessage.Message, keepOPT bool) {
+	if !keepOPT {
+		var additionals []dnsmessage.Resource
+		for _, rr := range msg.Additionals {
+			if rr.Header.Type != dnsmessage.TypeOPT {
+				additionals = append(additionals, rr)
+			}
+		}
+		msg.Additionals = additionals
+		return
+	}
+	msg.Additionals = withoutECS(msg.Additionals)
+}
+
+// HasOPT 判断消息是否包含 OPT 记录
+func HasOPT(msg *dnsmessage.Message) bool {
+	for _, rr := range msg.Additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutECS 复制附加记录并删除 OPT 记录中的 ECS 选项
+func withoutECS(additionals []dnsmessage.Resource) []dnsmessage.Resource {
+	result := make([]dnsmessage.Resource, 0, len(additionals)+1)
+	for _, rr := range additionals {
+		if opt, ok := rr.Body.(*dnsmessage.OPTResource); ok {
+			var options []dnsmessage.Option
+			for _, option := range opt.Options {
+				if option.Code != optionCode {
+					options = append(options, option)
+				}
+			}
+			rr.Body = &dnsmessage.OPTResource{Options: options}
+		}
+		result = append(result, rr)
+	}
+	return result
+}
+
+// encode 编码 ECS 选项：地址族、源前缀长度、作用域前缀长度和截断后的地址
+func encode(subnet *net.IPNet) []byte {
+	prefix, bits := subnet.Mask.Size()
+	family, ip := uint16(2), subnet.IP.To16()
+	if bits == 32 {
+		family, ip = 1, subnet.IP.To4()
+	}
+	data := make([]byte, 4, 4+(prefix+7)/8)
+	binary.BigEndian.PutUint16(data, family)
+	data[2] = byte(prefix)
+	data[3] = 0
+	return append(data, ip.Mask(subnet.Mask)[:(prefix+7)/8]...)
+}
+
+func decode(data []byte) (Subnet, bool) {
+	if len(data) < 4 {
+		return Subnet{}, false
+	}
+	family := binary.BigEndian.Uint16(data)
+	source, scope := int(data[2]), int(data[3])
+	bits := 0
+	switch family {
+	case 1:
+		bits = 32
+	case 2:
+		bits = 128
+	default:
+		return Subnet{}, false
+	}
+	if source > bits || scope > bits || len(data)-4 > bits/8 {
+		return Subnet{}, false
+	}
+
+	ip := make(net.IP, bits/8)
+	copy(ip, data[4:])
+	mask := net.CIDRMask(source, bits)
+	return Subnet{Net: &net.IPNet{IP: ip.Mask(mask), Mask: mask}, Scope: scope}, true
+}
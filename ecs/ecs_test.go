@@ -0,0 +1,133 @@
+package ecs
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func newQuery(withECS string) *dnsmessage.Message {
+	msg := &dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 1, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName("example.com."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	if withECS != "" {
+		_, subnet, _ := net.ParseCIDR(withECS)
+		var header dnsmessage.ResourceHeader
+		header.SetEDNS0(4096, dnsmessage.RCodeSuccess, false)
+		msg.Additionals = []dnsmessage.Resource{{
+			Header: header,
+			Body:   &dnsmessage.OPTResource{Options: []dnsmessage.Option{{Code: optionCode, Data: encode(subnet)}}},
+		}}
+	}
+	return msg
+}
+
+func TestParseOptions(t *testing.T) {
+	tests := []struct {
+		input      string
+		wantMode   string
+		wantSubnet string
+		wantErr    bool
+	}{
+		{"", ModeOff, "", false},
+		{"Forward", ModeForward, "", false},
+		{"strip", ModeStrip, "", false},
+		{"203.0.113.0/24", ModeFixed, "203.0.113.0/24", false},
+		{"203.0.113.7", ModeFixed, "203.0.113.7/32", false},
+		{"2001:db8::/48", ModeFixed, "2001:db8::/48", false},
+		{"anycast", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseOptions(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got.Mode != tt.wantMode {
+				t.Errorf("Mode = %s, want %s", got.Mode, tt.wantMode)
+			}
+			if tt.wantSubnet != "" && got.Subnet.String() != tt.wantSubnet {
+				t.Errorf("Subnet = %s, want %s", got.Subnet, tt.wantSubnet)
+			}
+		})
+	}
+}
+
+func TestPolicy_Apply(t *testing.T) {
+	_, fixed, _ := net.ParseCIDR("198.51.100.0/24")
+
+	tests := []struct {
+		name       string
+		options    Options
+		clientECS  string
+		clientIP   string
+		wantSubnet string
+	}{
+		{"off keeps client ecs", Options{Mode: ModeOff}, "192.0.2.0/24", "203.0.113.9", "192.0.2.0/24"},
+		{"strip", Options{Mode: ModeStrip}, "192.0.2.0/24", "203.0.113.9", ""},
+		{"fixed", Options{Mode: ModeFixed, Subnet: fixed}, "", "203.0.113.9", "198.51.100.0/24"},
+		{"fixed replaces client ecs", Options{Mode: ModeFixed, Subnet: fixed}, "192.0.2.0/24", "203.0.113.9", "198.51.100.0/24"},
+		{"forward", Options{Mode: ModeForward}, "", "203.0.113.9", "203.0.113.0/24"},
+		{"forward ipv6", Options{Mode: ModeForward}, "", "2001:db8:1:2::9", "2001:db8:1::/56"},
+		{"forward private client", Options{Mode: ModeForward}, "", "192.168.1.9", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := New(tt.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			original := newQuery(tt.clientECS)
+			msg := *original
+			p.Apply(&msg, net.ParseIP(tt.clientIP))
+
+			// 打包后重新解析，确认选项编码正确
+			packed, err := msg.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var parsed dnsmessage.Message
+			if err := parsed.Unpack(packed); err != nil {
+				t.Fatal(err)
+			}
+
+			subnet, ok := FromMessage(&parsed)
+			if tt.wantSubnet == "" {
+				if ok {
+					t.Errorf("FromMessage() = %s, want no ECS", subnet.Net)
+				}
+			} else if !ok || subnet.Net.String() != tt.wantSubnet {
+				t.Errorf("FromMessage() = %v, %v, want %s", subnet.Net, ok, tt.wantSubnet)
+			}
+
+			// 原来的查询不受影响
+			if tt.clientECS != "" {
+				if subnet, _ := FromMessage(original); subnet.Net.String() != tt.clientECS {
+					t.Errorf("original query ECS = %s, want %s", subnet.Net, tt.clientECS)
+				}
+			}
+		})
+	}
+}
+
+func TestStripResponse(t *testing.T) {
+	resp := newQuery("203.0.113.0/24")
+	StripResponse(resp, true)
+	if _, ok := FromMessage(resp); ok || !HasOPT(resp) {
+		t.Error("StripResponse(keepOPT) should remove ECS and keep OPT")
+	}
+
+	resp = newQuery("203.0.113.0/24")
+	StripResponse(resp, false)
+	if HasOPT(resp) {
+		t.Error("StripResponse() should remove OPT")
+	}
+}
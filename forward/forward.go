@@ -0,0 +1,125 @@
+package forward
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// privateReverseZones 内网地址的反向解析区域（RFC 1918、RFC 6303），以及运营商级 NAT 地址 100.64.0.0/10
+var privateReverseZones = func() []string {
+	zones := []string{
+		"10.in-addr.arpa",
+		"168.192.in-addr.arpa",
+		"254.169.in-addr.arpa",
+		"c.f.ip6.arpa",
+		"d.f.ip6.arpa",
+		"8.e.f.ip6.arpa",
+		"9.e.f.ip6.arpa",
+		"a.e.f.ip6.arpa",
+		"b.e.f.ip6.arpa",
+	}
+	for i := 16; i <= 31; i++ {
+		zones = append(zones, fmt.Sprintf("%d.172.in-addr.arpa", i))
+	}
+	for i := 64; i <= 127; i++ {
+		zones = append(zones, fmt.Sprintf("%d.100.in-addr.arpa", i))
+	}
+	return zones
+}()
+
+// localZones 局域网内使用的域名
+var localZones = []string{"lan", "home.arpa"}
+
+// DefaultZones 默认转发的区域，包括内网地址的反向解析区域和局域网域名
+func DefaultZones() []string {
+	return append(append([]string{}, privateReverseZones...), localZones...)
+}
+
+// Rule 一条条件转发规则
+type Rule struct {
+	// Zone 域名或反向解析区域，包含子域名
+	Zone string `json:"zone"`
+	// Server 上游 DNS 服务器，为空时直接返回 NXDOMAIN
+	Server string `json:"server"`
+}
+
+// ParseRule 解析条件转发规则，格式为 zone=server，例如 lan=127.0.0.1:5353。
+// server 为空时该区域直接返回 NXDOMAIN
+func ParseRule(s string) (Rule, error) {
+	zone, server, ok := strings.Cut(s, "=")
+	zone = normalizeZone(zone)
+	if !ok || zone == "" {
+		return Rule{}, fmt.Errorf("无效的条件转发规则: %s，格式为 zone=server", s)
+	}
+	return Rule{Zone: zone, Server: strings.TrimSpace(server)}, nil
+}
+
+// Options 条件转发配置
+type Options struct {
+	// Rules 条件转发规则，优先于默认区域
+	Rules []Rule
+	// LocalServer 默认区域使用的上游 DNS 服务器，例如路由器上的 dnsmasq，
+	// 为空时默认区域直接返回 NXDOMAIN，避免内部域名泄露到公共 DNS
+	LocalServer string
+	// DefaultZonesDisabled 不转发默认区域
+	DefaultZonesDisabled bool
+}
+
+// Forwarder 按域名选择条件转发规则
+type Forwarder struct {
+	rules []Rule
+}
+
+// New 创建条件转发，自定义规则覆盖默认区域中相同的区域
+func New(options Options) *Forwarder {
+	rules := make(map[string]Rule)
+	if !options.DefaultZonesDisabled {
+		for _, zone := range DefaultZones() {
+			rules[zone] = Rule{Zone: zone, Server: options.LocalServer}
+		}
+	}
+	for _, rule := range options.Rules {
+		rule.Zone = normalizeZone(rule.Zone)
+		rules[rule.Zone] = rule
+	}
+
+	f := &Forwarder{}
+	for _, rule := range rules {
+		f.rules = append(f.rules, rule)
+	}
+	// 更具体的区域优先匹配
+	sort.Slice(f.rules, func(i, j int) bool {
+		if len(f.rules[i].Zone) != len(f.rules[j].Zone) {
+			return len(f.rules[i].Zone) > len(f.rules[j].Zone)
+		}
+		return f.rules[i].Zone < f.rules[j].Zone
+	})
+	return f
+}
+
+// Match 返回域名匹配的条件转发规则
+func (f *Forwarder) Match(domain string) (Rule, bool) {
+	if f == nil {
+		return Rule{}, false
+	}
+	domain = normalizeZone(domain)
+	for _, rule := range f.rules {
+		if domain == rule.Zone || strings.HasSuffix(domain, "."+rule.Zone) {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+// Rules 返回所有条件转发规则
+func (f *Forwarder) Rules() []Rule {
+	if f == nil {
+		return nil
+	}
+	return f.rules
+}
+
+func normalizeZone(zone string) string {
+	return strings.ToLower(strings.Trim(strings.TrimSpace(zone), "."))
+}
@@ -0,0 +1,75 @@
+package forward
+
+import "testing"
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    Rule
+		wantErr bool
+	}{
+		{"lan=127.0.0.1:5353", Rule{Zone: "lan", Server: "127.0.0.1:5353"}, false},
+		{"Corp.Example.com.=tls://10.0.0.53", Rule{Zone: "corp.example.com", Server: "tls://10.0.0.53"}, false},
+		{"1.168.192.in-addr.arpa=", Rule{Zone: "1.168.192.in-addr.arpa"}, false},
+		{"lan", Rule{}, true},
+		{"=127.0.0.1", Rule{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseRule(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseRule() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwarder_Match(t *testing.T) {
+	f := New(Options{
+		LocalServer: "127.0.0.1:5353",
+		Rules: []Rule{
+			{Zone: "corp.example.com", Server: "10.0.0.53"},
+			{Zone: "1.168.192.in-addr.arpa", Server: "192.168.1.1"},
+			{Zone: "home.arpa", Server: ""},
+		},
+	})
+
+	tests := []struct {
+		domain     string
+		wantZone   string
+		wantServer string
+		wantOK     bool
+	}{
+		{"nas.lan", "lan", "127.0.0.1:5353", true},
+		{"10.2.168.192.in-addr.arpa.", "168.192.in-addr.arpa", "127.0.0.1:5353", true},
+		{"10.1.168.192.in-addr.arpa.", "1.168.192.in-addr.arpa", "192.168.1.1", true},
+		{"1.0.20.172.in-addr.arpa", "20.172.in-addr.arpa", "127.0.0.1:5353", true},
+		{"1.0.32.172.in-addr.arpa", "", "", false},
+		{"1.0.64.100.in-addr.arpa", "64.100.in-addr.arpa", "127.0.0.1:5353", true},
+		{"1.0.127.100.in-addr.arpa", "127.100.in-addr.arpa", "127.0.0.1:5353", true},
+		{"1.0.128.100.in-addr.arpa", "", "", false},
+		{"printer.home.arpa", "home.arpa", "", true},
+		{"git.corp.example.com", "corp.example.com", "10.0.0.53", true},
+		{"example.com", "", "", false},
+		{"plan", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			rule, ok := f.Match(tt.domain)
+			if ok != tt.wantOK || rule.Zone != tt.wantZone || rule.Server != tt.wantServer {
+				t.Errorf("Match(%s) = %+v, %v, want %s=%s, %v", tt.domain, rule, ok, tt.wantZone, tt.wantServer, tt.wantOK)
+			}
+		})
+	}
+
+	// 关闭默认区域后只使用自定义规则
+	f = New(Options{DefaultZonesDisabled: true})
+	if _, ok := f.Match("nas.lan"); ok {
+		t.Error("Match(nas.lan) with default zones disabled = true, want false")
+	}
+}
@@ -0,0 +1,433 @@
+package hosts
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DefaultTTL 本地记录的默认 TTL
+const DefaultTTL = 60
+
+// Record 一条本地记录
+type Record struct {
+	Name  string
+	Type  dnsmessage.Type
+	TTL   uint32
+	Value string
+}
+
+// Store 本地 hosts 文件和静态记录，在路由之前直接应答
+type Store struct {
+	hostsFile     string
+	staticRecords []Record
+
+	mu      sync.RWMutex
+	records map[string][]Record
+	modTime time.Time
+}
+
+// NewStore 创建本地记录存储，hostsFile 为空时只使用静态记录
+//
+// 静态记录格式为 "name [ttl] TYPE value"，支持 A、AAAA、CNAME、TXT、SRV、PTR，例如：
+//
+//	nas.home A 192.168.1.10
+//	_http._tcp.home 300 SRV 10 5 80 nas.home
+func NewStore(hostsFile string, staticRecords []string) (*Store, error) {
+	s := &Store{hostsFile: hostsFile}
+
+	for _, line := range staticRecords {
+		record, err := ParseRecord(line)
+		if err != nil {
+			return nil, err
+		}
+		s.staticRecords = append(s.staticRecords, record)
+	}
+
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload 重新读取 hosts 文件
+func (s *Store) Reload() error {
+	var fileRecords []Record
+	var modTime time.Time
+
+	if s.hostsFile != "" {
+		file, err := os.Open(s.hostsFile)
+		if err != nil {
+			return fmt.Errorf("打开 hosts 文件失败: %v", err)
+		}
+		defer file.Close()
+
+		if info, err := file.Stat(); err == nil {
+			modTime = info.ModTime()
+		}
+		fileRecords, err = ParseHosts(file)
+		if err != nil {
+			return fmt.Errorf("解析 hosts 文件失败: %v", err)
+		}
+	}
+
+	records := make(map[string][]Record)
+	for _, list := range [][]Record{s.staticRecords, fileRecords} {
+		for _, r := range list {
+			records[r.Name] = append(records[r.Name], r)
+		}
+	}
+	synthesizePTR(records)
+
+	s.mu.Lock()
+	s.records = records
+	s.modTime = modTime
+	s.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"file":  s.hostsFile,
+		"names": len(records),
+	}).Info("已加载本地记录")
+	return nil
+}
+
+// Watch 定期检查 hosts 文件修改时间，变化时重新加载，直到 stop 关闭
+func (s *Store) Watch(stop <-chan struct{}, interval time.Duration) {
+	if s.hostsFile == "" {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			info, err := os.Stat(s.hostsFile)
+			if err != nil {
+				continue
+			}
+
+			s.mu.RLock()
+			changed := !info.ModTime().Equal(s.modTime)
+			s.mu.RUnlock()
+
+			if changed {
+				if err := s.Reload(); err != nil {
+					log.WithError(err).Error("重新加载 hosts 文件失败")
+				}
+			}
+		}
+	}
+}
+
+// Lookup 查找本地记录，found 表示该域名由本地记录负责（可能没有对应类型的记录）
+func (s *Store) Lookup(question dnsmessage.Question) (answers []dnsmessage.Resource, found bool) {
+	name := normalizeName(question.Name.String())
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.records[name]; !ok {
+		return nil, false
+	}
+
+	// 跟随本地 CNAME，最多 8 层，找到目标类型的记录或者没有下一个 CNAME 时停止
+	var chain []dnsmessage.Resource
+	for i := 0; i < 8; i++ {
+		var cname *Record
+		for _, r := range s.records[name] {
+			r := r
+			if r.Type == question.Type {
+				rr, err := r.resource()
+				if err != nil {
+					log.WithError(err).WithField("name", r.Name).Error("本地记录无效")
+					continue
+				}
+				answers = append(answers, rr)
+			} else if r.Type == dnsmessage.TypeCNAME {
+				cname = &r
+			}
+		}
+
+		if len(answers) > 0 || cname == nil || question.Type == dnsmessage.TypeCNAME {
+			break
+		}
+
+		rr, err := cname.resource()
+		if err != nil {
+			break
+		}
+		chain = append(chain, rr)
+		name = normalizeName(cname.Value)
+	}
+
+	return append(chain, answers...), true
+}
+
+// Names 返回 IP 地址在本地记录中对应的域名
+func (s *Store) Names(ip net.IP) []string {
+	reverse, err := ReverseName(ip)
+	if err != nil {
+		return nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var names []string
+	for _, r := range s.records[reverse] {
+		if r.Type == dnsmessage.TypePTR {
+			names = append(names, normalizeName(r.Value))
+		}
+	}
+	return names
+}
+
+// Len 返回本地记录的域名数量
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.records)
+}
+
+// ParseHosts 解析 hosts 格式的内容
+func ParseHosts(r io.Reader) ([]Record, error) {
+	var records []Record
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		recordType := dnsmessage.TypeAAAA
+		if ip.To4() != nil {
+			recordType = dnsmessage.TypeA
+		}
+
+		for _, name := range fields[1:] {
+			records = append(records, Record{
+				Name:  normalizeName(name),
+				Type:  recordType,
+				TTL:   DefaultTTL,
+				Value: ip.String(),
+			})
+		}
+	}
+
+	return records, scanner.Err()
+}
+
+// ParseRecord 解析一条静态记录，格式为 "name [ttl] TYPE value"
+func ParseRecord(line string) (Record, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return Record{}, fmt.Errorf("无效的静态记录: %s", line)
+	}
+
+	record := Record{Name: normalizeName(fields[0]), TTL: DefaultTTL}
+	rest := fields[1:]
+	if ttl, err := strconv.ParseUint(rest[0], 10, 32); err == nil {
+		record.TTL = uint32(ttl)
+		rest = rest[1:]
+	}
+	if len(rest) < 2 {
+		return Record{}, fmt.Errorf("无效的静态记录: %s", line)
+	}
+
+	switch strings.ToUpper(rest[0]) {
+	case "A":
+		record.Type = dnsmessage.TypeA
+	case "AAAA":
+		record.Type = dnsmessage.TypeAAAA
+	case "CNAME":
+		record.Type = dnsmessage.TypeCNAME
+	case "TXT":
+		record.Type = dnsmessage.TypeTXT
+	case "SRV":
+		record.Type = dnsmessage.TypeSRV
+	case "PTR":
+		record.Type = dnsmessage.TypePTR
+	default:
+		return Record{}, fmt.Errorf("不支持的记录类型 %s: %s", rest[0], line)
+	}
+	record.Value = strings.Join(rest[1:], " ")
+	if record.Type == dnsmessage.TypeTXT {
+		record.Value = strings.Trim(record.Value, `"`)
+	}
+
+	// 提前检查记录值是否有效
+	if _, err := record.resource(); err != nil {
+		return Record{}, fmt.Errorf("无效的静态记录 %s: %v", line, err)
+	}
+	return record, nil
+}
+
+// resource 将记录转换为 DNS 应答资源
+func (r Record) resource() (dnsmessage.Resource, error) {
+	name, err := dnsmessage.NewName(r.Name + ".")
+	if err != nil {
+		return dnsmessage.Resource{}, err
+	}
+	header := dnsmessage.ResourceHeader{
+		Name:  name,
+		Type:  r.Type,
+		Class: dnsmessage.ClassINET,
+		TTL:   r.TTL,
+	}
+
+	var body dnsmessage.ResourceBody
+	switch r.Type {
+	case dnsmessage.TypeA:
+		ip := net.ParseIP(r.Value).To4()
+		if ip == nil {
+			return dnsmessage.Resource{}, fmt.Errorf("无效的 IPv4 地址: %s", r.Value)
+		}
+		a := &dnsmessage.AResource{}
+		copy(a.A[:], ip)
+		body = a
+	case dnsmessage.TypeAAAA:
+		ip := net.ParseIP(r.Value)
+		if ip == nil || ip.To4() != nil {
+			return dnsmessage.Resource{}, fmt.Errorf("无效的 IPv6 地址: %s", r.Value)
+		}
+		aaaa := &dnsmessage.AAAAResource{}
+		copy(aaaa.AAAA[:], ip.To16())
+		body = aaaa
+	case dnsmessage.TypeCNAME:
+		target, err := dnsmessage.NewName(fqdn(r.Value))
+		if err != nil {
+			return dnsmessage.Resource{}, err
+		}
+		body = &dnsmessage.CNAMEResource{CNAME: target}
+	case dnsmessage.TypePTR:
+		target, err := dnsmessage.NewName(fqdn(r.Value))
+		if err != nil {
+			return dnsmessage.Resource{}, err
+		}
+		body = &dnsmessage.PTRResource{PTR: target}
+	case dnsmessage.TypeTXT:
+		// 单个字符串最长 255 字节
+		var txt []string
+		value := r.Value
+		for len(value) > 255 {
+			txt = append(txt, value[:255])
+			value = value[255:]
+		}
+		body = &dnsmessage.TXTResource{TXT: append(txt, value)}
+	case dnsmessage.TypeSRV:
+		fields := strings.Fields(r.Value)
+		if len(fields) != 4 {
+			return dnsmessage.Resource{}, fmt.Errorf("SRV 记录格式应为 \"priority weight port target\": %s", r.Value)
+		}
+		var values [3]uint16
+		for i := 0; i < 3; i++ {
+			v, err := strconv.ParseUint(fields[i], 10, 16)
+			if err != nil {
+				return dnsmessage.Resource{}, fmt.Errorf("无效的 SRV 记录: %s", r.Value)
+			}
+			values[i] = uint16(v)
+		}
+		target, err := dnsmessage.NewName(fqdn(fields[3]))
+		if err != nil {
+			return dnsmessage.Resource{}, err
+		}
+		body = &dnsmessage.SRVResource{Priority: values[0], Weight: values[1], Port: values[2], Target: target}
+	default:
+		return dnsmessage.Resource{}, fmt.Errorf("不支持的记录类型: %s", r.Type)
+	}
+
+	return dnsmessage.Resource{Header: header, Body: body}, nil
+}
+
+// synthesizePTR 为 A/AAAA 记录生成反向解析记录，已有 PTR 记录的地址不会覆盖
+func synthesizePTR(records map[string][]Record) {
+	var ptrs []Record
+	for _, list := range records {
+		for _, r := range list {
+			if r.Type != dnsmessage.TypeA && r.Type != dnsmessage.TypeAAAA {
+				continue
+			}
+			reverse, err := ReverseName(net.ParseIP(r.Value))
+			if err != nil {
+				continue
+			}
+			ptrs = append(ptrs, Record{Name: reverse, Type: dnsmessage.TypePTR, TTL: r.TTL, Value: r.Name})
+		}
+	}
+
+	explicit := make(map[string]bool)
+	for name, list := range records {
+		for _, r := range list {
+			if r.Type == dnsmessage.TypePTR {
+				explicit[name] = true
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, ptr := range ptrs {
+		key := ptr.Name + " " + ptr.Value
+		if explicit[ptr.Name] || seen[key] {
+			continue
+		}
+		seen[key] = true
+		records[ptr.Name] = append(records[ptr.Name], ptr)
+	}
+}
+
+// ReverseName 返回 IP 地址对应的反向解析域名
+func ReverseName(ip net.IP) (string, error) {
+	if ip == nil {
+		return "", fmt.Errorf("无效的 IP 地址")
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip4[3], ip4[2], ip4[1], ip4[0]), nil
+	}
+
+	const hexDigits = "0123456789abcdef"
+	ip16 := ip.To16()
+	var b strings.Builder
+	for i := len(ip16) - 1; i >= 0; i-- {
+		b.WriteByte(hexDigits[ip16[i]&0x0f])
+		b.WriteByte('.')
+		b.WriteByte(hexDigits[ip16[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString("ip6.arpa")
+	return b.String(), nil
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+}
+
+func fqdn(name string) string {
+	name = strings.TrimSpace(name)
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
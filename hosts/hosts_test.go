@@ -0,0 +1,175 @@
+package hosts
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func question(name string, qtype dnsmessage.Type) dnsmessage.Question {
+	return dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  qtype,
+		Class: dnsmessage.ClassINET,
+	}
+}
+
+func TestParseRecord(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    Record
+		wantErr bool
+	}{
+		{"nas.lan A 192.168.1.10", Record{"nas.lan", dnsmessage.TypeA, DefaultTTL, "192.168.1.10"}, false},
+		{"NAS.lan. 300 aaaa fd00::10", Record{"nas.lan", dnsmessage.TypeAAAA, 300, "fd00::10"}, false},
+		{"www.lan CNAME nas.lan", Record{"www.lan", dnsmessage.TypeCNAME, DefaultTTL, "nas.lan"}, false},
+		{`nas.lan TXT "hello world"`, Record{"nas.lan", dnsmessage.TypeTXT, DefaultTTL, "hello world"}, false},
+		{"_http._tcp.lan SRV 10 5 80 nas.lan", Record{"_http._tcp.lan", dnsmessage.TypeSRV, DefaultTTL, "10 5 80 nas.lan"}, false},
+		{"nas.lan A fd00::10", Record{}, true},
+		{"nas.lan MX 10 mail.lan", Record{}, true},
+		{"_http._tcp.lan SRV 10 80 nas.lan", Record{}, true},
+		{"nas.lan A", Record{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			got, err := ParseRecord(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRecord() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("ParseRecord() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStore_Lookup(t *testing.T) {
+	hostsFile := filepath.Join(t.TempDir(), "hosts")
+	content := "# comment\n192.168.1.10 nas.lan nas\nfd00::10 nas.lan\n"
+	if err := os.WriteFile(hostsFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewStore(hostsFile, []string{
+		"www.lan CNAME nas.lan",
+		"app.lan CNAME www.lan",
+		"old.lan CNAME gone.lan",
+		"nas.lan TXT hello",
+		"_http._tcp.lan SRV 10 5 80 nas.lan",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		qtype     dnsmessage.Type
+		wantFound bool
+		wantTypes []dnsmessage.Type
+	}{
+		{"nas.lan.", dnsmessage.TypeA, true, []dnsmessage.Type{dnsmessage.TypeA}},
+		{"NAS.", dnsmessage.TypeA, true, []dnsmessage.Type{dnsmessage.TypeA}},
+		{"nas.lan.", dnsmessage.TypeAAAA, true, []dnsmessage.Type{dnsmessage.TypeAAAA}},
+		{"nas.lan.", dnsmessage.TypeTXT, true, []dnsmessage.Type{dnsmessage.TypeTXT}},
+		{"nas.lan.", dnsmessage.TypeMX, true, nil},
+		{"www.lan.", dnsmessage.TypeA, true, []dnsmessage.Type{dnsmessage.TypeCNAME, dnsmessage.TypeA}},
+		{"app.lan.", dnsmessage.TypeA, true, []dnsmessage.Type{dnsmessage.TypeCNAME, dnsmessage.TypeCNAME, dnsmessage.TypeA}},
+		{"app.lan.", dnsmessage.TypeCNAME, true, []dnsmessage.Type{dnsmessage.TypeCNAME}},
+		{"old.lan.", dnsmessage.TypeA, true, []dnsmessage.Type{dnsmessage.TypeCNAME}},
+		{"_http._tcp.lan.", dnsmessage.TypeSRV, true, []dnsmessage.Type{dnsmessage.TypeSRV}},
+		{"10.1.168.192.in-addr.arpa.", dnsmessage.TypePTR, true, []dnsmessage.Type{dnsmessage.TypePTR, dnsmessage.TypePTR}},
+		{"www.example.com.", dnsmessage.TypeA, false, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name+tt.qtype.String(), func(t *testing.T) {
+			answers, found := store.Lookup(question(tt.name, tt.qtype))
+			if found != tt.wantFound {
+				t.Fatalf("Lookup() found = %v, want %v", found, tt.wantFound)
+			}
+			if len(answers) != len(tt.wantTypes) {
+				t.Fatalf("Lookup() returned %d answers, want %d", len(answers), len(tt.wantTypes))
+			}
+			for i, answer := range answers {
+				if answer.Header.Type != tt.wantTypes[i] {
+					t.Errorf("answer[%d] type = %v, want %v", i, answer.Header.Type, tt.wantTypes[i])
+				}
+			}
+		})
+	}
+
+	// 反向解析指向 hosts 中的域名
+	answers, _ := store.Lookup(question("10.1.168.192.in-addr.arpa.", dnsmessage.TypePTR))
+	var names []string
+	for _, answer := range answers {
+		names = append(names, answer.Body.(*dnsmessage.PTRResource).PTR.String())
+	}
+	if strings.Join(names, ",") != "nas.lan.,nas." && strings.Join(names, ",") != "nas.,nas.lan." {
+		t.Errorf("PTR answers = %v, want nas.lan. and nas.", names)
+	}
+}
+
+func TestStore_Watch(t *testing.T) {
+	hostsFile := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(hostsFile, []byte("192.168.1.10 nas.lan\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewStore(hostsFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go store.Watch(stop, 10*time.Millisecond)
+
+	if err := os.WriteFile(hostsFile, []byte("192.168.1.20 printer.lan\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// 确保修改时间发生变化
+	future := time.Now().Add(time.Second)
+	if err := os.Chtimes(hostsFile, future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, found := store.Lookup(question("printer.lan.", dnsmessage.TypeA)); found {
+			if _, found := store.Lookup(question("nas.lan.", dnsmessage.TypeA)); found {
+				t.Error("Lookup(nas.lan) after reload found = true, want false")
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("hosts file was not reloaded")
+}
+
+func TestReverseName(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"192.168.1.10", "10.1.168.192.in-addr.arpa"},
+		{"2001:db8::1", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			got, err := ReverseName(net.ParseIP(tt.ip))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("ReverseName() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package ipset
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// 集合类型
+const (
+	// KindIPSet ipset 集合
+	KindIPSet = "ipset"
+	// KindNFT nftables 集合
+	KindNFT = "nft"
+)
+
+// Set 一个 ipset 集合或 nftables 集合
+type Set struct {
+	// Kind 集合类型
+	Kind string
+	// IPVersion 只添加该版本的地址，0 表示 IPv4 和 IPv6 都添加
+	IPVersion int
+	// Family nftables 表的协议族，例如 inet、ip、ip6
+	Family string
+	// Table nftables 表名
+	Table string
+	// Name 集合名称
+	Name string
+}
+
+// String 返回集合的描述，例如 inet#fw4#oversea4
+func (s Set) String() string {
+	name := s.Name
+	if s.Kind == KindNFT {
+		name = s.Family + "#" + s.Table + "#" + s.Name
+	}
+	if s.IPVersion != 0 {
+		name = strconv.Itoa(s.IPVersion) + "#" + name
+	}
+	return name
+}
+
+// accepts 判断集合是否接受该地址
+func (s Set) accepts(ip net.IP) bool {
+	isV4 := ip.To4() != nil
+	switch {
+	case s.IPVersion == 4 || s.Family == "ip":
+		return isV4
+	case s.IPVersion == 6 || s.Family == "ip6":
+		return !isV4
+	}
+	return true
+}
+
+// ParseSet 解析集合，ipset 集合的格式为 [4|6#]name，
+// nftables 集合的格式与 dnsmasq 的 nftset 相同，为 [4|6#]family#table#set
+func ParseSet(kind, s string) (Set, error) {
+	set := Set{Kind: kind}
+	fields := strings.Split(strings.TrimSpace(s), "#")
+	if fields[0] == "4" || fields[0] == "6" {
+		set.IPVersion, _ = strconv.Atoi(fields[0])
+		fields = fields[1:]
+	}
+
+	switch kind {
+	case KindIPSet:
+		if len(fields) != 1 || fields[0] == "" {
+			return Set{}, fmt.Errorf("无效的 ipset 集合: %s，格式为 [4|6#]name", s)
+		}
+		set.Name = fields[0]
+	case KindNFT:
+		if len(fields) != 3 || fields[0] == "" || fields[1] == "" || fields[2] == "" {
+			return Set{}, fmt.Errorf("无效的 nftables 集合: %s，格式为 [4|6#]family#table#set", s)
+		}
+		if _, ok := nftFamilies[fields[0]]; !ok {
+			return Set{}, fmt.Errorf("无效的 nftables 协议族: %s", fields[0])
+		}
+		set.Family, set.Table, set.Name = fields[0], fields[1], fields[2]
+	default:
+		return Set{}, fmt.Errorf("无效的集合类型: %s", kind)
+	}
+	return set, nil
+}
+
+// ParseSets 解析逗号分隔的多个集合
+func ParseSets(kind, s string) ([]Set, error) {
+	var sets []Set
+	for _, item := range strings.Split(s, ",") {
+		set, err := ParseSet(kind, item)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, set)
+	}
+	return sets, nil
+}
+
+// nftFamilies nftables 协议族对应的 NFPROTO 值
+var nftFamilies = map[string]uint8{
+	"inet":   1,
+	"ip":     2,
+	"arp":    3,
+	"netdev": 5,
+	"bridge": 7,
+	"ip6":    10,
+}
+
+// Rule 一条集合规则，匹配的域名（包含子域名）解析到的地址会添加到集合中
+type Rule struct {
+	Domains []string
+	Sets    []Set
+}
+
+// ParseRule 解析与 dnsmasq 相同格式的规则，例如 /google.com/youtube.com/oversea4,oversea6
+func ParseRule(kind, s string) (Rule, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 3 || parts[0] != "" {
+		return Rule{}, fmt.Errorf("无效的集合规则: %s，格式为 /domain[/domain...]/set[,set...]", s)
+	}
+
+	var rule Rule
+	for _, domain := range parts[1 : len(parts)-1] {
+		if domain = normalizeDomain(domain); domain != "" {
+			rule.Domains = append(rule.Domains, domain)
+		}
+	}
+	if len(rule.Domains) == 0 {
+		return Rule{}, fmt.Errorf("集合规则没有域名: %s", s)
+	}
+	sets, err := ParseSets(kind, parts[len(parts)-1])
+	if err != nil {
+		return Rule{}, err
+	}
+	rule.Sets = sets
+	return rule, nil
+}
+
+// Backend 向集合中添加地址
+type Backend interface {
+	Add(set Set, ip net.IP, timeout time.Duration) error
+}
+
+// Options 集合配置
+type Options struct {
+	// Rules 按域名添加的集合规则
+	Rules []Rule
+	// OverseaSets 使用海外 DNS 解析的域名，地址都添加到这些集合
+	OverseaSets []Set
+	// Backend 为空时通过 netlink 添加到内核的集合
+	Backend Backend
+}
+
+// Manager 将匹配的域名解析到的地址添加到集合中
+type Manager struct {
+	domains     map[string][]Set
+	overseaSets []Set
+	backend     Backend
+}
+
+// Failure 添加失败的地址
+type Failure struct {
+	Set Set
+	IP  net.IP
+	Err error
+}
+
+// New 创建集合管理，没有规则时返回 nil
+func New(options Options) (*Manager, error) {
+	if len(options.Rules) == 0 && len(options.OverseaSets) == 0 {
+		return nil, nil
+	}
+
+	backend := options.Backend
+	if backend == nil {
+		var err error
+		if backend, err = NewNetlinkBackend(); err != nil {
+			return nil, err
+		}
+	}
+
+	m := &Manager{
+		domains:     make(map[string][]Set),
+		overseaSets: options.OverseaSets,
+		backend:     backend,
+	}
+	for _, rule := range options.Rules {
+		for _, domain := range rule.Domains {
+			m.domains[domain] = append(m.domains[domain], rule.Sets...)
+		}
+	}
+	return m, nil
+}
+
+// Match 返回域名对应的集合，域名规则按最长后缀匹配，海外域名同时添加到 OverseaSets
+func (m *Manager) Match(domain string, oversea bool) []Set {
+	if m == nil {
+		return nil
+	}
+
+	var sets []Set
+	domain = normalizeDomain(domain)
+	for {
+		if matched, ok := m.domains[domain]; ok {
+			sets = append(sets, matched...)
+			break
+		}
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+	if oversea {
+		sets = append(sets, m.overseaSets...)
+	}
+	return sets
+}
+
+// Add 将应答中的 A 和 AAAA 记录添加到域名对应的集合，超时时间为记录的 TTL，返回添加失败的地址
+func (m *Manager) Add(domain string, oversea bool, answers []dnsmessage.Resource) []Failure {
+	sets := m.Match(domain, oversea)
+	if len(sets) == 0 {
+		return nil
+	}
+
+	var failures []Failure
+	for _, answer := range answers {
+		var ip net.IP
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = net.IP(body.A[:])
+		case *dnsmessage.AAAAResource:
+			ip = net.IP(body.AAAA[:])
+		default:
+			continue
+		}
+		if answer.Header.TTL == 0 {
+			continue
+		}
+		timeout := time.Duration(answer.Header.TTL) * time.Second
+		for _, set := range sets {
+			if !set.accepts(ip) {
+				continue
+			}
+			if err := m.backend.Add(set, ip, timeout); err != nil {
+				failures = append(failures, Failure{Set: set, IP: ip, Err: err})
+			}
+		}
+	}
+	return failures
+}
+
+// Sets 返回所有规则使用的集合，用于启动时显示配置
+func (m *Manager) Sets() []string {
+	if m == nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	for _, sets := range m.domains {
+		for _, set := range sets {
+			seen[set.String()] = true
+		}
+	}
+	for _, set := range m.overseaSets {
+		seen[set.String()] = true
+	}
+	var names []string
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.Trim(strings.TrimSpace(domain), "."))
+}
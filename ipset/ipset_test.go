@@ -0,0 +1,147 @@
+package ipset
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeBackend 记录添加的地址
+type fakeBackend struct {
+	added []string
+	fail  string
+}
+
+func (f *fakeBackend) Add(set Set, ip net.IP, timeout time.Duration) error {
+	if set.Name == f.fail {
+		return errors.New("add failed")
+	}
+	f.added = append(f.added, set.String()+" "+ip.String()+" "+timeout.String())
+	return nil
+}
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		kind    string
+		s       string
+		want    Rule
+		wantErr bool
+	}{
+		{KindIPSet, "/google.com/YouTube.com./oversea", Rule{
+			Domains: []string{"google.com", "youtube.com"},
+			Sets:    []Set{{Kind: KindIPSet, Name: "oversea"}},
+		}, false},
+		{KindNFT, "/google.com/4#inet#fw4#oversea4,6#inet#fw4#oversea6", Rule{
+			Domains: []string{"google.com"},
+			Sets: []Set{
+				{Kind: KindNFT, IPVersion: 4, Family: "inet", Table: "fw4", Name: "oversea4"},
+				{Kind: KindNFT, IPVersion: 6, Family: "inet", Table: "fw4", Name: "oversea6"},
+			},
+		}, false},
+		{KindIPSet, "google.com/oversea", Rule{}, true},
+		{KindIPSet, "//oversea", Rule{}, true},
+		{KindNFT, "/google.com/fw4#oversea", Rule{}, true},
+		{KindNFT, "/google.com/foo#fw4#oversea", Rule{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseRule(tt.kind, tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseRule() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestManager_Add(t *testing.T) {
+	ipv4 := Set{Kind: KindNFT, Family: "ip", Table: "fw", Name: "v4"}
+	ipv6 := Set{Kind: KindNFT, Family: "ip6", Table: "fw", Name: "v6"}
+	video := Set{Kind: KindIPSet, Name: "video"}
+	oversea := Set{Kind: KindIPSet, IPVersion: 4, Name: "oversea"}
+
+	answers := []dnsmessage.Resource{
+		{
+			Header: dnsmessage.ResourceHeader{Type: dnsmessage.TypeA, TTL: 300},
+			Body:   &dnsmessage.AResource{A: [4]byte{142, 250, 0, 1}},
+		},
+		{
+			Header: dnsmessage.ResourceHeader{Type: dnsmessage.TypeAAAA, TTL: 60},
+			Body:   &dnsmessage.AAAAResource{AAAA: [16]byte{0x24, 0x04, 15: 1}},
+		},
+		{
+			Header: dnsmessage.ResourceHeader{Type: dnsmessage.TypeA, TTL: 0},
+			Body:   &dnsmessage.AResource{A: [4]byte{142, 250, 0, 2}},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		domain  string
+		oversea bool
+		want    []string
+	}{
+		{"family filter", "www.google.com", false, []string{
+			"ip#fw#v4 142.250.0.1 5m0s",
+			"ip6#fw#v6 2404::1 1m0s",
+		}},
+		{"longest suffix", "www.youtube.google.com", false, []string{
+			"video 142.250.0.1 5m0s",
+			"video 2404::1 1m0s",
+		}},
+		{"oversea sets", "example.org", true, []string{
+			"4#oversea 142.250.0.1 5m0s",
+		}},
+		{"no match", "example.org", false, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &fakeBackend{}
+			m, err := New(Options{
+				Rules: []Rule{
+					{Domains: []string{"google.com"}, Sets: []Set{ipv4, ipv6}},
+					{Domains: []string{"youtube.google.com"}, Sets: []Set{video}},
+				},
+				OverseaSets: []Set{oversea},
+				Backend:     backend,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if failures := m.Add(tt.domain, tt.oversea, answers); len(failures) != 0 {
+				t.Errorf("Add() failures = %v", failures)
+			}
+			if !reflect.DeepEqual(backend.added, tt.want) {
+				t.Errorf("added = %v, want %v", backend.added, tt.want)
+			}
+		})
+	}
+}
+
+func TestManager_AddFailure(t *testing.T) {
+	backend := &fakeBackend{fail: "missing"}
+	m, err := New(Options{
+		Rules:   []Rule{{Domains: []string{"google.com"}, Sets: []Set{{Kind: KindIPSet, Name: "missing"}}}},
+		Backend: backend,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failures := m.Add("google.com", false, []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{Type: dnsmessage.TypeA, TTL: 300},
+		Body:   &dnsmessage.AResource{A: [4]byte{142, 250, 0, 1}},
+	}})
+	if len(failures) != 1 || failures[0].IP.String() != "142.250.0.1" {
+		t.Errorf("Add() failures = %v, want one failure for 142.250.0.1", failures)
+	}
+}
@@ -0,0 +1,269 @@
+//go:build linux
+
+package ipset
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// nfnetlink 常量（linux/netfilter/nfnetlink.h）
+const (
+	nfnlSubsysIPSet     = 6
+	nfnlSubsysNFTables  = 10
+	nfnlMsgBatchBegin   = 0x10
+	nfnlMsgBatchEnd     = 0x11
+	nlaFNested          = 0x8000
+	nlaFNetByteorder    = 0x4000
+	netlinkReadTimeout  = time.Second
+	netlinkReceiveBytes = 8192
+)
+
+// ipset 常量（linux/netfilter/ipset/ip_set.h）
+const (
+	ipsetProtocol       = 6
+	ipsetCmdAdd         = 9
+	ipsetAttrProtocol   = 1
+	ipsetAttrSetName    = 2
+	ipsetAttrData       = 7
+	ipsetAttrIP         = 1
+	ipsetAttrTimeout    = 6
+	ipsetAttrIPAddrIPv4 = 1
+	ipsetAttrIPAddrIPv6 = 2
+	// ipsetErrTimeout 集合创建时没有指定 timeout，不接受带超时时间的地址（IPSET_ERR_TIMEOUT）
+	ipsetErrTimeout = 4107
+)
+
+// nftables 常量（linux/netfilter/nf_tables.h）
+const (
+	nftMsgNewSetElem         = 12
+	nftaSetElemListTable     = 1
+	nftaSetElemListSet       = 2
+	nftaSetElemListElements  = 3
+	nftaListElem             = 1
+	nftaSetElemKey           = 1
+	nftaSetElemTimeout       = 4
+	nftaDataValue            = 1
+	nfprotoIPv4, nfprotoIPv6 = 2, 10
+)
+
+// nativeEndian netlink 消息头使用本机字节序
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// netlinkBackend 通过 nfnetlink 向内核的 ipset 和 nftables 集合添加地址
+type netlinkBackend struct {
+	mu  sync.Mutex
+	fd  int
+	seq uint32
+	// noTimeout 不支持超时时间的集合，之后添加地址时不再发送超时时间
+	noTimeout map[string]bool
+}
+
+// NewNetlinkBackend 创建 netlink 集合后端，需要 CAP_NET_ADMIN 权限
+func NewNetlinkBackend() (Backend, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_NETFILTER)
+	if err != nil {
+		return nil, fmt.Errorf("创建 netlink 连接失败: %v", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("绑定 netlink 连接失败: %v", err)
+	}
+	tv := syscall.NsecToTimeval(int64(netlinkReadTimeout))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("设置 netlink 超时失败: %v", err)
+	}
+	return &netlinkBackend{fd: fd, seq: uint32(time.Now().Unix()), noTimeout: make(map[string]bool)}, nil
+}
+
+// Add 添加地址，地址已经存在时更新超时时间。集合创建时没有指定 timeout 时，
+// 内核拒绝带超时时间的地址，此时记住该集合并改为不带超时时间添加
+func (b *netlinkBackend) Add(set Set, ip net.IP, timeout time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := set.Kind + ":" + set.String()
+	if b.noTimeout[key] {
+		return b.add(set, ip, 0)
+	}
+	err := b.add(set, ip, timeout)
+	if timeout > 0 && timeoutUnsupported(set, err) {
+		if err = b.add(set, ip, 0); err == nil {
+			b.noTimeout[key] = true
+		}
+	}
+	return err
+}
+
+// timeoutUnsupported 判断错误是否表示集合不支持超时时间，nftables 集合没有 timeout 标志时返回 EINVAL
+func timeoutUnsupported(set Set, err error) bool {
+	switch set.Kind {
+	case KindIPSet:
+		return err == syscall.Errno(ipsetErrTimeout)
+	case KindNFT:
+		return err == syscall.EINVAL
+	}
+	return false
+}
+
+// add 发送添加地址的消息并等待确认，timeout 为 0 时不发送超时时间
+func (b *netlinkBackend) add(set Set, ip net.IP, timeout time.Duration) error {
+	var data []byte
+	var seq uint32
+	switch set.Kind {
+	case KindIPSet:
+		data, seq = b.ipsetAdd(set, ip, timeout)
+	case KindNFT:
+		data, seq = b.nftAdd(set, ip, timeout)
+	default:
+		return fmt.Errorf("无效的集合类型: %s", set.Kind)
+	}
+
+	if err := syscall.Sendto(b.fd, data, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+	return b.waitAck(seq)
+}
+
+// ipsetAdd 构造 IPSET_CMD_ADD 消息，返回需要等待确认的序列号
+func (b *netlinkBackend) ipsetAdd(set Set, ip net.IP, timeout time.Duration) ([]byte, uint32) {
+	family, addrType, addr := uint8(nfprotoIPv4), uint16(ipsetAttrIPAddrIPv4), ip.To4()
+	if addr == nil {
+		family, addrType, addr = nfprotoIPv6, ipsetAttrIPAddrIPv6, ip.To16()
+	}
+
+	b.seq++
+	m := newNetlinkMessage(nfnlSubsysIPSet<<8|ipsetCmdAdd, syscall.NLM_F_REQUEST|syscall.NLM_F_ACK, b.seq, family, 0)
+	m.attr(ipsetAttrProtocol, []byte{ipsetProtocol})
+	m.attr(ipsetAttrSetName, cstring(set.Name))
+	m.nested(ipsetAttrData, func() {
+		m.nested(ipsetAttrIP, func() {
+			m.attr(addrType|nlaFNetByteorder, addr)
+		})
+		if timeout > 0 {
+			seconds := make([]byte, 4)
+			binary.BigEndian.PutUint32(seconds, uint32(timeout/time.Second))
+			m.attr(ipsetAttrTimeout|nlaFNetByteorder, seconds)
+		}
+	})
+	return m.bytes(), b.seq
+}
+
+// nftAdd 构造包含 NFT_MSG_NEWSETELEM 的批量消息，返回需要等待确认的序列号
+func (b *netlinkBackend) nftAdd(set Set, ip net.IP, timeout time.Duration) ([]byte, uint32) {
+	addr := ip.To4()
+	if addr == nil {
+		addr = ip.To16()
+	}
+
+	b.seq++
+	begin := newNetlinkMessage(nfnlMsgBatchBegin, syscall.NLM_F_REQUEST, b.seq, syscall.AF_UNSPEC, nfnlSubsysNFTables)
+
+	b.seq++
+	seq := b.seq
+	m := newNetlinkMessage(nfnlSubsysNFTables<<8|nftMsgNewSetElem,
+		syscall.NLM_F_REQUEST|syscall.NLM_F_CREATE|syscall.NLM_F_ACK, seq, nftFamilies[set.Family], 0)
+	m.attr(nftaSetElemListTable, cstring(set.Table))
+	m.attr(nftaSetElemListSet, cstring(set.Name))
+	m.nested(nftaSetElemListElements, func() {
+		m.nested(nftaListElem, func() {
+			m.nested(nftaSetElemKey, func() {
+				m.attr(nftaDataValue, addr)
+			})
+			if timeout > 0 {
+				millis := make([]byte, 8)
+				binary.BigEndian.PutUint64(millis, uint64(timeout/time.Millisecond))
+				m.attr(nftaSetElemTimeout, millis)
+			}
+		})
+	})
+
+	b.seq++
+	end := newNetlinkMessage(nfnlMsgBatchEnd, syscall.NLM_F_REQUEST, b.seq, syscall.AF_UNSPEC, nfnlSubsysNFTables)
+
+	data := append(begin.bytes(), m.bytes()...)
+	return append(data, end.bytes()...), seq
+}
+
+// waitAck 等待内核对序列号为 seq 的消息的确认
+func (b *netlinkBackend) waitAck(seq uint32) error {
+	buf := make([]byte, netlinkReceiveBytes)
+	for {
+		n, _, err := syscall.Recvfrom(b.fd, buf, 0)
+		if err != nil {
+			return fmt.Errorf("读取 netlink 应答失败: %v", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return fmt.Errorf("解析 netlink 应答失败: %v", err)
+		}
+		for _, msg := range msgs {
+			if msg.Header.Seq != seq || msg.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if len(msg.Data) < 4 {
+				return fmt.Errorf("netlink 应答长度错误")
+			}
+			if errno := int32(nativeEndian.Uint32(msg.Data)); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
+
+// netlinkMessage 带 nfgenmsg 头的 netlink 消息
+type netlinkMessage struct {
+	buf []byte
+}
+
+func newNetlinkMessage(typ, flags uint16, seq uint32, family uint8, resID uint16) *netlinkMessage {
+	buf := make([]byte, syscall.NLMSG_HDRLEN+4)
+	nativeEndian.PutUint16(buf[4:], typ)
+	nativeEndian.PutUint16(buf[6:], flags)
+	nativeEndian.PutUint32(buf[8:], seq)
+	buf[syscall.NLMSG_HDRLEN] = family
+	binary.BigEndian.PutUint16(buf[syscall.NLMSG_HDRLEN+2:], resID)
+	return &netlinkMessage{buf: buf}
+}
+
+// attr 添加属性，属性长度按 4 字节对齐
+func (m *netlinkMessage) attr(typ uint16, data []byte) {
+	header := make([]byte, syscall.SizeofRtAttr)
+	nativeEndian.PutUint16(header, uint16(syscall.SizeofRtAttr+len(data)))
+	nativeEndian.PutUint16(header[2:], typ)
+	m.buf = append(m.buf, header...)
+	m.buf = append(m.buf, data...)
+	for len(m.buf)%4 != 0 {
+		m.buf = append(m.buf, 0)
+	}
+}
+
+// nested 添加嵌套属性，fn 中添加的属性位于该属性内
+func (m *netlinkMessage) nested(typ uint16, fn func()) {
+	start := len(m.buf)
+	m.attr(typ|nlaFNested, nil)
+	fn()
+	nativeEndian.PutUint16(m.buf[start:], uint16(len(m.buf)-start))
+}
+
+func (m *netlinkMessage) bytes() []byte {
+	nativeEndian.PutUint32(m.buf, uint32(len(m.buf)))
+	return m.buf
+}
+
+func cstring(s string) []byte {
+	return append([]byte(s), 0)
+}
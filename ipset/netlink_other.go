@@ -0,0 +1,10 @@
+//go:build !linux
+
+package ipset
+
+import "errors"
+
+// NewNetlinkBackend 只支持 Linux
+func NewNetlinkBackend() (Backend, error) {
+	return nil, errors.New("ipset 和 nftables 集合只支持 Linux")
+}
@@ -1,16 +1,29 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"go-dns-proxy/admin"
+	"go-dns-proxy/bench"
+	"go-dns-proxy/config"
+	"go-dns-proxy/domain"
 	"go-dns-proxy/server"
+	"io"
+	"net"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
+	"unicode"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 func init() {
@@ -24,113 +37,151 @@ func init() {
 
 func main() {
 	app := &cli.App{
-		Flags: []cli.Flag{
+		Flags: withEnvVars([]cli.Flag{
 			&cli.StringFlag{
 				Name:  "logLevel",
 				Usage: "日志级别 (debug/info/warn/error)",
 				Value: "info",
 			},
-		},
+		}),
 		Before: func(c *cli.Context) error {
 			// 设置日志级别
-			level, err := log.ParseLevel(c.String("logLevel"))
-			if err != nil {
-				level = log.InfoLevel
-			}
-			log.SetLevel(level)
+			setLogLevel(c.String("logLevel"))
 			return nil
 		},
 		Commands: []*cli.Command{
 			{
-				Flags: []cli.Flag{
-					&cli.IntFlag{
-						Name:     "port",
-						Usage:    "dns server port",
-						Required: true,
-					},
-					&cli.StringFlag{
-						Name:  "chinaServer",
-						Usage: "国内 DNS 服务地址（支持普通 DNS、DOH 和 DOT）",
-						Value: "120.53.53.53",
-					},
-					&cli.StringFlag{
-						Name:  "overSeaServer",
-						Usage: "海外 DNS 服务地址（支持普通 DNS、DOH 和 DOT）",
-						Value: "1.1.1.1",
-					},
-					&cli.IntFlag{
-						Name:  "adminPort",
-						Usage: "管理后台端口",
-						Value: 8080,
-					},
-					&cli.StringFlag{
-						Name:  "dataDir",
-						Usage: "数据目录路径",
-						Value: "./data",
-					},
-					&cli.StringFlag{
-						Name:  "chinaDomainListUrl",
-						Usage: "中国域名列表下载地址",
-						Value: "https://raw.githubusercontent.com/felixonmars/dnsmasq-china-list/refs/heads/master/accelerated-domains.china.conf",
-					},
-				},
+				Flags: serverFlags(),
 				Name:  "start",
 				Usage: "start a proxy dns server",
 				Action: func(c *cli.Context) error {
 					log.Info("启动DNS代理服务器...")
 
+					// 合并配置文件、环境变量和命令行参数
+					cfg, err := config.Load(c.String("config"), c)
+					if err != nil {
+						return err
+					}
+					options, err := cfg.ServerOptions()
+					if err != nil {
+						return err
+					}
+					setLogLevel(cfg.LogLevel)
+
 					// 创建数据目录
-					dataDir := c.String("dataDir")
-					if err := os.MkdirAll(dataDir, 0755); err != nil {
+					if err := os.MkdirAll(cfg.DataDir, 0755); err != nil {
 						return err
 					}
 
 					// 初始化 DNS 服务器
-					dnsServer, err := server.NewDnsServer(&server.NewServerOptions{
-						ListenPort:      c.Int("port"),
-						ChinaServerAddr: c.String("chinaServer"),
-						OverSeaServerAddr: c.String("overSeaServer"),
-						DBPath:          filepath.Join(dataDir, "dns.db"),
-						DataDir:         dataDir,
-						ChinaDomainListUrl: c.String("chinaDomainListUrl"),
-					})
+					dnsServer, err := server.NewDnsServer(options)
 					if err != nil {
 						return err
 					}
 
+					// 没有管理员时创建默认管理员。在添加数据库日志钩子之前输出密码，避免写入日志表
+					if cfg.Admin.Auth {
+						password, err := admin.EnsureAdminUser(dnsServer.GetDB())
+						if err != nil {
+							return err
+						}
+						if password != "" {
+							log.WithFields(log.Fields{
+								"用户名": admin.DefaultUsername,
+								"密码":  password,
+							}).Warn("已创建管理后台账号，请登录后使用 go-dns-proxy admin passwd 修改密码")
+						}
+					} else if ip := net.ParseIP(cfg.Admin.Bind); cfg.Admin.Bind != "localhost" && (ip == nil || !ip.IsLoopback()) {
+						log.Warn("管理后台没有启用登录，并且允许其他设备访问")
+					}
+
 					// 添加数据库日志钩子
-					log.AddHook(admin.NewDBHook(dnsServer.GetDB()))
+					dbHook := admin.NewDBHook(dnsServer.GetDB())
+					log.AddHook(dbHook)
 
 					// 启动管理后台
-					adminServer := admin.NewServer(dnsServer.GetDB())
+					adminServer := admin.NewServer(dnsServer.GetDB(), cfg.AdminOptions())
 					admin.SetAdminServer(adminServer)
+					if learnedStore := dnsServer.GetLearnedDomainStore(); learnedStore != nil {
+						adminServer.SetLearnedDomainManager(learnedStore)
+					}
+					adminServer.SetListenerStatsProvider(dnsServer)
+					adminServer.SetRateLimitProvider(dnsServer)
+					adminServer.SetMetricsProvider(dnsServer)
+					adminServer.SetExplainProvider(admin.ExplainFunc(func(ctx context.Context, domain string, clientIP net.IP) (interface{}, error) {
+						return dnsServer.Explain(ctx, domain, clientIP)
+					}))
+					adminServer.SetReloadProvider(admin.ReloadFunc(func() (*admin.ReloadResult, error) {
+						cfg, err := config.Load(c.String("config"), c)
+						if err != nil {
+							return nil, err
+						}
+						options, err := cfg.ServerOptions()
+						if err != nil {
+							return nil, err
+						}
+						setLogLevel(cfg.LogLevel)
+						return dnsServer.Reload(options)
+					}))
 					go func() {
-						if err := adminServer.Start(fmt.Sprintf(":%d", c.Int("adminPort"))); err != nil {
+						if err := adminServer.Start(cfg.AdminAddr()); err != nil {
 							log.WithError(err).Error("管理后台启动失败")
 						}
 					}()
 
 					log.WithFields(log.Fields{
-						"国内DNS":  c.String("chinaServer"),
-						"海外DNS":  c.String("overSeaServer"),
-						"监听端口":   c.Int("port"),
-						"日志级别":   c.String("logLevel"),
-						"管理后台端口": c.Int("adminPort"),
-						"中国域名列表": c.String("chinaDomainListUrl"),
+						"配置文件":   c.String("config"),
+						"国内DNS":  cfg.Upstreams.China,
+						"海外DNS":  cfg.Upstreams.Oversea,
+						"监听端口":   cfg.Port,
+						"监听器":    len(options.Listeners),
+						"访问控制":   len(cfg.ACL.Allow) > 0 || len(cfg.ACL.Deny) > 0,
+						"日志级别":   cfg.LogLevel,
+						"管理后台地址": cfg.AdminURL(),
+						"管理后台登录": cfg.Admin.Auth,
+						"中国域名列表": cfg.ChinaDomains.ListURL,
+						"拼音判断":   cfg.Pinyin.Enabled,
+						"拼音阈值":   cfg.Pinyin.Threshold,
+						"备案查询":   cfg.Beian.APIURL != "",
+						"域名学习":   cfg.Learning.Enabled,
+						"hosts文件": cfg.Hosts.File,
+						"静态记录":   len(cfg.Hosts.Records),
+						"拦截列表":   len(cfg.Blocklist.URLs),
+						"拦截应答":   cfg.Blocklist.Response,
+						"客户端分组":  len(options.ClientGroups),
+						"查询限速":   cfg.RateLimit.QPS,
+						"响应限速":   cfg.RateLimit.RRLResponses,
+						"重绑定防护":  cfg.Rebind.Mode,
+						"污染检测":   cfg.Poison.Enabled,
+						"条件转发":   len(options.ForwardOptions.Rules),
+						"本地DNS":  cfg.Forward.LocalServer,
+						"国内ECS":  cfg.ECS.China,
+						"海外ECS":  cfg.ECS.Oversea,
+						"缓存大小":   cfg.Cache.Size,
+						"DNSSEC验证": cfg.DNSSEC.Enabled,
+						"集合规则":   len(options.IPSetOptions.Rules),
 					}).Info("服务器配置")
 
 					// 设置信号处理
 					sigChan := make(chan os.Signal, 1)
-					signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+					signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 					// 启动 DNS 服务器
 					go dnsServer.Start()
 
-					// 等待信号
-					sig := <-sigChan
-					log.WithField("signal", sig).Info("收到退出信号")
+					// 等待信号，收到 SIGHUP 时重载配置
+					for sig := range sigChan {
+						if sig == syscall.SIGHUP {
+							log.Info("收到 SIGHUP 信号，重载配置")
+							adminServer.Reload()
+							continue
+						}
+						log.WithField("signal", sig).Info("收到退出信号")
+						break
+					}
 
-					// 优雅关闭
+					// 优雅关闭，先保存队列中剩余的日志，之后的日志只输出到终端
+					dbHook.Close()
 					if err := dnsServer.Close(); err != nil {
 						log.WithError(err).Error("关闭服务器失败")
 					}
@@ -138,6 +189,386 @@ func main() {
 					return nil
 				},
 			},
+			{
+				Name:  "config",
+				Usage: "检查或导出配置",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "check",
+						Usage:     "离线检查配置文件，读取引用的本地文件并编译规则，发现问题时返回非零退出码",
+						ArgsUsage: "<file>",
+						Flags:     serverFlags(),
+						Action: func(c *cli.Context) error {
+							// 只输出检查结果，加载文件的日志不需要
+							if !c.IsSet("logLevel") {
+								log.SetLevel(log.WarnLevel)
+							}
+
+							file := configFile(c)
+							cfg, err := config.Load(file, c)
+							if err != nil {
+								return cli.Exit(err, 1)
+							}
+							if errs := cfg.Check(); len(errs) > 0 {
+								for _, err := range errs {
+									fmt.Fprintln(os.Stderr, err)
+								}
+								return cli.Exit(fmt.Sprintf("发现 %d 个问题", len(errs)), 1)
+							}
+							if file != "" {
+								fmt.Printf("%s: ", file)
+							}
+							fmt.Println("配置检查通过")
+							return nil
+						},
+					},
+					{
+						Name:      "dump",
+						Usage:     "以 YAML 格式输出合并默认值、配置文件、环境变量和命令行参数后的配置",
+						ArgsUsage: "[file]",
+						Flags:     serverFlags(),
+						Action: func(c *cli.Context) error {
+							cfg, err := config.Load(configFile(c), c)
+							if err != nil {
+								return cli.Exit(err, 1)
+							}
+							data, err := cfg.YAML()
+							if err != nil {
+								return err
+							}
+							_, err = os.Stdout.Write(data)
+							return err
+						},
+					},
+				},
+			},
+			{
+				Name:  "admin",
+				Usage: "管理后台的密码和 API 令牌，直接修改数据目录中的数据库，服务运行时也可以使用",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "passwd",
+						Usage: "设置管理后台密码，从标准输入读取新密码，修改后已登录的会话失效",
+						Flags: append(serverFlags(),
+							&cli.StringFlag{
+								Name:  "username",
+								Usage: "用户名",
+								Value: admin.DefaultUsername,
+							},
+						),
+						Action: func(c *cli.Context) error {
+							quietLogs(c)
+							db, err := openAdminDB(c)
+							if err != nil {
+								return cli.Exit(err, 1)
+							}
+							defer db.Close()
+
+							fmt.Fprint(os.Stderr, "新密码: ")
+							password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+							if err != nil && err != io.EOF {
+								return cli.Exit(err, 1)
+							}
+							password = strings.TrimRight(password, "\r\n")
+							if err := admin.SetAdminPassword(db, c.String("username"), password); err != nil {
+								return cli.Exit(err, 1)
+							}
+							fmt.Fprintf(os.Stderr, "已修改 %s 的密码\n", c.String("username"))
+							return nil
+						},
+					},
+					{
+						Name:  "token",
+						Usage: "创建、列出或吊销供脚本调用接口的 API 令牌",
+						Subcommands: []*cli.Command{
+							{
+								Name:      "create",
+								Usage:     "创建 API 令牌，令牌只输出这一次",
+								ArgsUsage: "<name>",
+								Flags:     serverFlags(),
+								Action: func(c *cli.Context) error {
+									quietLogs(c)
+									if c.NArg() != 1 {
+										return cli.Exit("用法: go-dns-proxy admin token create [options] <name>", 2)
+									}
+									db, err := openAdminDB(c)
+									if err != nil {
+										return cli.Exit(err, 1)
+									}
+									defer db.Close()
+									token, err := admin.CreateAPIToken(db, c.Args().First())
+									if err != nil {
+										return cli.Exit(err, 1)
+									}
+									fmt.Println(token.Token)
+									return nil
+								},
+							},
+							{
+								Name:  "list",
+								Usage: "列出 API 令牌",
+								Flags: serverFlags(),
+								Action: func(c *cli.Context) error {
+									quietLogs(c)
+									db, err := openAdminDB(c)
+									if err != nil {
+										return cli.Exit(err, 1)
+									}
+									defer db.Close()
+									tokens, err := admin.GetAPITokens(db)
+									if err != nil {
+										return cli.Exit(err, 1)
+									}
+									for _, t := range tokens {
+										lastUsed := "从未使用"
+										if t.LastUsedAt != nil {
+											lastUsed = t.LastUsedAt.Local().Format("2006-01-02 15:04:05")
+										}
+										fmt.Printf("%d\t%s\t创建于 %s\t%s\n", t.ID, t.Name, t.CreatedAt.Local().Format("2006-01-02 15:04:05"), lastUsed)
+									}
+									return nil
+								},
+							},
+							{
+								Name:      "revoke",
+								Usage:     "吊销 API 令牌",
+								ArgsUsage: "<id>",
+								Flags:     serverFlags(),
+								Action: func(c *cli.Context) error {
+									quietLogs(c)
+									id, err := strconv.ParseInt(c.Args().First(), 10, 64)
+									if c.NArg() != 1 || err != nil {
+										return cli.Exit("用法: go-dns-proxy admin token revoke [options] <id>", 2)
+									}
+									db, err := openAdminDB(c)
+									if err != nil {
+										return cli.Exit(err, 1)
+									}
+									defer db.Close()
+									deleted, err := admin.DeleteAPIToken(db, id)
+									if err != nil {
+										return cli.Exit(err, 1)
+									}
+									if !deleted {
+										return cli.Exit(fmt.Sprintf("令牌不存在: %d", id), 1)
+									}
+									return nil
+								},
+							},
+						},
+					},
+				},
+			},
+			{
+				Name:      "query",
+				Usage:     "按服务器的处理流程查询域名，输出路由判断、上游、用时和应答，不需要运行服务器",
+				ArgsUsage: "<domain> [type]",
+				Flags: append(serverFlags(),
+					&cli.StringFlag{
+						Name:  "server",
+						Usage: "直接查询运行中的服务器，例如 127.0.0.1:53、tcp://127.0.0.1:53、tls://dns.example.com 或 https://dns.example.com/dns-query",
+					},
+					&cli.StringFlag{
+						Name:  "client",
+						Usage: "客户端 IP，用于匹配客户端分组",
+					},
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "以 JSON 格式输出",
+					},
+					&cli.DurationFlag{
+						Name:  "timeout",
+						Usage: "查询超时时间",
+						Value: 5 * time.Second,
+					},
+				),
+				Action: func(c *cli.Context) error {
+					quietLogs(c)
+					if c.NArg() == 0 || c.NArg() > 2 {
+						return cli.Exit("用法: go-dns-proxy query [options] <domain> [type]", 2)
+					}
+					qtype := dnsmessage.TypeA
+					if c.NArg() == 2 {
+						var err error
+						if qtype, err = server.ParseType(c.Args().Get(1)); err != nil {
+							return cli.Exit(err, 2)
+						}
+					}
+					clientIP, err := clientFlag(c)
+					if err != nil {
+						return err
+					}
+
+					ctx, cancel := context.WithTimeout(context.Background(), c.Duration("timeout"))
+					defer cancel()
+
+					var result *server.QueryResult
+					if addr := c.String("server"); addr != "" {
+						if result, err = server.QueryServer(ctx, addr, c.Args().First(), qtype); err != nil {
+							return cli.Exit(fmt.Sprintf("查询失败: %v", err), 1)
+						}
+					} else {
+						querier, err := newQuerier(c)
+						if err != nil {
+							return cli.Exit(err, 1)
+						}
+						defer querier.Close()
+						if result, err = querier.Query(ctx, c.Args().First(), qtype, clientIP); err != nil {
+							return cli.Exit(fmt.Sprintf("查询失败: %v", err), 1)
+						}
+					}
+
+					if c.Bool("json") {
+						return writeJSON(result)
+					}
+					return result.WriteDig(os.Stdout)
+				},
+			},
+			{
+				Name:      "explain",
+				Usage:     "说明域名的处理过程：本地记录、拦截、条件转发、客户端分组和国内外分流判断的每一步，不查询上游",
+				ArgsUsage: "<domain>",
+				Flags: append(serverFlags(),
+					&cli.StringFlag{
+						Name:  "client",
+						Usage: "客户端 IP，用于匹配客户端分组",
+					},
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "以 JSON 格式输出",
+					},
+					&cli.DurationFlag{
+						Name:  "timeout",
+						Usage: "备案查询的超时时间",
+						Value: 5 * time.Second,
+					},
+				),
+				Action: func(c *cli.Context) error {
+					quietLogs(c)
+					if c.NArg() != 1 {
+						return cli.Exit("用法: go-dns-proxy explain [options] <domain>", 2)
+					}
+					clientIP, err := clientFlag(c)
+					if err != nil {
+						return err
+					}
+
+					querier, err := newQuerier(c)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					defer querier.Close()
+
+					ctx, cancel := context.WithTimeout(context.Background(), c.Duration("timeout"))
+					defer cancel()
+					explanation, err := querier.Explain(ctx, c.Args().First(), clientIP)
+					if err != nil {
+						return cli.Exit(err, 2)
+					}
+
+					if c.Bool("json") {
+						return writeJSON(explanation)
+					}
+					return explanation.WriteText(os.Stdout)
+				},
+			},
+			{
+				Name:      "bench",
+				Usage:     "按指定的 QPS 和并发数向 DNS 服务器发送查询，统计延迟、错误率、超时率和响应码",
+				ArgsUsage: "[domain...]",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:     "server",
+						Usage:    "压测的服务器，格式与上游地址相同，可重复指定以比较多个服务器",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "domains",
+						Usage: "域名列表文件，每行一个域名，可以在域名后指定类型",
+					},
+					&cli.StringFlag{
+						Name:  "queryLog",
+						Usage: "回放查询日志数据库中最近的查询，例如 /etc/go-dns-proxy/data/dns.db",
+					},
+					&cli.IntFlag{
+						Name:  "queryLogLimit",
+						Usage: "从查询日志中读取的最多查询数",
+						Value: 10000,
+					},
+					&cli.StringFlag{
+						Name:  "type",
+						Usage: "域名列表中没有指定类型时使用的查询类型",
+						Value: "A",
+					},
+					&cli.IntFlag{
+						Name:  "qps",
+						Usage: "每秒发送的查询数，0 表示不限制",
+						Value: 100,
+					},
+					&cli.IntFlag{
+						Name:  "concurrency",
+						Usage: "同时等待响应的查询数",
+						Value: 10,
+					},
+					&cli.IntFlag{
+						Name:  "count",
+						Usage: "发送的查询总数，查询不够时循环发送，0 表示发送一遍",
+					},
+					&cli.DurationFlag{
+						Name:  "duration",
+						Usage: "压测时长，与 --count 同时指定时先满足的条件结束压测",
+					},
+					&cli.DurationFlag{
+						Name:  "timeout",
+						Usage: "单个查询的超时时间",
+						Value: 2 * time.Second,
+					},
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "以 JSON 格式输出，便于比较多次压测的结果",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					quietLogs(c)
+					queries, err := benchQueries(c)
+					if err != nil {
+						return cli.Exit(err, 2)
+					}
+
+					// 收到中断信号时停止发送，仍然输出已经完成的部分
+					ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+					defer stop()
+
+					options := bench.Options{
+						QPS:         c.Int("qps"),
+						Concurrency: c.Int("concurrency"),
+						Count:       c.Int("count"),
+						Duration:    c.Duration("duration"),
+						Timeout:     c.Duration("timeout"),
+					}
+					var reports []*bench.Report
+					for _, addr := range c.StringSlice("server") {
+						report, err := bench.Run(ctx, server.NewResolver(addr), queries, options)
+						if err != nil {
+							return cli.Exit(err, 1)
+						}
+						reports = append(reports, report)
+						if ctx.Err() != nil {
+							break
+						}
+						if !c.Bool("json") {
+							if len(reports) > 1 {
+								fmt.Println()
+							}
+							report.WriteText(os.Stdout)
+						}
+					}
+					if c.Bool("json") {
+						return writeJSON(reports)
+					}
+					return nil
+				},
+			},
 		},
 	}
 
@@ -146,3 +577,469 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+// quietLogs 将日志输出到标准错误，避免影响命令的输出，没有指定日志级别时只输出警告和错误
+func quietLogs(c *cli.Context) {
+	log.SetOutput(os.Stderr)
+	if !c.IsSet("logLevel") {
+		log.SetLevel(log.WarnLevel)
+	}
+}
+
+// openAdminDB 打开配置的数据目录中的数据库
+func openAdminDB(c *cli.Context) (*sql.DB, error) {
+	cfg, err := config.Load(c.String("config"), c)
+	if err != nil {
+		return nil, err
+	}
+	return admin.InitDB(cfg.DBPath())
+}
+
+// clientFlag 解析 --client 参数，没有指定时返回 nil
+func clientFlag(c *cli.Context) (net.IP, error) {
+	s := c.String("client")
+	if s == "" {
+		return nil, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, cli.Exit(fmt.Sprintf("无效的客户端 IP: %s", s), 2)
+	}
+	return ip, nil
+}
+
+// newQuerier 根据配置文件和命令行参数创建查询，不监听端口
+func newQuerier(c *cli.Context) (*server.Querier, error) {
+	cfg, err := config.Load(c.String("config"), c)
+	if err != nil {
+		return nil, err
+	}
+	// 查询时不监听端口
+	if cfg.Port == 0 && len(cfg.Listen) == 0 {
+		cfg.Port = 53
+	}
+	options, err := cfg.ServerOptions()
+	if err != nil {
+		return nil, err
+	}
+	return server.NewQuerier(options)
+}
+
+// benchQueries 读取压测使用的查询，依次使用命令行参数中的域名、域名列表文件和查询日志
+func benchQueries(c *cli.Context) ([]bench.Query, error) {
+	qtype, err := server.ParseType(c.String("type"))
+	if err != nil {
+		return nil, err
+	}
+
+	var queries []bench.Query
+	for _, name := range c.Args().Slice() {
+		queries = append(queries, bench.Query{Name: name, Type: qtype})
+	}
+	if path := c.String("domains"); path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		domains, err := bench.LoadDomains(file, qtype)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		queries = append(queries, domains...)
+	}
+	if path := c.String("queryLog"); path != "" {
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+		db, err := admin.InitDB(path)
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+		logged, err := bench.LoadQueryLog(db, c.Int("queryLogLimit"))
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, logged...)
+	}
+
+	if len(queries) == 0 {
+		return nil, fmt.Errorf("用法: go-dns-proxy bench --server <addr> [--domains file | --queryLog db] [domain...]")
+	}
+	return queries, nil
+}
+
+// writeJSON 以缩进的 JSON 格式输出到标准输出
+func writeJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// serverFlags 返回 start 和 config 命令使用的参数
+func serverFlags() []cli.Flag {
+	return withEnvVars([]cli.Flag{
+		&cli.IntFlag{
+			Name:  "port",
+			Usage: "dns server port，没有配置 --listen 时必须指定",
+		},
+		&cli.StringFlag{
+			Name:  "config",
+			Usage: "YAML 配置文件，命令行参数和环境变量优先于配置文件",
+		},
+		&cli.StringFlag{
+			Name:  "chinaServer",
+			Usage: "国内 DNS 服务地址（支持普通 DNS、DOH 和 DOT）",
+			Value: "120.53.53.53",
+		},
+		&cli.StringFlag{
+			Name:  "overSeaServer",
+			Usage: "海外 DNS 服务地址（支持普通 DNS、DOH 和 DOT）",
+			Value: "1.1.1.1",
+		},
+		&cli.IntFlag{
+			Name:  "adminPort",
+			Usage: "管理后台端口",
+			Value: 8080,
+		},
+		&cli.StringFlag{
+			Name:  "adminBind",
+			Usage: "管理后台监听的地址，例如 127.0.0.1 只允许本机访问，默认监听所有地址",
+		},
+		&cli.BoolFlag{
+			Name:  "adminAuth",
+			Usage: "管理后台是否需要登录，关闭时任何能访问管理后台的人都可以查看查询记录和修改配置",
+			Value: true,
+		},
+		&cli.DurationFlag{
+			Name:  "adminSessionTtl",
+			Usage: "管理后台登录会话的有效时间",
+			Value: 7 * 24 * time.Hour,
+		},
+		&cli.StringSliceFlag{
+			Name:  "adminAllowedOrigin",
+			Usage: "允许调用管理后台接口和连接 WebSocket 的其他页面来源，例如 https://router.lan，可多次指定",
+		},
+		&cli.BoolFlag{
+			Name:  "adminTls",
+			Usage: "管理后台是否使用 HTTPS，由反向代理提供 HTTPS 时可以关闭",
+			Value: true,
+		},
+		&cli.StringFlag{
+			Name:  "adminCertFile",
+			Usage: "管理后台的证书文件（PEM 格式），没有配置时在数据目录中生成自签名证书",
+		},
+		&cli.StringFlag{
+			Name:  "adminKeyFile",
+			Usage: "管理后台证书的私钥文件（PEM 格式）",
+		},
+		&cli.StringFlag{
+			Name:  "dataDir",
+			Usage: "数据目录路径",
+			Value: "./data",
+		},
+		&cli.StringFlag{
+			Name:  "chinaDomainListUrl",
+			Usage: "中国域名列表下载地址",
+			Value: "https://raw.githubusercontent.com/felixonmars/dnsmasq-china-list/refs/heads/master/accelerated-domains.china.conf",
+		},
+		&cli.BoolFlag{
+			Name:  "pinyinEnabled",
+			Usage: "是否启用拼音域名判断",
+			Value: true,
+		},
+		&cli.Float64Flag{
+			Name:  "pinyinThreshold",
+			Usage: "拼音域名判断的置信度阈值 (0-1)",
+			Value: domain.DefaultPinyinThreshold,
+		},
+		&cli.StringSliceFlag{
+			Name:  "pinyinAllowlist",
+			Usage: "强制视为中国域名的域名后缀（拼音判断白名单）",
+		},
+		&cli.StringSliceFlag{
+			Name:  "pinyinDenylist",
+			Usage: "不使用拼音判断的域名后缀（拼音判断黑名单）",
+		},
+		&cli.StringFlag{
+			Name:  "beianApiUrl",
+			Usage: "备案查询接口地址，为空时不使用备案信息判断",
+		},
+		&cli.StringFlag{
+			Name:  "beianApiKey",
+			Usage: "备案查询接口 API Key",
+		},
+		&cli.DurationFlag{
+			Name:  "beianTimeout",
+			Usage: "单次 DNS 查询等待备案结果的最长时间",
+			Value: 300 * time.Millisecond,
+		},
+		&cli.DurationFlag{
+			Name:  "beianPositiveTTL",
+			Usage: "已备案结果的缓存时间",
+			Value: 7 * 24 * time.Hour,
+		},
+		&cli.DurationFlag{
+			Name:  "beianNegativeTTL",
+			Usage: "未备案结果的缓存时间",
+			Value: 24 * time.Hour,
+		},
+		&cli.StringFlag{
+			Name:  "chinaIpListUrl",
+			Usage: "中国 IP 列表下载地址，用于根据应答 IP 学习域名路由",
+			Value: "https://raw.githubusercontent.com/17mon/china_ip_list/master/china_ip_list.txt",
+		},
+		&cli.BoolFlag{
+			Name:  "learnEnabled",
+			Usage: "是否根据应答 IP 学习域名路由",
+			Value: true,
+		},
+		&cli.DurationFlag{
+			Name:  "learnTTL",
+			Usage: "待审核的学习结果的有效时间",
+			Value: 7 * 24 * time.Hour,
+		},
+		&cli.Int64Flag{
+			Name:  "learnMinHits",
+			Usage: "学习结果生效前需要观察到的最少次数",
+			Value: 2,
+		},
+		&cli.StringFlag{
+			Name:  "hostsFile",
+			Usage: "hosts 文件路径，文件修改后自动重新加载",
+		},
+		&cli.StringSliceFlag{
+			Name:  "staticRecord",
+			Usage: "静态记录，格式为 \"name [ttl] TYPE value\"，支持 A、AAAA、CNAME、TXT、SRV、PTR，可多次指定",
+		},
+		&cli.StringSliceFlag{
+			Name:  "blocklistUrl",
+			Usage: "广告和跟踪域名拦截列表订阅地址，支持 hosts 格式和 AdBlock 格式，可多次指定",
+		},
+		&cli.StringSliceFlag{
+			Name:  "blockRule",
+			Usage: "自定义拦截规则，格式与拦截列表相同，例如 \"||ads.example.com^\" 或 \"@@||example.com^\"，可多次指定",
+		},
+		&cli.DurationFlag{
+			Name:  "blocklistRefresh",
+			Usage: "拦截列表刷新间隔",
+			Value: 24 * time.Hour,
+		},
+		&cli.StringSliceFlag{
+			Name:  "listen",
+			Usage: "监听地址，格式为 udp://0.0.0.0:53 或 tcp://0.0.0.0:53，可以通过 ?allow=CIDR,...&deny=CIDR,...&action=refuse|drop 单独指定访问控制，可多次指定，默认在 port 上同时监听 UDP 和 TCP",
+		},
+		&cli.StringSliceFlag{
+			Name:  "allow",
+			Usage: "允许访问的 IP 或 CIDR，未指定时允许所有客户端，可多次指定",
+		},
+		&cli.StringSliceFlag{
+			Name:  "deny",
+			Usage: "拒绝访问的 IP 或 CIDR，优先于 allow，可多次指定",
+		},
+		&cli.StringFlag{
+			Name:  "denyAction",
+			Usage: "拒绝未授权客户端的方式：refuse（返回 REFUSED）或 drop（不应答）",
+			Value: "refuse",
+		},
+		&cli.Float64Flag{
+			Name:  "rateLimit",
+			Usage: "每个客户端每秒允许的查询数，超过后丢弃查询，0 表示不限制",
+		},
+		&cli.IntFlag{
+			Name:  "rateLimitBurst",
+			Usage: "每个客户端允许的突发查询数，默认等于 rateLimit",
+		},
+		&cli.IntFlag{
+			Name:  "rateLimitIpv4Prefix",
+			Usage: "按子网限速时 IPv4 客户端的前缀长度",
+			Value: 32,
+		},
+		&cli.IntFlag{
+			Name:  "rateLimitIpv6Prefix",
+			Usage: "按子网限速时 IPv6 客户端的前缀长度",
+			Value: 128,
+		},
+		&cli.StringSliceFlag{
+			Name:  "rateLimitExempt",
+			Usage: "不受限速的 IP 或 CIDR，本机地址始终不受限速，可多次指定",
+		},
+		&cli.Float64Flag{
+			Name:  "rrlResponses",
+			Usage: "每个客户端每秒允许发送的相同响应数（仅 UDP），0 表示不限制",
+		},
+		&cli.IntFlag{
+			Name:  "rrlSlip",
+			Usage: "超过响应限速时每隔多少个响应发送一个截断响应，其余丢弃，0 表示全部丢弃",
+			Value: 2,
+		},
+		&cli.StringFlag{
+			Name:  "rebindProtection",
+			Usage: "DNS 重绑定防护：off（不检查）、strip（删除上游应答中的内网地址）或 refuse（返回 REFUSED）",
+			Value: "off",
+		},
+		&cli.StringSliceFlag{
+			Name:  "rebindAllowDomain",
+			Usage: "允许解析到内网地址的域名（包含子域名），例如内部域名，可多次指定",
+		},
+		&cli.BoolFlag{
+			Name:  "poisonDetection",
+			Usage: "检测国内 DNS 应答是否被污染，疑似污染时使用海外 DNS 重新查询",
+			Value: true,
+		},
+		&cli.StringSliceFlag{
+			Name:  "bogusIp",
+			Usage: "额外的污染应答地址（IP 或 CIDR），内置已知的污染地址，可多次指定",
+		},
+		&cli.StringSliceFlag{
+			Name:  "bogusNxdomain",
+			Usage: "表示域名不存在的劫持地址（IP 或 CIDR），例如运营商的广告页面，可多次指定",
+		},
+		&cli.DurationFlag{
+			Name:  "poisonMinRtt",
+			Usage: "国内 DNS 应答时间低于该值时视为抢答的污染应答，0 表示不检查",
+		},
+		&cli.StringSliceFlag{
+			Name:  "forward",
+			Usage: "条件转发规则，格式为 zone=server，例如 lan=127.0.0.1:5353 或 168.192.in-addr.arpa=192.168.1.1，server 为空时返回 NXDOMAIN，可多次指定",
+		},
+		&cli.StringFlag{
+			Name:  "localServer",
+			Usage: "内网反向解析区域和 lan、home.arpa 使用的上游 DNS，例如路由器上的 dnsmasq，为空时这些区域直接返回 NXDOMAIN",
+		},
+		&cli.BoolFlag{
+			Name:  "forwardDefaultZones",
+			Usage: "是否默认转发内网反向解析区域和 lan、home.arpa，不发送到公共 DNS",
+			Value: true,
+		},
+		&cli.StringFlag{
+			Name:  "chinaEcs",
+			Usage: "国内上游的 ECS（EDNS Client Subnet）处理方式：off 不修改、forward 使用客户端子网、strip 删除，或者固定的子网，例如 203.0.113.0/24",
+			Value: "off",
+		},
+		&cli.StringFlag{
+			Name:  "overseaEcs",
+			Usage: "海外上游的 ECS 处理方式，取值同 chinaEcs",
+			Value: "off",
+		},
+		&cli.IntFlag{
+			Name:  "ecsIpv4Prefix",
+			Usage: "ECS 为 forward 时 IPv4 客户端发送给上游的前缀长度",
+			Value: 24,
+		},
+		&cli.IntFlag{
+			Name:  "ecsIpv6Prefix",
+			Usage: "ECS 为 forward 时 IPv6 客户端发送给上游的前缀长度",
+			Value: 56,
+		},
+		&cli.IntFlag{
+			Name:  "cacheSize",
+			Usage: "最多缓存的 DNS 响应数，0 表示不使用缓存",
+			Value: 4096,
+		},
+		&cli.DurationFlag{
+			Name:  "cacheMinTtl",
+			Usage: "缓存时间的下限，0 表示使用上游返回的 TTL",
+		},
+		&cli.DurationFlag{
+			Name:  "cacheMaxTtl",
+			Usage: "缓存时间的上限",
+			Value: 24 * time.Hour,
+		},
+		&cli.BoolFlag{
+			Name:  "dnssec",
+			Usage: "验证上游应答的 DNSSEC 签名，验证失败时返回 SERVFAIL，验证通过时设置 AD 标志",
+		},
+		&cli.StringSliceFlag{
+			Name:  "trustAnchor",
+			Usage: "DNSSEC 信任锚，DS 记录格式，例如 \". 20326 8 2 E06D...\"，默认使用内置的根区域信任锚，可多次指定",
+		},
+		&cli.StringSliceFlag{
+			Name:  "ipset",
+			Usage: "将域名解析到的地址添加到 ipset 集合，格式与 dnsmasq 相同，例如 /google.com/youtube.com/proxy，可多次指定",
+		},
+		&cli.StringSliceFlag{
+			Name:  "nftset",
+			Usage: "将域名解析到的地址添加到 nftables 集合，格式与 dnsmasq 相同，例如 /google.com/4#inet#fw4#proxy4,6#inet#fw4#proxy6，可多次指定",
+		},
+		&cli.StringSliceFlag{
+			Name:  "overseaIpset",
+			Usage: "使用海外 DNS 解析的域名，地址都添加到该 ipset 集合，格式为 [4|6#]name，可多次指定",
+		},
+		&cli.StringSliceFlag{
+			Name:  "overseaNftset",
+			Usage: "使用海外 DNS 解析的域名，地址都添加到该 nftables 集合，格式为 [4|6#]family#table#set，可多次指定",
+		},
+		&cli.StringFlag{
+			Name:  "clientGroupsFile",
+			Usage: "客户端分组配置文件（JSON），为不同客户端指定路由规则、拦截列表、上游 DNS 和安全搜索",
+		},
+		&cli.StringFlag{
+			Name:  "blockResponse",
+			Usage: "拦截应答方式：nxdomain、null（0.0.0.0 和 ::）、refused，或者自定义 IP（多个 IP 用逗号分隔）",
+			Value: "nxdomain",
+		},
+	})
+}
+
+// configFile 返回命令参数中的配置文件，没有时使用 --config
+func configFile(c *cli.Context) string {
+	if file := c.Args().First(); file != "" {
+		return file
+	}
+	return c.String("config")
+}
+
+// envPrefix 环境变量的前缀，例如 --chinaServer 对应 GO_DNS_PROXY_CHINA_SERVER
+const envPrefix = "GO_DNS_PROXY_"
+
+// withEnvVars 为每个参数添加对应的环境变量
+func withEnvVars(flags []cli.Flag) []cli.Flag {
+	for _, f := range flags {
+		env := []string{envName(f.Names()[0])}
+		switch f := f.(type) {
+		case *cli.StringFlag:
+			f.EnvVars = env
+		case *cli.IntFlag:
+			f.EnvVars = env
+		case *cli.Int64Flag:
+			f.EnvVars = env
+		case *cli.Float64Flag:
+			f.EnvVars = env
+		case *cli.BoolFlag:
+			f.EnvVars = env
+		case *cli.DurationFlag:
+			f.EnvVars = env
+		case *cli.StringSliceFlag:
+			f.EnvVars = env
+		}
+	}
+	return flags
+}
+
+// envName 将参数名转换为环境变量名，例如 beianPositiveTTL 转换为 GO_DNS_PROXY_BEIAN_POSITIVE_TTL
+func envName(flag string) string {
+	var b strings.Builder
+	b.WriteString(envPrefix)
+	for i, r := range flag {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := rune(flag[i-1])
+			nextLower := i+1 < len(flag) && unicode.IsLower(rune(flag[i+1]))
+			if !unicode.IsUpper(prev) || nextLower {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// setLogLevel 设置日志级别，无效的级别使用 info
+func setLogLevel(s string) {
+	level, err := log.ParseLevel(s)
+	if err != nil {
+		level = log.InfoLevel
+	}
+	log.SetLevel(level)
+}
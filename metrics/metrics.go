@@ -0,0 +1,381 @@
+// Package metrics 实现 Prometheus 文本格式的计数器、仪表和直方图。
+//
+// 所有更新都只使用原子操作或读锁，可以在查询处理过程中直接调用。
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ContentType Prometheus 文本格式的 Content-Type
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets 耗时直方图默认的分桶上限，单位为秒
+var DefaultBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// Sample 一个带标签的值，用于 GaugeFunc 和 CounterFunc
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+// collector 输出一个指标的所有序列
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+// Registry 保存所有指标，按注册顺序输出
+type Registry struct {
+	mu         sync.Mutex
+	names      map[string]bool
+	collectors []collector
+}
+
+// NewRegistry 创建一个空的指标注册表
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (r *Registry) register(name string, c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[name] {
+		panic("metrics: 重复注册指标 " + name)
+	}
+	r.names[name] = true
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteTo 以 Prometheus 文本格式输出所有指标
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// desc 指标的名称、说明、类型和标签名
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+// writeSample 输出一行样本，extra 为直方图的 le 标签
+func (d *desc) writeSample(w *bufio.Writer, suffix string, values []string, extra string, value float64) {
+	w.WriteString(d.name)
+	w.WriteString(suffix)
+	if len(values) > 0 || extra != "" {
+		w.WriteByte('{')
+		for i, name := range d.labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(name)
+			w.WriteString(`="`)
+			w.WriteString(escapeLabel(values[i]))
+			w.WriteByte('"')
+		}
+		if extra != "" {
+			if len(values) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extra)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+// vec 按标签值保存序列，序列创建后不会删除
+type vec struct {
+	desc
+	mu     sync.RWMutex
+	series map[string]interface{}
+	values map[string][]string
+	create func() interface{}
+}
+
+func newVec(d desc, create func() interface{}) *vec {
+	return &vec{
+		desc:   d,
+		series: make(map[string]interface{}),
+		values: make(map[string][]string),
+		create: create,
+	}
+}
+
+func (v *vec) get(values []string) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s 需要 %d 个标签值，实际为 %d 个", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.RLock()
+	s, ok := v.series[key]
+	v.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if s, ok = v.series[key]; !ok {
+		s = v.create()
+		v.series[key] = s
+		v.values[key] = append([]string(nil), values...)
+	}
+	return s
+}
+
+// each 按标签值排序遍历所有序列
+func (v *vec) each(f func(values []string, s interface{})) {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	v.mu.RUnlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v.mu.RLock()
+		s, values := v.series[key], v.values[key]
+		v.mu.RUnlock()
+		f(values, s)
+	}
+}
+
+// Counter 只增不减的计数器
+type Counter struct {
+	value uint64
+}
+
+// Inc 计数加 1
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+// Add 计数加 n
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+// Value 返回当前计数
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// CounterVec 按标签区分的计数器
+type CounterVec struct {
+	*vec
+}
+
+// NewCounterVec 注册按标签区分的计数器，name 应以 _total 结尾
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{newVec(desc{name, help, "counter", labels}, func() interface{} { return &Counter{} })}
+	r.register(name, v)
+	return v
+}
+
+// WithLabelValues 返回标签值对应的计数器，不存在时创建
+func (v *CounterVec) WithLabelValues(values ...string) *Counter {
+	return v.get(values).(*Counter)
+}
+
+func (v *CounterVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	v.each(func(values []string, s interface{}) {
+		v.writeSample(w, "", values, "", float64(s.(*Counter).Value()))
+	})
+}
+
+// Gauge 可增可减的整数仪表，例如正在处理的查询数
+type Gauge struct {
+	// 原子操作的 64 位字段放在最前面，保证在 32 位平台上对齐
+	value int64
+	desc
+}
+
+// NewGauge 注册没有标签的仪表
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{desc: desc{name: name, help: help, typ: "gauge"}}
+	r.register(name, g)
+	return g
+}
+
+// Inc 加 1
+func (g *Gauge) Inc() {
+	atomic.AddInt64(&g.value, 1)
+}
+
+// Dec 减 1
+func (g *Gauge) Dec() {
+	atomic.AddInt64(&g.value, -1)
+}
+
+// Value 返回当前值
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	g.writeSample(w, "", nil, "", float64(g.Value()))
+}
+
+// funcCollector 在输出时调用函数取值，用于已经在其他地方统计的数据
+type funcCollector struct {
+	desc
+	f func() []Sample
+}
+
+func (c *funcCollector) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	for _, s := range c.f() {
+		c.writeSample(w, "", s.Labels, "", s.Value)
+	}
+}
+
+// NewGaugeFunc 注册在输出时取值的仪表，每个 Sample 的标签值与 labels 对应
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, f func() []Sample) {
+	r.register(name, &funcCollector{desc{name, help, "gauge", labels}, f})
+}
+
+// NewCounterFunc 注册在输出时取值的计数器，f 返回的值不应减小
+func (r *Registry) NewCounterFunc(name, help string, labels []string, f func() []Sample) {
+	r.register(name, &funcCollector{desc{name, help, "counter", labels}, f})
+}
+
+// Histogram 直方图，记录值的分布、数量和总和
+type Histogram struct {
+	count   uint64
+	sumBits uint64
+	buckets []float64
+	counts  []uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+// Observe 记录一个值
+func (h *Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.buckets, value)
+	if i < len(h.buckets) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	atomic.AddUint64(&h.count, 1)
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		sum := math.Float64bits(math.Float64frombits(old) + value)
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, sum) {
+			return
+		}
+	}
+}
+
+// Count 返回记录的值的数量
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+// HistogramVec 按标签区分的直方图
+type HistogramVec struct {
+	*vec
+	buckets []float64
+}
+
+// NewHistogramVec 注册按标签区分的直方图，buckets 为递增的分桶上限，为空时使用 DefaultBuckets
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	v := &HistogramVec{buckets: buckets}
+	v.vec = newVec(desc{name, help, "histogram", labels}, func() interface{} { return newHistogram(v.buckets) })
+	r.register(name, v)
+	return v
+}
+
+// WithLabelValues 返回标签值对应的直方图，不存在时创建
+func (v *HistogramVec) WithLabelValues(values ...string) *Histogram {
+	return v.get(values).(*Histogram)
+}
+
+func (v *HistogramVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	v.each(func(values []string, s interface{}) {
+		h := s.(*Histogram)
+		// 先读取总数，各分桶的累计数量不会超过总数
+		count := h.Count()
+		var cumulative uint64
+		for i, upper := range v.buckets {
+			cumulative += atomic.LoadUint64(&h.counts[i])
+			if cumulative > count {
+				cumulative = count
+			}
+			v.writeSample(w, "_bucket", values, `le="`+formatFloat(upper)+`"`, float64(cumulative))
+		}
+		v.writeSample(w, "_bucket", values, `le="+Inf"`, float64(count))
+		v.writeSample(w, "_sum", values, "", math.Float64frombits(atomic.LoadUint64(&h.sumBits)))
+		v.writeSample(w, "_count", values, "", float64(count))
+	})
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var (
+	helpReplacer  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelReplacer.Replace(s)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRegistry_WriteTo(t *testing.T) {
+	r := NewRegistry()
+	queries := r.NewCounterVec("dns_queries_total", "DNS 查询数", "protocol", "qtype")
+	inflight := r.NewGauge("dns_inflight_queries", "正在处理的查询数")
+	latency := r.NewHistogramVec("dns_upstream_duration_seconds", "上游应答时间", []float64{0.01, 0.1}, "upstream")
+	r.NewGaugeFunc("dns_domain_list_size", "域名列表大小", []string{"list"}, func() []Sample {
+		return []Sample{{Labels: []string{"china"}, Value: 3}}
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			queries.WithLabelValues("udp", "A").Inc()
+		}()
+	}
+	wg.Wait()
+	queries.WithLabelValues("tcp", `"AAAA"`).Add(2)
+	inflight.Inc()
+	inflight.Inc()
+	inflight.Dec()
+	upstream := latency.WithLabelValues("udp://1.1.1.1:53")
+	upstream.Observe(0.005)
+	upstream.Observe(0.05)
+	upstream.Observe(0.5)
+
+	var b strings.Builder
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP dns_queries_total DNS 查询数
+# TYPE dns_queries_total counter
+dns_queries_total{protocol="tcp",qtype="\"AAAA\""} 2
+dns_queries_total{protocol="udp",qtype="A"} 100
+# HELP dns_inflight_queries 正在处理的查询数
+# TYPE dns_inflight_queries gauge
+dns_inflight_queries 1
+# HELP dns_upstream_duration_seconds 上游应答时间
+# TYPE dns_upstream_duration_seconds histogram
+dns_upstream_duration_seconds_bucket{upstream="udp://1.1.1.1:53",le="0.01"} 1
+dns_upstream_duration_seconds_bucket{upstream="udp://1.1.1.1:53",le="0.1"} 2
+dns_upstream_duration_seconds_bucket{upstream="udp://1.1.1.1:53",le="+Inf"} 3
+dns_upstream_duration_seconds_sum{upstream="udp://1.1.1.1:53"} 0.555
+dns_upstream_duration_seconds_count{upstream="udp://1.1.1.1:53"} 3
+# HELP dns_domain_list_size 域名列表大小
+# TYPE dns_domain_list_size gauge
+dns_domain_list_size{list="china"} 3
+`
+	if got := b.String(); got != want {
+		t.Errorf("WriteTo() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRegistry_DuplicateName(t *testing.T) {
+	r := NewRegistry()
+	r.NewGauge("dns_inflight_queries", "")
+	defer func() {
+		if recover() == nil {
+			t.Error("重复注册指标时应该 panic")
+		}
+	}()
+	r.NewGauge("dns_inflight_queries", "")
+}
@@ -0,0 +1,136 @@
+package poison
+
+import (
+	"fmt"
+	"go-dns-proxy/acl"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// 疑似污染的原因
+const (
+	ReasonBogusIP       = "bogus_ip"
+	ReasonBogusNXDomain = "bogus_nxdomain"
+	ReasonFastAnswer    = "fast_answer"
+)
+
+// knownBogusIPs 已知的 DNS 污染应答地址，以及不会出现在正常应答中的保留地址段
+var knownBogusIPs = []string{
+	"4.36.66.178",
+	"8.7.198.45",
+	"37.61.54.158",
+	"46.82.174.68",
+	"59.24.3.173",
+	"64.33.88.161",
+	"64.33.99.47",
+	"64.66.163.251",
+	"65.104.202.252",
+	"65.160.219.113",
+	"66.45.252.237",
+	"78.16.49.15",
+	"93.46.8.89",
+	"128.121.126.139",
+	"159.106.121.75",
+	"169.132.13.103",
+	"192.67.198.6",
+	"202.106.1.2",
+	"202.181.7.85",
+	"203.98.7.65",
+	"203.161.230.171",
+	"207.12.88.98",
+	"208.56.31.43",
+	"209.36.73.33",
+	"209.145.54.50",
+	"209.220.30.174",
+	"211.94.66.147",
+	"213.169.251.35",
+	"216.221.188.182",
+	"216.234.179.13",
+	"240.0.0.0/4",
+}
+
+// Options 污染检测配置
+type Options struct {
+	// Disabled 关闭污染检测
+	Disabled bool
+	// BogusIPs 额外的污染应答地址，IP 或 CIDR
+	BogusIPs []string
+	// BogusNXDomain 表示域名不存在的劫持地址，例如运营商的广告页面，IP 或 CIDR
+	BogusNXDomain []string
+	// MinRTT 应答时间低于该值时视为抢答的污染应答，0 表示不检查
+	MinRTT time.Duration
+}
+
+// Result 污染检测结果
+type Result struct {
+	Reason string
+	Detail string
+}
+
+// String 返回原因和详情，例如 bogus_ip:243.185.187.39
+func (r Result) String() string {
+	return r.Reason + ":" + r.Detail
+}
+
+// Detector 检测国内 DNS 的应答是否被污染
+type Detector struct {
+	bogusIPs      []*net.IPNet
+	bogusNXDomain []*net.IPNet
+	minRTT        time.Duration
+}
+
+// New 创建污染检测，Disabled 时返回 nil
+func New(options Options) (*Detector, error) {
+	if options.Disabled {
+		return nil, nil
+	}
+
+	bogusIPs, err := acl.ParseNets(append(append([]string{}, knownBogusIPs...), options.BogusIPs...))
+	if err != nil {
+		return nil, fmt.Errorf("无效的污染应答地址: %v", err)
+	}
+	bogusNXDomain, err := acl.ParseNets(options.BogusNXDomain)
+	if err != nil {
+		return nil, fmt.Errorf("无效的 bogus-nxdomain 地址: %v", err)
+	}
+	return &Detector{
+		bogusIPs:      bogusIPs,
+		bogusNXDomain: bogusNXDomain,
+		minRTT:        options.MinRTT,
+	}, nil
+}
+
+// Check 检查应答是否疑似被污染，rtt 为上游的应答时间
+func (d *Detector) Check(answers []dnsmessage.Resource, rtt time.Duration) (Result, bool) {
+	if d == nil {
+		return Result{}, false
+	}
+
+	hasAddr := false
+	for _, answer := range answers {
+		var ip net.IP
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = net.IP(body.A[:])
+		case *dnsmessage.AAAAResource:
+			ip = net.IP(body.AAAA[:])
+		default:
+			continue
+		}
+		hasAddr = true
+		if acl.ContainsIP(d.bogusNXDomain, ip) {
+			return Result{Reason: ReasonBogusNXDomain, Detail: ip.String()}, true
+		}
+		if acl.ContainsIP(d.bogusIPs, ip) {
+			return Result{Reason: ReasonBogusIP, Detail: ip.String()}, true
+		}
+	}
+
+	// 只有包含地址的应答才可能是抢答的污染应答
+	if d.minRTT > 0 && rtt < d.minRTT && hasAddr {
+		return Result{Reason: ReasonFastAnswer, Detail: rtt.String()}, true
+	}
+	return Result{}, false
+}
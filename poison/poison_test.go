@@ -0,0 +1,72 @@
+package poison
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func aRecord(ip string) dnsmessage.Resource {
+	var a [4]byte
+	copy(a[:], net.ParseIP(ip).To4())
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		Body:   &dnsmessage.AResource{A: a},
+	}
+}
+
+func TestDetector_Check(t *testing.T) {
+	d, err := New(Options{
+		BogusIPs:      []string{"198.51.100.0/24"},
+		BogusNXDomain: []string{"203.0.113.1"},
+		MinRTT:        5 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cname := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET},
+		Body:   &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("cdn.example.com.")},
+	}
+
+	tests := []struct {
+		name       string
+		answers    []dnsmessage.Resource
+		rtt        time.Duration
+		wantReason string
+	}{
+		{"normal", []dnsmessage.Resource{aRecord("93.184.216.34")}, 30 * time.Millisecond, ""},
+		{"known bogus ip", []dnsmessage.Resource{aRecord("93.46.8.89")}, 30 * time.Millisecond, ReasonBogusIP},
+		{"reserved range", []dnsmessage.Resource{aRecord("243.185.187.39")}, 30 * time.Millisecond, ReasonBogusIP},
+		{"configured bogus ip", []dnsmessage.Resource{aRecord("93.184.216.34"), aRecord("198.51.100.7")}, 30 * time.Millisecond, ReasonBogusIP},
+		{"bogus nxdomain", []dnsmessage.Resource{aRecord("203.0.113.1")}, 30 * time.Millisecond, ReasonBogusNXDomain},
+		{"fast answer", []dnsmessage.Resource{aRecord("93.184.216.34")}, time.Millisecond, ReasonFastAnswer},
+		{"fast answer without address", []dnsmessage.Resource{cname}, time.Millisecond, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, suspected := d.Check(tt.answers, tt.rtt)
+			if suspected != (tt.wantReason != "") || result.Reason != tt.wantReason {
+				t.Errorf("Check() = %v, %v, want reason %q", result, suspected, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	d, err := New(Options{Disabled: true})
+	if err != nil || d != nil {
+		t.Errorf("New() with Disabled = %v, %v, want nil detector", d, err)
+	}
+	if _, suspected := d.Check([]dnsmessage.Resource{aRecord("93.46.8.89")}, 0); suspected {
+		t.Error("disabled detector reported poisoned answer")
+	}
+
+	if _, err := New(Options{BogusNXDomain: []string{"isp.example.com"}}); err == nil {
+		t.Error("New() with invalid bogus-nxdomain returned no error")
+	}
+}
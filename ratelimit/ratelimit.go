@@ -0,0 +1,358 @@
+package ratelimit
+
+import (
+	"fmt"
+	"go-dns-proxy/acl"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 被限制的客户端记录保留的时间
+const limitedRetention = time.Hour
+
+// 最多跟踪的响应令牌桶数，超过时先清理已经补满的令牌桶，仍然超过时随机淘汰
+const maxResponses = 65536
+
+// 最多跟踪的客户端数，超过时的处理与响应令牌桶相同
+const maxClients = 65536
+
+// 响应限速的处理结果
+type Action int
+
+const (
+	// Send 正常发送响应
+	Send Action = iota
+	// Slip 发送截断响应，让真实客户端改用 TCP 重试
+	Slip
+	// Drop 丢弃响应
+	Drop
+)
+
+// Options 限速配置
+type Options struct {
+	// QPS 每个客户端每秒允许的查询数，0 表示不限制
+	QPS float64
+	// Burst 允许的突发查询数，默认等于 QPS
+	Burst int
+	// IPv4Prefix 按子网聚合 IPv4 客户端的前缀长度，默认 32
+	IPv4Prefix int
+	// IPv6Prefix 按子网聚合 IPv6 客户端的前缀长度，默认 128
+	IPv6Prefix int
+	// ResponsesPerSecond 每个客户端每秒允许发送的相同响应数（RRL），0 表示不限制
+	ResponsesPerSecond float64
+	// Slip 超过响应限速时每 Slip 个响应发送一个截断响应，其余丢弃，0 表示全部丢弃
+	Slip int
+	// Exempt 不受限速的 IP 或 CIDR
+	Exempt []string
+}
+
+// Client 被限制过的客户端
+type Client struct {
+	Client      string
+	Limited     int64
+	Slipped     int64
+	Dropped     int64
+	LastLimited time.Time
+}
+
+// bucket 令牌桶
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take 按 rate 补充令牌后取出一个，令牌不足时返回 false
+func (b *bucket) take(rate, burst float64, now time.Time) bool {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// clientState 一个客户端（或子网）的查询令牌桶和限制计数
+type clientState struct {
+	bucket
+	limited     int64
+	slipped     int64
+	dropped     int64
+	lastLimited time.Time
+}
+
+// responseState 一个客户端的一种响应的令牌桶
+type responseState struct {
+	bucket
+	limited int64
+}
+
+// Limiter 按客户端限制查询速率和相同响应的速率
+type Limiter struct {
+	options Options
+	burst   float64
+	// responseBurst 相同响应的突发数，至少为 1，否则速率小于 1 时所有响应都会被丢弃
+	responseBurst float64
+	exempt        []*net.IPNet
+	mu            sync.Mutex
+	clients       map[string]*clientState
+	responses     map[string]*responseState
+	maxClients    int
+	maxResponses  int
+	// lastPrune 最近一次因响应令牌桶过多而清理的时间
+	lastPrune time.Time
+	// lastClientPrune 最近一次因客户端过多而清理的时间
+	lastClientPrune time.Time
+	now             func() time.Time
+}
+
+// New 创建限速器
+func New(options Options) (*Limiter, error) {
+	if options.QPS < 0 || options.ResponsesPerSecond < 0 || options.Burst < 0 || options.Slip < 0 {
+		return nil, fmt.Errorf("限速参数不能为负数")
+	}
+	if options.IPv4Prefix == 0 {
+		options.IPv4Prefix = 32
+	}
+	if options.IPv6Prefix == 0 {
+		options.IPv6Prefix = 128
+	}
+	if options.IPv4Prefix > 32 || options.IPv6Prefix > 128 || options.IPv4Prefix < 0 || options.IPv6Prefix < 0 {
+		return nil, fmt.Errorf("无效的子网前缀长度: /%d, /%d", options.IPv4Prefix, options.IPv6Prefix)
+	}
+	exempt, err := acl.ParseNets(options.Exempt)
+	if err != nil {
+		return nil, err
+	}
+
+	burst := float64(options.Burst)
+	if burst == 0 {
+		burst = options.QPS
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	responseBurst := options.ResponsesPerSecond
+	if responseBurst < 1 {
+		responseBurst = 1
+	}
+
+	return &Limiter{
+		options:       options,
+		burst:         burst,
+		responseBurst: responseBurst,
+		exempt:        exempt,
+		clients:       make(map[string]*clientState),
+		responses:     make(map[string]*responseState),
+		maxClients:    maxClients,
+		maxResponses:  maxResponses,
+		now:           time.Now,
+	}, nil
+}
+
+// Enabled 判断是否配置了查询限速或响应限速
+func (l *Limiter) Enabled() bool {
+	return l != nil && (l.options.QPS > 0 || l.options.ResponsesPerSecond > 0)
+}
+
+// ResponseLimitEnabled 判断是否配置了响应限速
+func (l *Limiter) ResponseLimitEnabled() bool {
+	return l != nil && l.options.ResponsesPerSecond > 0
+}
+
+// AllowQuery 判断客户端的查询是否在限速范围内
+func (l *Limiter) AllowQuery(ip net.IP) bool {
+	if l == nil || l.options.QPS <= 0 || l.isExempt(ip) {
+		return true
+	}
+
+	key := l.clientKey(ip)
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	state := l.client(key, now)
+	if state.take(l.options.QPS, l.burst, now) {
+		return true
+	}
+	state.limited++
+	state.lastLimited = now
+	return false
+}
+
+// CheckResponse 检查发送给客户端的响应是否超过响应限速，response 用于区分不同的响应，
+// 例如 "example.com./A/NOERROR"
+func (l *Limiter) CheckResponse(ip net.IP, response string) Action {
+	if l == nil || l.options.ResponsesPerSecond <= 0 || l.isExempt(ip) {
+		return Send
+	}
+
+	key := l.clientKey(ip)
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	state, ok := l.responses[key+" "+response]
+	if !ok {
+		if len(l.responses) >= l.maxResponses {
+			l.pruneResponses(now)
+		}
+		state = &responseState{}
+		l.responses[key+" "+response] = state
+	}
+	if state.take(l.options.ResponsesPerSecond, l.responseBurst, now) {
+		return Send
+	}
+
+	state.limited++
+	client := l.client(key, now)
+	client.lastLimited = now
+	if l.options.Slip > 0 && state.limited%int64(l.options.Slip) == 0 {
+		client.slipped++
+		return Slip
+	}
+	client.dropped++
+	return Drop
+}
+
+// LimitedClients 返回最近被限制过的客户端，按最后一次被限制的时间倒序排列
+func (l *Limiter) LimitedClients() []Client {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var result []Client
+	for key, state := range l.clients {
+		if state.lastLimited.IsZero() {
+			continue
+		}
+		result = append(result, Client{
+			Client:      key,
+			Limited:     state.limited,
+			Slipped:     state.slipped,
+			Dropped:     state.dropped,
+			LastLimited: state.lastLimited,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].LastLimited.After(result[j].LastLimited)
+	})
+	return result
+}
+
+// Run 定期清理空闲的令牌桶，直到 stop 关闭
+func (l *Limiter) Run(stop <-chan struct{}) {
+	if !l.Enabled() {
+		return
+	}
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			l.cleanup()
+		}
+	}
+}
+
+// cleanup 删除已经补满的令牌桶，被限制过的客户端保留一段时间以便在管理后台查看
+func (l *Limiter) cleanup() {
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cleanupClients(now)
+	l.cleanupResponses(now)
+}
+
+// cleanupClients 删除空闲且最近没有被限制的客户端，调用时需要持有锁。
+// 不限制查询速率时令牌桶不使用，客户端只在响应被限制时更新，按最后一次被限制的时间过期
+func (l *Limiter) cleanupClients(now time.Time) {
+	for key, state := range l.clients {
+		idle := l.options.QPS <= 0 || now.Sub(state.last).Seconds()*l.options.QPS+state.tokens >= l.burst
+		if idle && now.Sub(state.lastLimited) > limitedRetention {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// cleanupResponses 删除已经补满的响应令牌桶，调用时需要持有锁
+func (l *Limiter) cleanupResponses(now time.Time) {
+	for key, state := range l.responses {
+		if now.Sub(state.last).Seconds()*l.options.ResponsesPerSecond+state.tokens >= l.responseBurst {
+			delete(l.responses, key)
+		}
+	}
+}
+
+// pruneResponses 在响应令牌桶达到上限时腾出空间，调用时需要持有锁。
+// 每秒最多完整清理一次，避免大量不同的响应让每次插入都遍历整个表
+func (l *Limiter) pruneResponses(now time.Time) {
+	if now.Sub(l.lastPrune) >= time.Second {
+		l.lastPrune = now
+		l.cleanupResponses(now)
+	}
+	for key := range l.responses {
+		if len(l.responses) < l.maxResponses {
+			break
+		}
+		delete(l.responses, key)
+	}
+}
+
+// pruneClients 在客户端达到上限时腾出空间，调用时需要持有锁
+func (l *Limiter) pruneClients(now time.Time) {
+	if now.Sub(l.lastClientPrune) >= time.Second {
+		l.lastClientPrune = now
+		l.cleanupClients(now)
+	}
+	for key := range l.clients {
+		if len(l.clients) < l.maxClients {
+			break
+		}
+		delete(l.clients, key)
+	}
+}
+
+func (l *Limiter) client(key string, now time.Time) *clientState {
+	state, ok := l.clients[key]
+	if !ok {
+		if len(l.clients) >= l.maxClients {
+			l.pruneClients(now)
+		}
+		state = &clientState{}
+		l.clients[key] = state
+	}
+	return state
+}
+
+func (l *Limiter) isExempt(ip net.IP) bool {
+	return ip == nil || ip.IsLoopback() || acl.ContainsIP(l.exempt, ip)
+}
+
+// clientKey 返回客户端所在的子网，前缀长度为完整地址时只返回 IP
+func (l *Limiter) clientKey(ip net.IP) string {
+	bits, prefix := 128, l.options.IPv6Prefix
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits, prefix = ip4, 32, l.options.IPv4Prefix
+	}
+	if prefix == bits {
+		return ip.String()
+	}
+	ipNet := net.IPNet{IP: ip.Mask(net.CIDRMask(prefix, bits)), Mask: net.CIDRMask(prefix, bits)}
+	return ipNet.String()
+}
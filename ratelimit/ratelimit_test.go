@@ -0,0 +1,211 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeClock 手动推进的时钟
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func newTestLimiter(t *testing.T, options Options) (*Limiter, *fakeClock) {
+	t.Helper()
+	l, err := New(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l.now = clock.now
+	return l, clock
+}
+
+func TestLimiter_AllowQuery(t *testing.T) {
+	l, clock := newTestLimiter(t, Options{QPS: 2, Burst: 3, IPv4Prefix: 24, Exempt: []string{"192.168.2.10"}})
+
+	client := net.ParseIP("192.168.1.10")
+	neighbor := net.ParseIP("192.168.1.20")
+	for i := 0; i < 3; i++ {
+		if !l.AllowQuery(client) {
+			t.Fatalf("query %d limited within burst", i)
+		}
+	}
+	// 同一子网共享令牌桶
+	if l.AllowQuery(neighbor) {
+		t.Error("AllowQuery() for client in same subnet = true after burst, want false")
+	}
+
+	// 0.5 秒后补充一个令牌
+	clock.t = clock.t.Add(500 * time.Millisecond)
+	if !l.AllowQuery(client) {
+		t.Error("AllowQuery() after refill = false, want true")
+	}
+	if l.AllowQuery(client) {
+		t.Error("AllowQuery() after refill used = true, want false")
+	}
+
+	// 豁免的客户端和本机不受限制
+	for i := 0; i < 10; i++ {
+		if !l.AllowQuery(net.ParseIP("192.168.2.10")) || !l.AllowQuery(net.ParseIP("127.0.0.1")) {
+			t.Fatal("exempt client was limited")
+		}
+	}
+
+	limited := l.LimitedClients()
+	if len(limited) != 1 || limited[0].Client != "192.168.1.0/24" || limited[0].Limited != 2 {
+		t.Errorf("LimitedClients() = %+v, want 192.168.1.0/24 limited twice", limited)
+	}
+}
+
+func TestLimiter_CheckResponse(t *testing.T) {
+	l, clock := newTestLimiter(t, Options{ResponsesPerSecond: 2, Slip: 2})
+
+	client := net.ParseIP("10.0.0.1")
+	want := []Action{Send, Send, Drop, Slip, Drop, Slip}
+	for i, w := range want {
+		if got := l.CheckResponse(client, "example.com./A/NOERROR"); got != w {
+			t.Errorf("response %d = %v, want %v", i, got, w)
+		}
+	}
+
+	// 不同的响应单独计数
+	if got := l.CheckResponse(client, "example.org./A/NOERROR"); got != Send {
+		t.Errorf("CheckResponse() for other response = %v, want Send", got)
+	}
+
+	clock.t = clock.t.Add(time.Second)
+	if got := l.CheckResponse(client, "example.com./A/NOERROR"); got != Send {
+		t.Errorf("CheckResponse() after refill = %v, want Send", got)
+	}
+
+	limited := l.LimitedClients()
+	if len(limited) != 1 || limited[0].Slipped != 2 || limited[0].Dropped != 2 {
+		t.Errorf("LimitedClients() = %+v, want 2 slipped and 2 dropped", limited)
+	}
+}
+
+func TestLimiter_CheckResponseLowRate(t *testing.T) {
+	l, clock := newTestLimiter(t, Options{ResponsesPerSecond: 0.5})
+
+	// 速率小于 1 时仍然允许一个响应，之后每 2 秒补充一个
+	client := net.ParseIP("10.0.0.1")
+	want := []Action{Send, Drop}
+	for i, w := range want {
+		if got := l.CheckResponse(client, "example.com./A/NOERROR"); got != w {
+			t.Errorf("response %d = %v, want %v", i, got, w)
+		}
+	}
+	clock.t = clock.t.Add(2 * time.Second)
+	if got := l.CheckResponse(client, "example.com./A/NOERROR"); got != Send {
+		t.Errorf("CheckResponse() after refill = %v, want Send", got)
+	}
+}
+
+func TestLimiter_MaxResponses(t *testing.T) {
+	l, clock := newTestLimiter(t, Options{ResponsesPerSecond: 1})
+	l.maxResponses = 3
+
+	client := net.ParseIP("10.0.0.1")
+	for i := 0; i < 10; i++ {
+		l.CheckResponse(client, fmt.Sprintf("host%d.example.com./A/NOERROR", i))
+		if len(l.responses) > 3 {
+			t.Fatalf("%d responses tracked, want at most 3", len(l.responses))
+		}
+	}
+
+	// 已经补满的令牌桶优先被清理，正在限速的响应保留
+	clock.t = clock.t.Add(2 * time.Second)
+	l.CheckResponse(client, "example.com./A/NOERROR")
+	l.CheckResponse(client, "example.com./A/NOERROR")
+	if got := l.CheckResponse(client, "example.org./A/NOERROR"); got != Send {
+		t.Errorf("CheckResponse() for new response = %v, want Send", got)
+	}
+	if _, ok := l.responses["10.0.0.1 example.com./A/NOERROR"]; !ok || len(l.responses) != 2 {
+		t.Errorf("responses = %v, want limited response kept", l.responses)
+	}
+}
+
+func TestLimiter_Cleanup(t *testing.T) {
+	l, clock := newTestLimiter(t, Options{QPS: 1, ResponsesPerSecond: 1})
+
+	l.AllowQuery(net.ParseIP("10.0.0.1"))
+	l.AllowQuery(net.ParseIP("10.0.0.2"))
+	l.AllowQuery(net.ParseIP("10.0.0.2"))
+	l.CheckResponse(net.ParseIP("10.0.0.1"), "example.com./A/NOERROR")
+
+	clock.t = clock.t.Add(10 * time.Second)
+	l.cleanup()
+	if len(l.clients) != 1 || len(l.responses) != 0 {
+		t.Errorf("after cleanup: %d clients, %d responses, want limited client kept", len(l.clients), len(l.responses))
+	}
+
+	clock.t = clock.t.Add(2 * limitedRetention)
+	l.cleanup()
+	if len(l.clients) != 0 {
+		t.Errorf("after retention: %d clients, want 0", len(l.clients))
+	}
+}
+
+func TestLimiter_CleanupResponseOnly(t *testing.T) {
+	l, clock := newTestLimiter(t, Options{ResponsesPerSecond: 1})
+
+	client := net.ParseIP("10.0.0.1")
+	l.CheckResponse(client, "example.com./A/NOERROR")
+	if got := l.CheckResponse(client, "example.com./A/NOERROR"); got != Drop {
+		t.Fatalf("CheckResponse() = %v, want Drop", got)
+	}
+	if len(l.clients) != 1 {
+		t.Fatalf("%d clients tracked, want 1", len(l.clients))
+	}
+
+	// 没有查询限速时被限制的客户端也会过期
+	clock.t = clock.t.Add(2 * limitedRetention)
+	l.cleanup()
+	if len(l.clients) != 0 {
+		t.Errorf("after retention: %d clients, want 0", len(l.clients))
+	}
+}
+
+func TestLimiter_MaxClients(t *testing.T) {
+	l, _ := newTestLimiter(t, Options{QPS: 1})
+	l.maxClients = 3
+
+	for i := 0; i < 10; i++ {
+		l.AllowQuery(net.ParseIP(fmt.Sprintf("10.0.0.%d", i+1)))
+		if len(l.clients) > 3 {
+			t.Fatalf("%d clients tracked, want at most 3", len(l.clients))
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+		wantErr bool
+	}{
+		{"disabled", Options{}, false},
+		{"negative qps", Options{QPS: -1}, true},
+		{"invalid prefix", Options{IPv4Prefix: 33}, true},
+		{"invalid exempt", Options{Exempt: []string{"lan"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := New(tt.options)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && l.Enabled() {
+				t.Error("Enabled() = true for empty options")
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package rebind
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// 处理包含内网地址的上游应答的方式
+const (
+	ModeOff    = "off"
+	ModeStrip  = "strip"
+	ModeRefuse = "refuse"
+)
+
+// privateNetworks 内网、运营商级 NAT、回环、链路本地和未指定地址
+var privateNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+// Options DNS 重绑定防护配置
+type Options struct {
+	// Mode 处理方式：off 不检查，strip 删除内网地址，refuse 返回 REFUSED
+	Mode string
+	// AllowedDomains 允许解析到内网地址的域名，包含子域名，例如内部域名
+	AllowedDomains []string
+}
+
+// Violation 上游应答中的一个内网地址
+type Violation struct {
+	Name string
+	IP   net.IP
+}
+
+// Protector 检查上游应答中的内网地址
+type Protector struct {
+	mode    string
+	allowed []string
+}
+
+// New 创建 DNS 重绑定防护
+func New(options Options) (*Protector, error) {
+	p := &Protector{mode: strings.ToLower(options.Mode)}
+	switch p.mode {
+	case "":
+		p.mode = ModeOff
+	case ModeOff, ModeStrip, ModeRefuse:
+	default:
+		return nil, fmt.Errorf("无效的 DNS 重绑定防护方式: %s", options.Mode)
+	}
+	for _, domain := range options.AllowedDomains {
+		if domain = strings.ToLower(strings.Trim(strings.TrimSpace(domain), ".")); domain != "" {
+			p.allowed = append(p.allowed, domain)
+		}
+	}
+	return p, nil
+}
+
+// Mode 返回处理方式
+func (p *Protector) Mode() string {
+	if p == nil {
+		return ModeOff
+	}
+	return p.mode
+}
+
+// Check 找出应答中的内网地址，domain 在允许列表中时不检查。
+// strip 模式下返回删除内网地址后的应答，其他模式下原样返回
+func (p *Protector) Check(domain string, answers []dnsmessage.Resource) ([]dnsmessage.Resource, []Violation) {
+	if p.Mode() == ModeOff || p.isAllowed(domain) {
+		return answers, nil
+	}
+
+	var kept []dnsmessage.Resource
+	var violations []Violation
+	for _, answer := range answers {
+		ip := answerIP(answer)
+		if ip == nil || !IsPrivate(ip) {
+			kept = append(kept, answer)
+			continue
+		}
+		violations = append(violations, Violation{
+			Name: strings.TrimSuffix(answer.Header.Name.String(), "."),
+			IP:   ip,
+		})
+	}
+	if len(violations) == 0 || p.mode != ModeStrip {
+		return answers, violations
+	}
+	return kept, violations
+}
+
+// IsPrivate 判断 IP 是否为内网、回环、链路本地或未指定地址
+func IsPrivate(ip net.IP) bool {
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Protector) isAllowed(domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, allowed := range p.allowed {
+		if domain == allowed || strings.HasSuffix(domain, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+func answerIP(answer dnsmessage.Resource) net.IP {
+	switch body := answer.Body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(body.A[:])
+	case *dnsmessage.AAAAResource:
+		return net.IP(body.AAAA[:])
+	}
+	return nil
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
@@ -0,0 +1,99 @@
+package rebind
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func aRecord(name string, ip string) dnsmessage.Resource {
+	var a [4]byte
+	copy(a[:], net.ParseIP(ip).To4())
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		Body:   &dnsmessage.AResource{A: a},
+	}
+}
+
+func aaaaRecord(name string, ip string) dnsmessage.Resource {
+	var aaaa [16]byte
+	copy(aaaa[:], net.ParseIP(ip).To16())
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET},
+		Body:   &dnsmessage.AAAAResource{AAAA: aaaa},
+	}
+}
+
+func TestIsPrivate(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"172.31.0.1", true},
+		{"172.32.0.1", false},
+		{"192.168.1.1", true},
+		{"127.0.0.1", true},
+		{"0.0.0.0", true},
+		{"169.254.1.1", true},
+		{"100.64.0.1", true},
+		{"100.127.255.254", true},
+		{"100.128.0.1", false},
+		{"192.0.0.8", true},
+		{"192.0.2.1", false},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"::1", true},
+		{"::ffff:10.0.0.1", true},
+		{"8.8.8.8", false},
+		{"2606:4700::1111", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := IsPrivate(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("IsPrivate(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProtector_Check(t *testing.T) {
+	answers := []dnsmessage.Resource{
+		aRecord("evil.example.com.", "93.184.216.34"),
+		aRecord("evil.example.com.", "192.168.1.1"),
+		aaaaRecord("evil.example.com.", "fd00::1"),
+	}
+
+	tests := []struct {
+		name           string
+		options        Options
+		domain         string
+		wantAnswers    int
+		wantViolations int
+	}{
+		{"off", Options{}, "evil.example.com", 3, 0},
+		{"strip", Options{Mode: ModeStrip}, "evil.example.com", 1, 2},
+		{"refuse", Options{Mode: ModeRefuse}, "evil.example.com", 3, 2},
+		{"allowed domain", Options{Mode: ModeStrip, AllowedDomains: []string{"example.com"}}, "evil.example.com", 3, 0},
+		{"allowed domain is suffix only", Options{Mode: ModeStrip, AllowedDomains: []string{"ample.com"}}, "evil.example.com", 1, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := New(tt.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kept, violations := p.Check(tt.domain, answers)
+			if len(kept) != tt.wantAnswers || len(violations) != tt.wantViolations {
+				t.Errorf("Check() = %d answers, %d violations, want %d, %d", len(kept), len(violations), tt.wantAnswers, tt.wantViolations)
+			}
+		})
+	}
+
+	if _, err := New(Options{Mode: "block"}); err == nil {
+		t.Error("New() with invalid mode returned no error")
+	}
+}
@@ -3,13 +3,26 @@ package server
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"go-dns-proxy/acl"
 	"go-dns-proxy/admin"
+	"go-dns-proxy/blocklist"
+	"go-dns-proxy/cache"
 	"go-dns-proxy/client"
+	"go-dns-proxy/clients"
+	"go-dns-proxy/dnssec"
 	"go-dns-proxy/domain"
+	"go-dns-proxy/ecs"
+	"go-dns-proxy/forward"
+	"go-dns-proxy/ipset"
+	"go-dns-proxy/poison"
+	"go-dns-proxy/ratelimit"
+	"go-dns-proxy/rebind"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -18,59 +31,182 @@ import (
 )
 
 type DnsServer struct {
-	listenConn         *net.UDPConn
-	chinaResolver      client.DNSResolver
-	overseaResolver    client.DNSResolver
-	chinaDomainService *domain.ChinaDomainService
+	listeners          []*listener
+	options            *NewServerOptions
+	config             *runtimeConfig
+	started            bool
+	chinaIPService     *domain.ChinaIPService
+	learnedStore       *domain.LearnedDomainStore
+	rateLimiter        *ratelimit.Limiter
+	cache              *cache.Cache
+	metrics            *serverMetrics
+	queryLog           *admin.QueryLogger
+	setBackend         ipset.Backend
 	db                 *sql.DB
 	mu                 sync.RWMutex
+	reloadMu           sync.Mutex
 	stopChan          chan struct{}
 }
 
 type NewServerOptions struct {
 	ListenPort         int
+	// Listeners 监听器，为空时在 ListenPort 上同时监听 UDP 和 TCP
+	Listeners          []ListenerOptions
 	ChinaServerAddr    string
 	OverSeaServerAddr  string
 	DBPath            string
 	DataDir           string
 	ChinaDomainListUrl string
+	PinyinOptions      domain.PinyinOptions
+	BeianAPIURL        string
+	BeianAPIKey        string
+	BeianOptions       domain.BeianOptions
+	ChinaIPListUrl     string
+	LearningOptions    domain.LearnedDomainOptions
+	HostsFile          string
+	StaticRecords      []string
+	BlocklistOptions   blocklist.Options
+	BlockResponse      string
+	ClientGroups       []*clients.Group
+	RateLimitOptions   ratelimit.Options
+	RebindOptions      rebind.Options
+	PoisonOptions      poison.Options
+	ForwardOptions     forward.Options
+	ChinaECS           ecs.Options
+	OverseaECS         ecs.Options
+	CacheOptions       cache.Options
+	DNSSECOptions      dnssec.Options
+	IPSetOptions       ipset.Options
 }
 
+// groupPolicy 客户端分组使用的解析器和拦截列表
+type groupPolicy struct {
+	group           *clients.Group
+	chinaResolver   client.DNSResolver
+	overseaResolver client.DNSResolver
+	blocklist       *blocklist.Blocklist
+}
+
+// queryContext 一次查询在处理过程中共享的信息
+type queryContext struct {
+	requestID string
+	startTime time.Time
+	listener  *listener
+	writer    responseWriter
+	clientIP  net.IP
+	policy     *groupPolicy
+	config     *runtimeConfig
+}
+
+// clientGroup 返回客户端分组名称，不属于任何分组时返回空字符串
+func (qc *queryContext) clientGroup() string {
+	if qc.policy == nil {
+		return ""
+	}
+	return qc.policy.group.Name
+}
+
+// 本地记录和拦截应答时使用的服务器名称和路由原因
+const (
+	routeLocal   = "local"
+	routeBlocked = "blocked"
+	routeForward = "forward"
+)
+
 func NewDnsServer(options *NewServerOptions) (*DnsServer, error) {
-	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: options.ListenPort, IP: net.ParseIP("0.0.0.0")})
+	listenerOptions := options.Listeners
+	if len(listenerOptions) == 0 {
+		addr := fmt.Sprintf("0.0.0.0:%d", options.ListenPort)
+		listenerOptions = []ListenerOptions{
+			{Network: "udp", Addr: addr},
+			{Network: "tcp", Addr: addr},
+		}
+	}
+	listeners, err := openListeners(listenerOptions)
 	if err != nil {
 		return nil, err
 	}
 
 	db, err := admin.InitDB(options.DBPath)
 	if err != nil {
-		conn.Close()
+		closeListeners(listeners)
 		return nil, err
 	}
 
-	var chinaResolver, overseaResolver client.DNSResolver
-
-	// 检查服务器类型
-	chinaResolver = createResolver(options.ChinaServerAddr)
-	overseaResolver = createResolver(options.OverSeaServerAddr)
-
-	chinaDomainService := domain.NewChinaDomainService()
+	// 根据应答 IP 学习域名路由
+	chinaIPService := domain.NewChinaIPService()
+	var learnedStore *domain.LearnedDomainStore
+	if !options.LearningOptions.Disabled {
+		if options.ChinaIPListUrl != "" {
+			if err := chinaIPService.DownloadAndLoadChinaIPList(options.ChinaIPListUrl, options.DataDir); err != nil {
+				log.WithError(err).Error("加载中国 IP 列表失败")
+			}
+		}
 
-	// 如果提供了中国域名列表 URL，则下载并加载
-	if options.ChinaDomainListUrl != "" {
-		if err := chinaDomainService.DownloadAndLoadChinaDomainList(options.ChinaDomainListUrl, options.DataDir); err != nil {
-			log.WithError(err).Error("加载中国域名列表失败")
+		learnedStore, err = domain.NewLearnedDomainStore(db, options.LearningOptions)
+		if err != nil {
+			closeListeners(listeners)
+			db.Close()
+			return nil, err
 		}
 	}
 
-	return &DnsServer{
-		listenConn:         conn,
-		chinaResolver:      chinaResolver,
-		overseaResolver:    overseaResolver,
-		chinaDomainService: chinaDomainService,
+	rateLimiter, err := ratelimit.New(options.RateLimitOptions)
+	if err != nil {
+		closeListeners(listeners)
+		learnedStore.Close()
+		db.Close()
+		return nil, err
+	}
+
+	s := &DnsServer{
+		listeners:          listeners,
+		options:            options,
+		chinaIPService:     chinaIPService,
+		learnedStore:       learnedStore,
+		rateLimiter:        rateLimiter,
+		cache:              cache.New(options.CacheOptions),
 		db:                 db,
 		stopChan:          make(chan struct{}),
-	}, nil
+	}
+	s.metrics = newServerMetrics(s)
+
+	// 上游解析器、域名列表和规则可以热重载
+	if s.config, err = s.newRuntimeConfig(options); err != nil {
+		closeListeners(listeners)
+		learnedStore.Close()
+		db.Close()
+		return nil, err
+	}
+	s.queryLog = admin.NewQueryLogger(db, admin.BatchOptions{})
+	return s, nil
+}
+
+// newGroupPolicy 根据分组配置创建解析器和拦截列表，未覆盖的上游使用全局解析器
+func newGroupPolicy(group *clients.Group, chinaResolver, overseaResolver client.DNSResolver, blocklistOptions blocklist.Options) *groupPolicy {
+	policy := &groupPolicy{
+		group:           group,
+		chinaResolver:   chinaResolver,
+		overseaResolver: overseaResolver,
+	}
+	if group.ChinaServer != "" {
+		policy.chinaResolver = createResolver(group.ChinaServer)
+	}
+	if group.OverseaServer != "" {
+		policy.overseaResolver = createResolver(group.OverseaServer)
+	}
+	if len(group.BlocklistURLs) > 0 || len(group.BlockRules) > 0 {
+		policy.blocklist = blocklist.New(blocklist.Options{
+			URLs:            group.BlocklistURLs,
+			Rules:           group.BlockRules,
+			RefreshInterval: blocklistOptions.RefreshInterval,
+			DataDir:         blocklistOptions.DataDir,
+		})
+		if err := policy.blocklist.LoadCached(); err != nil {
+			log.WithError(err).WithField("group", group.Name).Error("加载客户端分组拦截列表失败")
+		}
+	}
+	return policy
 }
 
 // createResolver 根据地址创建对应的解析器
@@ -82,55 +218,85 @@ func createResolver(addr string) client.DNSResolver {
 		return client.NewDOHClient(addr)
 	case strings.HasPrefix(addrLower, "tls://"):
 		return client.NewDOTClient(strings.TrimPrefix(addr, "tls://"))
+	case strings.HasPrefix(addrLower, "tcp://"):
+		return client.NewTCPClient(withDefaultPort(addr[len("tcp://"):]))
+	case strings.HasPrefix(addrLower, "udp://"):
+		return client.NewUDPClient(withDefaultPort(addr[len("udp://"):]))
 	default:
-		// 普通 DNS，添加默认端口
-		if !strings.Contains(addr, ":") {
-			addr = addr + ":53"
-		}
-		return client.NewUDPClient(addr)
+		return client.NewUDPClient(withDefaultPort(addr))
 	}
 }
 
+// withDefaultPort 普通 DNS 地址没有端口时添加默认端口 53
+func withDefaultPort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+	}
+	return addr
+}
+
 func (s *DnsServer) Start() {
 	log.Info("DNS服务器启动")
-	buffer := make([]byte, 512)
-
-	for {
-		select {
-		case <-s.stopChan:
-			return
-		default:
-			s.listenConn.SetReadDeadline(time.Now().Add(1 * time.Second))
-			n, remoteAddr, err := s.listenConn.ReadFromUDP(buffer)
-			if err != nil {
-				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-					continue
-				}
-				log.WithError(err).Error("读取UDP数据失败")
-				continue
+	s.mu.Lock()
+	s.started = true
+	s.config.start()
+	s.mu.Unlock()
+	go s.rateLimiter.Run(s.stopChan)
+
+	var wg sync.WaitGroup
+	for _, l := range s.listeners {
+		l := l
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			log.WithField("listener", l.options.String()).Info("开始监听")
+			if l.udpConn != nil {
+				s.serveUDP(l)
+			} else {
+				s.serveTCP(l)
 			}
-
-			go s.handleDNSQuery(remoteAddr, buffer[:n])
-		}
+		}()
 	}
+	wg.Wait()
 }
 
-func (s *DnsServer) handleDNSQuery(senderAddr *net.UDPAddr, queryData []byte) {
+func (s *DnsServer) handleDNSQuery(l *listener, w responseWriter, queryData []byte) {
+	atomic.AddInt64(&l.queries, 1)
+	s.metrics.inflight.Inc()
+	defer s.metrics.inflight.Dec()
+
+	// 访问控制，被拒绝的查询不记录到数据库
+	clientIP := w.RemoteIP()
+	if !l.acl.Allowed(clientIP) {
+		s.denyQuery(l, w, queryData)
+		return
+	}
+
+	// 超过限速的查询直接丢弃，不记录到数据库
+	if !s.limitQuery(l, clientIP) {
+		return
+	}
+	if l.udpConn != nil && s.rateLimiter.ResponseLimitEnabled() {
+		w = &rrlResponseWriter{responseWriter: w, limiter: s.rateLimiter, listener: l}
+	}
+
 	startTime := time.Now()
 	requestID := uuid.New().String()
 	logger := log.WithFields(log.Fields{
 		"requestId": requestID,
-		"clientIp": senderAddr.IP.String(),
+		"clientIp": clientIP.String(),
 	})
 
 	// 解析 DNS 查询
 	var queryMsg dnsmessage.Message
 	if err := queryMsg.Unpack(queryData); err != nil {
+		atomic.AddInt64(&l.invalid, 1)
 		logger.WithError(err).Error("解析 DNS 查询失败")
 		return
 	}
 
 	if len(queryMsg.Questions) == 0 {
+		atomic.AddInt64(&l.invalid, 1)
 		logger.Error("DNS 查询中没有问题")
 		return
 	}
@@ -142,53 +308,377 @@ func (s *DnsServer) handleDNSQuery(senderAddr *net.UDPAddr, queryData []byte) {
 		"type":   queryQuestion.Type.String(),
 	})
 
-	// 判断是否使用中国 DNS
+	qc := &queryContext{
+		requestID:  requestID,
+		startTime:  startTime,
+		listener:   l,
+		writer:     w,
+		clientIP:   clientIP,
+		config:     s.acquireConfig(),
+	}
+	defer qc.config.release()
+	if qc.config.clients != nil {
+		if group := qc.config.clients.Match(clientIP); group != nil {
+			qc.policy = qc.config.groupPolicies[group.Name]
+			logger = logger.WithField("clientGroup", group.Name)
+		}
+	}
+
+	// 优先使用本地记录应答
+	if qc.config.hosts != nil {
+		if localAnswers, ok := qc.config.hosts.Lookup(queryQuestion); ok {
+			s.replyLocal(logger, qc, &queryMsg, localAnswers)
+			return
+		}
+	}
+
+	// 拦截广告和跟踪域名
+	if match, blocked := s.matchBlocklist(qc, domain); blocked {
+		logger.WithField("rule", match.Rule).Info("拦截域名")
+		s.replyBlocked(logger, qc, &queryMsg, match)
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	ctx = context.WithValue(ctx, client.RequestIDKey, requestID)
 	defer cancel()
 
-	isChinaDNS := s.chinaDomainService.IsChinaDomain(ctx, domain)
-	var resolver client.DNSResolver
+	// 条件转发，优先于国内外分流
+	if rule, ok := qc.config.forwarder.Match(domain); ok {
+		logger = logger.WithField("zone", rule.Zone)
+		s.replyForward(ctx, logger, qc, &queryMsg, rule)
+		return
+	}
+
+	// 判断是否使用中国 DNS
+
+	decision := s.decideRoute(ctx, qc, domain)
+	isChinaDNS := decision.IsChina
+	logger = logger.WithField("routeReason", decision.Reason)
+	chinaResolver, overseaResolver := qc.config.chinaResolver, qc.config.overseaResolver
+	if qc.policy != nil {
+		chinaResolver, overseaResolver = qc.policy.chinaResolver, qc.policy.overseaResolver
+	}
 	if isChinaDNS {
-		resolver = s.chinaResolver
 		logger.Debug("使用中国 DNS 服务器")
 	} else {
-		resolver = s.overseaResolver
 		logger.Debug("使用海外 DNS 服务器")
 	}
 
-	// 发送查询
-	respData, err := resolver.Request(ctx, queryMsg)
+	// 安全搜索，将搜索引擎域名改为查询对应的安全搜索域名
+	upstreamMsg := queryMsg
+	safeSearchTarget := ""
+	if qc.policy != nil && qc.policy.group.SafeSearch {
+		if target, ok := clients.SafeSearchTarget(domain); ok {
+			safeSearchTarget = target
+			upstreamMsg.Questions = []dnsmessage.Question{{
+				Name:  dnsmessage.MustNewName(target + "."),
+				Type:  queryQuestion.Type,
+				Class: queryQuestion.Class,
+			}}
+			logger.WithField("target", target).Debug("使用安全搜索")
+		}
+	}
+
+	// 查询缓存或上游 DNS
+	result, err := s.resolveUpstream(ctx, logger, qc, domain, isChinaDNS, chinaResolver, overseaResolver, upstreamMsg)
 	if err != nil {
 		logger.WithError(err).Error("DNS 查询失败")
 		return
 	}
+	respMsg := result.msg
 
-	// 解析响应
-	var respMsg dnsmessage.Message
-	if err := respMsg.Unpack(respData); err != nil {
-		logger.WithError(err).Error("解析 DNS 响应失败")
+	var respData []byte
+	if safeSearchTarget != "" {
+		respData, err = rewriteSafeSearch(&respMsg, queryQuestion, safeSearchTarget)
+		if err != nil {
+			logger.WithError(err).Error("构造安全搜索响应失败")
+			return
+		}
+	} else if respData, err = respMsg.Pack(); err != nil {
+		logger.WithError(err).Error("打包DNS消息失败")
 		return
 	}
 
+	// 在发送响应之前将解析到的地址添加到 ipset 或 nftables 集合，
+	// 与 dnsmasq 相同，避免客户端收到响应后立即发起的连接没有匹配到防火墙规则
+	for _, failure := range qc.config.sets.Add(domain, !result.isChina, respMsg.Answers) {
+		logger.WithError(failure.Err).WithFields(log.Fields{
+			"set": failure.Set.String(),
+			"ip":  failure.IP.String(),
+		}).Warn("添加地址到集合失败")
+	}
+
 	// 发送响应
-	if _, err := s.listenConn.WriteToUDP(respData, senderAddr); err != nil {
+	if err := w.Write(respData); err != nil {
+		logger.WithError(err).Error("发送 DNS 响应失败")
+		return
+	}
+
+	answers, answerIPs := summarizeAnswers(respMsg.Answers)
+	if safeSearchTarget == "" && !result.cached {
+		s.learnFromAnswer(logger, decision, result.server, answerIPs)
+	}
+
+	routeDetail, err := json.Marshal(decision)
+	if err != nil {
+		logger.WithError(err).Error("序列化路由判断结果失败")
+		routeDetail = []byte("{}")
+	}
+
+	// 保存查询记录
+	dnsQuery := &admin.DNSQuery{
+		RequestID:    requestID,
+		Domain:      domain,
+		QueryType:   queryQuestion.Type.String(),
+		ClientIP:    clientIP.String(),
+		Server:      result.server,
+		IsChinaDNS:  result.isChina,
+		ResponseCode: int(respMsg.Header.RCode),
+		AnswerCount: len(respMsg.Answers),
+		TotalTimeMs: float64(time.Since(startTime).Microseconds()) / 1000.0, // 转换为毫秒的浮点数
+		CreatedAt:   startTime,
+		Answers:     answers,
+		RouteReason: decision.Reason,
+		RouteDetail: string(routeDetail),
+		ClientGroup: qc.clientGroup(),
+		PoisonReason: result.poisonReason,
+		Cached:      result.cached,
+		DNSSEC:      result.dnssec,
+	}
+	s.saveQuery(logger, qc, dnsQuery)
+}
+
+// matchBlocklist 依次检查全局拦截列表和客户端分组的拦截列表
+func (s *DnsServer) matchBlocklist(qc *queryContext, domain string) (*blocklist.Match, bool) {
+	if qc.config.blocklist != nil && (qc.policy == nil || !qc.policy.group.BlockingDisabled) {
+		if match, blocked := qc.config.blocklist.Match(domain); blocked {
+			return match, true
+		}
+	}
+	if qc.policy != nil && qc.policy.blocklist != nil {
+		return qc.policy.blocklist.Match(domain)
+	}
+	return nil, false
+}
+
+// decideRoute 判断域名使用的路由，客户端分组的规则优先
+func (s *DnsServer) decideRoute(ctx context.Context, qc *queryContext, name string) *domain.RouteDecision {
+	if qc.policy != nil {
+		if route, rule := qc.policy.group.RouteFor(name); route != "" {
+			return &domain.RouteDecision{
+				Domain:      name,
+				IsChina:     route == clients.RouteChina,
+				Reason:      domain.ReasonClientGroup,
+				MatchedRule: qc.policy.group.Name + ": " + rule,
+			}
+		}
+	}
+	return qc.config.chinaDomainService.Decide(ctx, name)
+}
+
+// rewriteSafeSearch 将安全搜索域名的响应改写为原始问题的响应，添加原始域名到安全搜索域名的 CNAME
+func rewriteSafeSearch(respMsg *dnsmessage.Message, question dnsmessage.Question, target string) ([]byte, error) {
+	targetName, err := dnsmessage.NewName(target + ".")
+	if err != nil {
+		return nil, err
+	}
+	cname := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  question.Name,
+			Type:  dnsmessage.TypeCNAME,
+			Class: dnsmessage.ClassINET,
+			TTL:   300,
+		},
+		Body: &dnsmessage.CNAMEResource{CNAME: targetName},
+	}
+	respMsg.Questions = []dnsmessage.Question{question}
+	respMsg.Answers = append([]dnsmessage.Resource{cname}, respMsg.Answers...)
+	return respMsg.Pack()
+}
+
+// replyLocal 使用本地记录应答查询
+func (s *DnsServer) replyLocal(logger *log.Entry, qc *queryContext, queryMsg *dnsmessage.Message, localAnswers []dnsmessage.Resource) {
+	respMsg := newResponse(queryMsg, dnsmessage.RCodeSuccess)
+	respMsg.Header.Authoritative = true
+	respMsg.Answers = localAnswers
+
+	if err := writeMessage(qc.writer, respMsg); err != nil {
+		logger.WithError(err).Error("发送 DNS 响应失败")
+		return
+	}
+
+	dnsQuery := directQuery(qc, respMsg)
+	dnsQuery.Server = routeLocal
+	dnsQuery.IsLocal = true
+	dnsQuery.RouteReason = routeLocal
+	s.saveQuery(logger, qc, dnsQuery)
+}
+
+// replyBlocked 使用配置的拦截应答方式应答被拦截的查询
+func (s *DnsServer) replyBlocked(logger *log.Entry, qc *queryContext, queryMsg *dnsmessage.Message, match *blocklist.Match) {
+	rcode, answers := qc.config.blockResponse.Answer(queryMsg.Questions[0])
+	respMsg := newResponse(queryMsg, rcode)
+	respMsg.Answers = answers
+
+	if err := writeMessage(qc.writer, respMsg); err != nil {
 		logger.WithError(err).Error("发送 DNS 响应失败")
 		return
 	}
 
-	// 提取 answers
+	routeDetail, err := json.Marshal(match)
+	if err != nil {
+		routeDetail = []byte("{}")
+	}
+
+	dnsQuery := directQuery(qc, respMsg)
+	dnsQuery.Server = routeBlocked
+	dnsQuery.Blocked = true
+	dnsQuery.BlockRule = match.Rule
+	dnsQuery.RouteReason = routeBlocked
+	dnsQuery.RouteDetail = string(routeDetail)
+	s.saveQuery(logger, qc, dnsQuery)
+}
+
+// replyForward 将查询转发到条件转发规则指定的上游，没有指定上游时返回 NXDOMAIN
+func (s *DnsServer) replyForward(ctx context.Context, logger *log.Entry, qc *queryContext, queryMsg *dnsmessage.Message, rule forward.Rule) {
+	server := routeLocal
+	respData, respMsg := []byte(nil), newResponse(queryMsg, dnsmessage.RCodeNameError)
+	if rule.Server != "" {
+		resolver := qc.config.forwardResolvers[rule.Server]
+		server = resolver.String()
+		data, msg, _, err := s.exchange(ctx, resolver, *queryMsg)
+		if err != nil {
+			logger.WithError(err).Error("条件转发查询失败")
+			return
+		}
+		respData, respMsg = data, &msg
+	} else {
+		respMsg.Header.Authoritative = true
+	}
+
+	var err error
+	if respData == nil {
+		err = writeMessage(qc.writer, respMsg)
+	} else {
+		err = qc.writer.Write(respData)
+	}
+	if err != nil {
+		logger.WithError(err).Error("发送 DNS 响应失败")
+		return
+	}
+
+	routeDetail, err := json.Marshal(rule)
+	if err != nil {
+		routeDetail = []byte("{}")
+	}
+
+	dnsQuery := directQuery(qc, respMsg)
+	dnsQuery.Server = server
+	dnsQuery.IsLocal = true
+	dnsQuery.RouteReason = routeForward
+	dnsQuery.RouteDetail = string(routeDetail)
+	s.saveQuery(logger, qc, dnsQuery)
+}
+
+// directQuery 为不经过上游 DNS 直接应答的查询创建查询记录
+func directQuery(qc *queryContext, respMsg *dnsmessage.Message) *admin.DNSQuery {
+	question := respMsg.Questions[0]
+	answers, _ := summarizeAnswers(respMsg.Answers)
+	return &admin.DNSQuery{
+		RequestID:    qc.requestID,
+		Domain:       strings.TrimSuffix(question.Name.String(), "."),
+		QueryType:    question.Type.String(),
+		ClientIP:     qc.clientIP.String(),
+		ResponseCode: int(respMsg.Header.RCode),
+		AnswerCount:  len(respMsg.Answers),
+		TotalTimeMs:  float64(time.Since(qc.startTime).Microseconds()) / 1000.0,
+		CreatedAt:    qc.startTime,
+		Answers:      answers,
+		RouteDetail:  "{}",
+		ClientGroup:  qc.clientGroup(),
+	}
+}
+
+// newResponse 根据查询创建一个空的响应
+func newResponse(queryMsg *dnsmessage.Message, rcode dnsmessage.RCode) *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 queryMsg.Header.ID,
+			Response:           true,
+			OpCode:             queryMsg.Header.OpCode,
+			RecursionDesired:   queryMsg.Header.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: queryMsg.Questions,
+	}
+}
+
+// writeMessage 打包并发送 DNS 消息
+func writeMessage(w responseWriter, msg *dnsmessage.Message) error {
+	packed, err := msg.Pack()
+	if err != nil {
+		return fmt.Errorf("打包DNS消息失败: %v", err)
+	}
+	return w.Write(packed)
+}
+
+// denyQuery 按监听器的配置拒绝未授权客户端的查询
+func (s *DnsServer) denyQuery(l *listener, w responseWriter, queryData []byte) {
+	logger := log.WithFields(log.Fields{
+		"listener": l.options.String(),
+		"clientIp": w.RemoteIP().String(),
+	})
+
+	if l.acl.Action() == acl.ActionDrop {
+		atomic.AddInt64(&l.dropped, 1)
+		logger.Debug("丢弃未授权客户端的查询")
+		return
+	}
+
+	var queryMsg dnsmessage.Message
+	if err := queryMsg.Unpack(queryData); err != nil {
+		atomic.AddInt64(&l.dropped, 1)
+		return
+	}
+	atomic.AddInt64(&l.refused, 1)
+	logger.Debug("拒绝未授权客户端的查询")
+
+	if err := writeMessage(w, newResponse(&queryMsg, dnsmessage.RCodeRefused)); err != nil {
+		logger.WithError(err).Debug("发送 DNS 响应失败")
+	}
+}
+
+// saveQuery 更新指标、将查询记录加入后台写入队列并输出查询完成日志
+func (s *DnsServer) saveQuery(logger *log.Entry, qc *queryContext, dnsQuery *admin.DNSQuery) {
+	s.metrics.observeQuery(qc, dnsQuery)
+	s.queryLog.Log(dnsQuery)
+
+	logger.WithFields(log.Fields{
+		"answers":     dnsQuery.AnswerCount,
+		"totalTimeMs": dnsQuery.TotalTimeMs,
+		"isChinaDNS":  dnsQuery.IsChinaDNS,
+		"server":      dnsQuery.Server,
+	}).Info("DNS 查询完成")
+}
+
+// summarizeAnswers 提取应答记录的文本表示和其中的 IP 地址
+func summarizeAnswers(resources []dnsmessage.Resource) ([]string, []net.IP) {
 	var answers []string
-	for _, answer := range respMsg.Answers {
+	var answerIPs []net.IP
+	for _, answer := range resources {
 		switch answer.Body.(type) {
 		case *dnsmessage.AResource:
 			a := answer.Body.(*dnsmessage.AResource)
 			ip := net.IP(a.A[:])
 			answers = append(answers, ip.String())
+			answerIPs = append(answerIPs, ip)
 		case *dnsmessage.AAAAResource:
 			aaaa := answer.Body.(*dnsmessage.AAAAResource)
 			ip := net.IP(aaaa.AAAA[:])
 			answers = append(answers, ip.String())
+			answerIPs = append(answerIPs, ip)
 		case *dnsmessage.CNAMEResource:
 			cname := answer.Body.(*dnsmessage.CNAMEResource)
 			answers = append(answers, cname.CNAME.String())
@@ -204,32 +694,67 @@ func (s *DnsServer) handleDNSQuery(senderAddr *net.UDPAddr, queryData []byte) {
 		case *dnsmessage.TXTResource:
 			txt := answer.Body.(*dnsmessage.TXTResource)
 			answers = append(answers, strings.Join(txt.TXT, " "))
+		case *dnsmessage.SRVResource:
+			srv := answer.Body.(*dnsmessage.SRVResource)
+			answers = append(answers, fmt.Sprintf("%d %d %d %s", srv.Priority, srv.Weight, srv.Port, srv.Target.String()))
 		}
 	}
+	return answers, answerIPs
+}
 
-	// 保存查询记录
-	dnsQuery := &admin.DNSQuery{
-		RequestID:    requestID,
-		Domain:      domain,
-		QueryType:   queryQuestion.Type.String(),
-		ClientIP:    senderAddr.IP.String(),
-		Server:      resolver.String(),
-		IsChinaDNS:  isChinaDNS,
-		ResponseCode: int(respMsg.Header.RCode),
-		AnswerCount: len(respMsg.Answers),
-		TotalTimeMs: float64(time.Since(startTime).Microseconds()) / 1000.0, // 转换为毫秒的浮点数
-		CreatedAt:   startTime,
-		Answers:     answers,
+// learnFromAnswer 根据应答 IP 所属地区学习域名路由
+//
+// 只有通过启发式规则（拼音、备案、默认路由）或之前的学习结果路由的域名才会学习，
+// 应答 IP 全部位于中国时学习为国内路由，全部不在中国时学习为海外路由。
+func (s *DnsServer) learnFromAnswer(logger *log.Entry, decision *domain.RouteDecision, server string, ips []net.IP) {
+	if s.learnedStore == nil || s.chinaIPService.Len() == 0 || len(ips) == 0 {
+		return
 	}
-	if err := admin.SaveDNSQuery(s.db, dnsQuery); err != nil {
-		logger.WithError(err).Error("保存查询记录失败")
+
+	switch decision.Reason {
+	case domain.ReasonDefault, domain.ReasonPinyin, domain.ReasonNoBeian, domain.ReasonLearned:
+	default:
+		return
 	}
 
-	logger.WithFields(log.Fields{
-		"answers":     len(respMsg.Answers),
-		"totalTimeMs": dnsQuery.TotalTimeMs,
-		"isChinaDNS": isChinaDNS,
-	}).Info("DNS 查询完成")
+	chinaCount := 0
+	for _, ip := range ips {
+		if s.chinaIPService.Contains(ip) {
+			chinaCount++
+		}
+	}
+
+	var route string
+	switch chinaCount {
+	case len(ips):
+		route = domain.RouteChina
+	case 0:
+		route = domain.RouteOversea
+	default:
+		return
+	}
+
+	decidedRoute := domain.RouteOversea
+	if decision.IsChina {
+		decidedRoute = domain.RouteChina
+	}
+	if route == decidedRoute && decision.Reason != domain.ReasonLearned {
+		return
+	}
+
+	evidence := fmt.Sprintf("%s 解析为 %s", server, ips[0].String())
+	if learned := s.learnedStore.Observe(decision.Domain, route, evidence); learned != nil {
+		logger.WithFields(log.Fields{
+			"route":    learned.Route,
+			"hitCount": learned.HitCount,
+			"status":   learned.Status,
+		}).Debug("记录学习域名")
+	}
+}
+
+// GetLearnedDomainStore 返回学习域名存储，未启用学习时为空
+func (s *DnsServer) GetLearnedDomainStore() *domain.LearnedDomainStore {
+	return s.learnedStore
 }
 
 func (s *DnsServer) GetDB() *sql.DB {
@@ -242,17 +767,17 @@ func (s *DnsServer) Close() error {
 	// 发送停止信号
 	close(s.stopChan)
 
-	// 关闭 UDP 连接
-	if err := s.listenConn.Close(); err != nil {
-		log.WithError(err).Error("关闭UDP连接失败")
-	}
+	// 关闭监听器
+	closeListeners(s.listeners)
 
-	// 关闭备案服务
-	if err := s.chinaDomainService.Close(); err != nil {
-		log.WithError(err).Error("关闭备案服务失败")
-	}
+	// 正在处理的查询完成后停止 hosts 文件监视和拦截列表刷新，关闭备案服务
+	s.mu.Lock()
+	s.config.retire()
+	s.mu.Unlock()
 
-	// 关闭数据库连接
+	// 保存队列中剩余的查询记录和学习域名，关闭数据库连接
+	s.queryLog.Close()
+	s.learnedStore.Close()
 	if err := s.db.Close(); err != nil {
 		log.WithError(err).Error("关闭数据库连接失败")
 	}
@@ -1,8 +1,26 @@
 package server
 
 import (
+	"encoding/binary"
+	"fmt"
+	"go-dns-proxy/acl"
+	"go-dns-proxy/cache"
+	"go-dns-proxy/client"
+	"go-dns-proxy/dnssec"
+	"go-dns-proxy/domain"
+	"go-dns-proxy/ecs"
+	"go-dns-proxy/forward"
+	"go-dns-proxy/ipset"
+	"go-dns-proxy/poison"
+	"go-dns-proxy/rebind"
+	"io"
 	"net"
-	"os"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -11,135 +29,850 @@ import (
 
 func TestCreateResolver(t *testing.T) {
 	tests := []struct {
-		name    string
-		addr    string
-		wantErr bool
+		name string
+		addr string
+		want interface{}
 	}{
-		{
-			name:    "Test UDP DNS",
-			addr:    "8.8.8.8",
-			wantErr: false,
-		},
-		{
-			name:    "Test UDP DNS with port",
-			addr:    "8.8.8.8:53",
-			wantErr: false,
-		},
-		{
-			name:    "Test DOH",
-			addr:    "https://1.1.1.1/dns-query",
-			wantErr: false,
-		},
-		{
-			name:    "Test DOT",
-			addr:    "tls://1.1.1.1:853",
-			wantErr: false,
-		},
+		{"UDP", "8.8.8.8", &client.UDPClient{}},
+		{"UDP with port", "8.8.8.8:53", &client.UDPClient{}},
+		{"DOH", "https://1.1.1.1/dns-query", &client.DOHClient{}},
+		{"DOT", "tls://1.1.1.1:853", &client.DOTClient{}},
+		{"UDP with scheme", "udp://8.8.8.8", &client.UDPClient{}},
+		{"TCP", "tcp://8.8.8.8:53", &client.TCPClient{}},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			resolver := createResolver(tt.addr)
 			if resolver == nil {
-				t.Error("createResolver() returned nil")
-				return
+				t.Fatal("createResolver() returned nil")
 			}
-
-			// 测试解析器是否可用
-			var msg dnsmessage.Message
-			msg.Header.ID = 1234
-			msg.Header.RecursionDesired = true
-			msg.Questions = []dnsmessage.Question{
-				{
-					Name:  dnsmessage.MustNewName("www.google.com."),
-					Type:  dnsmessage.TypeA,
-					Class: dnsmessage.ClassINET,
-				},
+			switch tt.want.(type) {
+			case *client.UDPClient:
+				_, ok := resolver.(*client.UDPClient)
+				if !ok {
+					t.Errorf("createResolver(%s) = %T, want *client.UDPClient", tt.addr, resolver)
+				}
+			case *client.DOHClient:
+				_, ok := resolver.(*client.DOHClient)
+				if !ok {
+					t.Errorf("createResolver(%s) = %T, want *client.DOHClient", tt.addr, resolver)
+				}
+			case *client.DOTClient:
+				_, ok := resolver.(*client.DOTClient)
+				if !ok {
+					t.Errorf("createResolver(%s) = %T, want *client.DOTClient", tt.addr, resolver)
+				}
+			case *client.TCPClient:
+				_, ok := resolver.(*client.TCPClient)
+				if !ok {
+					t.Errorf("createResolver(%s) = %T, want *client.TCPClient", tt.addr, resolver)
+				}
 			}
+		})
+	}
+}
+
+func TestParseListener(t *testing.T) {
+	defaultACL := acl.Options{Allow: []string{"192.168.0.0/16"}}
+
+	tests := []struct {
+		input     string
+		wantAddr  string
+		wantAllow int
+		wantDeny  int
+		wantErr   bool
+	}{
+		{"udp://0.0.0.0:53", "0.0.0.0:53", 1, 0, false},
+		{"tcp://[::]:53?allow=&deny=10.0.0.0/8,10.1.0.0/16&action=drop", "[::]:53", 0, 2, false},
+		{"tls://0.0.0.0:853", "", 0, 0, true},
+		{"udp://0.0.0.0", "", 0, 0, true},
+	}
 
-			resp, err := resolver.Request(msg)
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseListener(tt.input, defaultACL)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("resolver.Request() error = %v, wantErr %v", err, tt.wantErr)
+				t.Fatalf("ParseListener() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
 				return
 			}
+			if got.Addr != tt.wantAddr || len(got.ACL.Allow) != tt.wantAllow || len(got.ACL.Deny) != tt.wantDeny {
+				t.Errorf("ParseListener() = %+v", got)
+			}
+		})
+	}
+}
+
+// newTestServer 创建测试服务器，没有指定时只监听 127.0.0.1 的随机 UDP 端口，上游不可用
+func newTestServer(t *testing.T, options *NewServerOptions) *DnsServer {
+	t.Helper()
 
-			if !tt.wantErr && len(resp) == 0 {
-				t.Error("resolver.Request() returned empty response")
+	dataDir := t.TempDir()
+	if len(options.Listeners) == 0 {
+		options.Listeners = []ListenerOptions{{Network: "udp", Addr: "127.0.0.1:0"}}
+	}
+	if options.ChinaServerAddr == "" {
+		options.ChinaServerAddr = "127.0.0.1:1"
+	}
+	if options.OverSeaServerAddr == "" {
+		options.OverSeaServerAddr = "127.0.0.1:1"
+	}
+	options.DBPath = filepath.Join(dataDir, "dns.db")
+	options.DataDir = dataDir
+	options.LearningOptions = domain.LearnedDomainOptions{Disabled: true}
+
+	s, err := NewDnsServer(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// startUpstream 启动一个使用 handler 应答的 UDP 上游服务器，返回监听地址
+func startUpstream(t *testing.T, handler func(query *dnsmessage.Message) *dnsmessage.Message) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if err := query.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			resp := handler(&query)
+			if resp == nil {
+				continue
 			}
+			packed, err := resp.Pack()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(packed, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// answerA 返回包含 A 记录的响应
+func answerA(query *dnsmessage.Message, ips ...string) *dnsmessage.Message {
+	resp := newResponse(query, dnsmessage.RCodeSuccess)
+	for _, ip := range ips {
+		var a [4]byte
+		copy(a[:], net.ParseIP(ip).To4())
+		resp.Answers = append(resp.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: query.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.AResource{A: a},
 		})
 	}
+	return resp
+}
+
+// listenerAddr 返回监听器实际监听的地址
+func listenerAddr(s *DnsServer, network string) string {
+	for _, l := range s.listeners {
+		if l.options.Network != network {
+			continue
+		}
+		if l.udpConn != nil {
+			return l.udpConn.LocalAddr().String()
+		}
+		return l.tcpListener.Addr().String()
+	}
+	return ""
 }
 
-func TestDnsServer_Integration(t *testing.T) {
-	// 创建临时缓存文件
-	tmpfile, err := os.CreateTemp("", "beian_cache_*.json")
+func packQuery(t *testing.T, name string) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 1234, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packed
+}
+
+func exchangeUDP(t *testing.T, addr string, query []byte) (*dnsmessage.Message, error) {
+	t.Helper()
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(query); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
 	if err != nil {
+		return nil, err
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(buf[:n]); err != nil {
 		t.Fatal(err)
 	}
-	defer os.Remove(tmpfile.Name())
+	return &resp, nil
+}
 
-	// 创建服务器
-	server := NewDnsServer(&NewServerOptions{
-		ListenPort:         15353, // 使用非标准端口避免冲突
-		BeianCacheFile:     tmpfile.Name(),
-		BeianCacheInterval: 1,
-		ChinaServerAddr:    "114.114.114.114:53",
-		OverSeaServerAddr:  "8.8.8.8:53",
-		ApiKey:             "test_api_key",
+func exchangeTCP(t *testing.T, addr string, query []byte) *dnsmessage.Message {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	buf := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(buf, uint16(len(query)))
+	copy(buf[2:], query)
+	if _, err := conn.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatal(err)
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(data); err != nil {
+		t.Fatal(err)
+	}
+	return &resp
+}
+
+func TestDnsServer_LocalRecords(t *testing.T) {
+	s := newTestServer(t, &NewServerOptions{
+		Listeners: []ListenerOptions{
+			{Network: "udp", Addr: "127.0.0.1:0"},
+			{Network: "tcp", Addr: "127.0.0.1:0"},
+		},
+		StaticRecords: []string{"nas.lan A 192.168.1.10"},
 	})
 
-	// 启动服务器
-	go server.Start()
+	resp, err := exchangeUDP(t, listenerAddr(s, "udp"), packQuery(t, "nas.lan."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 1 {
+		t.Errorf("UDP response = %v with %d answers, want 1 answer", resp.RCode, len(resp.Answers))
+	}
+
+	resp = exchangeTCP(t, listenerAddr(s, "tcp"), packQuery(t, "nas.lan."))
+	if resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 1 {
+		t.Errorf("TCP response = %v with %d answers, want 1 answer", resp.RCode, len(resp.Answers))
+	}
+}
+
+func TestDnsServer_ACL(t *testing.T) {
+	s := newTestServer(t, &NewServerOptions{
+		Listeners: []ListenerOptions{
+			{Network: "udp", Addr: "127.0.0.1:0", ACL: acl.Options{Deny: []string{"127.0.0.0/8"}}},
+			{Network: "tcp", Addr: "127.0.0.1:0", ACL: acl.Options{Allow: []string{"10.0.0.0/8"}, Action: acl.ActionDrop}},
+		},
+	})
 
-	// 等待服务器启动
-	time.Sleep(time.Second)
+	// UDP 监听器返回 REFUSED
+	resp, err := exchangeUDP(t, listenerAddr(s, "udp"), packQuery(t, "nas.lan."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.RCode != dnsmessage.RCodeRefused {
+		t.Errorf("UDP response rcode = %v, want REFUSED", resp.RCode)
+	}
 
-	// 创建测试客户端
-	conn, err := net.Dial("udp", "127.0.0.1:15353")
+	// TCP 监听器直接关闭连接
+	conn, err := net.Dial("tcp", listenerAddr(s, "tcp"))
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("TCP connection from denied client was not closed")
+	}
 
-	// 构建测试查询
-	var msg dnsmessage.Message
-	msg.Header.ID = 1234
-	msg.Header.RecursionDesired = true
-	msg.Questions = []dnsmessage.Question{
-		{
-			Name:  dnsmessage.MustNewName("www.baidu.com."),
-			Type:  dnsmessage.TypeA,
-			Class: dnsmessage.ClassINET,
-		},
+	stats := s.ListenerStats()
+	if stats[0].Refused != 1 || stats[1].Dropped != 1 {
+		t.Errorf("ListenerStats() = %+v, want 1 refused on udp and 1 dropped on tcp", stats)
 	}
+}
 
-	// 发送查询
-	packed, err := msg.Pack()
+func TestDnsServer_Truncate(t *testing.T) {
+	ips := make([]string, 50)
+	for i := range ips {
+		ips[i] = fmt.Sprintf("93.184.216.%d", i+1)
+	}
+	upstream := startUpstream(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		return answerA(query, ips...)
+	})
+	s := newTestServer(t, &NewServerOptions{
+		ChinaServerAddr:   upstream,
+		OverSeaServerAddr: upstream,
+		Listeners: []ListenerOptions{
+			{Network: "udp", Addr: "127.0.0.1:0"},
+			{Network: "tcp", Addr: "127.0.0.1:0"},
+		},
+	})
+
+	// 没有 EDNS 的 UDP 查询只能收到 512 字节，超过时返回截断响应
+	resp, err := exchangeUDP(t, listenerAddr(s, "udp"), packQuery(t, "www.example.com."))
 	if err != nil {
 		t.Fatal(err)
 	}
+	if !resp.Header.Truncated || len(resp.Answers) != 0 || len(resp.Questions) != 1 {
+		t.Errorf("UDP response truncated = %v with %d answers, want truncated without answers", resp.Header.Truncated, len(resp.Answers))
+	}
+
+	// TCP 返回完整的响应
+	resp = exchangeTCP(t, listenerAddr(s, "tcp"), packQuery(t, "www.example.com."))
+	if resp.Header.Truncated || len(resp.Answers) != len(ips) {
+		t.Errorf("TCP response truncated = %v with %d answers, want %d answers", resp.Header.Truncated, len(resp.Answers), len(ips))
+	}
+}
+
+func TestClientUDPSize(t *testing.T) {
+	tests := []struct {
+		name string
+		size uint16
+		edns bool
+		want int
+	}{
+		{"no edns", 0, false, 512},
+		{"edns 1232", 1232, true, 1232},
+		{"edns below 512", 256, true, 512},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := newQuery("www.example.com", dnsmessage.TypeA)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.edns {
+				msg.Additionals = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("."), Type: dnsmessage.TypeOPT, Class: dnsmessage.Class(tt.size)},
+					Body:   &dnsmessage.OPTResource{},
+				}}
+			}
+			packed, err := msg.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := clientUDPSize(packed); got != tt.want {
+				t.Errorf("clientUDPSize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDnsServer_Rebind(t *testing.T) {
+	upstream := startUpstream(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		return answerA(query, "93.184.216.34", "192.168.1.1")
+	})
+
+	tests := []struct {
+		name        string
+		options     rebind.Options
+		domain      string
+		wantRCode   dnsmessage.RCode
+		wantAnswers int
+	}{
+		{"off", rebind.Options{}, "rebind.example.com.", dnsmessage.RCodeSuccess, 2},
+		{"strip", rebind.Options{Mode: rebind.ModeStrip}, "rebind.example.com.", dnsmessage.RCodeSuccess, 1},
+		{"refuse", rebind.Options{Mode: rebind.ModeRefuse}, "rebind.example.com.", dnsmessage.RCodeRefused, 0},
+		{"allowed", rebind.Options{Mode: rebind.ModeRefuse, AllowedDomains: []string{"corp.example.com"}}, "git.corp.example.com.", dnsmessage.RCodeSuccess, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, &NewServerOptions{
+				ChinaServerAddr:   upstream,
+				OverSeaServerAddr: upstream,
+				RebindOptions:     tt.options,
+			})
+
+			resp, err := exchangeUDP(t, listenerAddr(s, "udp"), packQuery(t, tt.domain))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.RCode != tt.wantRCode || len(resp.Answers) != tt.wantAnswers {
+				t.Errorf("response = %v with %d answers, want %v with %d answers", resp.RCode, len(resp.Answers), tt.wantRCode, tt.wantAnswers)
+			}
+		})
+	}
+}
+
+func TestDnsServer_Poison(t *testing.T) {
+	china := startUpstream(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		return answerA(query, "93.46.8.89")
+	})
+	oversea := startUpstream(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		return answerA(query, "93.184.216.34")
+	})
+
+	tests := []struct {
+		name    string
+		options poison.Options
+		want    string
+	}{
+		{"retry overseas", poison.Options{}, "93.184.216.34"},
+		{"disabled", poison.Options{Disabled: true}, "93.46.8.89"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, &NewServerOptions{
+				ChinaServerAddr:   china,
+				OverSeaServerAddr: oversea,
+				PoisonOptions:     tt.options,
+			})
+
+			// .cn 域名使用国内 DNS
+			resp, err := exchangeUDP(t, listenerAddr(s, "udp"), packQuery(t, "poisoned.example.cn."))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Answers) != 1 {
+				t.Fatalf("response has %d answers, want 1", len(resp.Answers))
+			}
+			a := resp.Answers[0].Body.(*dnsmessage.AResource).A
+			if got := net.IP(a[:]).String(); got != tt.want {
+				t.Errorf("answer = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDnsServer_Forward(t *testing.T) {
+	public := startUpstream(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		return answerA(query, "93.184.216.34")
+	})
+	local := startUpstream(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		return answerA(query, "192.168.1.20")
+	})
+
+	s := newTestServer(t, &NewServerOptions{
+		ChinaServerAddr:   public,
+		OverSeaServerAddr: public,
+		ForwardOptions: forward.Options{
+			Rules: []forward.Rule{{Zone: "corp.example.com", Server: local}},
+		},
+	})
+
+	tests := []struct {
+		domain      string
+		wantRCode   dnsmessage.RCode
+		wantAnswers int
+	}{
+		{"git.corp.example.com.", dnsmessage.RCodeSuccess, 1},
+		{"printer.lan.", dnsmessage.RCodeNameError, 0},
+		{"www.example.com.", dnsmessage.RCodeSuccess, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			resp, err := exchangeUDP(t, listenerAddr(s, "udp"), packQuery(t, tt.domain))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.RCode != tt.wantRCode || len(resp.Answers) != tt.wantAnswers {
+				t.Errorf("response = %v with %d answers, want %v with %d answers", resp.RCode, len(resp.Answers), tt.wantRCode, tt.wantAnswers)
+			}
+		})
+	}
+}
+
+func TestDnsServer_ECSCache(t *testing.T) {
+	var calls int64
+	subnets := make(chan string, 4)
+	upstream := startUpstream(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		atomic.AddInt64(&calls, 1)
+		subnet, _ := ecs.FromMessage(query)
+		if subnet.Net != nil {
+			subnets <- subnet.Net.String()
+		} else {
+			subnets <- ""
+		}
+		resp := answerA(query, "93.184.216.34")
+		resp.Additionals = query.Additionals
+		return resp
+	})
+
+	_, fixed, _ := net.ParseCIDR("203.0.113.0/24")
+	s := newTestServer(t, &NewServerOptions{
+		ChinaServerAddr:   upstream,
+		OverSeaServerAddr: upstream,
+		ChinaECS:          ecs.Options{Mode: ecs.ModeFixed, Subnet: fixed},
+		OverseaECS:        ecs.Options{Mode: ecs.ModeFixed, Subnet: fixed},
+		CacheOptions:      cache.Options{Size: 16},
+	})
+
+	for i := 0; i < 2; i++ {
+		resp, err := exchangeUDP(t, listenerAddr(s, "udp"), packQuery(t, "www.example.com."))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answers) != 1 {
+			t.Fatalf("response has %d answers, want 1", len(resp.Answers))
+		}
+		// 客户端的查询没有 OPT 记录，响应中也不应该有
+		if ecs.HasOPT(resp) {
+			t.Errorf("response has OPT record, want none")
+		}
+	}
+
+	if got := atomic.LoadInt64(&calls); got != 1 {
+		t.Errorf("upstream calls = %d, want 1", got)
+	}
+	if got := <-subnets; got != "203.0.113.0/24" {
+		t.Errorf("upstream ECS = %q, want 203.0.113.0/24", got)
+	}
+}
+
+func TestDnsServer_Metrics(t *testing.T) {
+	upstream := startUpstream(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		return answerA(query, "93.184.216.34")
+	})
+	s := newTestServer(t, &NewServerOptions{
+		ChinaServerAddr:   upstream,
+		OverSeaServerAddr: upstream,
+		StaticRecords:     []string{"nas.lan A 192.168.1.10"},
+		CacheOptions:      cache.Options{Size: 16},
+	})
+
+	for _, name := range []string{"nas.lan.", "www.example.com.", "www.example.com."} {
+		if _, err := exchangeUDP(t, listenerAddr(s, "udp"), packQuery(t, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{
+		`dns_queries_total{protocol="udp",route="local",rcode="NOERROR",qtype="A"} 1`,
+		`dns_query_duration_seconds_count{protocol="udp",route="local"} 1`,
+		`dns_upstream_duration_seconds_count{upstream="` + upstream + `"} 1`,
+		`dns_cache_hits_total 1`,
+		`dns_cache_misses_total 1`,
+		`dns_cache_entries 1`,
+		`dns_domain_list_size{list="hosts"} 2`,
+		`dns_listener_queries_total{listener="udp://127.0.0.1:0"} 3`,
+		`dns_dropped_packets_total{listener="udp://127.0.0.1:0",reason="acl"} 0`,
+	}
+	// 查询记录在发送应答之后更新，等待最后一个查询处理完成
+	var output string
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		var b strings.Builder
+		if err := s.WriteMetrics(&b); err != nil {
+			t.Fatal(err)
+		}
+		if output = b.String(); strings.Contains(output, "dns_inflight_queries 0") && strings.Count(output, "dns_queries_total{") >= 2 {
+			break
+		}
+	}
+	for _, line := range want {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("metrics missing %q\n%s", line, output)
+		}
+	}
+}
+
+func TestDnsServer_DNSSEC(t *testing.T) {
+	dnssecOK := make(chan bool, 16)
+	upstream := startUpstream(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		dnssecOK <- dnssec.DNSSECOK(query)
+		if query.Questions[0].Type != dnsmessage.TypeA {
+			return newResponse(query, dnsmessage.RCodeSuccess)
+		}
+		return answerA(query, "93.184.216.34")
+	})
 
-	_, err = conn.Write(packed)
+	s := newTestServer(t, &NewServerOptions{
+		ChinaServerAddr:   upstream,
+		OverSeaServerAddr: upstream,
+		DNSSECOptions:     dnssec.Options{Enabled: true},
+	})
+
+	// 上游没有返回签名，也无法证明域名所在的区域没有签名
+	resp, err := exchangeUDP(t, listenerAddr(s, "udp"), packQuery(t, "www.example.com."))
 	if err != nil {
 		t.Fatal(err)
 	}
+	if resp.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("response = %v, want %v", resp.RCode, dnsmessage.RCodeServerFailure)
+	}
+	if !<-dnssecOK {
+		t.Error("upstream query without DO bit")
+	}
+}
+
+func TestDnsServer_DNSSECCache(t *testing.T) {
+	var calls int64
+	upstream := startUpstream(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		// 验证时查询的 DNSKEY 和 DS 不计入
+		if query.Questions[0].Type != dnsmessage.TypeA {
+			return newResponse(query, dnsmessage.RCodeSuccess)
+		}
+		atomic.AddInt64(&calls, 1)
+		return answerA(query, "93.184.216.34")
+	})
+
+	tests := []struct {
+		name      string
+		options   dnssec.Options
+		wantCalls int64
+		// wantRCodes 依次发送 CD 查询和普通查询的响应码
+		wantRCodes []dnsmessage.RCode
+	}{
+		{
+			name:       "Test bogus answer cached from CD query",
+			options:    dnssec.Options{Enabled: true},
+			wantCalls:  1,
+			wantRCodes: []dnsmessage.RCode{dnsmessage.RCodeSuccess, dnsmessage.RCodeServerFailure},
+		},
+		{
+			name:       "Test CD bit forwarded without validation",
+			wantCalls:  2,
+			wantRCodes: []dnsmessage.RCode{dnsmessage.RCodeSuccess, dnsmessage.RCodeSuccess},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt64(&calls, 0)
+			s := newTestServer(t, &NewServerOptions{
+				ChinaServerAddr:   upstream,
+				OverSeaServerAddr: upstream,
+				DNSSECOptions:     tt.options,
+				CacheOptions:      cache.Options{Size: 16},
+			})
+
+			for i, cd := range []bool{true, false} {
+				msg := dnsmessage.Message{
+					Header: dnsmessage.Header{ID: 1234, RecursionDesired: true, CheckingDisabled: cd},
+					Questions: []dnsmessage.Question{{
+						Name:  dnsmessage.MustNewName("www.example.com."),
+						Type:  dnsmessage.TypeA,
+						Class: dnsmessage.ClassINET,
+					}},
+				}
+				query, err := msg.Pack()
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp, err := exchangeUDP(t, listenerAddr(s, "udp"), query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if resp.RCode != tt.wantRCodes[i] {
+					t.Errorf("response with CD=%v = %v, want %v", cd, resp.RCode, tt.wantRCodes[i])
+				}
+			}
+			if got := atomic.LoadInt64(&calls); got != tt.wantCalls {
+				t.Errorf("upstream calls = %d, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+// setBackend 记录添加到集合的地址
+type setBackend struct {
+	added chan string
+}
+
+func (b *setBackend) Add(set ipset.Set, ip net.IP, timeout time.Duration) error {
+	b.added <- set.String() + " " + ip.String() + " " + timeout.String()
+	return nil
+}
+
+func TestDnsServer_IPSet(t *testing.T) {
+	upstream := startUpstream(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		return answerA(query, "93.184.216.34")
+	})
+
+	backend := &setBackend{added: make(chan string, 4)}
+	s := newTestServer(t, &NewServerOptions{
+		ChinaServerAddr:   upstream,
+		OverSeaServerAddr: upstream,
+		IPSetOptions: ipset.Options{
+			Rules: []ipset.Rule{{
+				Domains: []string{"example.com"},
+				Sets:    []ipset.Set{{Kind: ipset.KindNFT, Family: "inet", Table: "fw4", Name: "proxy"}},
+			}},
+			Backend: backend,
+		},
+	})
+
+	if _, err := exchangeUDP(t, listenerAddr(s, "udp"), packQuery(t, "www.example.com.")); err != nil {
+		t.Fatal(err)
+	}
+	// 地址在发送响应之前添加到集合
+	select {
+	case got := <-backend.added:
+		if want := "inet#fw4#proxy 93.184.216.34 1m0s"; got != want {
+			t.Errorf("added %q, want %q", got, want)
+		}
+	default:
+		t.Error("answer was not added to the set before the response")
+	}
+}
+
+func TestDnsServer_Reload(t *testing.T) {
+	oldUpstream := startUpstream(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		return answerA(query, "93.184.216.34")
+	})
+	newUpstream := startUpstream(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		return answerA(query, "93.184.216.35")
+	})
+
+	s := newTestServer(t, &NewServerOptions{
+		ChinaServerAddr:   oldUpstream,
+		OverSeaServerAddr: oldUpstream,
+		StaticRecords:     []string{"nas.lan A 192.168.1.10"},
+	})
+	addr := listenerAddr(s, "udp")
+
+	// answer 返回查询的第一个 A 记录，没有时返回空字符串
+	answer := func(name string) string {
+		t.Helper()
+		resp, err := exchangeUDP(t, addr, packQuery(t, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answers) == 0 {
+			return ""
+		}
+		a := resp.Answers[0].Body.(*dnsmessage.AResource).A
+		return net.IP(a[:]).String()
+	}
+
+	if got := answer("www.example.com."); got != "93.184.216.34" {
+		t.Fatalf("before reload answer = %s, want 93.184.216.34", got)
+	}
+
+	// 无效的配置不会替换原来的配置
+	invalid := *s.options
+	invalid.BlockResponse = "invalid"
+	if _, err := s.Reload(&invalid); err == nil {
+		t.Fatal("Reload() with invalid block response error = nil")
+	}
+	if got := answer("nas.lan."); got != "192.168.1.10" {
+		t.Errorf("after failed reload answer = %s, want 192.168.1.10", got)
+	}
 
-	// 接收响应
-	response := make([]byte, 512)
-	n, err := conn.Read(response)
+	next := *s.options
+	next.ChinaServerAddr = newUpstream
+	next.OverSeaServerAddr = newUpstream
+	next.StaticRecords = []string{"nas.lan A 192.168.1.11"}
+	next.CacheOptions.Size = 100
+	result, err := s.Reload(&next)
 	if err != nil {
 		t.Fatal(err)
 	}
+	wantChanged := []string{"国内DNS", "海外DNS", "静态记录"}
+	if !reflect.DeepEqual(result.Changed, wantChanged) {
+		t.Errorf("Changed = %v, want %v", result.Changed, wantChanged)
+	}
+	if !reflect.DeepEqual(result.RestartRequired, []string{"缓存"}) {
+		t.Errorf("RestartRequired = %v, want [缓存]", result.RestartRequired)
+	}
+
+	// 监听器保持打开，新的查询使用新的配置
+	if got := answer("www.example.com."); got != "93.184.216.35" {
+		t.Errorf("after reload answer = %s, want 93.184.216.35", got)
+	}
+	if got := answer("nas.lan."); got != "192.168.1.11" {
+		t.Errorf("after reload answer = %s, want 192.168.1.11", got)
+	}
+
+	// 旧配置在使用它的查询完成后才停止
+	config := s.acquireConfig()
+	if _, err := s.Reload(&next); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-config.stopChan:
+		t.Error("old config stopped while a query was using it")
+	default:
+	}
+	config.release()
+	select {
+	case <-config.stopChan:
+	default:
+		t.Error("old config not stopped after the query finished")
+	}
+}
+
+func TestDnsServer_ReloadBeforeStart(t *testing.T) {
+	// 拦截列表下载一直没有完成，重载不等待下载
+	release := make(chan struct{})
+	lists := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer lists.Close()
+	defer close(release)
 
-	// 解析响应
-	var respMsg dnsmessage.Message
-	err = respMsg.Unpack(response[:n])
+	dataDir := t.TempDir()
+	options := &NewServerOptions{
+		Listeners:         []ListenerOptions{{Network: "udp", Addr: "127.0.0.1:0"}},
+		ChinaServerAddr:   "127.0.0.1:1",
+		OverSeaServerAddr: "127.0.0.1:1",
+		DBPath:            filepath.Join(dataDir, "dns.db"),
+		DataDir:           dataDir,
+		LearningOptions:   domain.LearnedDomainOptions{Disabled: true},
+	}
+	options.BlocklistOptions.URLs = []string{lists.URL}
+	options.BlocklistOptions.DataDir = dataDir
+	s, err := NewDnsServer(options)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer s.Close()
+
+	old := s.currentConfig()
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Reload(options)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Reload() waited for the blocklist download")
+	}
 
-	// 验证响应
-	if len(respMsg.Answers) == 0 {
-		t.Error("No answers in response")
+	// 没有启动时被替换的配置也会停止
+	select {
+	case <-old.stopChan:
+	default:
+		t.Error("old config not stopped after reload before start")
 	}
-} 
\ No newline at end of file
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"go-dns-proxy/clients"
+	"go-dns-proxy/domain"
+	"io"
+	"net"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// 服务器处理查询的步骤，在国内外分流判断之前
+const (
+	stepClient    = "client"
+	stepHosts     = "hosts"
+	stepBlocklist = "blocklist"
+	stepForward   = "forward"
+)
+
+// stepNames 步骤的中文名称
+var stepNames = map[string]string{
+	stepClient:                   "客户端分组",
+	stepHosts:                    "本地记录",
+	stepBlocklist:                "拦截列表",
+	stepForward:                  "条件转发",
+	domain.ReasonClientGroup:     "分组路由规则",
+	domain.ReasonDomainList:      "中国域名列表",
+	domain.ReasonChinaTLD:        "中国顶级域名",
+	domain.ReasonLearned:         "学习域名",
+	domain.StepMainDomain:        "主域名",
+	domain.ReasonBeian:           "备案",
+	domain.ReasonPinyinDenylist:  "拼音黑名单",
+	domain.ReasonPinyinAllowlist: "拼音白名单",
+	domain.ReasonPinyin:          "拼音",
+	domain.ReasonDefault:         "默认",
+}
+
+// Explanation 域名对某个客户端的完整处理过程，不查询上游，
+// 因此不包括污染检测后改用海外 DNS 的情况
+type Explanation struct {
+	Domain      string               `json:"domain"`
+	Client      string               `json:"client,omitempty"`
+	ClientGroup string               `json:"client_group,omitempty"`
+	Route       string               `json:"route"`
+	Server      string               `json:"server"`
+	Steps       []domain.ExplainStep `json:"steps"`
+	Routing     *domain.Explanation  `json:"routing"`
+}
+
+// Explain 说明当前配置下域名的处理过程，clientIP 用于匹配客户端分组，可以为 nil
+func (s *DnsServer) Explain(ctx context.Context, name string, clientIP net.IP) (*Explanation, error) {
+	config := s.acquireConfig()
+	defer config.release()
+	return s.explain(ctx, config, name, clientIP)
+}
+
+// Explain 说明域名的处理过程
+func (q *Querier) Explain(ctx context.Context, name string, clientIP net.IP) (*Explanation, error) {
+	return q.server.explain(ctx, q.server.currentConfig(), name, clientIP)
+}
+
+// explain 按服务器处理查询的顺序检查本地记录、拦截列表、条件转发和分组路由规则，
+// 再列出国内外分流判断的每一步
+func (s *DnsServer) explain(ctx context.Context, config *runtimeConfig, name string, clientIP net.IP) (*Explanation, error) {
+	msg, err := newQuery(name, dnsmessage.TypeA)
+	if err != nil {
+		return nil, err
+	}
+	question := msg.Questions[0]
+	e := &Explanation{Domain: strings.TrimSuffix(question.Name.String(), ".")}
+	qc := &queryContext{clientIP: clientIP, config: config}
+
+	// 客户端分组
+	switch {
+	case clientIP == nil:
+		e.addStep(stepClient, false, "没有指定客户端")
+	case config.clients == nil:
+		e.Client = clientIP.String()
+		e.addStep(stepClient, false, "没有配置客户端分组")
+	default:
+		e.Client = clientIP.String()
+		if group := config.clients.Match(clientIP); group != nil {
+			qc.policy = config.groupPolicies[group.Name]
+			e.ClientGroup = group.Name
+			e.addStep(stepClient, true, fmt.Sprintf("%s 属于分组 %s", e.Client, group.Name))
+		} else {
+			e.addStep(stepClient, false, fmt.Sprintf("%s 不属于任何分组", e.Client))
+		}
+	}
+
+	// 有记录但没有对应类型时同样由本地应答
+	local := false
+	if config.hosts != nil {
+		_, local = config.hosts.Lookup(question)
+	}
+	if local {
+		e.decide(stepHosts, routeLocal, routeLocal, "域名在 hosts 文件或静态记录中")
+	} else {
+		e.addStep(stepHosts, false, "没有本地记录")
+	}
+
+	if match, blocked := s.matchBlocklist(qc, e.Domain); blocked {
+		detail := "命中规则 " + match.Rule
+		if match.Source != "" {
+			detail += "，来源 " + match.Source
+		}
+		e.decide(stepBlocklist, routeBlocked, routeBlocked, detail)
+	} else {
+		e.addStep(stepBlocklist, false, "没有命中拦截规则")
+	}
+
+	if rule, ok := config.forwarder.Match(e.Domain); ok {
+		server := routeLocal
+		detail := fmt.Sprintf("命中区域 %s，返回 NXDOMAIN", rule.Zone)
+		if rule.Server != "" {
+			server = config.forwardResolvers[rule.Server].String()
+			detail = fmt.Sprintf("命中区域 %s，转发到 %s", rule.Zone, server)
+		}
+		e.decide(stepForward, routeForward, server, detail)
+	} else {
+		e.addStep(stepForward, false, "没有命中条件转发区域")
+	}
+
+	chinaResolver, overseaResolver := config.chinaResolver, config.overseaResolver
+	if qc.policy != nil {
+		chinaResolver, overseaResolver = qc.policy.chinaResolver, qc.policy.overseaResolver
+		if route, rule := qc.policy.group.RouteFor(e.Domain); route != "" {
+			server := overseaResolver.String()
+			if route == clients.RouteChina {
+				server = chinaResolver.String()
+			}
+			e.decide(domain.ReasonClientGroup, route, server, fmt.Sprintf("分组 %s 的规则 %s 指定使用 %s", qc.policy.group.Name, rule, route))
+		} else {
+			e.addStep(domain.ReasonClientGroup, false, "没有命中分组的路由规则")
+		}
+	}
+
+	// 前面的步骤已经决定了处理方式时，分流判断仅供参考
+	e.Routing = config.chinaDomainService.Explain(ctx, e.Domain)
+	if e.Route != "" {
+		for i := range e.Routing.Steps {
+			e.Routing.Steps[i].Decisive = false
+			e.Routing.Steps[i].Skipped = true
+		}
+		return e, nil
+	}
+	e.Route, e.Server = domain.RouteOversea, overseaResolver.String()
+	if e.Routing.Decision.IsChina {
+		e.Route, e.Server = domain.RouteChina, chinaResolver.String()
+	}
+	return e, nil
+}
+
+func (e *Explanation) addStep(name string, matched bool, detail string) {
+	step := domain.ExplainStep{Name: name, Matched: matched, Detail: detail}
+	step.Skipped = e.Route != ""
+	e.Steps = append(e.Steps, step)
+}
+
+// decide 记录决定处理方式的步骤，已经决定时只记录结果
+func (e *Explanation) decide(name, route, server, detail string) {
+	if e.Route != "" {
+		e.addStep(name, true, detail)
+		return
+	}
+	e.Route, e.Server = route, server
+	e.Steps = append(e.Steps, domain.ExplainStep{Name: name, Matched: true, Decisive: true, Detail: detail})
+}
+
+// WriteText 以表格输出处理过程，决定处理方式的步骤标记为 ✔，没有执行到的步骤标记为 -
+func (e *Explanation) WriteText(w io.Writer) error {
+	tw := bufio.NewWriter(w)
+	fmt.Fprintf(tw, "域名: %s\n", e.Domain)
+	if e.Client != "" {
+		group := e.ClientGroup
+		if group == "" {
+			group = "无"
+		}
+		fmt.Fprintf(tw, "客户端: %s（分组: %s）\n", e.Client, group)
+	}
+	fmt.Fprintf(tw, "路由: %s\n", e.Route)
+	fmt.Fprintf(tw, "上游: %s\n", e.Server)
+	if r := e.Routing; r != nil {
+		if r.MainDomain != "" {
+			fmt.Fprintf(tw, "主域名: %s\n", r.MainDomain)
+		}
+		if r.ListEntry != "" {
+			fmt.Fprintf(tw, "列表条目: %s\n", r.ListEntry)
+		}
+		if p := r.Pinyin; p != nil && len(p.Syllables) > 0 {
+			fmt.Fprintf(tw, "拼音拆分: %s\n", strings.Join(p.Syllables, " "))
+		}
+	}
+
+	fmt.Fprintln(tw)
+	steps := e.Steps
+	if e.Routing != nil {
+		steps = append(steps[:len(steps):len(steps)], e.Routing.Steps...)
+	}
+	for _, step := range steps {
+		mark := " "
+		switch {
+		case step.Decisive:
+			mark = "✔"
+		case step.Skipped:
+			mark = "-"
+		}
+		result := "未命中"
+		if step.Matched {
+			result = "命中"
+		}
+		fmt.Fprintf(tw, "%s %s  %s  %s\n", mark, padRight(stepNames[step.Name], 12), padRight(result, 6), step.Detail)
+	}
+	return tw.Flush()
+}
+
+// padRight 用空格补齐到指定的显示宽度，中文字符按两个字符宽度计算
+func padRight(s string, width int) string {
+	n := 0
+	for _, r := range s {
+		n++
+		if r >= 0x1100 {
+			n++
+		}
+	}
+	if n >= width {
+		return s
+	}
+	return s + strings.Repeat(" ", width-n)
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"go-dns-proxy/blocklist"
+	"go-dns-proxy/clients"
+	"go-dns-proxy/domain"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestDnsServer_Explain(t *testing.T) {
+	s := newTestServer(t, &NewServerOptions{
+		ChinaServerAddr:   "127.0.0.2",
+		OverSeaServerAddr: "127.0.0.3",
+		StaticRecords:     []string{"nas.home.arpa A 192.168.1.10"},
+		BlocklistOptions:  blocklist.Options{Rules: []string{"||ads.example.com^"}},
+		ClientGroups: []*clients.Group{{
+			Name:           "work",
+			Clients:        []string{"192.168.1.100"},
+			OverseaDomains: []string{"example.cn"},
+		}},
+	})
+
+	tests := []struct {
+		name         string
+		domain       string
+		client       string
+		wantRoute    string
+		wantServer   string
+		wantDecisive string
+		wantGroup    string
+	}{
+		{"local record", "nas.home.arpa", "", routeLocal, routeLocal, stepHosts, ""},
+		{"blocked", "ads.example.com", "", routeBlocked, routeBlocked, stepBlocklist, ""},
+		{"forward default zone", "printer.lan", "", routeForward, routeLocal, stepForward, ""},
+		{"china tld", "www.example.cn", "", domain.RouteChina, "127.0.0.2:53", domain.ReasonChinaTLD, ""},
+		{"group route", "www.example.cn", "192.168.1.100", domain.RouteOversea, "127.0.0.3:53", domain.ReasonClientGroup, "work"},
+		{"client without group", "www.example.com", "192.168.1.101", domain.RouteOversea, "127.0.0.3:53", domain.ReasonDefault, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := s.Explain(context.Background(), tt.domain, net.ParseIP(tt.client))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.Route != tt.wantRoute || e.Server != tt.wantServer || e.ClientGroup != tt.wantGroup {
+				t.Errorf("Explain() = route %s, server %s, group %q, want %s, %s, %q",
+					e.Route, e.Server, e.ClientGroup, tt.wantRoute, tt.wantServer, tt.wantGroup)
+			}
+
+			var decisive []string
+			for _, step := range append(e.Steps, e.Routing.Steps...) {
+				if step.Decisive {
+					decisive = append(decisive, step.Name)
+				}
+			}
+			if len(decisive) != 1 || decisive[0] != tt.wantDecisive {
+				t.Errorf("Explain() decisive steps = %v, want [%s]", decisive, tt.wantDecisive)
+			}
+
+			var out bytes.Buffer
+			if err := e.WriteText(&out); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(out.String(), "✔") {
+				t.Errorf("WriteText() = %s, want decisive step marked", out.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,399 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go-dns-proxy/acl"
+	"go-dns-proxy/admin"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// tcpIdleTimeout TCP 连接的空闲超时时间
+const tcpIdleTimeout = 10 * time.Second
+
+const (
+	// maxTCPConns 每个 TCP 监听器最多同时处理的连接数，超过时新连接被直接关闭
+	maxTCPConns = 256
+	// maxTCPPipeline 每个 TCP 连接最多同时处理的查询数，超过时暂停读取该连接
+	maxTCPPipeline = 16
+	// minUDPSize 客户端没有使用 EDNS 时 UDP 响应的最大长度
+	minUDPSize = 512
+)
+
+// ListenerOptions 监听器配置
+type ListenerOptions struct {
+	// Network 协议，udp 或 tcp
+	Network string
+	// Addr 监听地址，例如 0.0.0.0:53
+	Addr string
+	// ACL 访问控制
+	ACL acl.Options
+}
+
+// String 返回监听器名称，例如 udp://0.0.0.0:53
+func (o ListenerOptions) String() string {
+	return o.Network + "://" + o.Addr
+}
+
+// ParseListener 解析监听器配置，格式为 network://host:port?allow=CIDR,...&deny=CIDR,...&action=refuse|drop，
+// 没有指定 allow、deny 和 action 时使用 defaultACL
+func ParseListener(s string, defaultACL acl.Options) (ListenerOptions, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return ListenerOptions{}, fmt.Errorf("无效的监听地址 %s: %v", s, err)
+	}
+	if u.Scheme != "udp" && u.Scheme != "tcp" {
+		return ListenerOptions{}, fmt.Errorf("不支持的监听协议: %s", s)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return ListenerOptions{}, fmt.Errorf("无效的监听地址 %s: %v", s, err)
+	}
+
+	options := ListenerOptions{Network: u.Scheme, Addr: u.Host, ACL: defaultACL}
+	query := u.Query()
+	if query.Has("allow") {
+		options.ACL.Allow = splitList(query.Get("allow"))
+	}
+	if query.Has("deny") {
+		options.ACL.Deny = splitList(query.Get("deny"))
+	}
+	if query.Has("action") {
+		options.ACL.Action = query.Get("action")
+	}
+	return options, nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// responseWriter 将响应发送给客户端
+type responseWriter interface {
+	Write(msg []byte) error
+	RemoteIP() net.IP
+}
+
+// udpResponseWriter 响应超过客户端声明的 UDP 负载大小时发送截断响应，让客户端改用 TCP 重试
+type udpResponseWriter struct {
+	conn  *net.UDPConn
+	addr  *net.UDPAddr
+	query []byte
+}
+
+func (w *udpResponseWriter) Write(msg []byte) error {
+	if len(msg) > minUDPSize && len(msg) > clientUDPSize(w.query) {
+		truncated, err := truncateResponse(msg)
+		if err != nil {
+			return err
+		}
+		msg = truncated
+	}
+	_, err := w.conn.WriteToUDP(msg, w.addr)
+	return err
+}
+
+// clientUDPSize 返回查询的 OPT 记录声明的 UDP 负载大小，没有 EDNS 时为 512
+func clientUDPSize(query []byte) int {
+	var parser dnsmessage.Parser
+	if _, err := parser.Start(query); err != nil {
+		return minUDPSize
+	}
+	if parser.SkipAllQuestions() != nil || parser.SkipAllAnswers() != nil || parser.SkipAllAuthorities() != nil {
+		return minUDPSize
+	}
+	for {
+		header, err := parser.AdditionalHeader()
+		if err != nil {
+			return minUDPSize
+		}
+		if header.Type == dnsmessage.TypeOPT {
+			if size := int(header.Class); size > minUDPSize {
+				return size
+			}
+			return minUDPSize
+		}
+		if err := parser.SkipAdditional(); err != nil {
+			return minUDPSize
+		}
+	}
+}
+
+// truncateResponse 删除响应中的记录并设置 TC 标志，保留问题部分和 OPT 记录
+func truncateResponse(msg []byte) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(msg)
+	if err != nil {
+		return nil, err
+	}
+	questions, err := parser.AllQuestions()
+	if err != nil {
+		return nil, err
+	}
+	if err := parser.SkipAllAnswers(); err != nil {
+		return nil, err
+	}
+	if err := parser.SkipAllAuthorities(); err != nil {
+		return nil, err
+	}
+	additionals, err := parser.AllAdditionals()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := dnsmessage.Message{Header: header, Questions: questions}
+	resp.Header.Truncated = true
+	for _, rr := range additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT {
+			resp.Additionals = append(resp.Additionals, rr)
+		}
+	}
+	return resp.Pack()
+}
+
+func (w *udpResponseWriter) RemoteIP() net.IP {
+	return w.addr.IP
+}
+
+// tcpResponseWriter 同一连接上的多个查询并发处理，写入时需要加锁
+type tcpResponseWriter struct {
+	conn net.Conn
+	mu   *sync.Mutex
+}
+
+func (w *tcpResponseWriter) Write(msg []byte) error {
+	if len(msg) > 0xffff {
+		return fmt.Errorf("DNS 消息过长: %d", len(msg))
+	}
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.conn.SetWriteDeadline(time.Now().Add(tcpIdleTimeout))
+	_, err := w.conn.Write(buf)
+	return err
+}
+
+func (w *tcpResponseWriter) RemoteIP() net.IP {
+	if addr, ok := w.conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// listener 一个 UDP 或 TCP 监听器
+type listener struct {
+	options ListenerOptions
+	acl     *acl.ACL
+
+	udpConn     *net.UDPConn
+	tcpListener net.Listener
+
+	// tcpConns 正在处理的 TCP 连接，用于限制连接数
+	tcpConns chan struct{}
+
+	queries int64
+	refused int64
+	dropped int64
+	limited int64
+	// rrlDropped 超过响应限速被丢弃的响应数，invalid 无法解析的查询数
+	rrlDropped int64
+	invalid    int64
+	// overloaded 超过连接数限制被关闭的 TCP 连接数
+	overloaded int64
+}
+
+// openListeners 打开所有监听器，任意一个失败时关闭已打开的监听器
+func openListeners(optionsList []ListenerOptions) ([]*listener, error) {
+	var listeners []*listener
+	for _, options := range optionsList {
+		l, err := openListener(options)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+func openListener(options ListenerOptions) (*listener, error) {
+	a, err := acl.New(options.ACL)
+	if err != nil {
+		return nil, fmt.Errorf("监听器 %s 的访问控制无效: %v", options, err)
+	}
+	l := &listener{options: options, acl: a}
+
+	switch options.Network {
+	case "udp":
+		addr, err := net.ResolveUDPAddr("udp", options.Addr)
+		if err != nil {
+			return nil, err
+		}
+		if l.udpConn, err = net.ListenUDP("udp", addr); err != nil {
+			return nil, err
+		}
+	case "tcp":
+		if l.tcpListener, err = net.Listen("tcp", options.Addr); err != nil {
+			return nil, err
+		}
+		l.tcpConns = make(chan struct{}, maxTCPConns)
+	default:
+		return nil, fmt.Errorf("不支持的监听协议: %s", options.Network)
+	}
+	return l, nil
+}
+
+func closeListeners(listeners []*listener) {
+	for _, l := range listeners {
+		if err := l.close(); err != nil {
+			log.WithError(err).WithField("listener", l.options.String()).Error("关闭监听器失败")
+		}
+	}
+}
+
+func (l *listener) close() error {
+	if l.udpConn != nil {
+		return l.udpConn.Close()
+	}
+	return l.tcpListener.Close()
+}
+
+// stats 返回监听器的统计数据
+func (l *listener) stats() admin.ListenerStats {
+	return admin.ListenerStats{
+		Name:    l.options.String(),
+		Network: l.options.Network,
+		Addr:    l.options.Addr,
+		Queries: atomic.LoadInt64(&l.queries),
+		Refused: atomic.LoadInt64(&l.refused),
+		Dropped: atomic.LoadInt64(&l.dropped),
+		Limited: atomic.LoadInt64(&l.limited),
+	}
+}
+
+// serveUDP 读取 UDP 查询，直到 stop 关闭
+func (s *DnsServer) serveUDP(l *listener) {
+	buffer := make([]byte, 65535)
+
+	for {
+		select {
+		case <-s.stopChan:
+			return
+		default:
+		}
+
+		l.udpConn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, remoteAddr, err := l.udpConn.ReadFromUDP(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.WithError(err).Error("读取UDP数据失败")
+			continue
+		}
+
+		// 缓冲区会被下一次读取覆盖，复制一份交给处理协程
+		queryData := make([]byte, n)
+		copy(queryData, buffer[:n])
+		go s.handleDNSQuery(l, &udpResponseWriter{conn: l.udpConn, addr: remoteAddr, query: queryData}, queryData)
+	}
+}
+
+// serveTCP 接受 TCP 连接，直到监听器关闭
+func (s *DnsServer) serveTCP(l *listener) {
+	for {
+		conn, err := l.tcpListener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.WithError(err).Error("接受TCP连接失败")
+			continue
+		}
+
+		// 被拒绝且配置为丢弃的客户端直接关闭连接
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && !l.acl.Allowed(addr.IP) && l.acl.Action() == acl.ActionDrop {
+			atomic.AddInt64(&l.dropped, 1)
+			conn.Close()
+			continue
+		}
+
+		// 连接数达到上限时关闭新连接
+		select {
+		case l.tcpConns <- struct{}{}:
+		default:
+			atomic.AddInt64(&l.overloaded, 1)
+			log.WithFields(log.Fields{
+				"listener": l.options.String(),
+				"client":   conn.RemoteAddr().String(),
+			}).Debug("TCP 连接数达到上限，关闭新连接")
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer func() { <-l.tcpConns }()
+			s.handleTCPConn(l, conn)
+		}()
+	}
+}
+
+// handleTCPConn 读取一个 TCP 连接上的所有查询，每个查询前有两字节的长度。
+// 同时处理的查询达到上限时等待其中一个完成后再读取下一个查询
+func (s *DnsServer) handleTCPConn(l *listener, conn net.Conn) {
+	w := &tcpResponseWriter{conn: conn, mu: &sync.Mutex{}}
+	pipeline := make(chan struct{}, maxTCPPipeline)
+	defer func() {
+		// 等待正在处理的查询发送应答后再关闭连接
+		for i := 0; i < maxTCPPipeline; i++ {
+			pipeline <- struct{}{}
+		}
+		conn.Close()
+	}()
+
+	lengthBuf := make([]byte, 2)
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		if _, err := io.ReadFull(conn, lengthBuf); err != nil {
+			return
+		}
+		queryData := make([]byte, binary.BigEndian.Uint16(lengthBuf))
+		if _, err := io.ReadFull(conn, queryData); err != nil {
+			return
+		}
+		pipeline <- struct{}{}
+		go func() {
+			defer func() { <-pipeline }()
+			s.handleDNSQuery(l, w, queryData)
+		}()
+	}
+}
+
+// ListenerStats 返回所有监听器的统计数据
+func (s *DnsServer) ListenerStats() []admin.ListenerStats {
+	stats := make([]admin.ListenerStats, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		stats = append(stats, l.stats())
+	}
+	return stats
+}
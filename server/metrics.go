@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"go-dns-proxy/admin"
+	"go-dns-proxy/client"
+	"go-dns-proxy/domain"
+	"go-dns-proxy/metrics"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// serverMetrics Prometheus 指标，在查询处理过程中更新，不读写数据库
+type serverMetrics struct {
+	registry         *metrics.Registry
+	queries          *metrics.CounterVec
+	queryDuration    *metrics.HistogramVec
+	upstreamDuration *metrics.HistogramVec
+	upstreamErrors   *metrics.CounterVec
+	cacheHits        *metrics.Counter
+	cacheMisses      *metrics.Counter
+	inflight         *metrics.Gauge
+}
+
+func newServerMetrics(s *DnsServer) *serverMetrics {
+	r := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry:         r,
+		queries:          r.NewCounterVec("dns_queries_total", "已应答的 DNS 查询数", "protocol", "route", "rcode", "qtype"),
+		queryDuration:    r.NewHistogramVec("dns_query_duration_seconds", "从收到查询到发送应答的时间", nil, "protocol", "route"),
+		upstreamDuration: r.NewHistogramVec("dns_upstream_duration_seconds", "上游 DNS 的应答时间", nil, "upstream"),
+		upstreamErrors:   r.NewCounterVec("dns_upstream_errors_total", "上游 DNS 查询失败次数", "upstream"),
+		cacheHits:        r.NewCounterVec("dns_cache_hits_total", "命中缓存的查询数").WithLabelValues(),
+		cacheMisses:      r.NewCounterVec("dns_cache_misses_total", "没有命中缓存的查询数").WithLabelValues(),
+		inflight:         r.NewGauge("dns_inflight_queries", "正在处理的查询数"),
+	}
+
+	r.NewGaugeFunc("dns_cache_entries", "缓存的响应数", nil, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(s.cache.Len())}}
+	})
+	r.NewGaugeFunc("dns_domain_list_size", "域名列表、拦截规则和 IP 列表的条目数", []string{"list"}, s.listSizes)
+	r.NewCounterFunc("dns_query_log_dropped_total", "写入队列已满时丢弃的查询记录数", nil, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(s.queryLog.Dropped())}}
+	})
+	r.NewCounterFunc("dns_listener_queries_total", "监听器收到的查询数", []string{"listener"}, func() []metrics.Sample {
+		var samples []metrics.Sample
+		for _, l := range s.listeners {
+			samples = append(samples, metrics.Sample{Labels: []string{l.options.String()}, Value: float64(atomic.LoadInt64(&l.queries))})
+		}
+		return samples
+	})
+	r.NewCounterFunc("dns_refused_queries_total", "因访问控制拒绝的查询数", []string{"listener"}, func() []metrics.Sample {
+		var samples []metrics.Sample
+		for _, l := range s.listeners {
+			samples = append(samples, metrics.Sample{Labels: []string{l.options.String()}, Value: float64(atomic.LoadInt64(&l.refused))})
+		}
+		return samples
+	})
+	r.NewCounterFunc("dns_dropped_packets_total", "丢弃的查询、响应和连接数，reason 为 acl、ratelimit、rrl、invalid 或 tcp_limit", []string{"listener", "reason"}, func() []metrics.Sample {
+		var samples []metrics.Sample
+		for _, l := range s.listeners {
+			name := l.options.String()
+			samples = append(samples,
+				metrics.Sample{Labels: []string{name, "acl"}, Value: float64(atomic.LoadInt64(&l.dropped))},
+				metrics.Sample{Labels: []string{name, "ratelimit"}, Value: float64(atomic.LoadInt64(&l.limited))},
+				metrics.Sample{Labels: []string{name, "rrl"}, Value: float64(atomic.LoadInt64(&l.rrlDropped))},
+				metrics.Sample{Labels: []string{name, "invalid"}, Value: float64(atomic.LoadInt64(&l.invalid))},
+				metrics.Sample{Labels: []string{name, "tcp_limit"}, Value: float64(atomic.LoadInt64(&l.overloaded))},
+			)
+		}
+		return samples
+	})
+	return m
+}
+
+// listSizes 返回当前配置中各个列表的条目数
+func (s *DnsServer) listSizes() []metrics.Sample {
+	config := s.currentConfig()
+	var samples []metrics.Sample
+	add := func(list string, size int) {
+		samples = append(samples, metrics.Sample{Labels: []string{list}, Value: float64(size)})
+	}
+	add("china_domains", config.chinaDomainService.Len())
+	add("china_ip", s.chinaIPService.Len())
+	if config.blocklist != nil {
+		add("blocklist", config.blocklist.Len())
+	}
+	if config.hosts != nil {
+		add("hosts", config.hosts.Len())
+	}
+	if s.learnedStore != nil {
+		add("learned_domains", s.learnedStore.Len())
+	}
+	return samples
+}
+
+// observeQuery 记录一次已应答的查询
+func (m *serverMetrics) observeQuery(qc *queryContext, dnsQuery *admin.DNSQuery) {
+	protocol := qc.listener.options.Network
+	route := queryRoute(dnsQuery)
+	m.queries.WithLabelValues(
+		protocol,
+		route,
+		RCodeName(dnsmessage.RCode(dnsQuery.ResponseCode)),
+		strings.TrimPrefix(dnsQuery.QueryType, "Type"),
+	).Inc()
+	m.queryDuration.WithLabelValues(protocol, route).Observe(time.Since(qc.startTime).Seconds())
+}
+
+// queryRoute 返回查询记录的路由：china、oversea、local、blocked 或 forward
+func queryRoute(dnsQuery *admin.DNSQuery) string {
+	switch {
+	case dnsQuery.RouteReason == routeLocal || dnsQuery.RouteReason == routeBlocked || dnsQuery.RouteReason == routeForward:
+		return dnsQuery.RouteReason
+	case dnsQuery.IsChinaDNS:
+		return domain.RouteChina
+	default:
+		return domain.RouteOversea
+	}
+}
+
+// exchange 向上游发送查询并记录应答时间和失败次数
+func (s *DnsServer) exchange(ctx context.Context, resolver client.DNSResolver, msg dnsmessage.Message) ([]byte, dnsmessage.Message, time.Duration, error) {
+	respData, respMsg, rtt, err := exchange(ctx, resolver, msg)
+	upstream := resolver.String()
+	if err != nil {
+		s.metrics.upstreamErrors.WithLabelValues(upstream).Inc()
+	} else {
+		s.metrics.upstreamDuration.WithLabelValues(upstream).Observe(rtt.Seconds())
+	}
+	return respData, respMsg, rtt, err
+}
+
+// WriteMetrics 以 Prometheus 文本格式输出指标
+func (s *DnsServer) WriteMetrics(w io.Writer) error {
+	_, err := s.metrics.registry.WriteTo(w)
+	return err
+}
@@ -0,0 +1,514 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"go-dns-proxy/admin"
+	"go-dns-proxy/cache"
+	"go-dns-proxy/client"
+	"go-dns-proxy/clients"
+	"go-dns-proxy/dnssec"
+	"go-dns-proxy/domain"
+	"go-dns-proxy/ipset"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// QueryTimings 一次查询各阶段的用时，单位为毫秒
+type QueryTimings struct {
+	DecisionMs float64 `json:"decision_ms"`
+	UpstreamMs float64 `json:"upstream_ms"`
+	TotalMs    float64 `json:"total_ms"`
+}
+
+// QueryRecord 应答中的一条记录
+type QueryRecord struct {
+	Name string `json:"name"`
+	TTL  uint32 `json:"ttl"`
+	Type string `json:"type"`
+	Data string `json:"data"`
+}
+
+// QueryResult 命令行查询的结果。查询运行中的服务器时只有应答，没有路由判断
+type QueryResult struct {
+	Domain       string                `json:"domain"`
+	Type         string                `json:"type"`
+	Route        string                `json:"route,omitempty"`
+	Decision     *domain.RouteDecision `json:"decision,omitempty"`
+	ClientGroup  string                `json:"client_group,omitempty"`
+	BlockRule    string                `json:"block_rule,omitempty"`
+	ForwardZone  string                `json:"forward_zone,omitempty"`
+	Server       string                `json:"server"`
+	PoisonReason string                `json:"poison_reason,omitempty"`
+	DNSSEC       string                `json:"dnssec,omitempty"`
+	ID           uint16                `json:"id"`
+	RCode        string                `json:"rcode"`
+	Flags        []string              `json:"flags"`
+	Question     string                `json:"question"`
+	Answers      []QueryRecord         `json:"answers"`
+	Authorities  []QueryRecord         `json:"authorities"`
+	Additionals  []QueryRecord         `json:"additionals"`
+	Timings      QueryTimings          `json:"timings"`
+	Time         time.Time             `json:"time"`
+}
+
+// Querier 不启动监听器，按与服务器相同的流程处理单个查询，用于命令行调试。
+// 不使用缓存，不记录查询日志，也不学习域名路由和添加集合
+type Querier struct {
+	server *DnsServer
+}
+
+// NewQuerier 根据服务器配置创建查询，会打开数据目录中的数据库，使用学习到的域名路由和备案缓存
+func NewQuerier(options *NewServerOptions) (*Querier, error) {
+	db, err := admin.InitDB(options.DBPath)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &DnsServer{
+		options:  options,
+		cache:    cache.New(cache.Options{}),
+		db:       db,
+		stopChan: make(chan struct{}),
+	}
+	s.metrics = newServerMetrics(s)
+	if !options.LearningOptions.Disabled {
+		if s.learnedStore, err = domain.NewLearnedDomainStore(db, options.LearningOptions); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	// 不添加集合，也就不需要 netlink 连接
+	queryOptions := *options
+	queryOptions.IPSetOptions = ipset.Options{}
+	if s.config, err = s.newRuntimeConfig(&queryOptions); err != nil {
+		s.learnedStore.Close()
+		db.Close()
+		return nil, err
+	}
+	// 只查询一次，等待列表下载完成
+	s.config.refreshLists()
+	return &Querier{server: s}, nil
+}
+
+// Query 查询域名，clientIP 用于匹配客户端分组，可以为 nil
+func (q *Querier) Query(ctx context.Context, name string, qtype dnsmessage.Type, clientIP net.IP) (*QueryResult, error) {
+	msg, err := newQuery(name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	return q.server.query(ctx, q.server.currentConfig(), msg, clientIP)
+}
+
+// Close 关闭数据库和备案服务
+func (q *Querier) Close() error {
+	q.server.config.stop()
+	q.server.learnedStore.Close()
+	return q.server.db.Close()
+}
+
+// NewResolver 根据地址创建解析器，格式与上游地址相同
+func NewResolver(addr string) client.DNSResolver {
+	return createResolver(addr)
+}
+
+// QueryServer 直接向 DNS 服务器发送查询，例如运行中的代理服务器。
+// addr 的格式与上游地址相同，支持 udp://、tcp://、tls:// 和 https://，没有前缀时使用 UDP
+func QueryServer(ctx context.Context, addr, name string, qtype dnsmessage.Type) (*QueryResult, error) {
+	msg, err := newQuery(name, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	resolver := createResolver(addr)
+	_, resp, rtt, err := exchange(ctx, resolver, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	result := newQueryResult(msg, start)
+	result.Server = resolver.String()
+	result.Timings.UpstreamMs = milliseconds(rtt)
+	result.setResponse(&resp)
+	return result, nil
+}
+
+// query 按服务器处理查询的顺序得到应答，记录路由判断和各阶段的用时
+func (s *DnsServer) query(ctx context.Context, config *runtimeConfig, msg dnsmessage.Message, clientIP net.IP) (*QueryResult, error) {
+	start := time.Now()
+	qc := &queryContext{
+		requestID: uuid.New().String(),
+		startTime: start,
+		clientIP:  clientIP,
+		config:    config,
+	}
+	result := newQueryResult(msg, start)
+	if config.clients != nil && clientIP != nil {
+		if group := config.clients.Match(clientIP); group != nil {
+			qc.policy = config.groupPolicies[group.Name]
+			result.ClientGroup = group.Name
+		}
+	}
+	logger := log.WithFields(log.Fields{
+		"requestId": qc.requestID,
+		"domain":    result.Domain,
+		"type":      result.Type,
+	})
+
+	resp, err := s.queryResponse(ctx, logger, qc, &msg, result)
+	if err != nil {
+		return nil, err
+	}
+	result.setResponse(resp)
+	return result, nil
+}
+
+// queryResponse 依次使用本地记录、拦截列表、条件转发和国内外分流得到应答
+func (s *DnsServer) queryResponse(ctx context.Context, logger *log.Entry, qc *queryContext, msg *dnsmessage.Message, result *QueryResult) (*dnsmessage.Message, error) {
+	question := msg.Questions[0]
+	name := result.Domain
+
+	if qc.config.hosts != nil {
+		if answers, ok := qc.config.hosts.Lookup(question); ok {
+			resp := newResponse(msg, dnsmessage.RCodeSuccess)
+			resp.Header.Authoritative = true
+			resp.Answers = answers
+			result.Route, result.Server = routeLocal, routeLocal
+			return resp, nil
+		}
+	}
+
+	if match, blocked := s.matchBlocklist(qc, name); blocked {
+		rcode, answers := qc.config.blockResponse.Answer(question)
+		resp := newResponse(msg, rcode)
+		resp.Answers = answers
+		result.Route, result.Server, result.BlockRule = routeBlocked, routeBlocked, match.Rule
+		return resp, nil
+	}
+
+	if rule, ok := qc.config.forwarder.Match(name); ok {
+		result.Route, result.Server, result.ForwardZone = routeForward, routeLocal, rule.Zone
+		if rule.Server == "" {
+			resp := newResponse(msg, dnsmessage.RCodeNameError)
+			resp.Header.Authoritative = true
+			return resp, nil
+		}
+		resolver := qc.config.forwardResolvers[rule.Server]
+		result.Server = resolver.String()
+		_, resp, rtt, err := exchange(ctx, resolver, *msg)
+		result.Timings.UpstreamMs = milliseconds(rtt)
+		if err != nil {
+			return nil, err
+		}
+		return &resp, nil
+	}
+
+	decisionStart := time.Now()
+	result.Decision = s.decideRoute(ctx, qc, name)
+	result.Timings.DecisionMs = milliseconds(time.Since(decisionStart))
+
+	chinaResolver, overseaResolver := qc.config.chinaResolver, qc.config.overseaResolver
+	if qc.policy != nil {
+		chinaResolver, overseaResolver = qc.policy.chinaResolver, qc.policy.overseaResolver
+	}
+
+	// 安全搜索
+	upstreamMsg := *msg
+	safeSearchTarget := ""
+	if qc.policy != nil && qc.policy.group.SafeSearch {
+		if target, ok := clients.SafeSearchTarget(name); ok {
+			safeSearchTarget = target
+			upstreamMsg.Questions = []dnsmessage.Question{{
+				Name:  dnsmessage.MustNewName(target + "."),
+				Type:  question.Type,
+				Class: question.Class,
+			}}
+		}
+	}
+
+	upstreamStart := time.Now()
+	upstream, err := s.resolveUpstream(ctx, logger, qc, name, result.Decision.IsChina, chinaResolver, overseaResolver, upstreamMsg)
+	result.Timings.UpstreamMs = milliseconds(time.Since(upstreamStart))
+	if err != nil {
+		return nil, err
+	}
+
+	result.Route = domain.RouteOversea
+	if upstream.isChina {
+		result.Route = domain.RouteChina
+	}
+	result.Server = upstream.server
+	result.PoisonReason = upstream.poisonReason
+	result.DNSSEC = upstream.dnssec
+
+	resp := upstream.msg
+	if safeSearchTarget != "" {
+		if _, err := rewriteSafeSearch(&resp, question, safeSearchTarget); err != nil {
+			return nil, err
+		}
+	}
+	return &resp, nil
+}
+
+// newQuery 创建设置了 RD 标志的查询
+func newQuery(name string, qtype dnsmessage.Type) (dnsmessage.Message, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return dnsmessage.Message{}, fmt.Errorf("无效的域名 %s: %v", name, err)
+	}
+	return dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               uint16(rand.Intn(1 << 16)),
+			RecursionDesired: true,
+		},
+		Questions: []dnsmessage.Question{{
+			Name:  qname,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}, nil
+}
+
+func newQueryResult(msg dnsmessage.Message, start time.Time) *QueryResult {
+	question := msg.Questions[0]
+	return &QueryResult{
+		Domain: strings.TrimSuffix(question.Name.String(), "."),
+		Type:   TypeName(question.Type),
+		Time:   start,
+	}
+}
+
+// setResponse 记录应答的内容和总用时
+func (r *QueryResult) setResponse(resp *dnsmessage.Message) {
+	h := resp.Header
+	r.ID = h.ID
+	r.RCode = RCodeName(h.RCode)
+	r.Flags = []string{}
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"qr", h.Response},
+		{"aa", h.Authoritative},
+		{"tc", h.Truncated},
+		{"rd", h.RecursionDesired},
+		{"ra", h.RecursionAvailable},
+		{"ad", h.AuthenticData},
+		{"cd", h.CheckingDisabled},
+	} {
+		if f.set {
+			r.Flags = append(r.Flags, f.name)
+		}
+	}
+	if len(resp.Questions) > 0 {
+		q := resp.Questions[0]
+		r.Question = fmt.Sprintf("%s IN %s", q.Name.String(), TypeName(q.Type))
+	}
+	r.Answers = queryRecords(resp.Answers)
+	r.Authorities = queryRecords(resp.Authorities)
+	r.Additionals = queryRecords(resp.Additionals)
+	r.Timings.TotalMs = milliseconds(time.Since(r.Time))
+}
+
+// queryRecords 转换记录，OPT 记录不是真正的记录，忽略
+func queryRecords(resources []dnsmessage.Resource) []QueryRecord {
+	records := []QueryRecord{}
+	for _, rr := range resources {
+		if rr.Header.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		records = append(records, QueryRecord{
+			Name: rr.Header.Name.String(),
+			TTL:  rr.Header.TTL,
+			Type: TypeName(rr.Header.Type),
+			Data: recordData(rr.Body),
+		})
+	}
+	return records
+}
+
+// recordData 返回 dig 格式的记录内容
+func recordData(body dnsmessage.ResourceBody) string {
+	switch b := body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(b.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		return net.IP(b.AAAA[:]).String()
+	case *dnsmessage.CNAMEResource:
+		return b.CNAME.String()
+	case *dnsmessage.NSResource:
+		return b.NS.String()
+	case *dnsmessage.PTRResource:
+		return b.PTR.String()
+	case *dnsmessage.MXResource:
+		return fmt.Sprintf("%d %s", b.Pref, b.MX.String())
+	case *dnsmessage.TXTResource:
+		quoted := make([]string, len(b.TXT))
+		for i, s := range b.TXT {
+			quoted[i] = strconv.Quote(s)
+		}
+		return strings.Join(quoted, " ")
+	case *dnsmessage.SRVResource:
+		return fmt.Sprintf("%d %d %d %s", b.Priority, b.Weight, b.Port, b.Target.String())
+	case *dnsmessage.SOAResource:
+		return fmt.Sprintf("%s %s %d %d %d %d %d", b.NS.String(), b.MBox.String(), b.Serial, b.Refresh, b.Retry, b.Expire, b.MinTTL)
+	case *dnsmessage.UnknownResource:
+		return fmt.Sprintf("\\# %d %s", len(b.Data), hex.EncodeToString(b.Data))
+	}
+	return ""
+}
+
+// extraTypes dnsmessage 没有定义名称的常用记录类型
+var extraTypes = map[dnsmessage.Type]string{
+	dnssec.TypeDS:     "DS",
+	dnssec.TypeRRSIG:  "RRSIG",
+	dnssec.TypeNSEC:   "NSEC",
+	dnssec.TypeDNSKEY: "DNSKEY",
+	dnssec.TypeNSEC3:  "NSEC3",
+	64:                "SVCB",
+	65:                "HTTPS",
+	257:               "CAA",
+}
+
+// TypeName 返回记录类型的名称，例如 AAAA，未知的类型返回 TYPE99 的格式
+func TypeName(t dnsmessage.Type) string {
+	if name, ok := extraTypes[t]; ok {
+		return name
+	}
+	name := t.String()
+	if strings.HasPrefix(name, "Type") {
+		return strings.TrimPrefix(name, "Type")
+	}
+	return "TYPE" + name
+}
+
+// ParseType 解析记录类型，支持名称（不区分大小写）和 TYPE99 的格式
+func ParseType(s string) (dnsmessage.Type, error) {
+	s = strings.ToUpper(s)
+	if s == "ANY" || s == "*" {
+		return dnsmessage.TypeALL, nil
+	}
+	if strings.HasPrefix(s, "TYPE") {
+		if n, err := strconv.ParseUint(s[len("TYPE"):], 10, 16); err == nil {
+			return dnsmessage.Type(n), nil
+		}
+	}
+	for t := dnsmessage.Type(1); t <= 257; t++ {
+		if TypeName(t) == s {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("未知的记录类型: %s", s)
+}
+
+// WriteDig 以类似 dig 的格式输出查询结果
+func (r *QueryResult) WriteDig(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 1, '\t', 0)
+	fmt.Fprintf(tw, "; <<>> go-dns-proxy <<>> %s %s\n", r.Domain, r.Type)
+	if r.Route != "" {
+		fmt.Fprintf(tw, ";; 路由: %s\n", r.routeSummary())
+	}
+	if r.ClientGroup != "" {
+		fmt.Fprintf(tw, ";; 客户端分组: %s\n", r.ClientGroup)
+	}
+	if r.PoisonReason != "" {
+		fmt.Fprintf(tw, ";; 疑似污染: %s\n", r.PoisonReason)
+	}
+	if r.DNSSEC != "" {
+		fmt.Fprintf(tw, ";; DNSSEC: %s\n", r.DNSSEC)
+	}
+	fmt.Fprintf(tw, ";; ->>HEADER<<- opcode: QUERY, status: %s, id: %d\n", r.RCode, r.ID)
+	fmt.Fprintf(tw, ";; flags: %s; QUERY: 1, ANSWER: %d, AUTHORITY: %d, ADDITIONAL: %d\n",
+		strings.Join(r.Flags, " "), len(r.Answers), len(r.Authorities), len(r.Additionals))
+
+	fmt.Fprintf(tw, "\n;; QUESTION SECTION:\n;%s.\t\tIN\t%s\n", r.Domain, r.Type)
+	for _, section := range []struct {
+		name    string
+		records []QueryRecord
+	}{
+		{"ANSWER", r.Answers},
+		{"AUTHORITY", r.Authorities},
+		{"ADDITIONAL", r.Additionals},
+	} {
+		if len(section.records) == 0 {
+			continue
+		}
+		fmt.Fprintf(tw, "\n;; %s SECTION:\n", section.name)
+		for _, rr := range section.records {
+			fmt.Fprintf(tw, "%s\t%d\tIN\t%s\t%s\n", rr.Name, rr.TTL, rr.Type, rr.Data)
+		}
+	}
+
+	fmt.Fprintln(tw)
+	if r.Decision != nil {
+		fmt.Fprintf(tw, ";; 判断用时: %.3f ms\n", r.Timings.DecisionMs)
+	}
+	fmt.Fprintf(tw, ";; 上游用时: %.3f ms\n", r.Timings.UpstreamMs)
+	fmt.Fprintf(tw, ";; Query time: %.3f ms\n", r.Timings.TotalMs)
+	fmt.Fprintf(tw, ";; SERVER: %s\n", r.Server)
+	fmt.Fprintf(tw, ";; WHEN: %s\n", r.Time.Format(time.RFC1123))
+	return tw.Flush()
+}
+
+// routeSummary 返回路由和判断依据的简短说明
+func (r *QueryResult) routeSummary() string {
+	switch {
+	case r.BlockRule != "":
+		return fmt.Sprintf("%s (%s)", r.Route, r.BlockRule)
+	case r.ForwardZone != "":
+		return fmt.Sprintf("%s (%s)", r.Route, r.ForwardZone)
+	case r.Decision == nil:
+		return r.Route
+	}
+
+	summary := fmt.Sprintf("%s (%s", r.Route, r.Decision.Reason)
+	if r.Decision.MatchedRule != "" {
+		summary += ": " + r.Decision.MatchedRule
+	}
+	if p := r.Decision.Pinyin; p != nil {
+		summary += fmt.Sprintf(", 拼音 %s 得分 %.2f/%.2f", p.Label, p.Score, p.Threshold)
+	}
+	summary += ")"
+	if (r.Route == domain.RouteChina) != r.Decision.IsChina {
+		summary += "，国内 DNS 疑似污染后改用海外 DNS"
+	}
+	return summary
+}
+
+// RCodeName 返回与 dig 相同的响应码名称，例如 NOERROR 和 NXDOMAIN
+func RCodeName(rcode dnsmessage.RCode) string {
+	switch rcode {
+	case dnsmessage.RCodeSuccess:
+		return "NOERROR"
+	case dnsmessage.RCodeFormatError:
+		return "FORMERR"
+	case dnsmessage.RCodeServerFailure:
+		return "SERVFAIL"
+	case dnsmessage.RCodeNameError:
+		return "NXDOMAIN"
+	case dnsmessage.RCodeNotImplemented:
+		return "NOTIMP"
+	case dnsmessage.RCodeRefused:
+		return "REFUSED"
+	}
+	return strings.ToUpper(strings.TrimPrefix(rcode.String(), "RCode"))
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000.0
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"go-dns-proxy/blocklist"
+	"go-dns-proxy/domain"
+	"go-dns-proxy/forward"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestQuerier_Query(t *testing.T) {
+	china := startUpstream(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		return answerA(query, "114.114.114.114")
+	})
+	oversea := startUpstream(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		return answerA(query, "93.184.216.34")
+	})
+	local := startUpstream(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		return answerA(query, "192.168.1.20")
+	})
+
+	dataDir := t.TempDir()
+	querier, err := NewQuerier(&NewServerOptions{
+		ChinaServerAddr:   china,
+		OverSeaServerAddr: oversea,
+		DBPath:            filepath.Join(dataDir, "dns.db"),
+		DataDir:           dataDir,
+		LearningOptions:   domain.LearnedDomainOptions{Disabled: true},
+		StaticRecords:     []string{"nas.home.arpa A 192.168.1.10"},
+		BlocklistOptions:  blocklist.Options{Rules: []string{`/^ads?[0-9]*\./`}},
+		ForwardOptions: forward.Options{
+			Rules: []forward.Rule{{Zone: "corp.example.com", Server: local}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer querier.Close()
+
+	tests := []struct {
+		domain     string
+		wantRoute  string
+		wantReason string
+		wantServer string
+		wantRCode  string
+		wantData   string
+	}{
+		{"nas.home.arpa", routeLocal, "", routeLocal, "NOERROR", "192.168.1.10"},
+		{"ads1.example.com", routeBlocked, "", routeBlocked, "NXDOMAIN", ""},
+		{"git.corp.example.com", routeForward, "", local, "NOERROR", "192.168.1.20"},
+		{"www.example.cn", domain.RouteChina, domain.ReasonChinaTLD, china, "NOERROR", "114.114.114.114"},
+		{"www.example.com", domain.RouteOversea, domain.ReasonDefault, oversea, "NOERROR", "93.184.216.34"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			result, err := querier.Query(context.Background(), tt.domain, dnsmessage.TypeA, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Route != tt.wantRoute || result.Server != tt.wantServer || result.RCode != tt.wantRCode {
+				t.Errorf("Query() = route %s, server %s, rcode %s, want %s, %s, %s",
+					result.Route, result.Server, result.RCode, tt.wantRoute, tt.wantServer, tt.wantRCode)
+			}
+			if tt.wantReason != "" && (result.Decision == nil || result.Decision.Reason != tt.wantReason) {
+				t.Errorf("Query() decision = %+v, want reason %s", result.Decision, tt.wantReason)
+			}
+			data := ""
+			if len(result.Answers) > 0 {
+				data = result.Answers[0].Data
+			}
+			if data != tt.wantData {
+				t.Errorf("Query() answer = %q, want %q", data, tt.wantData)
+			}
+		})
+	}
+}
+
+func TestQueryServer(t *testing.T) {
+	s := newTestServer(t, &NewServerOptions{
+		Listeners: []ListenerOptions{
+			{Network: "udp", Addr: "127.0.0.1:0"},
+			{Network: "tcp", Addr: "127.0.0.1:0"},
+		},
+		StaticRecords: []string{"nas.home.arpa A 192.168.1.10"},
+	})
+	time.Sleep(100 * time.Millisecond)
+
+	for _, addr := range []string{listenerAddr(s, "udp"), "tcp://" + listenerAddr(s, "tcp")} {
+		t.Run(addr, func(t *testing.T) {
+			result, err := QueryServer(context.Background(), addr, "nas.home.arpa", dnsmessage.TypeA)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Answers) != 1 || result.Answers[0].Data != "192.168.1.10" {
+				t.Fatalf("QueryServer() answers = %+v", result.Answers)
+			}
+
+			var out bytes.Buffer
+			if err := result.WriteDig(&out); err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range []string{"status: NOERROR", "flags: qr aa rd ra", "nas.home.arpa.\t60\tIN\tA\t192.168.1.10"} {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("WriteDig() = %s, want containing %q", out.String(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseType(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    dnsmessage.Type
+		wantErr bool
+	}{
+		{"A", dnsmessage.TypeA, false},
+		{"aaaa", dnsmessage.TypeAAAA, false},
+		{"ANY", dnsmessage.TypeALL, false},
+		{"HTTPS", 65, false},
+		{"DNSKEY", 48, false},
+		{"TYPE99", 99, false},
+		{"BOGUS", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseType(tt.s)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("ParseType() = %v, %v, want %v, wantErr %v", got, err, tt.want, tt.wantErr)
+			}
+			if !tt.wantErr && !strings.EqualFold(TypeName(got), tt.s) && tt.s != "ANY" {
+				t.Errorf("TypeName(%v) = %s, want %s", got, TypeName(got), tt.s)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"fmt"
+	"go-dns-proxy/admin"
+	"go-dns-proxy/ratelimit"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// rrlResponseWriter 发送 UDP 响应前检查响应限速，超过限速的响应被丢弃或改为截断响应
+type rrlResponseWriter struct {
+	responseWriter
+	limiter  *ratelimit.Limiter
+	listener *listener
+}
+
+func (w *rrlResponseWriter) Write(msg []byte) error {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(msg)
+	if err != nil {
+		return w.responseWriter.Write(msg)
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return w.responseWriter.Write(msg)
+	}
+
+	switch w.limiter.CheckResponse(w.RemoteIP(), responseKey(question, header.RCode)) {
+	case ratelimit.Drop:
+		atomic.AddInt64(&w.listener.rrlDropped, 1)
+		return nil
+	case ratelimit.Slip:
+		truncated, err := truncatedResponse(header, question)
+		if err != nil {
+			return err
+		}
+		return w.responseWriter.Write(truncated)
+	}
+	return w.responseWriter.Write(msg)
+}
+
+// responseKey 区分不同响应的键，相同域名、类型和响应码的响应视为相同的响应
+func responseKey(question dnsmessage.Question, rcode dnsmessage.RCode) string {
+	return fmt.Sprintf("%s/%s/%s", strings.ToLower(question.Name.String()), question.Type, rcode)
+}
+
+// truncatedResponse 创建只包含问题部分并设置了 TC 标志的响应
+func truncatedResponse(header dnsmessage.Header, question dnsmessage.Question) ([]byte, error) {
+	header.Truncated = true
+	builder := dnsmessage.NewBuilder(nil, header)
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(question); err != nil {
+		return nil, err
+	}
+	return builder.Finish()
+}
+
+// limitQuery 检查客户端的查询速率，返回 false 时查询被丢弃
+func (s *DnsServer) limitQuery(l *listener, clientIP net.IP) bool {
+	if s.rateLimiter.AllowQuery(clientIP) {
+		return true
+	}
+	atomic.AddInt64(&l.limited, 1)
+	log.WithFields(log.Fields{
+		"listener": l.options.String(),
+		"clientIp": clientIP.String(),
+	}).Debug("客户端查询超过限速，丢弃查询")
+	return false
+}
+
+// LimitedClients 返回最近被限速的客户端
+func (s *DnsServer) LimitedClients() []admin.LimitedClient {
+	clients := []admin.LimitedClient{}
+	for _, c := range s.rateLimiter.LimitedClients() {
+		clients = append(clients, admin.LimitedClient{
+			Client:      c.Client,
+			Limited:     c.Limited,
+			Slipped:     c.Slipped,
+			Dropped:     c.Dropped,
+			LastLimited: c.LastLimited,
+		})
+	}
+	return clients
+}
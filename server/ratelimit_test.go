@@ -0,0 +1,69 @@
+package server
+
+import (
+	"go-dns-proxy/ratelimit"
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// recordWriter 记录写入的响应
+type recordWriter struct {
+	ip      net.IP
+	written [][]byte
+}
+
+func (w *recordWriter) Write(msg []byte) error {
+	w.written = append(w.written, msg)
+	return nil
+}
+
+func (w *recordWriter) RemoteIP() net.IP {
+	return w.ip
+}
+
+func TestRRLResponseWriter(t *testing.T) {
+	limiter, err := ratelimit.New(ratelimit.Options{ResponsesPerSecond: 1, Slip: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &recordWriter{ip: net.ParseIP("192.168.1.10")}
+	l := &listener{}
+	w := &rrlResponseWriter{responseWriter: recorder, limiter: limiter, listener: l}
+
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 1},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName("example.com."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	resp := newResponse(&query, dnsmessage.RCodeSuccess)
+	resp.Answers = []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{Name: query.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+		Body:   &dnsmessage.AResource{A: [4]byte{1, 2, 3, 4}},
+	}}
+
+	// 第一个响应正常发送，第二个被丢弃，第三个以截断响应发送
+	for i := 0; i < 3; i++ {
+		if err := writeMessage(w, resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(recorder.written) != 2 {
+		t.Fatalf("written %d responses, want 2", len(recorder.written))
+	}
+	if l.rrlDropped != 1 {
+		t.Errorf("rrlDropped = %d, want 1", l.rrlDropped)
+	}
+
+	var truncated dnsmessage.Message
+	if err := truncated.Unpack(recorder.written[1]); err != nil {
+		t.Fatal(err)
+	}
+	if !truncated.Header.Truncated || len(truncated.Answers) != 0 || len(truncated.Questions) != 1 {
+		t.Errorf("slipped response = %+v, want truncated response without answers", truncated)
+	}
+}
@@ -0,0 +1,381 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go-dns-proxy/admin"
+	"go-dns-proxy/blocklist"
+	"go-dns-proxy/client"
+	"go-dns-proxy/clients"
+	"go-dns-proxy/dnssec"
+	"go-dns-proxy/domain"
+	"go-dns-proxy/ecs"
+	"go-dns-proxy/forward"
+	"go-dns-proxy/hosts"
+	"go-dns-proxy/ipset"
+	"go-dns-proxy/poison"
+	"go-dns-proxy/rebind"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// runtimeConfig 可以热重载的上游解析器、域名列表和规则。
+// 重载时整体替换，正在处理的查询继续使用开始处理时的配置
+type runtimeConfig struct {
+	options            *NewServerOptions
+	chinaResolver      client.DNSResolver
+	overseaResolver    client.DNSResolver
+	chinaDomainService *domain.ChinaDomainService
+	hosts              *hosts.Store
+	blocklist          *blocklist.Blocklist
+	blockResponse      blocklist.Response
+	clients            *clients.Manager
+	groupPolicies      map[string]*groupPolicy
+	rebind             *rebind.Protector
+	poison             *poison.Detector
+	forwarder          *forward.Forwarder
+	forwardResolvers   map[string]client.DNSResolver
+	chinaECS           *ecs.Policy
+	overseaECS         *ecs.Policy
+	dnssec             *dnssec.Validator
+	sets               *ipset.Manager
+	stopChan           chan struct{}
+	stopOnce           sync.Once
+	// chinaListCached 中国域名列表已从本地缓存加载，不需要在后台下载
+	chinaListCached bool
+
+	// inflight 使用该配置正在处理的查询数，被替换后等这些查询完成才停止
+	inflightMu sync.Mutex
+	inflight   int
+	retired    bool
+}
+
+// newRuntimeConfig 根据配置创建解析器、域名列表和规则。列表只从本地缓存加载，
+// 下载在 start 后于后台进行，避免重载时等待下载。创建失败时停止已经创建的部分
+func (s *DnsServer) newRuntimeConfig(options *NewServerOptions) (config *runtimeConfig, err error) {
+	chinaResolver := createResolver(options.ChinaServerAddr)
+	overseaResolver := createResolver(options.OverSeaServerAddr)
+
+	chinaDomainService := domain.NewChinaDomainService()
+	chinaDomainService.SetPinyinOptions(options.PinyinOptions)
+
+	config = &runtimeConfig{
+		options:            options,
+		chinaResolver:      chinaResolver,
+		overseaResolver:    overseaResolver,
+		chinaDomainService: chinaDomainService,
+		stopChan:           make(chan struct{}),
+	}
+	defer func(c *runtimeConfig) {
+		if err != nil {
+			c.stop()
+		}
+	}(config)
+
+	// 配置了备案查询接口时使用备案信息判断
+	if options.BeianAPIURL != "" {
+		provider := domain.NewHTTPICPProvider(options.BeianAPIURL, options.BeianAPIKey)
+		chinaDomainService.SetBeianService(domain.NewBeianService(provider, s.db, options.BeianOptions))
+	}
+
+	// 如果提供了中国域名列表 URL，先加载本地缓存
+	if options.ChinaDomainListUrl != "" {
+		if config.chinaListCached, err = chinaDomainService.LoadCachedChinaDomainList(options.DataDir); err != nil {
+			log.WithError(err).Error("加载中国域名列表失败")
+			err = nil
+		}
+	}
+	if s.learnedStore != nil {
+		chinaDomainService.SetLearnedStore(s.learnedStore)
+	}
+
+	// 本地 hosts 文件和静态记录
+	if options.HostsFile != "" || len(options.StaticRecords) > 0 {
+		if config.hosts, err = hosts.NewStore(options.HostsFile, options.StaticRecords); err != nil {
+			return nil, err
+		}
+	}
+
+	// 广告和跟踪域名拦截
+	if config.blockResponse, err = blocklist.ParseResponse(options.BlockResponse); err != nil {
+		return nil, err
+	}
+	if len(options.BlocklistOptions.URLs) > 0 || len(options.BlocklistOptions.Rules) > 0 {
+		config.blocklist = blocklist.New(options.BlocklistOptions)
+		if err := config.blocklist.LoadCached(); err != nil {
+			log.WithError(err).Error("加载拦截列表失败")
+		}
+	}
+
+	// 客户端分组
+	config.groupPolicies = make(map[string]*groupPolicy)
+	if len(options.ClientGroups) > 0 {
+		var names clients.NameResolver
+		if config.hosts != nil {
+			names = config.hosts.Names
+		}
+		config.clients, err = clients.NewManager(options.ClientGroups, clients.NewNeighborTable(nil, 0), names)
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range config.clients.Groups() {
+			config.groupPolicies[group.Name] = newGroupPolicy(group, chinaResolver, overseaResolver, options.BlocklistOptions)
+		}
+	}
+
+	if config.rebind, err = rebind.New(options.RebindOptions); err != nil {
+		return nil, err
+	}
+	if config.poison, err = poison.New(options.PoisonOptions); err != nil {
+		return nil, err
+	}
+
+	if config.chinaECS, err = ecs.New(options.ChinaECS); err != nil {
+		return nil, err
+	}
+	if config.overseaECS, err = ecs.New(options.OverseaECS); err != nil {
+		return nil, err
+	}
+
+	if config.dnssec, err = dnssec.New(options.DNSSECOptions); err != nil {
+		return nil, err
+	}
+
+	// netlink 连接在重载之间共用，避免旧的集合配置仍在使用时关闭连接
+	setOptions := options.IPSetOptions
+	if setOptions.Backend == nil && (len(setOptions.Rules) > 0 || len(setOptions.OverseaSets) > 0) {
+		if s.setBackend == nil {
+			if s.setBackend, err = ipset.NewNetlinkBackend(); err != nil {
+				return nil, err
+			}
+		}
+		setOptions.Backend = s.setBackend
+	}
+	if config.sets, err = ipset.New(setOptions); err != nil {
+		return nil, err
+	}
+
+	// 条件转发，每个上游只创建一个解析器
+	config.forwarder = forward.New(options.ForwardOptions)
+	config.forwardResolvers = make(map[string]client.DNSResolver)
+	for _, rule := range config.forwarder.Rules() {
+		if _, ok := config.forwardResolvers[rule.Server]; !ok && rule.Server != "" {
+			config.forwardResolvers[rule.Server] = createResolver(rule.Server)
+		}
+	}
+	return config, nil
+}
+
+// refreshLists 下载中国域名列表和拦截列表，中国域名列表已有本地缓存时不下载。配置停止后不再继续下载
+func (c *runtimeConfig) refreshLists() {
+	stopped := func() bool {
+		select {
+		case <-c.stopChan:
+			return true
+		default:
+			return false
+		}
+	}
+
+	if c.options.ChinaDomainListUrl != "" && !c.chinaListCached {
+		if err := c.chinaDomainService.DownloadAndLoadChinaDomainList(c.options.ChinaDomainListUrl, c.options.DataDir); err != nil {
+			log.WithError(err).Error("加载中国域名列表失败")
+		}
+	}
+	if c.blocklist != nil && !stopped() {
+		if err := c.blocklist.Load(); err != nil {
+			log.WithError(err).Error("加载拦截列表失败")
+		}
+	}
+	for name, policy := range c.groupPolicies {
+		if policy.blocklist == nil || stopped() {
+			continue
+		}
+		if err := policy.blocklist.Load(); err != nil {
+			log.WithError(err).WithField("group", name).Error("加载客户端分组拦截列表失败")
+		}
+	}
+}
+
+// start 启动列表下载、hosts 文件监视、拦截列表刷新和邻居表刷新
+func (c *runtimeConfig) start() {
+	go c.refreshLists()
+	if c.hosts != nil {
+		go c.hosts.Watch(c.stopChan, 5*time.Second)
+	}
+	if c.clients != nil {
+		go c.clients.Run(c.stopChan)
+	}
+	if c.blocklist != nil {
+		go c.blocklist.Run(c.stopChan)
+	}
+	for _, policy := range c.groupPolicies {
+		if policy.blocklist != nil {
+			go policy.blocklist.Run(c.stopChan)
+		}
+	}
+}
+
+// stop 停止后台任务并关闭备案服务，可以重复调用
+func (c *runtimeConfig) stop() {
+	c.stopOnce.Do(func() {
+		close(c.stopChan)
+		if err := c.chinaDomainService.Close(); err != nil {
+			log.WithError(err).Error("关闭备案服务失败")
+		}
+	})
+}
+
+// acquire 记录一个使用该配置的查询，处理完成后调用 release
+func (c *runtimeConfig) acquire() {
+	c.inflightMu.Lock()
+	c.inflight++
+	c.inflightMu.Unlock()
+}
+
+// release 查询处理完成，配置已被替换且没有其他查询时停止
+func (c *runtimeConfig) release() {
+	c.inflightMu.Lock()
+	c.inflight--
+	stop := c.retired && c.inflight == 0
+	c.inflightMu.Unlock()
+	if stop {
+		c.stop()
+	}
+}
+
+// retire 配置被替换或服务器关闭，正在处理的查询完成后停止
+func (c *runtimeConfig) retire() {
+	c.inflightMu.Lock()
+	c.retired = true
+	stop := c.inflight == 0
+	c.inflightMu.Unlock()
+	if stop {
+		c.stop()
+	}
+}
+
+// ecsPolicy 返回国内或海外上游使用的 ECS 策略
+func (c *runtimeConfig) ecsPolicy(isChina bool) *ecs.Policy {
+	if isChina {
+		return c.chinaECS
+	}
+	return c.overseaECS
+}
+
+// upstreamQuery 按上游的 ECS 策略和 DNSSEC 验证复制并修改查询
+func (c *runtimeConfig) upstreamQuery(msg dnsmessage.Message, isChina bool, clientIP net.IP) dnsmessage.Message {
+	c.ecsPolicy(isChina).Apply(&msg, clientIP)
+	c.dnssec.PrepareQuery(&msg)
+	return msg
+}
+
+// configItem 用于比较重载前后变化的配置项
+type configItem struct {
+	name  string
+	value interface{}
+}
+
+// reloadableItems 返回重载时生效的配置项
+func reloadableItems(o *NewServerOptions) []configItem {
+	return []configItem{
+		{"国内DNS", o.ChinaServerAddr},
+		{"海外DNS", o.OverSeaServerAddr},
+		{"中国域名列表", o.ChinaDomainListUrl},
+		{"拼音判断", o.PinyinOptions},
+		{"备案查询", []interface{}{o.BeianAPIURL, o.BeianAPIKey, o.BeianOptions}},
+		{"hosts文件", o.HostsFile},
+		{"静态记录", o.StaticRecords},
+		{"拦截列表", o.BlocklistOptions},
+		{"拦截应答", o.BlockResponse},
+		{"客户端分组", o.ClientGroups},
+		{"重绑定防护", o.RebindOptions},
+		{"污染检测", o.PoisonOptions},
+		{"条件转发", o.ForwardOptions},
+		{"国内ECS", o.ChinaECS},
+		{"海外ECS", o.OverseaECS},
+		{"DNSSEC验证", o.DNSSECOptions},
+		{"集合规则", o.IPSetOptions},
+	}
+}
+
+// restartItems 返回需要重启才能生效的配置项
+func restartItems(o *NewServerOptions) []configItem {
+	return []configItem{
+		{"监听器", []interface{}{o.ListenPort, o.Listeners}},
+		{"数据目录", []interface{}{o.DataDir, o.DBPath}},
+		{"中国IP列表", o.ChinaIPListUrl},
+		{"域名学习", o.LearningOptions},
+		{"查询限速", o.RateLimitOptions},
+		{"缓存", o.CacheOptions},
+	}
+}
+
+// changedItems 返回值不同的配置项名称。按 JSON 比较，忽略客户端分组等配置在使用时设置的私有字段
+func changedItems(old, new []configItem) []string {
+	changed := []string{}
+	for i := range old {
+		oldValue, _ := json.Marshal(old[i].value)
+		newValue, _ := json.Marshal(new[i].value)
+		if !bytes.Equal(oldValue, newValue) {
+			changed = append(changed, old[i].name)
+		}
+	}
+	return changed
+}
+
+// Reload 使用新的配置重新创建上游解析器、域名列表和规则并整体替换，监听器保持打开。
+// 创建失败时继续使用原来的配置，配置有变化时清空缓存
+func (s *DnsServer) Reload(options *NewServerOptions) (*admin.ReloadResult, error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	config, err := s.newRuntimeConfig(options)
+	if err != nil {
+		return nil, fmt.Errorf("重载配置失败: %v", err)
+	}
+
+	s.mu.Lock()
+	old := s.config
+	s.config = config
+	if s.started {
+		config.start()
+	}
+	old.retire()
+	s.mu.Unlock()
+
+	result := &admin.ReloadResult{
+		Time:            time.Now(),
+		Changed:         changedItems(reloadableItems(old.options), reloadableItems(options)),
+		RestartRequired: changedItems(restartItems(s.options), restartItems(options)),
+	}
+	if len(result.Changed) > 0 {
+		s.cache.Flush()
+	}
+
+	log.WithFields(log.Fields{
+		"changed":         result.Changed,
+		"restartRequired": result.RestartRequired,
+	}).Info("配置已重载")
+	return result, nil
+}
+
+// currentConfig 返回当前使用的配置
+func (s *DnsServer) currentConfig() *runtimeConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config
+}
+
+// acquireConfig 返回当前使用的配置并记录一个正在处理的查询，处理完成后调用 release
+func (s *DnsServer) acquireConfig() *runtimeConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.config.acquire()
+	return s.config
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"go-dns-proxy/cache"
+	"go-dns-proxy/client"
+	"go-dns-proxy/dnssec"
+	"go-dns-proxy/ecs"
+	"go-dns-proxy/rebind"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// upstreamResult 上游查询的结果
+type upstreamResult struct {
+	msg          dnsmessage.Message
+	server       string
+	isChina      bool
+	poisonReason string
+	dnssec       string
+	// bogus DNSSEC 验证失败
+	bogus  bool
+	cached bool
+}
+
+// resolveUpstream 查询缓存或上游 DNS。国内 DNS 的应答疑似被污染时改用海外 DNS 重新查询，
+// 应答经过 DNSSEC 验证和 DNS 重绑定防护后写入缓存
+func (s *DnsServer) resolveUpstream(ctx context.Context, logger *log.Entry, qc *queryContext, domain string, isChina bool, chinaResolver, overseaResolver client.DNSResolver, msg dnsmessage.Message) (*upstreamResult, error) {
+	resolver := overseaResolver
+	if isChina {
+		resolver = chinaResolver
+	}
+	upstreamMsg := qc.config.upstreamQuery(msg, isChina, qc.clientIP)
+	key := cache.NewKey(msg.Questions[0], resolver.String(), upstreamMsg.Header.CheckingDisabled)
+	entry, ok := s.cache.Get(key, querySubnet(&upstreamMsg))
+	if s.cache != nil {
+		if ok {
+			s.metrics.cacheHits.Inc()
+		} else {
+			s.metrics.cacheMisses.Inc()
+		}
+	}
+	if ok {
+		entry.Msg.Header.ID = msg.Header.ID
+		logger.Debug("使用缓存的响应")
+		result := &upstreamResult{
+			msg:          entry.Msg,
+			server:       entry.Server,
+			isChina:      entry.IsChina,
+			poisonReason: entry.PoisonReason,
+			dnssec:       entry.DNSSEC,
+			bogus:        entry.Bogus,
+			cached:       true,
+		}
+		result.finish(&msg)
+		return result, nil
+	}
+
+	_, respMsg, rtt, err := s.exchange(ctx, resolver, upstreamMsg)
+	if err != nil {
+		return nil, err
+	}
+	result := &upstreamResult{msg: respMsg, server: resolver.String(), isChina: isChina}
+
+	// 国内 DNS 的应答疑似被污染时改用海外 DNS 重新查询
+	if isChina {
+		if poisonResult, suspected := qc.config.poison.Check(respMsg.Answers, rtt); suspected {
+			logger.WithFields(log.Fields{
+				"reason": poisonResult.Reason,
+				"detail": poisonResult.Detail,
+			}).Warn("国内 DNS 应答疑似被污染，使用海外 DNS 重新查询")
+
+			upstreamMsg = qc.config.upstreamQuery(msg, false, qc.clientIP)
+			if _, respMsg, _, err = s.exchange(ctx, overseaResolver, upstreamMsg); err != nil {
+				return nil, err
+			}
+			resolver = overseaResolver
+			result.msg = respMsg
+			result.server = overseaResolver.String()
+			result.isChina = false
+			result.poisonReason = poisonResult.String()
+		}
+	}
+
+	// DNSSEC 验证，验证失败的应答也会缓存，返回给客户端时再按 CD 标志决定是否改为 SERVFAIL
+	if qc.config.dnssec != nil {
+		validation := qc.config.dnssec.Validate(ctx, resolver, &result.msg)
+		result.dnssec = validation.String()
+		result.bogus = validation.Status == dnssec.StatusBogus
+		result.msg.Header.AuthenticData = validation.Status == dnssec.StatusSecure
+		if result.bogus {
+			logger.WithField("reason", validation.Reason).Warn("DNSSEC 验证失败")
+		}
+	}
+
+	// DNS 重绑定防护，检查上游应答中的内网地址
+	if kept, violations := qc.config.rebind.Check(domain, result.msg.Answers); len(violations) > 0 {
+		action := "删除"
+		if qc.config.rebind.Mode() == rebind.ModeRefuse {
+			action = "拒绝"
+			result.msg = *newResponse(&msg, dnsmessage.RCodeRefused)
+		} else {
+			result.msg.Answers = kept
+		}
+		for _, v := range violations {
+			logger.WithFields(log.Fields{
+				"name":   v.Name,
+				"ip":     v.IP.String(),
+				"action": action,
+			}).Warn("上游应答包含内网地址")
+		}
+	}
+
+	// 上游返回的作用域决定缓存的响应适用于哪些客户端
+	scope := 0
+	if subnet, ok := ecs.FromMessage(&result.msg); ok {
+		scope = subnet.Scope
+	}
+	if qc.config.ecsPolicy(result.isChina).Mode() != ecs.ModeOff {
+		ecs.StripResponse(&result.msg, true)
+	}
+
+	s.cache.Set(key, querySubnet(&upstreamMsg), scope, cache.Entry{
+		Msg:          result.msg,
+		Server:       result.server,
+		IsChina:      result.isChina,
+		PoisonReason: result.poisonReason,
+		DNSSEC:       result.dnssec,
+		Bogus:        result.bogus,
+	})
+	result.finish(&msg)
+	return result, nil
+}
+
+// finish 将上游或缓存的应答转换为返回给客户端的响应。
+// DNSSEC 验证失败时返回 SERVFAIL，客户端设置了 CD 标志时仍然返回应答
+func (r *upstreamResult) finish(query *dnsmessage.Message) {
+	if r.bogus && !query.Header.CheckingDisabled {
+		r.msg = *newResponse(query, dnsmessage.RCodeServerFailure)
+		return
+	}
+	clientResponse(&r.msg, query)
+}
+
+// clientResponse 删除客户端的查询没有请求的 OPT 记录和 DNSSEC 记录
+func clientResponse(resp, query *dnsmessage.Message) {
+	if !ecs.HasOPT(query) {
+		ecs.StripResponse(resp, false)
+	}
+	if !dnssec.DNSSECOK(query) {
+		dnssec.StripRecords(resp, query.Questions[0].Type)
+	}
+}
+
+// querySubnet 返回查询中的 ECS 子网，没有 ECS 时返回 nil
+func querySubnet(msg *dnsmessage.Message) *net.IPNet {
+	if subnet, ok := ecs.FromMessage(msg); ok {
+		return subnet.Net
+	}
+	return nil
+}
+
+// exchange 向上游发送查询并解析响应，同时返回上游的应答时间
+func exchange(ctx context.Context, resolver client.DNSResolver, msg dnsmessage.Message) ([]byte, dnsmessage.Message, time.Duration, error) {
+	start := time.Now()
+	respData, err := resolver.Request(ctx, msg)
+	rtt := time.Since(start)
+	if err != nil {
+		return nil, dnsmessage.Message{}, rtt, err
+	}
+
+	var respMsg dnsmessage.Message
+	if err := respMsg.Unpack(respData); err != nil {
+		return nil, dnsmessage.Message{}, rtt, fmt.Errorf("解析 DNS 响应失败: %v", err)
+	}
+	return respData, respMsg, rtt, nil
+}